@@ -0,0 +1,55 @@
+// Typeahead for reference fields. A text input with the attribute data-autocomplete="<format>" suggests the records
+// of the format whose display field starts with the typed text. When one of them is picked, its ID is stored in the
+// input whose id is the value of the attribute data-target or, if there isn't one, in the next input, which is the
+// one submitted with the form. Text that isn't one of the suggestions clears the ID, and the suggestions of earlier
+// text that arrive late are ignored.
+function bindAutocomplete(input) {
+    var target = input.dataset.target ? document.getElementById(input.dataset.target) : input.nextElementSibling;
+    var list = document.createElement("datalist");
+    list.id = "autocomplete_" + Math.random().toString(36).slice(2);
+    input.setAttribute("list", list.id);
+    input.setAttribute("autocomplete", "off");
+    input.parentNode.appendChild(list);
+    var ids = {};
+    var latest = 0;
+
+    input.addEventListener("input", function () {
+        if (ids[input.value] !== undefined) {
+            target.value = ids[input.value];
+            return;
+        }
+        target.value = "";
+        var request = ++latest;
+        fetch("/autocomplete/" + input.dataset.autocomplete + "?prefix=" + encodeURIComponent(input.value))
+            .then(function (response) { return response.json(); })
+            .then(function (options) {
+                if (request !== latest) {
+                    return;
+                }
+                ids = {};
+                list.innerHTML = "";
+                options.forEach(function (option) {
+                    ids[option.label] = option.id;
+                    var element = document.createElement("option");
+                    element.value = option.label;
+                    list.appendChild(element);
+                });
+                if (ids[input.value] !== undefined) {
+                    target.value = ids[input.value];
+                }
+            });
+    });
+}
+
+// Repeatable inputs of list fields. A button with the attribute data-repeat="<template id>" appends a copy of the
+// content of the template to the element before the button.
+function bindRepeat(button) {
+    button.addEventListener("click", function () {
+        var content = document.getElementById(button.dataset.repeat).content.cloneNode(true);
+        content.querySelectorAll("input[data-autocomplete]").forEach(bindAutocomplete);
+        button.previousElementSibling.appendChild(content);
+    });
+}
+
+document.querySelectorAll("input[data-autocomplete]").forEach(bindAutocomplete);
+document.querySelectorAll("button[data-repeat]").forEach(bindRepeat);
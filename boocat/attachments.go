@@ -0,0 +1,260 @@
+package boocat
+
+// Implements the files attached to records. Attachment fields have the keys of the files in the blob store, and the
+// content types of the files are kept in internal fields of the records.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ivanmartinez/boocat/boocat/blob"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+const (
+	// Maximum width and height of the thumbnails of images
+	ThumbnailSize = 200
+	// Content type of the thumbnails of images
+	ThumbnailContentType = "image/jpeg"
+	// Suffix of the keys of thumbnails, after the key of their image
+	thumbnailSuffix = "_thumbnail"
+	// Number of bytes used to detect the content type of files
+	sniffLength = 512
+)
+
+// ErrBlobStoreNotSet is returned when attaching files without a blob store
+var ErrBlobStoreNotSet = errors.New("blob store not set")
+
+// upload is the attachment field of a format a file was attached for, and the content type of the file
+type upload struct {
+	formatName  string
+	field       string
+	contentType string
+}
+
+// AttachmentTypeField returns the internal field of records with the content type of the file attached in the
+// attachment field. Records stored before content types were kept don't have it.
+func AttachmentTypeField(field string) string {
+	return "_" + field + "type"
+}
+
+// AddAttachment stores a file to be attached to a record of a format in an attachment field, and returns its key,
+// which is the value of the field. The content type is detected from the content. If the field doesn't accept it, the
+// error is a ValidationFailedError. Images also get a thumbnail. The key can only be stored in that field of a record
+// of the format, and the file must be discarded with DiscardAttachments if the record isn't stored.
+func (bc *Boocat) AddAttachment(ctx context.Context, formatName, field, name string, r io.Reader) (string, error) {
+	if bc.blobs == nil {
+		return "", bcerrors.NewUnexpectedError(ErrBlobStoreNotSet)
+	}
+	format, found := bc.format(formatName)
+	if !found {
+		return "", bcerrors.ErrFormatNotFound
+	}
+	accepted, found := format.Attachments[field]
+	if !found {
+		return "", bcerrors.ErrFieldNotFound
+	}
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", bcerrors.NewUnexpectedError(fmt.Errorf("reading attachment: %v\n", err))
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	if !acceptsContentType(accepted, contentType) {
+		return "", bcerrors.ValidationFailedError{Failed: map[string]string{
+			field: fmt.Sprintf("content type '%s' not accepted", contentType),
+		}}
+	}
+	key := blob.NewKey()
+	info := blob.Info{Name: name, ContentType: contentType}
+	content := io.MultiReader(bytes.NewReader(head), r)
+	if !strings.HasPrefix(contentType, "image/") {
+		if err := bc.blobs.Put(ctx, key, info, content); err != nil {
+			return "", bcerrors.NewUnexpectedError(fmt.Errorf("storing attachment: %v\n", err))
+		}
+		bc.addUpload(key, upload{formatName: formatName, field: field, contentType: contentType})
+		return key, nil
+	}
+	// Images are read whole to make the thumbnail as well
+	image, err := ioutil.ReadAll(content)
+	if err != nil {
+		return "", bcerrors.NewUnexpectedError(fmt.Errorf("reading attachment: %v\n", err))
+	}
+	if err := bc.blobs.Put(ctx, key, info, bytes.NewReader(image)); err != nil {
+		return "", bcerrors.NewUnexpectedError(fmt.Errorf("storing attachment: %v\n", err))
+	}
+	// Images that can't be decoded don't have thumbnails
+	if thumbnail, err := blob.Thumbnail(bytes.NewReader(image), ThumbnailSize); err == nil {
+		thumbnailInfo := blob.Info{Name: name, ContentType: ThumbnailContentType}
+		if err := bc.blobs.Put(ctx, key+thumbnailSuffix, thumbnailInfo, bytes.NewReader(thumbnail)); err != nil {
+			bc.deleteAttachments(ctx, []string{key})
+			return "", bcerrors.NewUnexpectedError(fmt.Errorf("storing thumbnail: %v\n", err))
+		}
+	}
+	bc.addUpload(key, upload{formatName: formatName, field: field, contentType: contentType})
+	return key, nil
+}
+
+// Attachment returns the attached file with the key, or its thumbnail, and its info. The file must be closed.
+func (bc *Boocat) Attachment(ctx context.Context, key string, thumbnail bool) (blob.Blob, blob.Info, error) {
+	if bc.blobs == nil {
+		return nil, blob.Info{}, bcerrors.NewUnexpectedError(ErrBlobStoreNotSet)
+	}
+	if thumbnail {
+		key += thumbnailSuffix
+	}
+	file, info, err := bc.blobs.Get(ctx, key)
+	switch {
+	case err == nil:
+		return file, info, nil
+	case errors.Is(err, blob.ErrNotFound), errors.Is(err, blob.ErrInvalidKey):
+		return nil, blob.Info{}, bcerrors.ErrRecordNotFound
+	default:
+		return nil, blob.Info{}, bcerrors.NewUnexpectedError(fmt.Errorf("getting attachment: %v\n", err))
+	}
+}
+
+// DiscardAttachments deletes the files with the keys that were attached with AddAttachment but aren't stored in
+// records, e.g. because the record failed validation. Keys of files stored in records are ignored.
+func (bc *Boocat) DiscardAttachments(ctx context.Context, keys []string) {
+	bc.uploadsMutex.Lock()
+	discarded := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, found := bc.uploads[key]; found {
+			delete(bc.uploads, key)
+			discarded = append(discarded, key)
+		}
+	}
+	bc.uploadsMutex.Unlock()
+	bc.deleteAttachments(ctx, discarded)
+}
+
+// addUpload adds the key of a file attached for the attachment field of a format that isn't stored in a record yet
+func (bc *Boocat) addUpload(key string, u upload) {
+	bc.uploadsMutex.Lock()
+	defer bc.uploadsMutex.Unlock()
+	if bc.uploads == nil {
+		bc.uploads = make(map[string]upload)
+	}
+	bc.uploads[key] = u
+}
+
+// claimUploads removes the keys of the attachment fields of the stored record of the format from the files that aren't
+// stored in records
+func (bc *Boocat) claimUploads(format Format, record map[string]string) {
+	bc.uploadsMutex.Lock()
+	defer bc.uploadsMutex.Unlock()
+	for field := range format.Attachments {
+		delete(bc.uploads, record[field])
+	}
+}
+
+// setAttachmentTypes sets the AttachmentTypeField of the attachment fields of the record of the format that is about to
+// be stored to the content types of the files just attached, and removes it from the fields without file. The other
+// fields keep the content types they have.
+func (bc *Boocat) setAttachmentTypes(format Format, record map[string]string) {
+	bc.uploadsMutex.Lock()
+	defer bc.uploadsMutex.Unlock()
+	for field := range format.Attachments {
+		if record[field] == "" {
+			delete(record, AttachmentTypeField(field))
+		} else if u, uploaded := bc.uploads[record[field]]; uploaded {
+			record[AttachmentTypeField(field)] = u.contentType
+		}
+	}
+}
+
+// validateAttachments adds to failed the attachment fields of the record of the format whose values aren't the keys
+// of the files stored in the record, or of files just attached for the field. Otherwise records could take the files of
+// other records, and delete them when they are replaced.
+func (bc *Boocat) validateAttachments(ctx context.Context, format Format, record, failed map[string]string) error {
+	var stored map[string]string
+	for field := range format.Attachments {
+		key := record[field]
+		if key == "" {
+			continue
+		}
+		bc.uploadsMutex.Lock()
+		u, uploaded := bc.uploads[key]
+		bc.uploadsMutex.Unlock()
+		if uploaded && u.formatName == format.Name && u.field == field {
+			continue
+		}
+		if stored == nil && record["id"] != "" {
+			var err error
+			stored, err = bc.db.GetRecord(ctx, format.Name, record["id"])
+			if err != nil && !errors.Is(err, bcerrors.ErrRecordNotFound) {
+				return bcerrors.NewUnexpectedError(fmt.Errorf("getting record from database: %v\n", err))
+			}
+		}
+		if stored[field] != key {
+			failed[field] = "not a file attached to the record"
+		}
+	}
+	return nil
+}
+
+// replacedAttachments returns the keys of the files attached to the stored version of a record of the format that
+// aren't attached to the record anymore
+func (bc *Boocat) replacedAttachments(format Format, stored, record map[string]string) []string {
+	if bc.blobs == nil {
+		return nil
+	}
+	var keys []string
+	for field := range format.Attachments {
+		if stored[field] != "" && stored[field] != record[field] {
+			keys = append(keys, stored[field])
+		}
+	}
+	return keys
+}
+
+// attachmentKeys returns the keys of the files attached to the record of the format with the id
+func (bc *Boocat) attachmentKeys(ctx context.Context, formatName, id string) []string {
+	format, _ := bc.format(formatName)
+	if bc.blobs == nil || len(format.Attachments) == 0 {
+		return nil
+	}
+	record, err := bc.db.GetRecord(ctx, formatName, id)
+	if err != nil {
+		return nil
+	}
+	var keys []string
+	for field := range format.Attachments {
+		if record[field] != "" {
+			keys = append(keys, record[field])
+		}
+	}
+	return keys
+}
+
+// deleteAttachments deletes the attached files with the keys and their thumbnails. Files that can't be deleted are
+// left behind, because the records that had them are already changed.
+func (bc *Boocat) deleteAttachments(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		bc.blobs.Delete(ctx, key)
+		bc.blobs.Delete(ctx, key+thumbnailSuffix)
+	}
+}
+
+// acceptsContentType returns if the content type is accepted by an attachment field that accepts the accepted one
+func acceptsContentType(accepted, contentType string) bool {
+	if accepted == "" {
+		return true
+	}
+	// Remove parameters, e.g. "; charset=utf-8"
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	if strings.HasSuffix(accepted, "/") {
+		return strings.HasPrefix(contentType, accepted)
+	}
+	return contentType == accepted
+}
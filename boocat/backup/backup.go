@@ -0,0 +1,162 @@
+package backup
+
+// Implements backups of all the records in JSON Lines archives. The first line of an archive is the manifest with the
+// definitions of the formats, and every other line is a record of one of them.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ivanmartinez/boocat/boocat"
+)
+
+// Version of the archive layout
+const version = 1
+
+// Manifest describes the formats of the records in an archive
+type Manifest struct {
+	Version int                `json:"version"`
+	Formats []FormatDefinition `json:"formats"`
+}
+
+// FormatDefinition is the definition of a format without its validators
+type FormatDefinition struct {
+	Name       string            `json:"name"`
+	Fields     []string          `json:"fields"`
+	Searchable []string          `json:"searchable,omitempty"`
+	References map[string]string `json:"references,omitempty"`
+	Display    string            `json:"display,omitempty"`
+}
+
+// line is a line of an archive. It's either the manifest or a record.
+type line struct {
+	Manifest *Manifest         `json:"manifest,omitempty"`
+	Format   string            `json:"format,omitempty"`
+	Record   map[string]string `json:"record,omitempty"`
+}
+
+// Dump writes an archive with all the records of all the formats of bc to w, including the ones in the trash. It
+// returns the number of records written per format.
+func Dump(ctx context.Context, bc *boocat.Boocat, w io.Writer) (map[string]int, error) {
+	manifest := newManifest(bc.Formats())
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(line{Manifest: &manifest}); err != nil {
+		return nil, fmt.Errorf("writing manifest: %w", err)
+	}
+	counts := make(map[string]int, len(manifest.Formats))
+	for _, definition := range manifest.Formats {
+		records, err := bc.AllRecords(ctx, definition.Name)
+		if err != nil {
+			return counts, fmt.Errorf("getting records of format '%s': %w", definition.Name, err)
+		}
+		for _, record := range records {
+			if err := encoder.Encode(line{Format: definition.Name, Record: record}); err != nil {
+				return counts, fmt.Errorf("writing record of format '%s': %w", definition.Name, err)
+			}
+			counts[definition.Name]++
+		}
+	}
+	return counts, nil
+}
+
+// Restore reads an archive from r and stores its records in bc with the same IDs, replacing any records with those
+// IDs. Every format in the manifest must be a format of bc with at least the same fields, and every record must be of a
+// format in the manifest. It returns the number of records restored per format.
+func Restore(ctx context.Context, bc *boocat.Boocat, r io.Reader) (map[string]int, error) {
+	decoder := json.NewDecoder(r)
+	var first line
+	if err := decoder.Decode(&first); err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	if first.Manifest == nil {
+		return nil, fmt.Errorf("archive doesn't start with a manifest")
+	}
+	if err := checkManifest(*first.Manifest, bc.Formats()); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(first.Manifest.Formats))
+	for _, definition := range first.Manifest.Formats {
+		counts[definition.Name] = 0
+	}
+	for number := 2; ; number++ {
+		var l line
+		err := decoder.Decode(&l)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return counts, fmt.Errorf("reading line %d: %w", number, err)
+		}
+		if _, found := counts[l.Format]; !found {
+			return counts, fmt.Errorf("format '%s' of line %d isn't in the manifest", l.Format, number)
+		}
+		if err := bc.RestoreRecord(ctx, l.Format, l.Record); err != nil {
+			return counts, fmt.Errorf("restoring line %d: %w", number, err)
+		}
+		counts[l.Format]++
+	}
+	return counts, nil
+}
+
+// newManifest returns the manifest of the formats, sorted by name
+func newManifest(formats map[string]boocat.Format) Manifest {
+	manifest := Manifest{
+		Version: version,
+		Formats: make([]FormatDefinition, 0, len(formats)),
+	}
+	for _, format := range formats {
+		manifest.Formats = append(manifest.Formats, FormatDefinition{
+			Name:       format.Name,
+			Fields:     fieldNames(format),
+			Searchable: setNames(format.Searchable),
+			References: format.References,
+			Display:    format.Display,
+		})
+	}
+	sort.Slice(manifest.Formats, func(i, j int) bool {
+		return manifest.Formats[i].Name < manifest.Formats[j].Name
+	})
+	return manifest
+}
+
+// checkManifest returns an error if the records of the manifest can't be restored into the formats
+func checkManifest(manifest Manifest, formats map[string]boocat.Format) error {
+	if manifest.Version != version {
+		return fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	for _, definition := range manifest.Formats {
+		format, found := formats[definition.Name]
+		if !found {
+			return fmt.Errorf("format '%s' of the archive isn't defined", definition.Name)
+		}
+		for _, field := range definition.Fields {
+			if _, found := format.Fields[field]; !found {
+				return fmt.Errorf("field '%s' of format '%s' of the archive isn't defined", field, definition.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// fieldNames returns the names of the fields of the format sorted alphabetically
+func fieldNames(format boocat.Format) []string {
+	names := make([]string, 0, len(format.Fields))
+	for name := range format.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setNames returns the names in the set sorted alphabetically
+func setNames(set map[string]struct{}) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/internal/teststore"
+)
+
+// TestRoundTrip tests dumping records, including trashed ones and ones with IDs that other databases wouldn't generate,
+// and restoring them into another database with the same IDs
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	source, _ := teststore.NewBoocat(formats()...)
+	records := map[string][]map[string]string{
+		"author": {
+			{"id": "5f1d7b2e9c3a4b0012345678", "name": "Frank Herbert"},
+			{"id": "author-2", "name": "Mary Shelley", boocat.TrashedField: "2021-05-01T08:30:00Z"},
+		},
+		"book": {{"id": "42", "name": "Dune", "author": "5f1d7b2e9c3a4b0012345678"}},
+	}
+	for formatName, formatRecords := range records {
+		for _, record := range formatRecords {
+			if err := source.RestoreRecord(ctx, formatName, record); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+	var archive bytes.Buffer
+	counts, err := Dump(ctx, source, &archive)
+	if err != nil || !reflect.DeepEqual(counts, map[string]int{"author": 2, "book": 1}) {
+		t.Fatalf("unexpected dump: %v, %v", counts, err)
+	}
+	target, _ := teststore.NewBoocat(formats()...)
+	counts, err = Restore(ctx, target, &archive)
+	if err != nil || !reflect.DeepEqual(counts, map[string]int{"author": 2, "book": 1}) {
+		t.Fatalf("unexpected restore: %v, %v", counts, err)
+	}
+	for formatName, formatRecords := range records {
+		restored, err := target.AllRecords(ctx, formatName)
+		if err != nil || !reflect.DeepEqual(restored, formatRecords) {
+			t.Errorf("unexpected records of format '%s': %v, %v", formatName, restored, err)
+		}
+	}
+}
+
+// TestRestoreFormatNotInManifest tests rejecting a record of a format that isn't in the manifest of the archive
+func TestRestoreFormatNotInManifest(t *testing.T) {
+	bc, _ := teststore.NewBoocat(formats()...)
+	archive := `{"manifest":{"version":1,"formats":[{"name":"author","fields":["name"]}]}}
+{"format":"author","record":{"id":"1","name":"Frank Herbert"}}
+{"format":"book","record":{"id":"2","name":"Dune"}}
+`
+	counts, err := Restore(context.Background(), bc, strings.NewReader(archive))
+	if err == nil || !strings.Contains(err.Error(), "line 3") || counts["author"] != 1 {
+		t.Errorf("unexpected restore: %v, %v", counts, err)
+	}
+	if books, _ := bc.AllRecords(context.Background(), "book"); len(books) != 0 {
+		t.Errorf("unexpected books: %v", books)
+	}
+}
+
+// formats returns the formats of authors and books
+func formats() []boocat.Format {
+	return []boocat.Format{
+		{Name: "author", Fields: map[string]boocat.Validate{"name": nil}, Display: "name"},
+		{Name: "book", Fields: map[string]boocat.Validate{"name": nil, "author": nil},
+			References: map[string]string{"author": "author"}, Display: "name"},
+	}
+}
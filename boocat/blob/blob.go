@@ -0,0 +1,65 @@
+package blob
+
+// Implements the storage of blobs, the contents of the attachments of records
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"regexp"
+	"time"
+)
+
+// ErrNotFound is returned when there's no blob with a key
+var ErrNotFound = errors.New("blob not found")
+
+// ErrInvalidKey is returned when a key has characters other than lowercase letters, digits and underscores
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// Valid keys, which can be used as file names
+var keyRegExp = regexp.MustCompile("^[a-z0-9_]+$")
+
+// Info describes a blob
+type Info struct {
+	// Name of the uploaded file
+	Name string
+	// MIME type of the content
+	ContentType string
+	// Size in bytes. It's ignored when storing blobs.
+	Size int64
+	// Time the blob was stored. It's ignored when storing blobs.
+	ModTime time.Time
+}
+
+// Blob is the content of a stored blob. It can be read from any position, so that it can be served with range
+// requests.
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Store stores blobs by key
+type Store interface {
+	// Put stores a blob with the key, replacing the blob with that key if there is one
+	Put(ctx context.Context, key string, info Info, r io.Reader) error
+	// Get returns the blob with the key and its info. The blob must be closed.
+	Get(ctx context.Context, key string) (Blob, Info, error)
+	// Delete deletes the blob with the key
+	Delete(ctx context.Context, key string) error
+}
+
+// NewKey returns a new random key
+func NewKey() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// ValidKey returns if the key is valid
+func ValidKey(key string) bool {
+	return keyRegExp.MatchString(key)
+}
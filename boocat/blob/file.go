@@ -0,0 +1,115 @@
+package blob
+
+// Implements a store of blobs in a directory of the local filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileStore stores every blob in a file named as its key, and its info in a JSON file with the same name plus ".json"
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a store of blobs in the directory, creating it if it doesn't exist
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating directory: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Put stores a blob with the key, replacing the blob with that key if there is one
+func (s *FileStore) Put(_ context.Context, key string, info Info, r io.Reader) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	// Write to a temporary file first, so that a failed upload doesn't leave a partial blob
+	tmp, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	metadata, err := json.Marshal(Info{Name: info.Name, ContentType: info.ContentType})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.infoPath(key), metadata, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+// Get returns the blob with the key and its info
+func (s *FileStore) Get(_ context.Context, key string) (Blob, Info, error) {
+	if !ValidKey(key) {
+		return nil, Info{}, ErrInvalidKey
+	}
+	metadata, err := ioutil.ReadFile(s.infoPath(key))
+	if os.IsNotExist(err) {
+		return nil, Info{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, Info{}, err
+	}
+	var info Info
+	if err := json.Unmarshal(metadata, &info); err != nil {
+		return nil, Info{}, fmt.Errorf("reading info of blob '%s': %w", key, err)
+	}
+	file, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, Info{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, Info{}, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, Info{}, err
+	}
+	info.Size = stat.Size()
+	info.ModTime = stat.ModTime()
+	return file, info, nil
+}
+
+// Delete deletes the blob with the key
+func (s *FileStore) Delete(_ context.Context, key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(s.infoPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// path returns the path of the file of the blob with the key
+func (s *FileStore) path(key string) string {
+	return filepath.Join(s.dir, key)
+}
+
+// infoPath returns the path of the file with the info of the blob with the key
+func (s *FileStore) infoPath(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
@@ -0,0 +1,70 @@
+package blob
+
+// Implements the generation of thumbnails of images
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	_ "image/gif" // Register the GIF decoder
+	"image/jpeg"
+	_ "image/png" // Register the PNG decoder
+	"io"
+)
+
+// Quality of the JPEG encoding of thumbnails
+const thumbnailQuality = 80
+
+// Thumbnail decodes a GIF, JPEG or PNG image and returns a JPEG thumbnail whose width and height are at most maxSize.
+// Images that are already small enough keep their size.
+func Thumbnail(r io.Reader, maxSize int) ([]byte, error) {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, scale(src, maxSize), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// scale returns the image scaled down to fit in a square of maxSize, keeping its proportions. Every pixel of the
+// scaled image is the average of the pixels of the source image it covers.
+func scale(src image.Image, maxSize int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSize && height <= maxSize {
+		return src
+	}
+	dstWidth, dstHeight := maxSize, maxSize
+	if width > height {
+		dstHeight = max(1, height*maxSize/width)
+	} else {
+		dstWidth = max(1, width*maxSize/height)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0, y1 := bounds.Min.Y+y*height/dstHeight, bounds.Min.Y+max((y+1)*height/dstHeight, y*height/dstHeight+1)
+		for x := 0; x < dstWidth; x++ {
+			x0, x1 := bounds.Min.X+x*width/dstWidth, bounds.Min.X+max((x+1)*width/dstWidth, x*width/dstWidth+1)
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sr, sg, sb, sa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+sr, g+sg, b+sb, a+sa, n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// max returns the greatest of two integers
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
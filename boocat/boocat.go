@@ -6,7 +6,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 
+	"github.com/ivanmartinez/boocat/boocat/blob"
 	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
 )
 
@@ -14,16 +17,37 @@ import (
 type database interface {
 	AddRecord(ctx context.Context, formatName string, record map[string]string) (string, error)
 	UpdateRecord(ctx context.Context, formatName string, record map[string]string) error
+	RestoreRecord(ctx context.Context, formatName string, record map[string]string) error
+	DeleteRecord(ctx context.Context, formatName, id string) error
 	GetAllRecords(ctx context.Context, formatName string) ([]map[string]string, error)
 	GetRecord(ctx context.Context, formatName, id string) (map[string]string, error)
 	SearchRecord(ctx context.Context, formatName, value string) ([]map[string]string, error)
+	FilterRecords(ctx context.Context, formatName string, equal map[string]string) ([]map[string]string, error)
+	PrefixRecords(ctx context.Context, formatName, field, prefix string, limit int) ([]map[string]string, error)
 	ReferenceValidator(formatName string) Validate
+	InitializeCollection(ctx context.Context, format Format) error
+	GetFormatDefinitions(ctx context.Context) ([]FormatDefinition, error)
+	SaveFormatDefinition(ctx context.Context, definition FormatDefinition) error
 }
 
 // Boocat contains the data for the boocat API and logic
 type Boocat struct {
+	// mutex protects the formats and definitions, which can change while serving requests
+	mutex   sync.RWMutex
 	formats map[string]Format
-	db      database
+	// Definitions of the formats defined at runtime, by name
+	definitions map[string]FormatDefinition
+	// Validator factories by name
+	validators map[string]ValidatorFactory
+	db         database
+	// Store of the files attached to records
+	blobs blob.Store
+	// Hooks called after records change
+	changeHooks []ChangeHook
+	// uploadsMutex protects uploads
+	uploadsMutex sync.Mutex
+	// Keys of the files attached but not stored in records yet, and the attachment fields they were attached for
+	uploads map[string]upload
 }
 
 // SetDatabase sets the database to be used
@@ -32,8 +56,16 @@ func (bc *Boocat) SetDatabase(db database) *Boocat {
 	return bc
 }
 
+// SetBlobStore sets the store of the files attached to records
+func (bc *Boocat) SetBlobStore(blobs blob.Store) *Boocat {
+	bc.blobs = blobs
+	return bc
+}
+
 // SetFormat sets a format to be used
 func (bc *Boocat) SetFormat(name string, format Format) *Boocat {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
 	if bc.formats == nil {
 		bc.formats = make(map[string]Format)
 	}
@@ -43,16 +75,32 @@ func (bc *Boocat) SetFormat(name string, format Format) *Boocat {
 
 // Formats returns all the defined formats
 func (bc *Boocat) Formats() map[string]Format {
-	return bc.formats
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+	formats := make(map[string]Format, len(bc.formats))
+	for name, format := range bc.formats {
+		formats[name] = format
+	}
+	return formats
 }
 
-// GetRecord returns a record of a format by id
+// format returns the format with the name, and if it's found
+func (bc *Boocat) format(name string) (Format, bool) {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+	format, found := bc.formats[name]
+	return format, found
+}
+
+// GetRecord returns a record of a format by id. Records in the trash aren't found.
 func (bc *Boocat) GetRecord(ctx context.Context, formatName string, id string) (map[string]string, error) {
 	if bc.db == nil {
 		return nil, bcerrors.NewUnexpectedError(errors.New("database not set"))
 	}
 	record, err := bc.db.GetRecord(ctx, formatName, id)
 	switch {
+	case err == nil && trashed(record):
+		return nil, bcerrors.ErrRecordNotFound
 	case err == nil:
 		return record, nil
 	case errors.Is(err, bcerrors.ErrFormatNotFound):
@@ -64,7 +112,7 @@ func (bc *Boocat) GetRecord(ctx context.Context, formatName string, id string) (
 	}
 }
 
-// ListRecords returns a slice with all records of a format
+// ListRecords returns a slice with all records of a format, except the ones in the trash
 func (bc *Boocat) ListRecords(ctx context.Context, formatName string) ([]map[string]string, error) {
 	if bc.db == nil {
 		return nil, bcerrors.NewUnexpectedError(errors.New("database not set"))
@@ -72,7 +120,7 @@ func (bc *Boocat) ListRecords(ctx context.Context, formatName string) ([]map[str
 	records, err := bc.db.GetAllRecords(ctx, formatName)
 	switch {
 	case err == nil:
-		return records, nil
+		return untrashed(records), nil
 	case errors.Is(err, bcerrors.ErrFormatNotFound):
 		return nil, bcerrors.ErrFormatNotFound
 	default:
@@ -88,7 +136,119 @@ func (bc *Boocat) SearchRecords(ctx context.Context, formatName string, search s
 	records, err := bc.db.SearchRecord(ctx, formatName, search)
 	switch {
 	case err == nil:
-		return records, nil
+		return untrashed(records), nil
+	case errors.Is(err, bcerrors.ErrFormatNotFound):
+		return nil, bcerrors.ErrFormatNotFound
+	default:
+		return nil, bcerrors.NewUnexpectedError(fmt.Errorf("getting records from database: %v\n", err))
+	}
+}
+
+// FilterRecords returns the records of a format that pass the filter sorted as it sets, and the counts of the values
+// of the format's facet fields in those records
+func (bc *Boocat) FilterRecords(ctx context.Context, formatName string, filter Filter) (FilteredRecords, error) {
+	if bc.db == nil {
+		return FilteredRecords{}, bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	format, found := bc.format(formatName)
+	if !found {
+		return FilteredRecords{}, bcerrors.ErrFormatNotFound
+	}
+	for _, field := range filter.fields() {
+		if _, found := format.Fields[field]; !found {
+			return FilteredRecords{}, bcerrors.ErrFieldNotFound
+		}
+	}
+	if _, found := format.Fields[filter.Sort]; !found && filter.Sort != "" && !strings.HasPrefix(filter.Sort, "_") {
+		return FilteredRecords{}, bcerrors.ErrFieldNotFound
+	}
+	var (
+		records []map[string]string
+		err     error
+	)
+	if filter.Search != "" {
+		records, err = bc.db.SearchRecord(ctx, formatName, filter.Search)
+	} else {
+		records, err = bc.db.FilterRecords(ctx, formatName, filter.Equal)
+	}
+	switch {
+	case errors.Is(err, bcerrors.ErrFormatNotFound):
+		return FilteredRecords{}, bcerrors.ErrFormatNotFound
+	case err != nil:
+		return FilteredRecords{}, bcerrors.NewUnexpectedError(fmt.Errorf("getting records from database: %v\n", err))
+	}
+	filtered := make([]map[string]string, 0, len(records))
+	for _, record := range records {
+		if !trashed(record) && filter.matches(format, record) {
+			filtered = append(filtered, record)
+		}
+	}
+	filter.sort(filtered)
+	return FilteredRecords{
+		Records: filtered,
+		Facets:  countFacets(format, filtered),
+	}, nil
+}
+
+// CompleteRecords returns up to limit records of a format whose display field starts with prefix, case-insensitive.
+// Records in the trash are left out after applying the limit, so there can be fewer.
+func (bc *Boocat) CompleteRecords(ctx context.Context, formatName string, prefix string, limit int) (
+	[]map[string]string, error) {
+	if bc.db == nil {
+		return nil, bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	format, found := bc.format(formatName)
+	if !found {
+		return nil, bcerrors.ErrFormatNotFound
+	}
+	if format.Display == "" {
+		return nil, bcerrors.ErrNoDisplayField
+	}
+	records, err := bc.db.PrefixRecords(ctx, formatName, format.Display, prefix, limit)
+	switch {
+	case err == nil:
+		return untrashed(records), nil
+	case errors.Is(err, bcerrors.ErrFormatNotFound):
+		return nil, bcerrors.ErrFormatNotFound
+	default:
+		return nil, bcerrors.NewUnexpectedError(fmt.Errorf("getting records from database: %v\n", err))
+	}
+}
+
+// ValidateRecord normalizes and validates a record of a format without storing it, and returns the fields that failed
+// validation
+func (bc *Boocat) ValidateRecord(ctx context.Context, formatName string, record map[string]string) (
+	map[string]string, error) {
+	if bc.db == nil {
+		return nil, bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	format, found := bc.format(formatName)
+	if !found {
+		return nil, bcerrors.ErrFormatNotFound
+	}
+	return bc.validate(ctx, format, record)
+}
+
+// FindRecord returns the record of a format whose unique field has the value
+func (bc *Boocat) FindRecord(ctx context.Context, formatName, field, value string) (map[string]string, error) {
+	if bc.db == nil {
+		return nil, bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	format, found := bc.format(formatName)
+	if !found {
+		return nil, bcerrors.ErrFormatNotFound
+	}
+	if !format.IsUnique(field) {
+		return nil, bcerrors.ErrFieldNotFound
+	}
+	value = format.Normalize(map[string]string{field: value})[field]
+	records, err := bc.db.FilterRecords(ctx, formatName, map[string]string{field: value})
+	records = untrashed(records)
+	switch {
+	case err == nil && len(records) > 0:
+		return records[0], nil
+	case err == nil:
+		return nil, bcerrors.ErrRecordNotFound
 	case errors.Is(err, bcerrors.ErrFormatNotFound):
 		return nil, bcerrors.ErrFormatNotFound
 	default:
@@ -101,12 +261,24 @@ func (bc *Boocat) AddRecord(ctx context.Context, formatName string, record map[s
 	if bc.db == nil {
 		return "", bcerrors.NewUnexpectedError(errors.New("database not set"))
 	}
-	format := bc.formats[formatName] // TODO: Check that the format exists
-	failed := format.Validate(ctx, record)
+	format, _ := bc.format(formatName) // TODO: Check that the format exists
+	failed, err := bc.validate(ctx, format, record)
+	if err != nil {
+		return "", err
+	}
 	if len(failed) > 0 {
 		return "", bcerrors.ValidationFailedError{Failed: failed}
 	}
-	id, err := bc.db.AddRecord(ctx, format.Name, record)
+	added := make(map[string]string, len(record)+2)
+	for field, value := range record {
+		added[field] = value
+	}
+	added[ModifiedField] = modifiedNow()
+	bc.setAttachmentTypes(format, added)
+	id, err := bc.db.AddRecord(ctx, format.Name, added)
+	if failed, isDuplicate := duplicateFails(err); isDuplicate {
+		return "", bcerrors.ValidationFailedError{Failed: failed}
+	}
 	switch {
 	case errors.Is(err, bcerrors.ErrFormatNotFound):
 		return "", bcerrors.ErrFormatNotFound
@@ -115,28 +287,251 @@ func (bc *Boocat) AddRecord(ctx context.Context, formatName string, record map[s
 	case err != nil:
 		return "", bcerrors.NewUnexpectedError(fmt.Errorf("adding record to database: %v\n", err))
 	}
+	added["id"] = id
+	bc.claimUploads(format, added)
+	bc.changed(ctx, format.Name, added)
 	return id, nil
 }
 
-// UpdateRecord updates a record of a format
+// UpdateRecord updates a record of a format. Records in the trash aren't found, and the internal fields of the stored
+// record are kept.
 func (bc *Boocat) UpdateRecord(ctx context.Context, formatName string, record map[string]string) error {
 	if bc.db == nil {
 		return bcerrors.NewUnexpectedError(errors.New("database not set"))
 	}
-	format := bc.formats[formatName] // TODO: Check that the format exists
-	failed := format.Validate(ctx, record)
+	format, _ := bc.format(formatName) // TODO: Check that the format exists
+	failed, err := bc.validate(ctx, format, record)
+	if err != nil {
+		return err
+	}
 	if len(failed) > 0 {
 		return bcerrors.ValidationFailedError{Failed: failed}
 	}
-	err := bc.db.UpdateRecord(ctx, format.Name, record)
+	stored, err := bc.db.GetRecord(ctx, format.Name, record["id"])
+	if err == nil && trashed(stored) {
+		return bcerrors.ErrRecordNotFound
+	}
+	replaced := bc.replacedAttachments(format, stored, record)
+	updated := withInternalFields(record, stored)
+	updated[ModifiedField] = modifiedNow()
+	bc.setAttachmentTypes(format, updated)
+	err = bc.db.UpdateRecord(ctx, format.Name, updated)
+	if failed, isDuplicate := duplicateFails(err); isDuplicate {
+		return bcerrors.ValidationFailedError{Failed: failed}
+	}
 	switch {
 	case err == nil:
+		bc.claimUploads(format, updated)
+		bc.deleteAttachments(ctx, replaced)
+		bc.changed(ctx, format.Name, updated)
 		return nil
 	case errors.Is(err, bcerrors.ErrFormatNotFound):
 		return bcerrors.ErrFormatNotFound
 	case errors.Is(err, bcerrors.ErrRecordDoesntHaveID):
 		return bcerrors.ErrRecordDoesntHaveID
+	case errors.Is(err, bcerrors.ErrRecordNotFound):
+		return bcerrors.ErrRecordNotFound
+	default:
+		return bcerrors.NewUnexpectedError(fmt.Errorf("updating record in database: %v\n", err))
+	}
+}
+
+// RestoreRecord stores a record of a format with the ID it has, replacing the record with that ID if there is one. The
+// record isn't validated, so that backups can be restored in any order even if records reference others.
+func (bc *Boocat) RestoreRecord(ctx context.Context, formatName string, record map[string]string) error {
+	if bc.db == nil {
+		return bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	if _, found := bc.format(formatName); !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	if record["id"] == "" {
+		return bcerrors.ErrRecordDoesntHaveID
+	}
+	err := bc.db.RestoreRecord(ctx, formatName, record)
+	switch {
+	case err == nil:
+		bc.changed(ctx, formatName, record)
+		return nil
+	case errors.Is(err, bcerrors.ErrFormatNotFound):
+		return bcerrors.ErrFormatNotFound
+	default:
+		return bcerrors.NewUnexpectedError(fmt.Errorf("restoring record in database: %v\n", err))
+	}
+}
+
+// SetInternalFields sets internal fields of the record of a format with the id, keeping the rest of the record. The
+// names of internal fields start with an underscore, and an empty value removes the field. The record isn't
+// validated, and records in the trash aren't found.
+func (bc *Boocat) SetInternalFields(ctx context.Context, formatName, id string, fields map[string]string) error {
+	if bc.db == nil {
+		return bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	for field := range fields {
+		if !strings.HasPrefix(field, "_") {
+			return bcerrors.ErrFieldNotFound
+		}
+	}
+	stored, err := bc.db.GetRecord(ctx, formatName, id)
+	if err == nil && trashed(stored) {
+		return bcerrors.ErrRecordNotFound
+	}
+	if err == nil {
+		updated := withInternalFields(stored, nil)
+		for field, value := range fields {
+			if value == "" {
+				delete(updated, field)
+			} else {
+				updated[field] = value
+			}
+		}
+		err = bc.db.UpdateRecord(ctx, formatName, updated)
+	}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, bcerrors.ErrFormatNotFound):
+		return bcerrors.ErrFormatNotFound
+	case errors.Is(err, bcerrors.ErrRecordNotFound):
+		return bcerrors.ErrRecordNotFound
 	default:
 		return bcerrors.NewUnexpectedError(fmt.Errorf("updating record in database: %v\n", err))
 	}
 }
+
+// validate normalizes the record and returns the fields that fail validation, including the unique fields whose
+// values are already used by other records of the format and the reference fields with records in the trash
+func (bc *Boocat) validate(ctx context.Context, format Format, record map[string]string) (map[string]string, error) {
+	format.Normalize(record)
+	failed := format.Validate(ctx, record)
+	if err := bc.validateAttachments(ctx, format, record, failed); err != nil {
+		return nil, err
+	}
+	for field, refFormatName := range format.References {
+		if _, found := failed[field]; found {
+			continue
+		}
+		for _, refID := range format.Values(field, record[field]) {
+			if referenced, err := bc.db.GetRecord(ctx, refFormatName, refID); err == nil && trashed(referenced) {
+				failed[field] = "referenced record is deleted"
+				break
+			}
+		}
+	}
+	if err := bc.validateFormatReferences(ctx, format, record, failed); err != nil {
+		return nil, err
+	}
+	for _, fields := range format.Unique {
+		equal, complete := uniqueValues(record, fields)
+		// Sets with empty values or fields that already failed aren't checked
+		if !complete || anyFailed(failed, fields) {
+			continue
+		}
+		used, err := bc.usedByOther(ctx, format, record["id"], equal)
+		if err != nil {
+			return nil, err
+		}
+		if used {
+			addDuplicateFails(failed, fields)
+		}
+	}
+	return failed, nil
+}
+
+// validateFormatReferences adds to failed the fields of the record that reference records of any format, or name
+// their formats, whose referenced records aren't found, are deleted, or are of formats that don't exist
+func (bc *Boocat) validateFormatReferences(ctx context.Context, format Format, record map[string]string,
+	failed map[string]string) error {
+	for field, formatField := range format.FormatReferences {
+		if anyFailed(failed, []string{field, formatField}) {
+			continue
+		}
+		refFormatName := record[formatField]
+		if _, found := bc.format(refFormatName); !found {
+			failed[formatField] = fmt.Sprintf("format '%s' not found", refFormatName)
+			continue
+		}
+		referenced, err := bc.db.GetRecord(ctx, refFormatName, record[field])
+		switch {
+		case errors.Is(err, bcerrors.ErrRecordNotFound):
+			failed[field] = fmt.Sprintf("record of format '%s' and ID '%s' not found", refFormatName, record[field])
+		case err != nil:
+			return bcerrors.NewUnexpectedError(fmt.Errorf("getting record from database: %v\n", err))
+		case trashed(referenced):
+			failed[field] = "referenced record is deleted"
+		}
+	}
+	return nil
+}
+
+// uniqueValues returns the values of the record in a set of unique fields, and if none of them is empty
+func uniqueValues(record map[string]string, fields []string) (map[string]string, bool) {
+	equal := make(map[string]string, len(fields))
+	for _, field := range fields {
+		if value := record[field]; value != "" {
+			equal[field] = value
+		}
+	}
+	return equal, len(equal) == len(fields)
+}
+
+// usedByOther returns if a record of the format other than the one with the id has the values. Records in the trash
+// don't keep their values.
+func (bc *Boocat) usedByOther(ctx context.Context, format Format, id string, equal map[string]string) (bool, error) {
+	records, err := bc.db.FilterRecords(ctx, format.Name, equal)
+	if err != nil && !errors.Is(err, bcerrors.ErrFormatNotFound) {
+		return false, bcerrors.NewUnexpectedError(fmt.Errorf("getting records from database: %v\n", err))
+	}
+	for _, other := range records {
+		if other["id"] != id && !trashed(other) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// withInternalFields returns a copy of the record with the internal fields of the stored record, whose names start
+// with an underscore
+func withInternalFields(record, stored map[string]string) map[string]string {
+	updated := make(map[string]string, len(record))
+	for field, value := range record {
+		updated[field] = value
+	}
+	for field, value := range stored {
+		if strings.HasPrefix(field, "_") {
+			updated[field] = value
+		}
+	}
+	return updated
+}
+
+// duplicateFails returns the validation fails of a duplicate error, or false if err isn't one
+func duplicateFails(err error) (map[string]string, bool) {
+	var duplicateError bcerrors.DuplicateError
+	if !errors.As(err, &duplicateError) {
+		return nil, false
+	}
+	return addDuplicateFails(make(map[string]string, len(duplicateError.Fields)), duplicateError.Fields), true
+}
+
+// addDuplicateFails returns failed with the fails of a set of unique fields whose values are already used
+func addDuplicateFails(failed map[string]string, fields []string) map[string]string {
+	for _, field := range fields {
+		if len(fields) == 1 {
+			failed[field] = "already used by another record"
+		} else {
+			failed[field] = fmt.Sprintf("combination of %v already used by another record", fields)
+		}
+	}
+	return failed
+}
+
+// anyFailed returns if any of the fields is in failed
+func anyFailed(failed map[string]string, fields []string) bool {
+	for _, field := range fields {
+		if _, found := failed[field]; found {
+			return true
+		}
+	}
+	return false
+}
@@ -1,22 +1,28 @@
 package boocat
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"image"
+	imagepng "image/png"
 	"log"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/ivanmartinez/boocat/boocat/blob"
 	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
 )
 
 // MockDB is a database mock for testing
 type MockDB struct {
-	records map[string][]map[string]string
+	records     map[string][]map[string]string
+	definitions map[string]FormatDefinition
 }
 
 // NewDB returns a new MockDB with sets for author and book records
@@ -63,6 +69,42 @@ func (db *MockDB) UpdateRecord(_ context.Context, formatName string, record map[
 	return nil
 }
 
+// RestoreRecord stores a record of the format with its id, replacing the record with that id if there is one
+func (db *MockDB) RestoreRecord(_ context.Context, formatName string, record map[string]string) error {
+	if _, found := record["id"]; !found {
+		return bcerrors.ErrRecordDoesntHaveID
+	}
+	if _, found := db.records[formatName]; !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	i, err := strconv.Atoi(record["id"])
+	if err != nil {
+		return fmt.Errorf("couldn't convert id %q to integer: %v", record["id"], err)
+	}
+	for len(db.records[formatName]) <= i {
+		db.records[formatName] = append(db.records[formatName], nil)
+	}
+	db.records[formatName][i] = record
+	return nil
+}
+
+// DeleteRecord deletes the record of the format with the id, leaving its position empty so that IDs don't change
+func (db *MockDB) DeleteRecord(_ context.Context, formatName, id string) error {
+	slice, found := db.records[formatName]
+	if !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	i, err := strconv.Atoi(id)
+	if err != nil {
+		return fmt.Errorf("couldn't convert id %q to integer: %v", id, err)
+	}
+	if i < 0 || i >= len(slice) || slice[i] == nil {
+		return bcerrors.ErrRecordNotFound
+	}
+	slice[i] = nil
+	return nil
+}
+
 // GetRecord returns the record of the format with the id
 func (db *MockDB) GetRecord(_ context.Context, formatName, id string) (map[string]string, error) {
 	slice, found := db.records[formatName]
@@ -73,7 +115,7 @@ func (db *MockDB) GetRecord(_ context.Context, formatName, id string) (map[strin
 	if err != nil {
 		return nil, fmt.Errorf("couldn't convert id %q to integer: %v", id, err)
 	}
-	if i < 0 || i >= len(slice) {
+	if i < 0 || i >= len(slice) || slice[i] == nil {
 		return nil, bcerrors.ErrRecordNotFound
 	}
 	record := slice[i]
@@ -86,7 +128,7 @@ func (db *MockDB) GetAllRecords(_ context.Context, formatName string) ([]map[str
 	if !found {
 		return nil, bcerrors.ErrFormatNotFound
 	}
-	return slice, nil
+	return present(slice), nil
 }
 
 // SearchRecord returns all records the format that have the value in their searchable fields, which in this case are
@@ -97,7 +139,7 @@ func (db *MockDB) SearchRecord(_ context.Context, formatName, value string) ([]m
 		return nil, bcerrors.ErrFormatNotFound
 	}
 	result := make([]map[string]string, 0, len(slice))
-	for _, record := range slice {
+	for _, record := range present(slice) {
 		if matchesSearch(record, value) {
 			result = append(result, record)
 		}
@@ -105,6 +147,41 @@ func (db *MockDB) SearchRecord(_ context.Context, formatName, value string) ([]m
 	return result, nil
 }
 
+// FilterRecords returns all records of the format whose fields have the values in equal
+func (db *MockDB) FilterRecords(_ context.Context, formatName string, equal map[string]string) (
+	[]map[string]string, error) {
+	slice, found := db.records[formatName]
+	if !found {
+		return nil, bcerrors.ErrFormatNotFound
+	}
+	result := make([]map[string]string, 0, len(slice))
+	for _, record := range present(slice) {
+		if matchesEqual(record, equal) {
+			result = append(result, record)
+		}
+	}
+	return result, nil
+}
+
+// PrefixRecords returns up to limit records of the format whose field starts with prefix, case-insensitive
+func (db *MockDB) PrefixRecords(_ context.Context, formatName, field, prefix string, limit int) (
+	[]map[string]string, error) {
+	slice, found := db.records[formatName]
+	if !found {
+		return nil, bcerrors.ErrFormatNotFound
+	}
+	result := make([]map[string]string, 0, limit)
+	for _, record := range present(slice) {
+		if len(result) == limit {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(record[field]), strings.ToLower(prefix)) {
+			result = append(result, record)
+		}
+	}
+	return result, nil
+}
+
 // ReferenceValidator returns a validator of references to records of the format
 func (db *MockDB) ReferenceValidator(formatName string) Validate {
 	return func(ctx context.Context, value interface{}) string {
@@ -117,6 +194,43 @@ func (db *MockDB) ReferenceValidator(formatName string) Validate {
 	}
 }
 
+// InitializeCollection creates the set of records of the format if it doesn't exist
+func (db *MockDB) InitializeCollection(_ context.Context, format Format) error {
+	if _, found := db.records[format.Name]; !found {
+		db.records[format.Name] = []map[string]string{}
+	}
+	return nil
+}
+
+// GetFormatDefinitions returns the stored format definitions
+func (db *MockDB) GetFormatDefinitions(_ context.Context) ([]FormatDefinition, error) {
+	definitions := make([]FormatDefinition, 0, len(db.definitions))
+	for _, definition := range db.definitions {
+		definitions = append(definitions, definition)
+	}
+	return definitions, nil
+}
+
+// SaveFormatDefinition stores a format definition
+func (db *MockDB) SaveFormatDefinition(_ context.Context, definition FormatDefinition) error {
+	if db.definitions == nil {
+		db.definitions = make(map[string]FormatDefinition)
+	}
+	db.definitions[definition.Name] = definition
+	return nil
+}
+
+// present returns the records that haven't been deleted
+func present(slice []map[string]string) []map[string]string {
+	records := make([]map[string]string, 0, len(slice))
+	for _, record := range slice {
+		if record != nil {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
 // matchesSearch returns if the value of any field of the record contains the search term, case-insensitive.
 func matchesSearch(record map[string]string, search string) bool {
 	for _, value := range record {
@@ -127,6 +241,22 @@ func matchesSearch(record map[string]string, search string) bool {
 	return false
 }
 
+// matchesEqual returns if the record has all the field values. Fields with several values match if any of them does.
+func matchesEqual(record map[string]string, equal map[string]string) bool {
+	for field, value := range equal {
+		matches := false
+		for _, recordValue := range strings.Split(record[field], ListSeparator) {
+			if recordValue == value {
+				matches = true
+			}
+		}
+		if !matches {
+			return false
+		}
+	}
+	return true
+}
+
 // TestGetRecord tests successfully getting a record with GetRecord
 func TestGetRecord(t *testing.T) {
 	db := initializedDatabase()
@@ -166,6 +296,124 @@ func TestSearchRecords(t *testing.T) {
 	}
 }
 
+// TestFilterRecords tests successfully filtering records by equal values and ranges with FilterRecords
+func TestFilterRecords(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	result, err := bc.FilterRecords(context.Background(), "book", Filter{
+		Equal:  map[string]string{"author": "1"},
+		Ranges: map[string]Range{"year": {Min: "1940", Max: "1946"}},
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(result.Records, []map[string]string{db.records["book"][2]}) {
+		t.Errorf("unexpected records: %v", result.Records)
+	}
+	if !reflect.DeepEqual(result.Facets, map[string]map[string]int{
+		"year":   {"1945": 1},
+		"author": {"1": 1},
+	}) {
+		t.Errorf("unexpected facets: %v", result.Facets)
+	}
+}
+
+// TestFilterRecordsFacets tests the facet counts of all the records with FilterRecords
+func TestFilterRecordsFacets(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	result, err := bc.FilterRecords(context.Background(), "book", Filter{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(result.Records) != len(db.records["book"]) {
+		t.Errorf("unexpected records: %v", result.Records)
+	}
+	if !reflect.DeepEqual(result.Facets["author"], map[string]int{"0": 2, "1": 2}) {
+		t.Errorf("unexpected facets: %v", result.Facets)
+	}
+}
+
+// TestFilterRecordsSort tests sorting the filtered records by a field in descending order with FilterRecords
+func TestFilterRecordsSort(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	result, err := bc.FilterRecords(context.Background(), "book", Filter{Sort: "year", Descending: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var ids []string
+	for _, record := range result.Records {
+		ids = append(ids, record["id"])
+	}
+	if !reflect.DeepEqual(ids, []string{"1", "0", "3", "2"}) {
+		t.Errorf("unexpected order: %v", ids)
+	}
+	_, err = bc.FilterRecords(context.Background(), "book", Filter{Sort: "publisher"})
+	if !errors.Is(err, bcerrors.ErrFieldNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestFilterRecordsFieldNotFound tests filtering records by a field that isn't of the format with FilterRecords
+func TestFilterRecordsFieldNotFound(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	_, err := bc.FilterRecords(context.Background(), "book", Filter{
+		Equal: map[string]string{"publisher": "Penguin"},
+	})
+	if !errors.Is(err, bcerrors.ErrFieldNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestCompleteRecords tests successfully getting records by the prefix of their display field with CompleteRecords
+func TestCompleteRecords(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	result, err := bc.CompleteRecords(context.Background(), "author", "geo", 10)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(result) != 1 || !reflect.DeepEqual(result[0], db.records["author"][1]) {
+		t.Errorf("unexpected records: %v", result)
+	}
+}
+
+// TestCompleteRecordsFormatNotFound tests getting records of a format that doesn't exist with CompleteRecords
+func TestCompleteRecordsFormatNotFound(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	_, err := bc.CompleteRecords(context.Background(), "publisher", "geo", 10)
+	if !errors.Is(err, bcerrors.ErrFormatNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestValidateRecord tests validating a record without storing it with ValidateRecord
+func TestValidateRecord(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	booksCount := len(db.records["book"])
+	failed, err := bc.ValidateRecord(
+		context.Background(),
+		"book",
+		map[string]string{
+			"name":   "Homage To Catalonia",
+			"year":   "MCMXXXVIII",
+			"author": "1",
+		})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(failed, map[string]string{"year": "not a valid year number"}) {
+		t.Errorf("unexpected validation errors: %v", failed)
+	}
+	if len(db.records["book"]) != booksCount {
+		t.Errorf("number of books has changed to %v", len(db.records["book"]))
+	}
+}
+
 // TestAddRecord tests successfully adding a record with AddRecord
 func TestAddRecord(t *testing.T) {
 	db := initializedDatabase()
@@ -187,7 +435,11 @@ func TestAddRecord(t *testing.T) {
 	if err != nil {
 		t.Errorf("couldn't convert result %q to integer: %v", result, err)
 	}
-	// Check that the record is stored as expected
+	// Check that the record is stored as expected, with the time it was modified
+	if _, err := time.Parse(time.RFC3339, db.records["book"][i][ModifiedField]); err != nil {
+		t.Errorf("unexpected modification time: %v", err)
+	}
+	delete(db.records["book"][i], ModifiedField)
 	if !reflect.DeepEqual(db.records["book"][i], map[string]string{
 		"id":       "4",
 		"name":     "The Wind-Up Bird Chronicle",
@@ -199,6 +451,127 @@ func TestAddRecord(t *testing.T) {
 	}
 }
 
+// TestAddRecordNormalized tests that values are normalized when adding a record with AddRecord
+func TestAddRecordNormalized(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	id, err := bc.AddRecord(
+		context.Background(),
+		"book",
+		map[string]string{
+			"name": "Animal Farm",
+			"isbn": "0-452-28424-4",
+		})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	record, _ := db.GetRecord(context.Background(), "book", id)
+	if record["isbn"] != "9780452284241" {
+		t.Errorf("unexpected ISBN: %v", record["isbn"])
+	}
+}
+
+// TestAddRecordEmptyISBN tests adding books without ISBN with AddRecord, as posted by forms with the field empty
+func TestAddRecordEmptyISBN(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	for _, name := range []string{"Don Quixote", "Hamlet"} {
+		if _, err := bc.AddRecord(context.Background(), "book", map[string]string{"name": name, "isbn": ""}); err != nil {
+			t.Errorf("unexpected error adding %s: %v", name, err)
+		}
+	}
+}
+
+// TestAddRecordUniqueFail tests that a record can't be added with AddRecord with a value of a unique field that
+// another record has
+func TestAddRecordUniqueFail(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	booksCount := len(db.records["book"])
+	_, err := bc.AddRecord(
+		context.Background(),
+		"book",
+		map[string]string{
+			"name": "Nineteen Eighty-Four",
+			"isbn": "0-451-52493-4",
+		})
+	var validationErrors bcerrors.ValidationFailedError
+	if errors.As(err, &validationErrors) {
+		if !reflect.DeepEqual(validationErrors.Failed, map[string]string{
+			"isbn": "already used by another record",
+		}) {
+			t.Errorf("unexpected validation errors: %v", validationErrors.Failed)
+		}
+	} else {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(db.records["book"]) != booksCount {
+		t.Errorf("number of books has changed to %v", len(db.records["book"]))
+	}
+}
+
+// TestUpdateRecordUniqueFail tests that a record can't be updated with UpdateRecord with the combined values of a set
+// of unique fields that another record has
+func TestUpdateRecordUniqueFail(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	storedRecord := db.records["author"][2]
+	err := bc.UpdateRecord(
+		context.Background(),
+		"author",
+		map[string]string{
+			"id":        "2",
+			"name":      "George Orwell",
+			"birthdate": "1903",
+		})
+	var validationErrors bcerrors.ValidationFailedError
+	if errors.As(err, &validationErrors) {
+		if !reflect.DeepEqual(validationErrors.Failed, map[string]string{
+			"name":      "combination of [name birthdate] already used by another record",
+			"birthdate": "combination of [name birthdate] already used by another record",
+		}) {
+			t.Errorf("unexpected validation errors: %v", validationErrors.Failed)
+		}
+	} else {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(db.records["author"][2], storedRecord) {
+		t.Errorf("updated record: %v", db.records["author"][2])
+	}
+}
+
+// TestUpdateRecordUniqueSameRecord tests that a record can be updated with UpdateRecord keeping the values of its
+// unique fields
+func TestUpdateRecordUniqueSameRecord(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	err := bc.UpdateRecord(
+		context.Background(),
+		"author",
+		map[string]string{
+			"id":        "1",
+			"name":      "George Orwell",
+			"birthdate": "1903",
+			"biography": "British",
+		})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestFindRecord tests successfully getting a record by the value of a unique field with FindRecord
+func TestFindRecord(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	result, err := bc.FindRecord(context.Background(), "book", "isbn", "978-0-451-52493-5")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(result, db.records["book"][3]) {
+		t.Errorf("unexpected record: %v", result)
+	}
+}
+
 // TestAddRecordValidationFail tests validation fails when attempting to add a record with AddRecord
 func TestAddRecordValidationFail(t *testing.T) {
 	db := initializedDatabase()
@@ -249,7 +622,11 @@ func TestUpdateRecord(t *testing.T) {
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	// Check that the record is stored as expected
+	// Check that the record is stored as expected, with the time it was modified
+	if _, err := time.Parse(time.RFC3339, db.records["author"][2][ModifiedField]); err != nil {
+		t.Errorf("unexpected modification time: %v", err)
+	}
+	delete(db.records["author"][2], ModifiedField)
 	if !reflect.DeepEqual(db.records["author"][2], map[string]string{
 		"id":        "2",
 		"name":      "Miguel De Cervantes Saavedra",
@@ -290,6 +667,669 @@ func TestUpdateRecordValidationFail(t *testing.T) {
 	}
 }
 
+// TestResolveRecord tests successfully getting a record with its references resolved with ResolveRecord
+func TestResolveRecord(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	book, err := bc.ResolveRecord(context.Background(), "book", "2")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(book["author"], db.records["author"][1]) {
+		t.Errorf("unexpected author: %v", book["author"])
+	}
+	author, err := bc.ResolveRecord(context.Background(), "author", "1")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(author["books"], []map[string]string{db.records["book"][2], db.records["book"][3]}) {
+		t.Errorf("unexpected books: %v", author["books"])
+	}
+}
+
+// TestResolveReferencesNotFound tests resolving references to records that don't exist with ResolveReferences
+func TestResolveReferencesNotFound(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	resolved := bc.ResolveReferences(context.Background(), "book", map[string]string{"author": "7"})
+	if !reflect.DeepEqual(resolved["author"], map[string]string{"id": "7"}) {
+		t.Errorf("unexpected author: %v", resolved["author"])
+	}
+}
+
+// TestResolveReferencesList tests resolving the references of a list field with ResolveReferences
+func TestResolveReferencesList(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	resolved := bc.ResolveReferences(context.Background(), "book", map[string]string{
+		"translators": "0" + ListSeparator + "2",
+	})
+	if !reflect.DeepEqual(resolved["translators"], []map[string]string{db.records["author"][0],
+		db.records["author"][2]}) {
+		t.Errorf("unexpected translators: %v", resolved["translators"])
+	}
+}
+
+// TestAddRecordList tests adding a record with a list field that fails validation in one of its values with AddRecord
+func TestAddRecordList(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	_, err := bc.AddRecord(context.Background(), "book", map[string]string{
+		"name":        "Tokyo Blues",
+		"year":        "2005",
+		"translators": "0" + ListSeparator + "7",
+	})
+	var validationError bcerrors.ValidationFailedError
+	if !errors.As(err, &validationError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(validationError.Failed["translators"], "value 2: ") {
+		t.Errorf("unexpected failure: %v", validationError.Failed["translators"])
+	}
+}
+
+// TestFilterRecordsList tests filtering records by a value of a list field with FilterRecords
+func TestFilterRecordsList(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	db.records["book"][0]["translators"] = "1" + ListSeparator + "2"
+	filtered, err := bc.FilterRecords(context.Background(), "book", Filter{
+		Equal: map[string]string{"translators": "2"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(filtered.Records, []map[string]string{db.records["book"][0]}) {
+		t.Errorf("unexpected records: %v", filtered.Records)
+	}
+}
+
+// TestReferencesTo tests getting the fields that reference a format with ReferencesTo
+func TestReferencesTo(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	if references := bc.ReferencesTo("author"); !reflect.DeepEqual(references, []Reference{
+		{FormatName: "book", Field: "author"},
+		{FormatName: "book", Field: "translators"},
+	}) {
+		t.Errorf("unexpected references: %v", references)
+	}
+}
+
+// TestRestoreRecord tests successfully restoring a record with its ID and without validation with RestoreRecord
+func TestRestoreRecord(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	record := map[string]string{
+		"id":        "5",
+		"name":      "jorge luis borges",
+		"birthdate": "1899",
+	}
+	err := bc.RestoreRecord(context.Background(), "author", record)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(db.records["author"][5], record) {
+		t.Errorf("unexpected record: %v", db.records["author"][5])
+	}
+}
+
+// TestSetInternalFields tests setting and removing internal fields of a record with SetInternalFields
+func TestSetInternalFields(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	err := bc.SetInternalFields(context.Background(), "book", "0", map[string]string{"_rating": "4.5"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if record := db.records["book"][0]; record["_rating"] != "4.5" || record["name"] != "Norwegian Wood" {
+		t.Errorf("unexpected record: %v", record)
+	}
+	err = bc.SetInternalFields(context.Background(), "book", "0", map[string]string{"_rating": ""})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, found := db.records["book"][0]["_rating"]; found {
+		t.Errorf("unexpected record: %v", db.records["book"][0])
+	}
+	err = bc.SetInternalFields(context.Background(), "book", "0", map[string]string{"name": "Kafka on the Shore"})
+	if !errors.Is(err, bcerrors.ErrFieldNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestRestoreRecordWithoutID tests restoring a record without ID with RestoreRecord
+func TestRestoreRecordWithoutID(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	err := bc.RestoreRecord(context.Background(), "author", map[string]string{"name": "Jorge Luis Borges"})
+	if !errors.Is(err, bcerrors.ErrRecordDoesntHaveID) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestDeleteRecord tests successfully deleting a record that isn't referenced with DeleteRecord
+func TestDeleteRecord(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	if err := bc.DeleteRecord(context.Background(), "book", "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := bc.GetRecord(context.Background(), "book", "0"); !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestOnChange tests that the change hooks are called when records are added and deleted, but not when their internal
+// fields are set
+func TestOnChange(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	db.records["book"][0]["translators"] = "2"
+	var changes []string
+	bc.OnChange(func(_ context.Context, formatName string, record map[string]string) {
+		changes = append(changes, fmt.Sprintf("%v %v %v", formatName, record["id"], trashed(record)))
+	})
+	id, err := bc.AddRecord(context.Background(), "author", map[string]string{"name": "Jane Austen"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := bc.SetInternalFields(context.Background(), "author", id, map[string]string{"_note": "x"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := bc.DeleteRecord(context.Background(), "author", "2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"author 3 false", "book 0 false", "author 2 true"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+}
+
+// TestDeleteRecordRestricted tests deleting a record referenced by a field that restricts it with DeleteRecord
+func TestDeleteRecordRestricted(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	err := bc.DeleteRecord(context.Background(), "author", "0")
+	var referencedError bcerrors.ReferencedError
+	if !errors.As(err, &referencedError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(referencedError.Fields, []string{"book.author"}) {
+		t.Errorf("unexpected fields: %v", referencedError.Fields)
+	}
+	if trashed(db.records["author"][0]) {
+		t.Errorf("record deleted")
+	}
+}
+
+// TestDeleteRecordSetNull tests deleting a record referenced by a list field that sets it to null with DeleteRecord
+func TestDeleteRecordSetNull(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	db.records["book"][0]["translators"] = "2" + ListSeparator + "0"
+	if err := bc.DeleteRecord(context.Background(), "author", "2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if db.records["book"][0]["translators"] != "0" {
+		t.Errorf("unexpected translators: %q", db.records["book"][0]["translators"])
+	}
+}
+
+// TestDeleteRecordCascade tests deleting a record referenced by a field that cascades with DeleteRecord
+func TestDeleteRecordCascade(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	format := bc.Formats()["book"]
+	format.OnDelete = map[string]ReferencePolicy{"author": Cascade}
+	bc.SetFormat("book", format)
+	if err := bc.DeleteRecord(context.Background(), "author", "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !trashed(db.records["author"][0]) || !trashed(db.records["book"][0]) || !trashed(db.records["book"][1]) {
+		t.Errorf("records not deleted")
+	}
+	if trashed(db.records["book"][2]) {
+		t.Errorf("record of another author deleted")
+	}
+}
+
+// TestDeleteRecordTrash tests that deleted records are hidden from GetRecord, ListRecords, SearchRecords and
+// UpdateRecord, and can't be referenced
+func TestDeleteRecordTrash(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	if err := bc.DeleteRecord(context.Background(), "author", "2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if records, _ := bc.ListRecords(context.Background(), "author"); len(records) != 2 {
+		t.Errorf("unexpected records: %v", records)
+	}
+	if records, _ := bc.SearchRecords(context.Background(), "author", "spanish"); len(records) != 0 {
+		t.Errorf("unexpected records: %v", records)
+	}
+	err := bc.UpdateRecord(context.Background(), "author", map[string]string{"id": "2", "name": "Miguel"})
+	if !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	failed, _ := bc.ValidateRecord(context.Background(), "book", map[string]string{"author": "2"})
+	if _, found := failed["author"]; !found {
+		t.Errorf("reference to deleted record didn't fail")
+	}
+	trash, err := bc.Trash(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(trash) != 1 || trash[0].FormatName != "author" || trash[0].Record["id"] != "2" {
+		t.Errorf("unexpected trash: %v", trash)
+	}
+}
+
+// TestRestoreFromTrash tests restoring a record deleted with others in cascade with RestoreFromTrash
+func TestRestoreFromTrash(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	format := bc.Formats()["book"]
+	format.OnDelete = map[string]ReferencePolicy{"author": Cascade}
+	bc.SetFormat("book", format)
+	if err := bc.DeleteRecord(context.Background(), "author", "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := bc.RestoreFromTrash(context.Background(), "book", "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, key := range []recordKey{{"author", "0"}, {"book", "0"}, {"book", "1"}} {
+		if _, err := bc.GetRecord(context.Background(), key.formatName, key.id); err != nil {
+			t.Errorf("%s %s not restored: %v", key.formatName, key.id, err)
+		}
+	}
+	if err := bc.RestoreFromTrash(context.Background(), "book", "1"); !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestTrashUniqueValues tests that the values of unique fields of records in the trash can be used by other records,
+// and that RestoreFromTrash fails if they are
+func TestTrashUniqueValues(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	result, err := bc.FindRecord(context.Background(), "book", "isbn", "9780451524935")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	id := result["id"]
+	if err := bc.DeleteRecord(context.Background(), "book", id); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	book := map[string]string{"name": "Nineteen Eighty-Four", "isbn": "9780451524935"}
+	if _, err := bc.AddRecord(context.Background(), "book", book); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var duplicateError bcerrors.DuplicateError
+	err = bc.RestoreFromTrash(context.Background(), "book", id)
+	if !errors.As(err, &duplicateError) || !reflect.DeepEqual(duplicateError.Fields, []string{"isbn"}) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := bc.GetRecord(context.Background(), "book", id); !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestPurgeTrash tests permanently deleting the records deleted before a time with PurgeTrash
+func TestPurgeTrash(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	if err := bc.DeleteRecord(context.Background(), "book", "2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if purged, err := bc.PurgeTrash(context.Background(), time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+		t.Errorf("unexpected result: %v, %v", purged, err)
+	}
+	if purged, err := bc.PurgeTrash(context.Background(), time.Now().Add(time.Second)); err != nil || purged != 1 {
+		t.Errorf("unexpected result: %v, %v", purged, err)
+	}
+	if db.records["book"][2] != nil {
+		t.Errorf("record not purged")
+	}
+}
+
+// TestCheckReferences tests finding and repairing dangling references with CheckReferences and RepairReferences
+func TestCheckReferences(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	db.records["book"][0]["author"] = "7"
+	db.records["book"][1]["translators"] = "1" + ListSeparator + "8"
+	dangling, err := bc.CheckReferences(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(dangling, []DanglingReference{
+		{FormatName: "book", ID: "0", Field: "author", RefID: "7"},
+		{FormatName: "book", ID: "1", Field: "translators", RefID: "8"},
+	}) {
+		t.Errorf("unexpected dangling references: %v", dangling)
+	}
+	if err := bc.RepairReferences(context.Background(), dangling); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, found := db.records["book"][0]["author"]; found {
+		t.Errorf("reference not removed: %v", db.records["book"][0])
+	}
+	if db.records["book"][1]["translators"] != "1" {
+		t.Errorf("unexpected translators: %q", db.records["book"][1]["translators"])
+	}
+}
+
+// TestFindDuplicates tests finding records whose display fields have the same words with FindDuplicates, and leaving
+// out the records marked as distinct with MarkDistinct
+func TestFindDuplicates(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	db.AddRecord(context.Background(), "author", map[string]string{"name": "Orwell, George", "birthdate": "1903"})
+	db.AddRecord(context.Background(), "author", map[string]string{"name": "G. Orwell", "birthdate": "1950"})
+	duplicates, err := bc.FindDuplicates(context.Background(), "author", 0.8)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(duplicates) != 1 || duplicates[0].Records[0]["id"] != "1" || duplicates[0].Records[1]["id"] != "3" ||
+		duplicates[0].Score != 1 {
+		t.Errorf("unexpected duplicates: %v", duplicates)
+	}
+	if duplicates, _ := bc.FindDuplicates(context.Background(), "author", 0.2); len(duplicates) != 3 {
+		t.Errorf("unexpected duplicates: %v", duplicates)
+	}
+	if err := bc.MarkDistinct(context.Background(), "author", "3", "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if duplicates, _ := bc.FindDuplicates(context.Background(), "author", 0.8); len(duplicates) != 0 {
+		t.Errorf("unexpected duplicates: %v", duplicates)
+	}
+}
+
+// TestMergeRecords tests merging a record into another with MergeRecords, which changes the references to it and
+// deletes the records that become duplicates
+func TestMergeRecords(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	format := bc.Formats()["book"]
+	format.Unique = [][]string{{"isbn"}, {"name", "author"}}
+	bc.SetFormat("book", format)
+	db.AddRecord(context.Background(), "author", map[string]string{"name": "Orwell, George", "biography": "British"})
+	db.records["author"][1]["biography"] = ""
+	db.AddRecord(context.Background(), "book", map[string]string{"name": "Homage To Catalonia", "author": "3"})
+	db.AddRecord(context.Background(), "book", map[string]string{"name": "Animal Farm", "author": "3"})
+	db.records["book"][0]["translators"] = "3" + ListSeparator + "1"
+	if err := bc.MergeRecords(context.Background(), "author", "1", "3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if author := db.records["author"][1]; author["name"] != "George Orwell" || author["biography"] != "British" {
+		t.Errorf("unexpected author: %v", author)
+	}
+	if !trashed(db.records["author"][3]) {
+		t.Errorf("merged record not deleted")
+	}
+	if db.records["book"][4]["author"] != "1" || db.records["book"][0]["translators"] != "1" {
+		t.Errorf("unexpected references: %v, %v", db.records["book"][4], db.records["book"][0])
+	}
+	if !trashed(db.records["book"][5]) || trashed(db.records["book"][2]) {
+		t.Errorf("duplicate book not deleted")
+	}
+	if err := bc.MergeRecords(context.Background(), "author", "1", "1"); !errors.Is(err, bcerrors.ErrSameRecord) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestAddAttachment tests successfully attaching an image with AddAttachment, getting it and its thumbnail with
+// Attachment, and deleting them when the record is updated
+func TestAddAttachment(t *testing.T) {
+	bc := initializedBoocat(initializedDatabase())
+	blobs, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bc.SetBlobStore(blobs)
+	var png bytes.Buffer
+	if err := imagepng.Encode(&png, image.NewRGBA(image.Rect(0, 0, 400, 100))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	key, err := bc.AddAttachment(context.Background(), "book", "cover", "cover.png", &png)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	file, info, err := bc.Attachment(context.Background(), key, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	file.Close()
+	if info.Name != "cover.png" || info.ContentType != "image/png" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	thumbnail, _, err := bc.Attachment(context.Background(), key, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	config, _, err := image.DecodeConfig(thumbnail)
+	thumbnail.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Width != ThumbnailSize || config.Height != ThumbnailSize/4 {
+		t.Errorf("unexpected thumbnail size: %vx%v", config.Width, config.Height)
+	}
+	book, _ := bc.GetRecord(context.Background(), "book", "0")
+	book["cover"] = key
+	if err := bc.UpdateRecord(context.Background(), "book", book); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if book, _ := bc.GetRecord(context.Background(), "book", "0"); book[AttachmentTypeField("cover")] != "image/png" {
+		t.Errorf("unexpected book: %v", book)
+	}
+	// Copy the record, because the mock database stores the updated one
+	updated := make(map[string]string)
+	for field, value := range book {
+		updated[field] = value
+	}
+	updated["cover"] = ""
+	if err := bc.UpdateRecord(context.Background(), "book", updated); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := bc.Attachment(context.Background(), key, false); !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if book, _ := bc.GetRecord(context.Background(), "book", "0"); book[AttachmentTypeField("cover")] != "" {
+		t.Errorf("unexpected book: %v", book)
+	}
+}
+
+// TestAttachmentOfOtherRecordFail tests that records can't take the attached files of other records with AddRecord
+// and UpdateRecord, and that files attached for a field can't be stored in another one
+func TestAttachmentOfOtherRecordFail(t *testing.T) {
+	bc := initializedBoocat(initializedDatabase())
+	blobs, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bc.SetBlobStore(blobs)
+	bc.SetFormat("book", withAttachment(bc.Formats()["book"], "pdf", ""))
+	key, err := bc.AddAttachment(context.Background(), "book", "pdf", "book.pdf", strings.NewReader("%PDF-1.4"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := bc.AddRecord(context.Background(), "book", map[string]string{"name": "Emma", "cover": key}); err == nil {
+		t.Errorf("file attached for another field stored")
+	}
+	// Copy the records, because the mock database returns the stored ones
+	book := copyRecord(t, bc, "0")
+	book["pdf"] = key
+	if err := bc.UpdateRecord(context.Background(), "book", book); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	other := copyRecord(t, bc, "1")
+	other["pdf"] = key
+	var validationError bcerrors.ValidationFailedError
+	if err := bc.UpdateRecord(context.Background(), "book", other); !errors.As(err, &validationError) ||
+		validationError.Failed["pdf"] == "" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := bc.AddRecord(context.Background(), "book", map[string]string{"name": "Emma", "pdf": key}); err == nil {
+		t.Errorf("file of another record stored")
+	}
+	// The record can be updated keeping its file
+	book = copyRecord(t, bc, "0")
+	book["synopsis"] = "Dystopia"
+	if err := bc.UpdateRecord(context.Background(), "book", book); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// copyRecord returns a copy of the book with the id without its internal fields
+func copyRecord(t *testing.T, bc *Boocat, id string) map[string]string {
+	book, err := bc.GetRecord(context.Background(), "book", id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	copied := make(map[string]string, len(book))
+	for field, value := range book {
+		if !strings.HasPrefix(field, "_") {
+			copied[field] = value
+		}
+	}
+	return copied
+}
+
+// TestDiscardAttachments tests deleting the attached files that aren't stored in records with DiscardAttachments
+func TestDiscardAttachments(t *testing.T) {
+	bc := initializedBoocat(initializedDatabase())
+	blobs, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bc.SetBlobStore(blobs)
+	bc.SetFormat("book", withAttachment(bc.Formats()["book"], "pdf", ""))
+	discarded, err := bc.AddAttachment(context.Background(), "book", "pdf", "a.pdf", strings.NewReader("%PDF-1.4"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored, err := bc.AddAttachment(context.Background(), "book", "pdf", "b.pdf", strings.NewReader("%PDF-1.4"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := bc.AddRecord(context.Background(), "book", map[string]string{"name": "Emma", "pdf": stored}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bc.DiscardAttachments(context.Background(), []string{discarded, stored})
+	if _, _, err := bc.Attachment(context.Background(), discarded, false); !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	file, _, err := bc.Attachment(context.Background(), stored, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	file.Close()
+}
+
+// withAttachment returns the format with an attachment field that accepts the content type
+func withAttachment(format Format, field, accepted string) Format {
+	fields := map[string]Validate{field: nil}
+	for name, validate := range format.Fields {
+		fields[name] = validate
+	}
+	attachments := map[string]string{field: accepted}
+	for name, contentType := range format.Attachments {
+		attachments[name] = contentType
+	}
+	format.Fields = fields
+	format.Attachments = attachments
+	return format
+}
+
+// TestAddAttachmentContentTypeFail tests attaching a file whose content type isn't accepted with AddAttachment
+func TestAddAttachmentContentTypeFail(t *testing.T) {
+	bc := initializedBoocat(initializedDatabase())
+	blobs, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bc.SetBlobStore(blobs)
+	_, err = bc.AddAttachment(context.Background(), "book", "cover", "cover.txt", strings.NewReader("Not an image"))
+	var validationError bcerrors.ValidationFailedError
+	if !errors.As(err, &validationError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, found := validationError.Failed["cover"]; !found {
+		t.Errorf("unexpected failed fields: %v", validationError.Failed)
+	}
+}
+
+// TestSaveFormat tests successfully defining a format at runtime with SaveFormat and adding a record of it
+func TestSaveFormat(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	definition := FormatDefinition{
+		Name:       "magazine",
+		Fields:     map[string]string{"title": "regexp:^[A-Z]", "editor": "reference:author", "issn": ""},
+		Searchable: []string{"title"},
+		Display:    "title",
+	}
+	if err := bc.SaveFormat(context.Background(), definition); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(db.definitions["magazine"], definition) {
+		t.Errorf("unexpected stored definition: %v", db.definitions["magazine"])
+	}
+	if references := bc.ReferencesTo("author"); len(references) != 3 {
+		t.Errorf("unexpected references: %v", references)
+	}
+	_, err := bc.AddRecord(context.Background(), "magazine", map[string]string{"title": "time", "editor": "7"})
+	var validationError bcerrors.ValidationFailedError
+	if !errors.As(err, &validationError) || len(validationError.Failed) != 2 {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := bc.AddRecord(context.Background(), "magazine", map[string]string{"title": "Time"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestSaveFormatValidationFail tests defining formats at runtime with definitions that aren't valid with SaveFormat
+func TestSaveFormatValidationFail(t *testing.T) {
+	db := initializedDatabase()
+	bc := initializedBoocat(db)
+	err := bc.SaveFormat(context.Background(), FormatDefinition{
+		Name:       "book",
+		Fields:     map[string]string{"title": "unknown", "Bad": "", "editor": "reference:editor"},
+		Searchable: []string{"name"},
+		Display:    "name",
+	})
+	var validationError bcerrors.ValidationFailedError
+	if !errors.As(err, &validationError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, failed := range []string{"name", "fields.title", "fields.Bad", "fields.editor", "searchable", "display"} {
+		if _, found := validationError.Failed[failed]; !found {
+			t.Errorf("%s didn't fail: %v", failed, validationError.Failed)
+		}
+	}
+}
+
+// TestLoadFormats tests setting the formats defined at runtime stored in the database with LoadFormats
+func TestLoadFormats(t *testing.T) {
+	db := initializedDatabase()
+	db.SaveFormatDefinition(context.Background(), FormatDefinition{
+		Name:   "magazine",
+		Fields: map[string]string{"title": "isbn"},
+	})
+	bc := initializedBoocat(db)
+	if err := bc.LoadFormats(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, found := bc.Formats()["magazine"]; !found {
+		t.Errorf("format not set")
+	}
+	if definitions := bc.FormatDefinitions(); len(definitions) != 1 || definitions[0].Name != "magazine" {
+		t.Errorf("unexpected definitions: %v", definitions)
+	}
+}
+
 // initializedDatabase returns a MockDB with data for testing
 func initializedDatabase() (db *MockDB) {
 	db = NewDB()
@@ -331,6 +1371,7 @@ func initializedDatabase() (db *MockDB) {
 		"year":     "1949",
 		"author":   "1",
 		"synopsys": "dystopia",
+		"isbn":     "9780451524935",
 	})
 	return db
 }
@@ -346,16 +1387,29 @@ func initializedBoocat(db database) *Boocat {
 			"biography": nil,
 		},
 		Searchable: map[string]struct{}{"name": {}, "biography": {}},
+		Unique:     [][]string{{"name", "birthdate"}},
+		Display:    "name",
 	})
 	bc.SetFormat("book", Format{
 		Name: "book",
 		Fields: map[string]Validate{
-			"name":     regExpValidator("^([A-Z][a-z]*)([ |-][A-Z][a-z]*)*$"),
-			"year":     validateYear,
-			"author":   db.ReferenceValidator("author"),
-			"synopsis": nil,
+			"name":        regExpValidator("^([A-Z][a-z]*)([ |-][A-Z][a-z]*)*$"),
+			"year":        validateYear,
+			"author":      db.ReferenceValidator("author"),
+			"translators": db.ReferenceValidator("author"),
+			"synopsis":    nil,
+			"isbn":        ValidateISBN,
+			"cover":       nil,
 		},
-		Searchable: map[string]struct{}{"name": {}, "synopsis": {}},
+		Searchable:  map[string]struct{}{"name": {}, "synopsis": {}},
+		Lists:       map[string]struct{}{"translators": {}},
+		References:  map[string]string{"author": "author", "translators": "author"},
+		OnDelete:    map[string]ReferencePolicy{"translators": SetNull},
+		Attachments: map[string]string{"cover": "image/"},
+		Facets:      map[string]struct{}{"year": {}, "author": {}},
+		Normalizers: map[string]Normalize{"isbn": NormalizeISBN},
+		Unique:      [][]string{{"isbn"}},
+		Display:     "name",
 	})
 	bc.SetDatabase(db)
 	return &bc
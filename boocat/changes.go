@@ -0,0 +1,37 @@
+package boocat
+
+// Implements hooks to follow the changes of records, so that data derived from them can be kept up to date
+
+import (
+	"context"
+	"time"
+)
+
+// ModifiedField is the internal field of records with the time they were last added, updated, deleted or restored, in
+// RFC 3339 format in UTC to the second, so that the times sort as strings. Changes made with SetInternalFields don't
+// change it, but can set it, e.g. when data shown with the record changes in other records. Records restored with
+// RestoreRecord keep the time they have.
+const ModifiedField = "_modified"
+
+// ChangeHook is called after a record of a format is added, updated, deleted or restored, with the record as it is
+// after the change. Deleted records have the TrashedField.
+type ChangeHook func(ctx context.Context, formatName string, record map[string]string)
+
+// OnChange adds a hook called after every change of records. Changes made with SetInternalFields don't call the hooks,
+// so that hooks can store data derived from the records in their internal fields. Hooks must be added before records
+// are changed.
+func (bc *Boocat) OnChange(hook ChangeHook) {
+	bc.changeHooks = append(bc.changeHooks, hook)
+}
+
+// changed calls the change hooks with the record of the format
+func (bc *Boocat) changed(ctx context.Context, formatName string, record map[string]string) {
+	for _, hook := range bc.changeHooks {
+		hook(ctx, formatName, record)
+	}
+}
+
+// modifiedNow returns the current time as the value of the ModifiedField
+func modifiedNow() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
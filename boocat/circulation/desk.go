@@ -0,0 +1,366 @@
+package circulation
+
+// Implements the circulation desk, where copies are checked out, returned and renewed
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// ErrOnLoan is returned when checking out a copy that is already on loan
+var ErrOnLoan = errors.New("copy is already on loan")
+
+// ErrNotOnLoan is returned when returning or renewing a copy that isn't on loan
+var ErrNotOnLoan = errors.New("copy isn't on loan")
+
+// ErrRenewalLimit is returned when renewing a loan that has been renewed as many times as the policy allows
+var ErrRenewalLimit = errors.New("loan can't be renewed again")
+
+// Policy sets the terms of the loans
+type Policy struct {
+	// Days copies are lent for, from the checkout or the last renewal
+	LoanDays int
+	// Maximum number of times a loan can be renewed
+	MaxRenewals int
+	// Days the copies assigned to holds wait to be picked up
+	PickupDays int
+}
+
+// DefaultPolicy lends copies for three weeks, renewable twice, and keeps copies for holds for a week
+var DefaultPolicy = Policy{LoanDays: 21, MaxRenewals: 2, PickupDays: 7}
+
+// Loan is a loan of a copy to a patron
+type Loan struct {
+	ID       string
+	CopyID   string
+	PatronID string
+	// Dates of the checkout, the return, which is zero while the copy is on loan, and the due date of the return
+	Checkout time.Time
+	Due      time.Time
+	Returned time.Time
+	// Number of times the loan has been renewed
+	Renewals int
+}
+
+// store is the part of boocat.Boocat that the desk uses
+type store interface {
+	GetRecord(ctx context.Context, formatName string, id string) (map[string]string, error)
+	ListRecords(ctx context.Context, formatName string) ([]map[string]string, error)
+	FilterRecords(ctx context.Context, formatName string, filter boocat.Filter) (boocat.FilteredRecords, error)
+	AddRecord(ctx context.Context, formatName string, record map[string]string) (string, error)
+	UpdateRecord(ctx context.Context, formatName string, record map[string]string) error
+	DeleteRecord(ctx context.Context, formatName string, id string) error
+}
+
+// Desk checks out, returns and renews copies, and manages the holds of books, following a policy. A copy can only have
+// one active loan, which the format of loans enforces. Operations that change several records undo their changes if
+// they can't complete, and return an unexpected error if they can't undo them either.
+type Desk struct {
+	store  store
+	policy Policy
+	// mutex serializes the changes of loans and holds made through the desk, so that they check the same records
+	mutex sync.Mutex
+	// now returns the current time
+	now func() time.Time
+}
+
+// NewDesk returns a circulation desk of the records of bc that follows the policy, which assigns the copies that are
+// added to the holds waiting for their books
+func NewDesk(bc *boocat.Boocat, policy Policy) *Desk {
+	d := newDesk(bc, policy)
+	bc.OnChange(d.Changed)
+	return d
+}
+
+// newDesk returns a circulation desk of the records of s that follows the policy
+func newDesk(s store, policy Policy) *Desk {
+	return &Desk{store: s, policy: policy, now: time.Now}
+}
+
+// Policy returns the policy of the desk
+func (d *Desk) Policy() Policy {
+	return d.policy
+}
+
+// Active returns if the copy hasn't been returned yet
+func (l Loan) Active() bool {
+	return l.Returned.IsZero()
+}
+
+// Overdue returns if the copy hasn't been returned and the due date is before the day
+func (l Loan) Overdue(day time.Time) bool {
+	return l.Active() && l.Due.Before(day)
+}
+
+// Changed assigns the copy of the record of the format to the first hold in the queue of its book, if it's a copy that
+// was added, updated or restored and can be checked out. It's a boocat.ChangeHook. On errors, the copy isn't assigned.
+func (d *Desk) Changed(ctx context.Context, formatName string, record map[string]string) {
+	if _, deleted := record[boocat.TrashedField]; deleted || formatName != CopyFormat {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if available, err := d.available(ctx, record["id"]); err == nil && available {
+		d.assignCopy(ctx, record["id"], record["book"])
+	}
+}
+
+// Checkout lends the copy with the id to the patron with the id, and returns the loan. If the copy is assigned to a
+// hold of the patron, the hold is fulfilled. Otherwise, the active hold of the patron on the book of the copy, if any,
+// is fulfilled, and the copy assigned to it if it was ready is assigned to the next hold in the queue. The error is
+// ErrOnLoan if the copy is already on loan, and ErrOnHold if it's assigned to a hold of another patron.
+func (d *Desk) Checkout(ctx context.Context, copyID, patronID string) (Loan, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	copyRecord, err := d.store.GetRecord(ctx, CopyFormat, copyID)
+	if err != nil {
+		return Loan{}, err
+	}
+	if _, err := d.store.GetRecord(ctx, PatronFormat, patronID); err != nil {
+		return Loan{}, err
+	}
+	_, found, err := d.ActiveLoan(ctx, copyID)
+	if err != nil {
+		return Loan{}, err
+	}
+	if found {
+		return Loan{}, ErrOnLoan
+	}
+	hold, onHold, err := d.ReadyHold(ctx, copyID)
+	if err != nil {
+		return Loan{}, err
+	}
+	if onHold && hold.PatronID != patronID {
+		return Loan{}, ErrOnHold
+	}
+	if onHold {
+		fulfilled := hold
+		fulfilled.Status = Fulfilled
+		if err := d.store.UpdateRecord(ctx, HoldFormat, fulfilled.record()); err != nil {
+			return Loan{}, err
+		}
+	}
+	today := d.Today()
+	loan := Loan{
+		CopyID:   copyID,
+		PatronID: patronID,
+		Checkout: today,
+		Due:      today.AddDate(0, 0, d.policy.LoanDays),
+	}
+	loan.ID, err = d.store.AddRecord(ctx, LoanFormat, loan.record())
+	if err != nil {
+		if onHold {
+			if undoErr := d.store.UpdateRecord(ctx, HoldFormat, hold.record()); undoErr != nil {
+				return Loan{}, bcerrors.NewUndoError(err, undoErr)
+			}
+		}
+		// The copy was checked out by another desk in the meantime
+		var validationError bcerrors.ValidationFailedError
+		if errors.As(err, &validationError) && validationError.Failed["onloan"] != "" {
+			return Loan{}, ErrOnLoan
+		}
+		return Loan{}, err
+	}
+	if onHold {
+		return loan, nil
+	}
+	if err := d.fulfillPatronHold(ctx, copyRecord["book"], patronID); err != nil {
+		if undoErr := d.store.DeleteRecord(ctx, LoanFormat, loan.ID); undoErr != nil {
+			return Loan{}, bcerrors.NewUndoError(err, undoErr)
+		}
+		return Loan{}, err
+	}
+	return loan, nil
+}
+
+// fulfillPatronHold fulfills the active hold of the patron with the id on the book with the id, if there is one
+func (d *Desk) fulfillPatronHold(ctx context.Context, bookID, patronID string) error {
+	holds, err := d.holds(ctx, map[string]string{"book": bookID, "patron": patronID})
+	if err != nil {
+		return err
+	}
+	for _, hold := range holds {
+		if hold.Active() {
+			return d.endHold(ctx, hold, Fulfilled)
+		}
+	}
+	return nil
+}
+
+// Return records that the copy with the id has been returned, and returns its loan. The copy is assigned to the first
+// hold in the queue of its book, if any, which can be got with ReadyHold. The error is ErrNotOnLoan if the copy isn't
+// on loan.
+func (d *Desk) Return(ctx context.Context, copyID string) (Loan, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	loan, found, err := d.ActiveLoan(ctx, copyID)
+	if err != nil {
+		return Loan{}, err
+	}
+	if !found {
+		return Loan{}, ErrNotOnLoan
+	}
+	bookID, err := d.bookOf(ctx, copyID)
+	if err != nil {
+		return Loan{}, err
+	}
+	returned := loan
+	returned.Returned = d.Today()
+	if err := d.store.UpdateRecord(ctx, LoanFormat, returned.record()); err != nil {
+		return Loan{}, err
+	}
+	if _, _, err := d.assignCopy(ctx, copyID, bookID); err != nil {
+		if undoErr := d.store.UpdateRecord(ctx, LoanFormat, loan.record()); undoErr != nil {
+			return Loan{}, bcerrors.NewUndoError(err, undoErr)
+		}
+		return Loan{}, err
+	}
+	return returned, nil
+}
+
+// Renew extends the loan of the copy with the id for the days of the policy from today, and returns the loan. The
+// error is ErrNotOnLoan if the copy isn't on loan, ErrRenewalLimit if the loan can't be renewed again, and
+// ErrHoldsWaiting if there are holds waiting for the book of the copy.
+func (d *Desk) Renew(ctx context.Context, copyID string) (Loan, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	loan, found, err := d.ActiveLoan(ctx, copyID)
+	if err != nil {
+		return Loan{}, err
+	}
+	if !found {
+		return Loan{}, ErrNotOnLoan
+	}
+	if loan.Renewals >= d.policy.MaxRenewals {
+		return Loan{}, ErrRenewalLimit
+	}
+	bookID, err := d.bookOf(ctx, copyID)
+	if err != nil {
+		return Loan{}, err
+	}
+	queue, err := d.queue(ctx, bookID)
+	if err != nil {
+		return Loan{}, err
+	}
+	if len(queue) > 0 {
+		return Loan{}, ErrHoldsWaiting
+	}
+	loan.Renewals++
+	if due := d.Today().AddDate(0, 0, d.policy.LoanDays); due.After(loan.Due) {
+		loan.Due = due
+	}
+	if err := d.store.UpdateRecord(ctx, LoanFormat, loan.record()); err != nil {
+		return Loan{}, err
+	}
+	return loan, nil
+}
+
+// PatronLoans returns the active loans of the patron with the id, sorted by due date
+func (d *Desk) PatronLoans(ctx context.Context, patronID string) ([]Loan, error) {
+	filtered, err := d.store.FilterRecords(ctx, LoanFormat, boocat.Filter{Equal: map[string]string{"patron": patronID}})
+	if err != nil {
+		return nil, err
+	}
+	var loans []Loan
+	for _, record := range filtered.Records {
+		if loan := loanFromRecord(record); loan.Active() {
+			loans = append(loans, loan)
+		}
+	}
+	sortByDue(loans)
+	return loans, nil
+}
+
+// Overdue returns the active loans whose due date is before today, the most overdue first
+func (d *Desk) Overdue(ctx context.Context) ([]Loan, error) {
+	records, err := d.store.ListRecords(ctx, LoanFormat)
+	if err != nil {
+		return nil, err
+	}
+	today := d.Today()
+	var loans []Loan
+	for _, record := range records {
+		if loan := loanFromRecord(record); loan.Overdue(today) {
+			loans = append(loans, loan)
+		}
+	}
+	sortByDue(loans)
+	return loans, nil
+}
+
+// Today returns the start of the current day in local time
+func (d *Desk) Today() time.Time {
+	now := d.now().Local()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// ActiveLoan returns the loan of the copy with the id that hasn't been returned, and if there is one
+func (d *Desk) ActiveLoan(ctx context.Context, copyID string) (Loan, bool, error) {
+	filtered, err := d.store.FilterRecords(ctx, LoanFormat, boocat.Filter{Equal: map[string]string{"copy": copyID}})
+	if err != nil {
+		return Loan{}, false, err
+	}
+	for _, record := range filtered.Records {
+		if loan := loanFromRecord(record); loan.Active() {
+			return loan, true, nil
+		}
+	}
+	return Loan{}, false, nil
+}
+
+// record returns the record of the loan
+func (l Loan) record() map[string]string {
+	record := map[string]string{
+		"copy":     l.CopyID,
+		"patron":   l.PatronID,
+		"checkout": l.Checkout.Format(dateLayout),
+		"due":      l.Due.Format(dateLayout),
+		"renewals": strconv.Itoa(l.Renewals),
+	}
+	if l.ID != "" {
+		record["id"] = l.ID
+	}
+	if l.Returned.IsZero() {
+		record["onloan"] = l.CopyID
+	} else {
+		record["returned"] = l.Returned.Format(dateLayout)
+	}
+	return record
+}
+
+// loanFromRecord returns the loan of a record. Dates that can't be parsed are zero.
+func loanFromRecord(record map[string]string) Loan {
+	loan := Loan{
+		ID:       record["id"],
+		CopyID:   record["copy"],
+		PatronID: record["patron"],
+		Checkout: parseDate(record["checkout"]),
+		Due:      parseDate(record["due"]),
+		Returned: parseDate(record["returned"]),
+	}
+	loan.Renewals, _ = strconv.Atoi(record["renewals"])
+	return loan
+}
+
+// parseDate returns the date in local time, or zero if it's empty or can't be parsed
+func parseDate(value string) time.Time {
+	date, err := time.ParseInLocation(dateLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// sortByDue sorts the loans by due date
+func sortByDue(loans []Loan) {
+	sort.SliceStable(loans, func(i, j int) bool {
+		return loans[i].Due.Before(loans[j].Due)
+	})
+}
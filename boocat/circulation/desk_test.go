@@ -0,0 +1,390 @@
+package circulation
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/internal/teststore"
+)
+
+// errFailed is the error of the changes of failingStore
+var errFailed = errors.New("failed")
+
+// failingStore is a store that fails to add records and to update them after a number of updates
+type failingStore struct {
+	store
+	// Number of updates that succeed
+	updates int
+}
+
+// AddRecord fails
+func (s *failingStore) AddRecord(context.Context, string, map[string]string) (string, error) {
+	return "", errFailed
+}
+
+// UpdateRecord updates the record if there are updates left, and fails otherwise
+func (s *failingStore) UpdateRecord(ctx context.Context, formatName string, record map[string]string) error {
+	if s.updates == 0 {
+		return errFailed
+	}
+	s.updates--
+	return s.store.UpdateRecord(ctx, formatName, record)
+}
+
+// TestCheckout tests successfully checking out a copy, and the due date of the loan
+func TestCheckout(t *testing.T) {
+	desk := initializedDesk(initializedStore())
+	loan, err := desk.Checkout(context.Background(), "0", "0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !loan.Checkout.Equal(date("2021-03-01")) || !loan.Due.Equal(date("2021-03-22")) || !loan.Active() {
+		t.Errorf("unexpected loan: %+v", loan)
+	}
+}
+
+// TestCheckoutOnLoan tests checking out a copy that is already on loan
+func TestCheckoutOnLoan(t *testing.T) {
+	desk := initializedDesk(initializedStore())
+	if _, err := desk.Checkout(context.Background(), "0", "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := desk.Checkout(context.Background(), "0", "1"); !errors.Is(err, ErrOnLoan) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := desk.Checkout(context.Background(), "7", "1"); !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestCheckoutUniqueLoan tests that a copy checked out can't get another active loan other than through the desk
+func TestCheckoutUniqueLoan(t *testing.T) {
+	bc := initializedStore()
+	loan, err := initializedDesk(bc).Checkout(context.Background(), "0", "0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	loan.ID, loan.PatronID = "", "1"
+	_, err = bc.AddRecord(context.Background(), LoanFormat, loan.record())
+	var validationError bcerrors.ValidationFailedError
+	if !errors.As(err, &validationError) || validationError.Failed["onloan"] == "" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestCheckoutUndoFail tests checking out a copy assigned to a hold when the loan can't be added and the hold can't be
+// restored
+func TestCheckoutUndoFail(t *testing.T) {
+	desk := initializedDesk(initializedStore())
+	checkOutAll(t, desk)
+	placeHolds(t, desk, "2")
+	if _, err := desk.Return(context.Background(), "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	failing := &failingStore{store: desk.store, updates: 1}
+	desk.store = failing
+	_, err := desk.Checkout(context.Background(), "1", "2")
+	var unexpectedError bcerrors.UnexpectedError
+	if !errors.As(err, &unexpectedError) || !errors.Is(err, errFailed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestReturn tests returning a copy, after which it can be checked out again
+func TestReturn(t *testing.T) {
+	desk := initializedDesk(initializedStore())
+	if _, err := desk.Checkout(context.Background(), "0", "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	loan, err := desk.Return(context.Background(), "0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loan.Active() {
+		t.Errorf("loan still active: %+v", loan)
+	}
+	if _, err := desk.Return(context.Background(), "0"); !errors.Is(err, ErrNotOnLoan) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := desk.Checkout(context.Background(), "0", "1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestRenew tests renewing a loan until the limit of the policy
+func TestRenew(t *testing.T) {
+	desk := initializedDesk(initializedStore())
+	if _, err := desk.Checkout(context.Background(), "0", "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	desk.now = func() time.Time { return date("2021-03-15") }
+	loan, err := desk.Renew(context.Background(), "0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !loan.Due.Equal(date("2021-04-05")) || loan.Renewals != 1 {
+		t.Errorf("unexpected loan: %+v", loan)
+	}
+	if _, err := desk.Renew(context.Background(), "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := desk.Renew(context.Background(), "0"); !errors.Is(err, ErrRenewalLimit) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestOverdue tests listing the loans whose due date has passed
+func TestOverdue(t *testing.T) {
+	desk := initializedDesk(initializedStore())
+	if _, err := desk.Checkout(context.Background(), "0", "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	desk.now = func() time.Time { return date("2021-03-10") }
+	if _, err := desk.Checkout(context.Background(), "1", "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	desk.now = func() time.Time { return date("2021-03-23") }
+	overdue, err := desk.Overdue(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(overdue) != 1 || overdue[0].CopyID != "0" {
+		t.Errorf("unexpected overdue loans: %+v", overdue)
+	}
+}
+
+// TestPlaceHold tests placing holds on a book whose copies are on loan, and their positions in the queue
+func TestPlaceHold(t *testing.T) {
+	desk := initializedDesk(initializedStore())
+	if _, err := desk.PlaceHold(context.Background(), "0", "2"); !errors.Is(err, ErrCopyAvailable) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	checkOutAll(t, desk)
+	first, err := desk.PlaceHold(context.Background(), "0", "2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.Status != Waiting || first.Position != 1 {
+		t.Errorf("unexpected hold: %+v", first)
+	}
+	if _, err := desk.PlaceHold(context.Background(), "0", "2"); !errors.Is(err, ErrHoldExists) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	desk.now = func() time.Time { return date("2021-03-02") }
+	second, err := desk.PlaceHold(context.Background(), "0", "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second.Position != 2 {
+		t.Errorf("unexpected hold: %+v", second)
+	}
+	if _, err := desk.PlaceHold(context.Background(), "7", "1"); !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestHoldAssignment tests assigning returned copies to the holds in the order they were placed, and checking them out
+func TestHoldAssignment(t *testing.T) {
+	desk := initializedDesk(initializedStore())
+	checkOutAll(t, desk)
+	placeHolds(t, desk, "2", "1")
+	if _, err := desk.Renew(context.Background(), "1"); !errors.Is(err, ErrHoldsWaiting) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := desk.Return(context.Background(), "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hold, found, err := desk.ReadyHold(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || hold.PatronID != "2" || !hold.Expires.Equal(date("2021-03-08")) {
+		t.Errorf("unexpected hold: %+v", hold)
+	}
+	if _, err := desk.Checkout(context.Background(), "1", "1"); !errors.Is(err, ErrOnHold) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := desk.Checkout(context.Background(), "1", "2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	holds, err := desk.PatronHolds(context.Background(), "2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(holds) != 0 {
+		t.Errorf("unexpected holds: %+v", holds)
+	}
+	holds, err = desk.PatronHolds(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(holds) != 1 || holds[0].Position != 1 {
+		t.Errorf("unexpected holds: %+v", holds)
+	}
+}
+
+// TestCheckoutOtherCopy tests that checking out another copy of a book fulfills the waiting or ready hold of the
+// patron, and assigns the copy of a ready hold to the next hold
+func TestCheckoutOtherCopy(t *testing.T) {
+	s := initializedStore()
+	desk := initializedDesk(s)
+	checkOutAll(t, desk)
+	placeHolds(t, desk, "2", "1")
+	copyID, err := s.AddRecord(context.Background(), CopyFormat, map[string]string{"book": "0", "barcode": "B0003"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := desk.Checkout(context.Background(), copyID, "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if queue, err := desk.Queue(context.Background(), "0"); err != nil || len(queue) != 1 || queue[0].PatronID != "2" {
+		t.Errorf("unexpected queue: %+v, %v", queue, err)
+	}
+	if _, err := desk.Return(context.Background(), "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	copyID, err = s.AddRecord(context.Background(), CopyFormat, map[string]string{"book": "0", "barcode": "B0004"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := desk.Checkout(context.Background(), copyID, "2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if holds, err := desk.PatronHolds(context.Background(), "2"); err != nil || len(holds) != 0 {
+		t.Errorf("unexpected holds: %+v, %v", holds, err)
+	}
+	if hold, found, err := desk.ReadyHold(context.Background(), "0"); err != nil || found {
+		t.Errorf("unexpected hold: %+v, %v", hold, err)
+	}
+}
+
+// TestAddCopy tests assigning the copies added to a book to the holds waiting for it
+func TestAddCopy(t *testing.T) {
+	s := initializedStore()
+	desk := initializedDesk(s)
+	s.OnChange(desk.Changed)
+	checkOutAll(t, desk)
+	placeHolds(t, desk, "2")
+	copyID, err := s.AddRecord(context.Background(), CopyFormat, map[string]string{"book": "0", "barcode": "B0003"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hold, found, err := desk.ReadyHold(context.Background(), copyID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || hold.PatronID != "2" || !hold.Expires.Equal(date("2021-03-08")) {
+		t.Errorf("unexpected hold: %+v", hold)
+	}
+}
+
+// TestExpireHolds tests expiring a hold that wasn't picked up, whose copy is assigned to the next hold
+func TestExpireHolds(t *testing.T) {
+	desk := initializedDesk(initializedStore())
+	checkOutAll(t, desk)
+	placeHolds(t, desk, "2", "1")
+	if _, err := desk.Return(context.Background(), "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	desk.now = func() time.Time { return date("2021-03-08") }
+	if expired, err := desk.ExpireHolds(context.Background()); err != nil || expired != 0 {
+		t.Errorf("unexpected expired holds: %v, %v", expired, err)
+	}
+	desk.now = func() time.Time { return date("2021-03-09") }
+	if expired, err := desk.ExpireHolds(context.Background()); err != nil || expired != 1 {
+		t.Errorf("unexpected expired holds: %v, %v", expired, err)
+	}
+	hold, found, err := desk.ReadyHold(context.Background(), "0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || hold.PatronID != "1" || !hold.Expires.Equal(date("2021-03-16")) {
+		t.Errorf("unexpected hold: %+v", hold)
+	}
+}
+
+// TestCancelHold tests cancelling a ready hold, whose copy is assigned to the next hold
+func TestCancelHold(t *testing.T) {
+	desk := initializedDesk(initializedStore())
+	checkOutAll(t, desk)
+	placeHolds(t, desk, "2", "1")
+	if _, err := desk.Return(context.Background(), "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hold, _, err := desk.ReadyHold(context.Background(), "0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := desk.CancelHold(context.Background(), hold.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := desk.CancelHold(context.Background(), hold.ID); !errors.Is(err, ErrHoldNotActive) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	next, found, err := desk.ReadyHold(context.Background(), "0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || next.PatronID != "1" {
+		t.Errorf("unexpected hold: %+v", next)
+	}
+	queue, err := desk.Queue(context.Background(), "0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(queue) != 0 {
+		t.Errorf("unexpected queue: %+v", queue)
+	}
+}
+
+// checkOutAll checks out the copies of the book to the first patron
+func checkOutAll(t *testing.T, desk *Desk) {
+	for _, copyID := range []string{"0", "1"} {
+		if _, err := desk.Checkout(context.Background(), copyID, "0"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+// placeHolds places holds on the book for the patrons, one each day from 2021-03-01
+func placeHolds(t *testing.T, desk *Desk, patronIDs ...string) {
+	for i, patronID := range patronIDs {
+		day := date("2021-03-01").AddDate(0, 0, i)
+		desk.now = func() time.Time { return day }
+		if _, err := desk.PlaceHold(context.Background(), "0", patronID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	desk.now = func() time.Time { return date("2021-03-01") }
+}
+
+// initializedDesk returns a desk of the store with the default policy, on 2021-03-01
+func initializedDesk(s store) *Desk {
+	desk := newDesk(s, DefaultPolicy)
+	desk.now = func() time.Time { return date("2021-03-01") }
+	return desk
+}
+
+// initializedStore returns a boocat with copies and patrons for testing
+func initializedStore() *boocat.Boocat {
+	db := teststore.NewDB()
+	bc := db.Boocat(append(Formats(db.ReferenceValidator), teststore.Book(db.ReferenceValidator))...)
+	db.Restore(CopyFormat,
+		map[string]string{"id": "0", "book": "0", "barcode": "B0001"},
+		map[string]string{"id": "1", "book": "0", "barcode": "B0002"})
+	db.Restore(PatronFormat,
+		map[string]string{"id": "0", "name": "Haruki Murakami", "card": "P0001"},
+		map[string]string{"id": "1", "name": "George Orwell", "card": "P0002"},
+		map[string]string{"id": "2", "name": "Franz Kafka", "card": "P0003"})
+	db.Restore("book", map[string]string{"id": "0", "name": "Norwegian Wood"})
+	return bc
+}
+
+// date returns the date in local time
+func date(value string) time.Time {
+	return parseDate(value)
+}
@@ -0,0 +1,129 @@
+package circulation
+
+// Implements the formats of the records of circulation
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat"
+)
+
+// Names of the formats of circulation
+const (
+	// Physical copies of books
+	CopyFormat = "copy"
+	// People who borrow copies
+	PatronFormat = "patron"
+	// Loans of copies to patrons, which are kept after the copies are returned as the circulation history
+	LoanFormat = "loan"
+	// Holds of books for patrons
+	HoldFormat = "hold"
+)
+
+// Layout of the dates of loans
+const dateLayout = "2006-01-02"
+
+// Formats returns the formats of circulation. reference returns the validator of the fields that reference records
+// of a format. Loans have the copy in the unique field "onloan" too until it's returned, so that a copy can only have
+// one active loan.
+func Formats(reference func(formatName string) boocat.Validate) []boocat.Format {
+	return []boocat.Format{
+		{
+			Name: CopyFormat,
+			Fields: map[string]boocat.Validate{
+				"book":     reference("book"),
+				"barcode":  boocat.ValidateRequired,
+				"location": nil,
+				"notes":    nil,
+			},
+			References: map[string]string{"book": "book"},
+			Facets:     map[string]struct{}{"location": {}},
+			Unique:     [][]string{{"barcode"}},
+			Display:    "barcode",
+		},
+		{
+			Name: PatronFormat,
+			Fields: map[string]boocat.Validate{
+				"name":  boocat.ValidateRequired,
+				"card":  boocat.ValidateRequired,
+				"email": nil,
+			},
+			Searchable: map[string]struct{}{"name": {}},
+			Unique:     [][]string{{"card"}},
+			Display:    "name",
+		},
+		{
+			Name: LoanFormat,
+			Fields: map[string]boocat.Validate{
+				"copy":     reference(CopyFormat),
+				"patron":   reference(PatronFormat),
+				"checkout": validateDate,
+				"due":      validateDate,
+				"returned": validateOptionalDate,
+				"renewals": validateCount,
+				"onloan":   boocat.Optional(reference(CopyFormat)),
+			},
+			References: map[string]string{"copy": CopyFormat, "patron": PatronFormat, "onloan": CopyFormat},
+			Unique:     [][]string{{"onloan"}},
+		},
+		{
+			Name: HoldFormat,
+			Fields: map[string]boocat.Validate{
+				"book":    reference("book"),
+				"patron":  reference(PatronFormat),
+				"placed":  validatePlaced,
+				"status":  validateStatus,
+				"copy":    reference(CopyFormat),
+				"expires": validateOptionalDate,
+			},
+			References: map[string]string{"book": "book", "patron": PatronFormat, "copy": CopyFormat},
+			Facets:     map[string]struct{}{"status": {}},
+		},
+	}
+}
+
+// validateDate validates a date in the layout of the dates of loans
+func validateDate(_ context.Context, value interface{}) string {
+	if _, err := time.Parse(dateLayout, fmt.Sprintf("%v", value)); err != nil {
+		return "not a date as YYYY-MM-DD"
+	}
+	return ""
+}
+
+// validateOptionalDate validates an empty value or a date in the layout of the dates of loans
+func validateOptionalDate(ctx context.Context, value interface{}) string {
+	if fmt.Sprintf("%v", value) == "" {
+		return ""
+	}
+	return validateDate(ctx, value)
+}
+
+// validatePlaced validates the time a hold was placed
+func validatePlaced(_ context.Context, value interface{}) string {
+	if _, err := time.Parse(placedLayout, fmt.Sprintf("%v", value)); err != nil {
+		return "not a time in RFC 3339 format"
+	}
+	return ""
+}
+
+// validateStatus validates the status of a hold
+func validateStatus(_ context.Context, value interface{}) string {
+	switch HoldStatus(fmt.Sprintf("%v", value)) {
+	case Waiting, Ready, Fulfilled, Cancelled, Expired:
+		return ""
+	default:
+		return "not a hold status"
+	}
+}
+
+// validateCount validates a number that isn't negative
+func validateCount(_ context.Context, value interface{}) string {
+	count, err := strconv.Atoi(fmt.Sprintf("%v", value))
+	if err != nil || count < 0 {
+		return "not a number of zero or more"
+	}
+	return ""
+}
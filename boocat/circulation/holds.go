@@ -0,0 +1,337 @@
+package circulation
+
+// Implements the holds of books, which queue patrons for the copies of a book when all of them are on loan. Returned
+// copies are assigned to the first hold in the queue, which is ready to be picked up until it expires.
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// ErrHoldExists is returned when placing a hold on a book for a patron who already has an active hold on it
+var ErrHoldExists = errors.New("patron already has a hold on the book")
+
+// ErrCopyAvailable is returned when placing a hold on a book that has copies that can be checked out
+var ErrCopyAvailable = errors.New("book has copies available")
+
+// ErrOnHold is returned when checking out a copy that is assigned to the hold of another patron
+var ErrOnHold = errors.New("copy is on hold for another patron")
+
+// ErrHoldsWaiting is returned when renewing the loan of a copy of a book that patrons are waiting for
+var ErrHoldsWaiting = errors.New("patrons are waiting for the book")
+
+// ErrHoldNotActive is returned when cancelling a hold that is no longer waiting or ready
+var ErrHoldNotActive = errors.New("hold isn't active")
+
+// HoldStatus is the status of a hold
+type HoldStatus string
+
+const (
+	// Waiting holds are queued for a copy
+	Waiting HoldStatus = "waiting"
+	// Ready holds have a copy assigned, which waits to be picked up
+	Ready HoldStatus = "ready"
+	// Fulfilled holds had their copy checked out by the patron
+	Fulfilled HoldStatus = "fulfilled"
+	// Cancelled holds were cancelled before they were fulfilled
+	Cancelled HoldStatus = "cancelled"
+	// Expired holds weren't picked up in time
+	Expired HoldStatus = "expired"
+)
+
+// Layout of the times holds are placed, which order the queues
+const placedLayout = time.RFC3339Nano
+
+// Hold is a hold of a book for a patron
+type Hold struct {
+	ID       string
+	BookID   string
+	PatronID string
+	// Time the hold was placed
+	Placed time.Time
+	Status HoldStatus
+	// Copy assigned to the hold and the last day it can be picked up, which are only set for ready holds
+	CopyID  string
+	Expires time.Time
+	// Position in the queue of the book, starting at 1, for waiting holds. It isn't stored.
+	Position int
+}
+
+// Active returns if the hold is waiting or ready
+func (h Hold) Active() bool {
+	return h.Status == Waiting || h.Status == Ready
+}
+
+// PlaceHold queues the patron with the id for a copy of the book with the id, and returns the hold. The error is
+// ErrCopyAvailable if a copy of the book can be checked out, and ErrHoldExists if the patron already has a hold on the
+// book.
+func (d *Desk) PlaceHold(ctx context.Context, bookID, patronID string) (Hold, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, err := d.store.GetRecord(ctx, "book", bookID); err != nil {
+		return Hold{}, err
+	}
+	if _, err := d.store.GetRecord(ctx, PatronFormat, patronID); err != nil {
+		return Hold{}, err
+	}
+	holds, err := d.holds(ctx, map[string]string{"book": bookID, "patron": patronID})
+	if err != nil {
+		return Hold{}, err
+	}
+	for _, hold := range holds {
+		if hold.Active() {
+			return Hold{}, ErrHoldExists
+		}
+	}
+	copies, err := d.store.FilterRecords(ctx, CopyFormat, boocat.Filter{Equal: map[string]string{"book": bookID}})
+	if err != nil {
+		return Hold{}, err
+	}
+	for _, copyRecord := range copies.Records {
+		available, err := d.available(ctx, copyRecord["id"])
+		if err != nil {
+			return Hold{}, err
+		}
+		if available {
+			return Hold{}, ErrCopyAvailable
+		}
+	}
+	hold := Hold{BookID: bookID, PatronID: patronID, Placed: d.now().UTC(), Status: Waiting}
+	hold.ID, err = d.store.AddRecord(ctx, HoldFormat, hold.record())
+	if err != nil {
+		return Hold{}, err
+	}
+	queue, err := d.queue(ctx, bookID)
+	if err != nil {
+		return Hold{}, err
+	}
+	hold.Position = len(queue)
+	return hold, nil
+}
+
+// CancelHold cancels the hold with the id, and returns it. The copy of a ready hold is assigned to the next hold in
+// the queue. The error is ErrHoldNotActive if the hold isn't waiting or ready.
+func (d *Desk) CancelHold(ctx context.Context, holdID string) (Hold, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	record, err := d.store.GetRecord(ctx, HoldFormat, holdID)
+	if err != nil {
+		return Hold{}, err
+	}
+	hold := holdFromRecord(record)
+	if !hold.Active() {
+		return Hold{}, ErrHoldNotActive
+	}
+	if err := d.endHold(ctx, hold, Cancelled); err != nil {
+		return Hold{}, err
+	}
+	hold.Status = Cancelled
+	return hold, nil
+}
+
+// ExpireHolds expires the ready holds whose last day to pick up their copy has passed, assigning the copies to the
+// next holds in the queues, and returns how many holds expired
+func (d *Desk) ExpireHolds(ctx context.Context) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ready, err := d.holds(ctx, map[string]string{"status": string(Ready)})
+	if err != nil {
+		return 0, err
+	}
+	today := d.Today()
+	expired := 0
+	for _, hold := range ready {
+		if !hold.Expires.Before(today) {
+			continue
+		}
+		if err := d.endHold(ctx, hold, Expired); err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// Queue returns the waiting holds of the book with the id, in the order they will be assigned copies
+func (d *Desk) Queue(ctx context.Context, bookID string) ([]Hold, error) {
+	return d.queue(ctx, bookID)
+}
+
+// PatronHolds returns the active holds of the patron with the id, with their positions in the queues of their books
+func (d *Desk) PatronHolds(ctx context.Context, patronID string) ([]Hold, error) {
+	holds, err := d.holds(ctx, map[string]string{"patron": patronID})
+	if err != nil {
+		return nil, err
+	}
+	var active []Hold
+	for _, hold := range holds {
+		if !hold.Active() {
+			continue
+		}
+		if hold.Status == Waiting {
+			queue, err := d.queue(ctx, hold.BookID)
+			if err != nil {
+				return nil, err
+			}
+			for _, queued := range queue {
+				if queued.ID == hold.ID {
+					hold.Position = queued.Position
+				}
+			}
+		}
+		active = append(active, hold)
+	}
+	sortByPlaced(active)
+	return active, nil
+}
+
+// ReadyHolds returns the holds whose copies wait to be picked up, the ones that expire first first
+func (d *Desk) ReadyHolds(ctx context.Context) ([]Hold, error) {
+	ready, err := d.holds(ctx, map[string]string{"status": string(Ready)})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ready, func(i, j int) bool {
+		return ready[i].Expires.Before(ready[j].Expires)
+	})
+	return ready, nil
+}
+
+// ReadyHold returns the ready hold the copy with the id is assigned to, and if there is one
+func (d *Desk) ReadyHold(ctx context.Context, copyID string) (Hold, bool, error) {
+	holds, err := d.holds(ctx, map[string]string{"copy": copyID, "status": string(Ready)})
+	if err != nil || len(holds) == 0 {
+		return Hold{}, false, err
+	}
+	return holds[0], true, nil
+}
+
+// endHold sets the status of the active hold, and assigns its copy to the next hold in the queue if it was ready. If
+// the copy can't be assigned, the hold is left as it was.
+func (d *Desk) endHold(ctx context.Context, hold Hold, status HoldStatus) error {
+	ended := hold
+	ended.Status = status
+	if err := d.store.UpdateRecord(ctx, HoldFormat, ended.record()); err != nil {
+		return err
+	}
+	if hold.Status != Ready {
+		return nil
+	}
+	if _, _, err := d.assignCopy(ctx, hold.CopyID, hold.BookID); err != nil {
+		if undoErr := d.store.UpdateRecord(ctx, HoldFormat, hold.record()); undoErr != nil {
+			return bcerrors.NewUndoError(err, undoErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// assignCopy assigns the copy with the id to the first hold in the queue of the book with the id, and returns the
+// hold and if there was one
+func (d *Desk) assignCopy(ctx context.Context, copyID, bookID string) (Hold, bool, error) {
+	queue, err := d.queue(ctx, bookID)
+	if err != nil || len(queue) == 0 {
+		return Hold{}, false, err
+	}
+	hold := queue[0]
+	hold.Status = Ready
+	hold.CopyID = copyID
+	hold.Expires = d.Today().AddDate(0, 0, d.policy.PickupDays)
+	hold.Position = 0
+	if err := d.store.UpdateRecord(ctx, HoldFormat, hold.record()); err != nil {
+		return Hold{}, false, err
+	}
+	return hold, true, nil
+}
+
+// available returns if the copy with the id can be checked out, because it isn't on loan or assigned to a hold
+func (d *Desk) available(ctx context.Context, copyID string) (bool, error) {
+	_, onLoan, err := d.ActiveLoan(ctx, copyID)
+	if err != nil || onLoan {
+		return false, err
+	}
+	_, onHold, err := d.ReadyHold(ctx, copyID)
+	return !onHold, err
+}
+
+// bookOf returns the id of the book of the copy with the id
+func (d *Desk) bookOf(ctx context.Context, copyID string) (string, error) {
+	copyRecord, err := d.store.GetRecord(ctx, CopyFormat, copyID)
+	if err != nil {
+		return "", err
+	}
+	return copyRecord["book"], nil
+}
+
+// queue returns the waiting holds of the book with the id, sorted by the time they were placed, with their positions
+func (d *Desk) queue(ctx context.Context, bookID string) ([]Hold, error) {
+	queue, err := d.holds(ctx, map[string]string{"book": bookID, "status": string(Waiting)})
+	if err != nil {
+		return nil, err
+	}
+	sortByPlaced(queue)
+	for i := range queue {
+		queue[i].Position = i + 1
+	}
+	return queue, nil
+}
+
+// holds returns the holds whose records have the field values
+func (d *Desk) holds(ctx context.Context, equal map[string]string) ([]Hold, error) {
+	filtered, err := d.store.FilterRecords(ctx, HoldFormat, boocat.Filter{Equal: equal})
+	if err != nil {
+		return nil, err
+	}
+	holds := make([]Hold, 0, len(filtered.Records))
+	for _, record := range filtered.Records {
+		holds = append(holds, holdFromRecord(record))
+	}
+	return holds, nil
+}
+
+// record returns the record of the hold
+func (h Hold) record() map[string]string {
+	record := map[string]string{
+		"book":   h.BookID,
+		"patron": h.PatronID,
+		"placed": h.Placed.Format(placedLayout),
+		"status": string(h.Status),
+	}
+	if h.ID != "" {
+		record["id"] = h.ID
+	}
+	if h.Status == Ready {
+		record["copy"] = h.CopyID
+		record["expires"] = h.Expires.Format(dateLayout)
+	}
+	return record
+}
+
+// holdFromRecord returns the hold of a record
+func holdFromRecord(record map[string]string) Hold {
+	placed, _ := time.Parse(placedLayout, record["placed"])
+	return Hold{
+		ID:       record["id"],
+		BookID:   record["book"],
+		PatronID: record["patron"],
+		Placed:   placed,
+		Status:   HoldStatus(record["status"]),
+		CopyID:   record["copy"],
+		Expires:  parseDate(record["expires"]),
+	}
+}
+
+// sortByPlaced sorts the holds by the time they were placed, and by id if they were placed at the same time
+func sortByPlaced(holds []Hold) {
+	sort.SliceStable(holds, func(i, j int) bool {
+		if !holds[i].Placed.Equal(holds[j].Placed) {
+			return holds[i].Placed.Before(holds[j].Placed)
+		}
+		return holds[i].ID < holds[j].ID
+	})
+}
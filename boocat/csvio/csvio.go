@@ -0,0 +1,268 @@
+package csvio
+
+// Implements the import and export of the records of a format from and to CSV files
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// Options of an import or export
+type Options struct {
+	// DryRun validates the imported rows without adding them
+	DryRun bool
+	// Resolve translates the values of reference fields to and from the display field of the referenced records,
+	// e.g. author IDs to author names
+	Resolve bool
+}
+
+// RowFailure is a row that couldn't be imported
+type RowFailure struct {
+	// Line of the row in the CSV file, starting at 1 for the header
+	Line int
+	// Fields that failed validation and why
+	Failed map[string]string
+	// Error that isn't a validation failure, if any
+	Err error
+}
+
+// Report is the result of an import
+type Report struct {
+	// Number of rows read, excluding the header
+	Rows int
+	// Number of rows added, or that would be added in a dry run
+	Added int
+	// Rows that couldn't be imported
+	Failures []RowFailure
+}
+
+// resolver translates references between IDs and display values, caching the results
+type resolver struct {
+	bc       *boocat.Boocat
+	ids      map[string]map[string][]string
+	displays map[string]map[string]string
+}
+
+// Import reads records of the format from r and adds them. The first row is the header, whose columns are field
+// names of the format. An "id" column is ignored, because records get new IDs. Empty cells are left out of the records.
+func Import(ctx context.Context, bc *boocat.Boocat, formatName string, r io.Reader, options Options) (Report, error) {
+	format, found := bc.Formats()[formatName]
+	if !found {
+		return Report{}, bcerrors.ErrFormatNotFound
+	}
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return Report{}, fmt.Errorf("reading header: %w", err)
+	}
+	for _, column := range header {
+		if _, found := format.Fields[column]; !found && column != "id" {
+			return Report{}, fmt.Errorf("column '%s' is not a field of format '%s'", column, formatName)
+		}
+	}
+	res := newResolver(bc)
+	var report Report
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("reading line %d: %w", line, err)
+		}
+		report.Rows++
+		record := rowToRecord(header, row)
+		failed := make(map[string]string)
+		if options.Resolve {
+			failed = res.resolveIDs(ctx, format, record)
+		}
+		if len(failed) == 0 {
+			failed, err = importRecord(ctx, bc, formatName, record, options.DryRun)
+		}
+		if len(failed) > 0 || err != nil {
+			report.Failures = append(report.Failures, RowFailure{Line: line, Failed: failed, Err: err})
+			continue
+		}
+		report.Added++
+	}
+	return report, nil
+}
+
+// Export writes all the records of the format to w. The first row is the header, with the ID column followed by the
+// fields of the format in alphabetical order.
+func Export(ctx context.Context, bc *boocat.Boocat, formatName string, w io.Writer, options Options) error {
+	format, found := bc.Formats()[formatName]
+	if !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	records, err := bc.ListRecords(ctx, formatName)
+	if err != nil {
+		return err
+	}
+	header := make([]string, 0, len(format.Fields)+1)
+	for field := range format.Fields {
+		header = append(header, field)
+	}
+	sort.Strings(header)
+	header = append([]string{"id"}, header...)
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	res := newResolver(bc)
+	for _, record := range records {
+		if options.Resolve {
+			record = res.resolveDisplays(ctx, format, record)
+		}
+		row := make([]string, len(header))
+		for i, column := range header {
+			row[i] = record[column]
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// importRecord validates the record and, if it's not a dry run, adds it. It returns the fields that failed
+// validation.
+func importRecord(ctx context.Context, bc *boocat.Boocat, formatName string, record map[string]string,
+	dryRun bool) (map[string]string, error) {
+	if dryRun {
+		return bc.ValidateRecord(ctx, formatName, record)
+	}
+	_, err := bc.AddRecord(ctx, formatName, record)
+	var validationError bcerrors.ValidationFailedError
+	if errors.As(err, &validationError) {
+		return validationError.Failed, nil
+	}
+	return nil, err
+}
+
+// rowToRecord returns the record with the non-empty values of the row, except the ID
+func rowToRecord(header, row []string) map[string]string {
+	record := make(map[string]string, len(header))
+	for i, column := range header {
+		if i < len(row) && row[i] != "" && column != "id" {
+			record[column] = row[i]
+		}
+	}
+	return record
+}
+
+// newResolver returns a resolver of references between records of bc
+func newResolver(bc *boocat.Boocat) *resolver {
+	return &resolver{
+		bc:       bc,
+		ids:      make(map[string]map[string][]string),
+		displays: make(map[string]map[string]string),
+	}
+}
+
+// resolveIDs replaces the display values in the reference fields of the record with the IDs of the referenced
+// records. Values that don't match any record are left as they are, so they can be IDs. Every value of list fields is
+// resolved. It returns the fields with values that match more than one record.
+func (res *resolver) resolveIDs(ctx context.Context, format boocat.Format, record map[string]string) map[string]string {
+	failed := make(map[string]string)
+	for field, refFormatName := range format.References {
+		value, found := record[field]
+		if !found {
+			continue
+		}
+		values := format.Values(field, value)
+		for i, v := range values {
+			ids := res.idsOf(ctx, refFormatName, v)
+			switch len(ids) {
+			case 0:
+			case 1:
+				values[i] = ids[0]
+			default:
+				failed[field] = fmt.Sprintf("more than one record of format '%s' is '%s'", refFormatName, v)
+			}
+		}
+		record[field] = joinValues(format, field, values)
+	}
+	return failed
+}
+
+// resolveDisplays returns a copy of the record whose reference fields have the display values of the referenced
+// records instead of their IDs. IDs of records that aren't found are left as they are.
+func (res *resolver) resolveDisplays(ctx context.Context, format boocat.Format,
+	record map[string]string) map[string]string {
+	resolved := make(map[string]string, len(record))
+	for field, value := range record {
+		resolved[field] = value
+	}
+	for field, refFormatName := range format.References {
+		id, found := record[field]
+		if !found {
+			continue
+		}
+		values := format.Values(field, id)
+		for i, v := range values {
+			if display := res.displayOf(ctx, refFormatName, v); display != "" {
+				values[i] = display
+			}
+		}
+		resolved[field] = joinValues(format, field, values)
+	}
+	return resolved
+}
+
+// joinValues returns the value of a field of the format with the values, as returned by Format.Values
+func joinValues(format boocat.Format, field string, values []string) string {
+	if format.IsList(field) {
+		return boocat.JoinList(values)
+	}
+	return values[0]
+}
+
+// idsOf returns the IDs of the records of the format whose display field has the value
+func (res *resolver) idsOf(ctx context.Context, formatName, value string) []string {
+	if ids, found := res.ids[formatName][value]; found {
+		return ids
+	}
+	display := res.bc.Formats()[formatName].Display
+	var ids []string
+	if display != "" {
+		filtered, err := res.bc.FilterRecords(ctx, formatName, boocat.Filter{
+			Equal: map[string]string{display: value},
+		})
+		if err == nil {
+			for _, record := range filtered.Records {
+				ids = append(ids, record["id"])
+			}
+		}
+	}
+	if res.ids[formatName] == nil {
+		res.ids[formatName] = make(map[string][]string)
+	}
+	res.ids[formatName][value] = ids
+	return ids
+}
+
+// displayOf returns the value of the display field of the record of the format with the ID, or the empty string if
+// the record isn't found
+func (res *resolver) displayOf(ctx context.Context, formatName, id string) string {
+	if display, found := res.displays[formatName][id]; found {
+		return display
+	}
+	var display string
+	if record, err := res.bc.GetRecord(ctx, formatName, id); err == nil {
+		display = record[res.bc.Formats()[formatName].Display]
+	}
+	if res.displays[formatName] == nil {
+		res.displays[formatName] = make(map[string]string)
+	}
+	res.displays[formatName][id] = display
+	return display
+}
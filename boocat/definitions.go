@@ -0,0 +1,247 @@
+package boocat
+
+// Implements the formats defined at runtime, whose definitions are stored in the database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// Name of the validator of references, whose argument is the name of the referenced format
+const referenceValidator = "reference"
+
+// Names of formats and fields defined at runtime
+var definitionNameRegExp = regexp.MustCompile("^[a-z][a-z0-9_]*$")
+
+// FormatDefinition is the definition of a format that can be stored and changed at runtime. Validators are set by
+// name, followed by a colon and an argument if they take one, e.g. "isbn", "regexp:^[0-9]+$" or "reference:author".
+type FormatDefinition struct {
+	// Name of the format
+	Name string
+	// Field names and validators. The empty string means no validator.
+	Fields map[string]string
+	// Names of the searchable fields
+	Searchable []string
+	// Name of the field used to display the records
+	Display string
+}
+
+// ValidatorFactory returns the validator with the argument of a validator set by name, or an error if the argument
+// isn't valid
+type ValidatorFactory func(argument string) (Validate, error)
+
+// SetValidator sets a validator that can be used by name in format definitions
+func (bc *Boocat) SetValidator(name string, factory ValidatorFactory) *Boocat {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if bc.validators == nil {
+		bc.validators = make(map[string]ValidatorFactory)
+	}
+	bc.validators[name] = factory
+	return bc
+}
+
+// ValidatorNames returns the sorted names of the validators that can be used in format definitions
+func (bc *Boocat) ValidatorNames() []string {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+	names := []string{referenceValidator}
+	for name := range builtInValidators {
+		names = append(names, name)
+	}
+	for name := range bc.validators {
+		if _, builtIn := builtInValidators[name]; !builtIn && name != referenceValidator {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FormatDefinitions returns the definitions of the formats defined at runtime, sorted by name
+func (bc *Boocat) FormatDefinitions() []FormatDefinition {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+	definitions := make([]FormatDefinition, 0, len(bc.definitions))
+	for _, definition := range bc.definitions {
+		definitions = append(definitions, definition)
+	}
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].Name < definitions[j].Name
+	})
+	return definitions
+}
+
+// LoadFormats sets the formats defined by the definitions stored in the database. Definitions of formats that are
+// already set, i.e. defined in code, are ignored.
+func (bc *Boocat) LoadFormats(ctx context.Context) error {
+	if bc.db == nil {
+		return bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	definitions, err := bc.db.GetFormatDefinitions(ctx)
+	if err != nil {
+		return bcerrors.NewUnexpectedError(fmt.Errorf("getting format definitions from database: %v\n", err))
+	}
+	for _, definition := range definitions {
+		if _, found := bc.format(definition.Name); found {
+			continue
+		}
+		format, failed := bc.formatFromDefinition(definition)
+		if len(failed) > 0 {
+			return fmt.Errorf("format definition '%s' isn't valid: %v", definition.Name, failed)
+		}
+		if err := bc.db.InitializeCollection(ctx, format); err != nil {
+			return bcerrors.NewUnexpectedError(fmt.Errorf("initializing collection: %v\n", err))
+		}
+		bc.setDefinedFormat(definition, format)
+	}
+	return nil
+}
+
+// SaveFormat validates a format definition, stores it and sets the format, creating or updating its collection in the
+// database. Formats defined in code can't be changed. If the definition isn't valid, the error is a
+// ValidationFailedError with the failures of "name", "searchable", "display" and "fields.<field>".
+func (bc *Boocat) SaveFormat(ctx context.Context, definition FormatDefinition) error {
+	if bc.db == nil {
+		return bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	format, failed := bc.formatFromDefinition(definition)
+	bc.mutex.RLock()
+	_, defined := bc.formats[definition.Name]
+	_, definedAtRuntime := bc.definitions[definition.Name]
+	bc.mutex.RUnlock()
+	if defined && !definedAtRuntime {
+		failed["name"] = "format defined in code can't be changed"
+	}
+	for field, refFormatName := range format.References {
+		if _, found := bc.format(refFormatName); !found && refFormatName != definition.Name {
+			failed["fields."+field] = fmt.Sprintf("format '%s' not found", refFormatName)
+		}
+	}
+	if len(failed) > 0 {
+		return bcerrors.ValidationFailedError{Failed: failed}
+	}
+	if err := bc.db.InitializeCollection(ctx, format); err != nil {
+		return bcerrors.NewUnexpectedError(fmt.Errorf("initializing collection: %v\n", err))
+	}
+	if err := bc.db.SaveFormatDefinition(ctx, definition); err != nil {
+		return bcerrors.NewUnexpectedError(fmt.Errorf("saving format definition in database: %v\n", err))
+	}
+	bc.setDefinedFormat(definition, format)
+	return nil
+}
+
+// setDefinedFormat sets a format defined at runtime and its definition
+func (bc *Boocat) setDefinedFormat(definition FormatDefinition, format Format) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if bc.formats == nil {
+		bc.formats = make(map[string]Format)
+	}
+	if bc.definitions == nil {
+		bc.definitions = make(map[string]FormatDefinition)
+	}
+	bc.formats[definition.Name] = format
+	bc.definitions[definition.Name] = definition
+}
+
+// formatFromDefinition returns the format with the definition, and the failures of the parts of the definition that
+// aren't valid
+func (bc *Boocat) formatFromDefinition(definition FormatDefinition) (Format, map[string]string) {
+	failed := make(map[string]string)
+	if !definitionNameRegExp.MatchString(definition.Name) {
+		failed["name"] = "must be lowercase letters, digits and underscores, starting with a letter"
+	}
+	format := Format{
+		Name:       definition.Name,
+		Fields:     make(map[string]Validate, len(definition.Fields)),
+		Searchable: make(map[string]struct{}, len(definition.Searchable)),
+		References: make(map[string]string),
+		Display:    definition.Display,
+	}
+	if len(definition.Fields) == 0 {
+		failed["fields"] = "a format needs at least one field"
+	}
+	for field, spec := range definition.Fields {
+		if !definitionNameRegExp.MatchString(field) || field == "id" {
+			failed["fields."+field] = "not a valid field name"
+			continue
+		}
+		validate, refFormatName, err := bc.validatorFromSpec(spec)
+		if err != nil {
+			failed["fields."+field] = err.Error()
+			continue
+		}
+		format.Fields[field] = validate
+		if refFormatName != "" {
+			format.References[field] = refFormatName
+		}
+	}
+	for _, field := range definition.Searchable {
+		if _, found := definition.Fields[field]; !found {
+			failed["searchable"] = fmt.Sprintf("'%s' is not a field", field)
+		}
+		format.Searchable[field] = struct{}{}
+	}
+	if _, found := definition.Fields[definition.Display]; !found && definition.Display != "" {
+		failed["display"] = fmt.Sprintf("'%s' is not a field", definition.Display)
+	}
+	return format, failed
+}
+
+// validatorFromSpec returns the validator set by a validator name and optional argument, and the name of the
+// referenced format if it's a reference validator
+func (bc *Boocat) validatorFromSpec(spec string) (Validate, string, error) {
+	if spec == "" {
+		return nil, "", nil
+	}
+	name, argument := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, argument = spec[:i], spec[i+1:]
+	}
+	if name == referenceValidator {
+		if argument == "" {
+			return nil, "", errors.New("reference validator needs the name of a format")
+		}
+		return bc.db.ReferenceValidator(argument), argument, nil
+	}
+	bc.mutex.RLock()
+	factory, found := bc.validators[name]
+	bc.mutex.RUnlock()
+	if !found {
+		factory, found = builtInValidators[name]
+	}
+	if !found {
+		return nil, "", fmt.Errorf("validator '%s' not found", name)
+	}
+	validate, err := factory(argument)
+	if err != nil {
+		return nil, "", fmt.Errorf("validator '%s': %v", name, err)
+	}
+	return validate, "", nil
+}
+
+// builtInValidators are the validators that can always be used in format definitions
+var builtInValidators = map[string]ValidatorFactory{
+	"isbn": func(_ string) (Validate, error) {
+		return ValidateISBN, nil
+	},
+	"regexp": func(argument string) (Validate, error) {
+		regExp, err := regexp.Compile(argument)
+		if err != nil {
+			return nil, err
+		}
+		return func(_ context.Context, value interface{}) string {
+			if !regExp.MatchString(fmt.Sprintf("%v", value)) {
+				return fmt.Sprintf("does not match regular expression '%s'", argument)
+			}
+			return ""
+		}, nil
+	},
+}
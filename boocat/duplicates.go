@@ -0,0 +1,328 @@
+package boocat
+
+// Implements the detection of records that seem to be duplicates of each other, and the merging of duplicates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// DistinctField is the internal field of the records that aren't duplicates of other records that seem to be, with the
+// IDs of those records
+const DistinctField = "_distinct"
+
+// Weights in the score of duplicates of the similarity of the display field and of the rest of the fields
+const (
+	displayWeight = 0.7
+	fieldsWeight  = 0.3
+)
+
+// Duplicate is a pair of records of a format that seem to be the same
+type Duplicate struct {
+	Records [2]map[string]string
+	// Score from 0 to 1 of how similar the records are
+	Score float64
+}
+
+// FindDuplicates returns the pairs of records of a format whose score is at least minScore, the highest first. The
+// score combines the similarity of the display field, ignoring case, punctuation and the order of words so that
+// "George Orwell" and "Orwell, George" are the same, and the proportion of the other fields with values in both
+// records that are the same. Only records that share a word in the display field are compared, and records marked as
+// distinct aren't paired.
+func (bc *Boocat) FindDuplicates(ctx context.Context, formatName string, minScore float64) ([]Duplicate, error) {
+	format, found := bc.format(formatName)
+	if !found {
+		return nil, bcerrors.ErrFormatNotFound
+	}
+	if format.Display == "" {
+		return nil, bcerrors.ErrNoDisplayField
+	}
+	records, err := bc.ListRecords(ctx, formatName)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(records))
+	byWord := make(map[string][]int)
+	for i, record := range records {
+		words := comparableWords(record[format.Display])
+		names[i] = strings.Join(words, " ")
+		for j, word := range words {
+			if j == 0 || word != words[j-1] {
+				byWord[word] = append(byWord[word], i)
+			}
+		}
+	}
+	compared := make(map[[2]int]struct{})
+	var duplicates []Duplicate
+	for _, indexes := range byWord {
+		for a := range indexes {
+			for _, b := range indexes[a+1:] {
+				pair := [2]int{indexes[a], b}
+				if _, found := compared[pair]; found {
+					continue
+				}
+				compared[pair] = struct{}{}
+				first, second := records[pair[0]], records[pair[1]]
+				if distinct(first, second) {
+					continue
+				}
+				score := similarity(names[pair[0]], names[pair[1]])
+				if proportion, found := format.sameFields(first, second); found {
+					score = displayWeight*score + fieldsWeight*proportion
+				}
+				if score >= minScore {
+					duplicates = append(duplicates, Duplicate{Records: [2]map[string]string{first, second}, Score: score})
+				}
+			}
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		a, b := duplicates[i], duplicates[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Records[0]["id"] != b.Records[0]["id"] {
+			return a.Records[0]["id"] < b.Records[0]["id"]
+		}
+		return a.Records[1]["id"] < b.Records[1]["id"]
+	})
+	return duplicates, nil
+}
+
+// MarkDistinct marks the records of a format with the ids as not being duplicates of each other, so that
+// FindDuplicates doesn't pair them
+func (bc *Boocat) MarkDistinct(ctx context.Context, formatName, id, otherID string) error {
+	if id == otherID {
+		return bcerrors.ErrSameRecord
+	}
+	records := make([]map[string]string, 2)
+	for i, recordID := range []string{id, otherID} {
+		record, err := bc.GetRecord(ctx, formatName, recordID)
+		if err != nil {
+			return err
+		}
+		records[i] = record
+	}
+	for i, record := range records {
+		other := records[1-i]["id"]
+		if distinct(record, records[1-i]) {
+			continue
+		}
+		fields := map[string]string{DistinctField: JoinList(append(SplitList(record[DistinctField]), other))}
+		if err := bc.SetInternalFields(ctx, formatName, record["id"], fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MergeRecords merges the record of a format with mergedID into the record with keptID, and deletes it. The kept
+// record takes the values of the merged record in the fields it doesn't have, except unique fields and attachments,
+// and list fields take the values of both. The references to the merged record are changed to the kept record, and the
+// records that become duplicates in a set of unique fields are deleted, e.g. reviews of both records by the same
+// patron.
+func (bc *Boocat) MergeRecords(ctx context.Context, formatName, keptID, mergedID string) error {
+	if bc.db == nil {
+		return bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	format, found := bc.format(formatName)
+	if !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	if keptID == mergedID {
+		return bcerrors.ErrSameRecord
+	}
+	kept, err := bc.GetRecord(ctx, formatName, keptID)
+	if err != nil {
+		return err
+	}
+	merged, err := bc.GetRecord(ctx, formatName, mergedID)
+	if err != nil {
+		return err
+	}
+	if err := bc.UpdateRecord(ctx, formatName, format.combined(kept, merged)); err != nil {
+		return err
+	}
+	referencing, err := bc.referencingByField(ctx, formatName, mergedID)
+	if err != nil {
+		return err
+	}
+	for _, reference := range bc.ReferencesTo(formatName) {
+		for _, record := range referencing[reference] {
+			key := recordKey{formatName: reference.FormatName, id: record["id"]}
+			if key.formatName == formatName && (key.id == keptID || key.id == mergedID) {
+				continue
+			}
+			if err := bc.replaceReference(ctx, key, reference.Field, mergedID, keptID); err != nil {
+				return err
+			}
+		}
+	}
+	return bc.DeleteRecord(ctx, formatName, mergedID)
+}
+
+// combined returns the fields of the kept record with the values of the merged record that MergeRecords takes, without
+// internal fields and without references of the kept record to the merged record
+func (f Format) combined(kept, merged map[string]string) map[string]string {
+	combined := make(map[string]string, len(kept))
+	for field, value := range kept {
+		if !strings.HasPrefix(field, "_") {
+			combined[field] = value
+		}
+	}
+	for field, value := range merged {
+		if strings.HasPrefix(field, "_") || field == "id" || value == "" || f.IsAttachment(field) || f.isUnique(field) {
+			continue
+		}
+		if f.IsList(field) {
+			values := f.Values(field, combined[field])
+			for _, mergedValue := range SplitList(value) {
+				if !contains(values, mergedValue) {
+					values = append(values, mergedValue)
+				}
+			}
+			combined[field] = JoinList(values)
+		} else if combined[field] == "" {
+			combined[field] = value
+		}
+	}
+	for field, refFormatName := range f.References {
+		if refFormatName != f.Name || combined[field] == "" {
+			continue
+		}
+		var values []string
+		for _, value := range f.Values(field, combined[field]) {
+			if value != merged["id"] {
+				values = append(values, value)
+			}
+		}
+		if joined := JoinList(values); joined != "" {
+			combined[field] = joined
+		} else {
+			delete(combined, field)
+		}
+	}
+	return combined
+}
+
+// replaceReference replaces the reference to fromID in the field of the record with toID, without validating it. If
+// the record becomes a duplicate of another in a set of unique fields, it's deleted instead.
+func (bc *Boocat) replaceReference(ctx context.Context, key recordKey, field, fromID, toID string) error {
+	record, err := bc.GetRecord(ctx, key.formatName, key.id)
+	if errors.Is(err, bcerrors.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	format, _ := bc.format(key.formatName)
+	updated := make(map[string]string, len(record))
+	for f, value := range record {
+		updated[f] = value
+	}
+	var values []string
+	for _, value := range format.Values(field, updated[field]) {
+		if value == fromID {
+			value = toID
+		}
+		if !contains(values, value) {
+			values = append(values, value)
+		}
+	}
+	updated[field] = JoinList(values)
+	for _, fields := range format.Unique {
+		equal, complete := uniqueValues(updated, fields)
+		if !contains(fields, field) || !complete {
+			continue
+		}
+		used, err := bc.usedByOther(ctx, format, key.id, equal)
+		if err != nil {
+			return err
+		}
+		if used {
+			return bc.DeleteRecord(ctx, key.formatName, key.id)
+		}
+	}
+	updated[ModifiedField] = modifiedNow()
+	if err := bc.db.UpdateRecord(ctx, key.formatName, updated); err != nil {
+		return bcerrors.NewUnexpectedError(fmt.Errorf("updating record in database: %v\n", err))
+	}
+	bc.changed(ctx, key.formatName, updated)
+	return nil
+}
+
+// isUnique returns if the field is in a set of unique fields
+func (f Format) isUnique(field string) bool {
+	for _, fields := range f.Unique {
+		if contains(fields, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameFields returns the proportion of the fields other than the display field and attachments with values in both
+// records that have the same comparable words, or false if there are no such fields
+func (f Format) sameFields(a, b map[string]string) (float64, bool) {
+	compared, same := 0, 0
+	for field := range f.Fields {
+		if field == f.Display || f.IsAttachment(field) || a[field] == "" || b[field] == "" {
+			continue
+		}
+		compared++
+		if strings.Join(comparableWords(a[field]), " ") == strings.Join(comparableWords(b[field]), " ") {
+			same++
+		}
+	}
+	if compared == 0 {
+		return 0, false
+	}
+	return float64(same) / float64(compared), true
+}
+
+// distinct returns if the records are marked as not being duplicates of each other
+func distinct(a, b map[string]string) bool {
+	return contains(SplitList(a[DistinctField]), b["id"]) || contains(SplitList(b[DistinctField]), a["id"])
+}
+
+// comparableWords returns the words of the value in lower case and sorted, without the characters that aren't letters
+// or digits
+func comparableWords(value string) []string {
+	words := strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	sort.Strings(words)
+	return words
+}
+
+// similarity returns the Dice coefficient of the pairs of consecutive characters of the strings, from 0 for strings
+// without pairs in common to 1 for the same strings
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	pairs := make(map[[2]rune]int)
+	runesA, runesB := []rune(a), []rune(b)
+	for i := 1; i < len(runesA); i++ {
+		pairs[[2]rune{runesA[i-1], runesA[i]}]++
+	}
+	common := 0
+	for i := 1; i < len(runesB); i++ {
+		pair := [2]rune{runesB[i-1], runesB[i]}
+		if pairs[pair] > 0 {
+			pairs[pair]--
+			common++
+		}
+	}
+	total := len(runesA) + len(runesB) - 2
+	if total <= 0 {
+		return 0
+	}
+	return 2 * float64(common) / float64(total)
+}
@@ -16,16 +16,36 @@ var (
 	ErrRecordNotFound     = errors.New("record not found")
 	ErrRecordHasID        = errors.New("record has ID")
 	ErrRecordDoesntHaveID = errors.New("record doesn't have ID")
+	ErrNoDisplayField     = errors.New("format doesn't have display field")
+	ErrFieldNotFound      = errors.New("field not found")
+	ErrSameRecord         = errors.New("same record")
 )
 
 type ValidationFailedError struct {
 	Failed map[string]string
 }
 
+// DuplicateError is returned by databases when a record has the same values in a set of unique fields as another
+type DuplicateError struct {
+	Fields []string
+}
+
+// ReferencedError is returned when deleting a record that is referenced by fields that restrict the deletion
+type ReferencedError struct {
+	// Fields that reference the record, as "<format>.<field>"
+	Fields []string
+}
+
 func NewUnexpectedError(err error) UnexpectedError {
 	return UnexpectedError{err: err}
 }
 
+// NewUndoError returns the unexpected error of an operation that failed with err and couldn't undo the changes it had
+// made because of undoErr, which leaves the records inconsistent
+func NewUndoError(err, undoErr error) UnexpectedError {
+	return UnexpectedError{err: fmt.Errorf("undoing changes after error '%v': %w", err, undoErr)}
+}
+
 func (e UnexpectedError) Error() string {
 	return fmt.Sprintf("internal error: %v", e.err)
 }
@@ -37,3 +57,11 @@ func (e UnexpectedError) Unwrap() error {
 func (e ValidationFailedError) Error() string {
 	return "validation failed"
 }
+
+func (e DuplicateError) Error() string {
+	return fmt.Sprintf("duplicate values of unique fields %v", e.Fields)
+}
+
+func (e ReferencedError) Error() string {
+	return fmt.Sprintf("record referenced by %v", e.Fields)
+}
@@ -0,0 +1,165 @@
+package boocat
+
+// Implements the filtering and sorting of records by field values and the facet counts
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Filter selects records of a format by the values of their fields
+type Filter struct {
+	// Value to search for in the searchable fields. Empty means no search.
+	Search string
+	// Field names and the values that records must have in them
+	Equal map[string]string
+	// Field names and the ranges that the values of records must be within
+	Ranges map[string]Range
+	// Name of the field to sort the records by, which can be an internal field, and if the order is descending. Empty
+	// keeps the order of the database.
+	Sort       string
+	Descending bool
+}
+
+// Range of field values. Bounds are inclusive and an empty bound means no limit on that side.
+type Range struct {
+	Min string
+	Max string
+}
+
+// FilteredRecords contains the records that passed a filter and the facet counts of those records
+type FilteredRecords struct {
+	Records []map[string]string
+	// Facet field names, and the number of records per value of the field
+	Facets map[string]map[string]int
+}
+
+// FacetValue is a value of a facet field and the number of records that have it
+type FacetValue struct {
+	Value string
+	Count int
+}
+
+// Contains returns if value is within the range. Values are compared as numbers if they and the bounds are numbers,
+// and as strings otherwise.
+func (r Range) Contains(value string) bool {
+	if r.Min != "" && compareValues(value, r.Min) < 0 {
+		return false
+	}
+	if r.Max != "" && compareValues(value, r.Max) > 0 {
+		return false
+	}
+	return true
+}
+
+// SortedValues returns the values of a facet sorted by descending count, and by value for the same count
+func SortedValues(facet map[string]int) []FacetValue {
+	values := make([]FacetValue, 0, len(facet))
+	for value, count := range facet {
+		values = append(values, FacetValue{Value: value, Count: count})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+	return values
+}
+
+// matches returns if the record of the format has the equal values and is within the ranges of the filter. A list
+// field matches if any of its values does.
+func (f Filter) matches(format Format, record map[string]string) bool {
+	for field, value := range f.Equal {
+		if !anyValue(format.Values(field, record[field]), func(v string) bool { return v == value }) {
+			return false
+		}
+	}
+	for field, r := range f.Ranges {
+		value, found := record[field]
+		if !found || !anyValue(format.Values(field, value), r.Contains) {
+			return false
+		}
+	}
+	return true
+}
+
+// anyValue returns if any of the values satisfies the condition
+func anyValue(values []string, condition func(string) bool) bool {
+	for _, value := range values {
+		if condition(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// fields returns the names of all the fields used by the filter
+func (f Filter) fields() []string {
+	fields := make([]string, 0, len(f.Equal)+len(f.Ranges))
+	for field := range f.Equal {
+		fields = append(fields, field)
+	}
+	for field := range f.Ranges {
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// sort sorts the records by the field of the filter. Records without a value in the field go last in either order.
+func (f Filter) sort(records []map[string]string) {
+	if f.Sort == "" {
+		return
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i][f.Sort], records[j][f.Sort]
+		switch {
+		case a == "" || b == "":
+			return a != "" && b == ""
+		case f.Descending:
+			return compareValues(a, b) > 0
+		default:
+			return compareValues(a, b) < 0
+		}
+	})
+}
+
+// countFacets returns the number of records of the format per value of every facet field. Every value of a list field
+// is counted.
+func countFacets(format Format, records []map[string]string) map[string]map[string]int {
+	counts := make(map[string]map[string]int, len(format.Facets))
+	for field := range format.Facets {
+		counts[field] = make(map[string]int)
+	}
+	for _, record := range records {
+		for field := range format.Facets {
+			for _, value := range format.Values(field, record[field]) {
+				if value != "" {
+					counts[field][value]++
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// compareValues compares two values as numbers if both are numbers, or as strings otherwise. The result is negative
+// if a < b, zero if a == b and positive if a > b.
+func compareValues(a, b string) int {
+	aNumber, aErr := strconv.ParseFloat(a, 64)
+	bNumber, bErr := strconv.ParseFloat(b, 64)
+	switch {
+	case aErr == nil && bErr == nil && aNumber < bNumber:
+		return -1
+	case aErr == nil && bErr == nil && aNumber > bNumber:
+		return 1
+	case aErr == nil && bErr == nil:
+		return 0
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -5,8 +5,12 @@ package boocat
 import (
 	"context"
 	"fmt"
+	"strings"
 )
 
+// ListSeparator separates the values of list fields in records
+const ListSeparator = "\n"
+
 // Format definition
 type Format struct {
 	// Name of the format
@@ -15,12 +19,130 @@ type Format struct {
 	Fields map[string]Validate
 	// Names of the searchable fields
 	Searchable map[string]struct{}
+	// Names of the fields whose values are lists. Every value of a list is normalized and validated on its own.
+	Lists map[string]struct{}
+	// Names of the fields that reference records of other formats, and the names of those formats
+	References map[string]string
+	// Names of the fields that reference records of any format, and the names of the fields whose values are the names
+	// of those formats
+	FormatReferences map[string]string
+	// Names of reference fields and what happens to the records of the format when the records they reference are
+	// deleted. Reference fields that aren't here restrict the deletion.
+	OnDelete map[string]ReferencePolicy
+	// Names of the fields whose values are the keys of attached files, and the content types they accept. A content
+	// type ending in "/", e.g. "image/", accepts all the subtypes, and the empty string accepts any file.
+	Attachments map[string]string
+	// Names of the fields whose values are counted when filtering records
+	Facets map[string]struct{}
+	// Field names and the functions that normalize their values before validation
+	Normalizers map[string]Normalize
+	// Sets of field names whose combined values can't be repeated in different records. A set with a single field
+	// makes that field unique on its own.
+	Unique [][]string
+	// Name of the field used to display the records, e.g. when picking a referenced record
+	Display string
 }
 
+// ReferencePolicy is what happens to the records that reference a record when it's deleted
+type ReferencePolicy int
+
+const (
+	// Restrict prevents deleting records that are referenced
+	Restrict ReferencePolicy = iota
+	// Cascade deletes the records that reference the deleted record
+	Cascade
+	// SetNull removes the reference to the deleted record from the records that reference it
+	SetNull
+)
+
 // Signature of validation functions. If validation succeeds, they return the empty string. Otherwise they return a
 // human readable explanation of why it failed.
 type Validate func(ctx context.Context, value interface{}) string
 
+// ValidateRequired validates that the value isn't empty
+func ValidateRequired(_ context.Context, value interface{}) string {
+	if fmt.Sprintf("%v", value) == "" {
+		return "required"
+	}
+	return ""
+}
+
+// Optional returns a validator of values that are empty or that validate validates, e.g. for optional references
+func Optional(validate Validate) Validate {
+	return func(ctx context.Context, value interface{}) string {
+		if fmt.Sprintf("%v", value) == "" {
+			return ""
+		}
+		return validate(ctx, value)
+	}
+}
+
+// Signature of normalization functions. They return the value in the canonical form it's stored with.
+type Normalize func(value string) string
+
+// SplitList returns the values of a list field. The empty string is an empty list.
+func SplitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ListSeparator)
+}
+
+// JoinList returns the value of a list field with the values, leaving out the empty ones
+func JoinList(values []string) string {
+	nonEmpty := make([]string, 0, len(values))
+	for _, value := range values {
+		if value != "" {
+			nonEmpty = append(nonEmpty, value)
+		}
+	}
+	return strings.Join(nonEmpty, ListSeparator)
+}
+
+// IsList returns if the field is a list field
+func (f Format) IsList(field string) bool {
+	_, found := f.Lists[field]
+	return found
+}
+
+// Values returns the values of a field of the format, which are the values of the list for list fields and just the
+// value otherwise
+func (f Format) Values(field, value string) []string {
+	if f.IsList(field) {
+		return SplitList(value)
+	}
+	return []string{value}
+}
+
+// Policy returns what happens to the records of the format when the records referenced by the field are deleted
+func (f Format) Policy(field string) ReferencePolicy {
+	return f.OnDelete[field]
+}
+
+// IsAttachment returns if the field is an attachment field
+func (f Format) IsAttachment(field string) bool {
+	_, found := f.Attachments[field]
+	return found
+}
+
+// Normalize normalizes the values of the fields of the record that have a normalizer
+func (f Format) Normalize(record map[string]string) map[string]string {
+	for name, normalize := range f.Normalizers {
+		if value, found := record[name]; found && normalize != nil {
+			if f.IsList(name) {
+				values := SplitList(value)
+				for i := range values {
+					values[i] = normalize(values[i])
+				}
+				record[name] = JoinList(values)
+			} else {
+				record[name] = normalize(value)
+			}
+		}
+	}
+	return record
+}
+
 // Validate takes a record and returns a map with the result of the validation of every field
 func (f Format) Validate(ctx context.Context, record map[string]string) map[string]string {
 	failed := make(map[string]string, len(record))
@@ -28,7 +150,7 @@ func (f Format) Validate(ctx context.Context, record map[string]string) map[stri
 		if name != "id" {
 			if validateFunc, found := f.Fields[name]; found {
 				if validateFunc != nil {
-					if fail := validateFunc(ctx, value); fail != "" {
+					if fail := f.validateValues(ctx, validateFunc, name, value); fail != "" {
 						failed[name] = fail
 					}
 				}
@@ -40,6 +162,20 @@ func (f Format) Validate(ctx context.Context, record map[string]string) map[stri
 	return failed
 }
 
+// validateValues validates the value of a field, or every value of the list if it's a list field. It returns the
+// failure of the first value that fails.
+func (f Format) validateValues(ctx context.Context, validateFunc Validate, field, value string) string {
+	if !f.IsList(field) {
+		return validateFunc(ctx, value)
+	}
+	for i, listValue := range SplitList(value) {
+		if fail := validateFunc(ctx, listValue); fail != "" {
+			return fmt.Sprintf("value %d: %s", i+1, fail)
+		}
+	}
+	return ""
+}
+
 // SearchableAre returns if the searchable fields are the same as the ones passed as parameters
 func (f Format) SearchableAre(fields map[string]struct{}) bool {
 	if len(f.Searchable) != len(fields) {
@@ -52,3 +188,13 @@ func (f Format) SearchableAre(fields map[string]struct{}) bool {
 	}
 	return true
 }
+
+// IsUnique returns if the field is unique on its own
+func (f Format) IsUnique(field string) bool {
+	for _, fields := range f.Unique {
+		if len(fields) == 1 && fields[0] == field {
+			return true
+		}
+	}
+	return false
+}
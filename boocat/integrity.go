@@ -0,0 +1,303 @@
+package boocat
+
+// Implements the deletion of records and the integrity of the references between records
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// DanglingReference is a reference to a record that doesn't exist
+type DanglingReference struct {
+	// Name of the format of the record with the reference
+	FormatName string
+	// ID of the record with the reference
+	ID string
+	// Reference field
+	Field string
+	// ID of the referenced record that doesn't exist
+	RefID string
+}
+
+// recordKey identifies a record of a format
+type recordKey struct {
+	formatName string
+	id         string
+}
+
+// deletion is the set of changes needed to delete a record applying the policies of the fields that reference it
+type deletion struct {
+	// Records to delete, starting with the requested one and followed by the ones deleted in cascade
+	deleted []recordKey
+	// Records whose references are removed, by reference field and with the removed IDs
+	nulled map[recordKey]map[string][]string
+	// Fields that restrict the deletion, as "<format>.<field>", and the records with them
+	restricted map[recordKey][]string
+}
+
+// DeleteRecord deletes a record of a format by id, moving it to the trash until it's purged. The records that reference
+// it are deleted or have their references removed according to the policies of their reference fields. If any of them
+// restricts the deletion, nothing is deleted and the error is a ReferencedError.
+func (bc *Boocat) DeleteRecord(ctx context.Context, formatName string, id string) error {
+	if bc.db == nil {
+		return bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	if _, found := bc.format(formatName); !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	if _, err := bc.GetRecord(ctx, formatName, id); err != nil {
+		return err
+	}
+	d := &deletion{
+		nulled:     make(map[recordKey]map[string][]string),
+		restricted: make(map[recordKey][]string),
+	}
+	if err := bc.planDeletion(ctx, d, recordKey{formatName: formatName, id: id}); err != nil {
+		return err
+	}
+	if fields := d.restrictingFields(); len(fields) > 0 {
+		return bcerrors.ReferencedError{Fields: fields}
+	}
+	for key, fields := range d.nulled {
+		if d.deletes(key) {
+			continue
+		}
+		if err := bc.removeReferences(ctx, key, fields); err != nil {
+			return err
+		}
+	}
+	trashedTime := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, key := range d.deleted {
+		if err := bc.trash(ctx, key, trashedTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planDeletion adds to d the deletion of the record and the changes in the records that reference it, following
+// cascades
+func (bc *Boocat) planDeletion(ctx context.Context, d *deletion, key recordKey) error {
+	d.deleted = append(d.deleted, key)
+	referencing, err := bc.referencingByField(ctx, key.formatName, key.id)
+	if err != nil {
+		return err
+	}
+	for _, reference := range bc.ReferencesTo(key.formatName) {
+		format, _ := bc.format(reference.FormatName)
+		policy := format.Policy(reference.Field)
+		for _, record := range referencing[reference] {
+			refKey := recordKey{formatName: reference.FormatName, id: record["id"]}
+			switch policy {
+			case Cascade:
+				if !d.deletes(refKey) {
+					if err := bc.planDeletion(ctx, d, refKey); err != nil {
+						return err
+					}
+				}
+			case SetNull:
+				if d.nulled[refKey] == nil {
+					d.nulled[refKey] = make(map[string][]string)
+				}
+				d.nulled[refKey][reference.Field] = append(d.nulled[refKey][reference.Field], key.id)
+			default:
+				d.restricted[refKey] = append(d.restricted[refKey], reference.FormatName+"."+reference.Field)
+			}
+		}
+	}
+	return nil
+}
+
+// deletes returns if the record is deleted
+func (d *deletion) deletes(key recordKey) bool {
+	for _, deleted := range d.deleted {
+		if deleted == key {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictingFields returns the sorted fields that restrict the deletion, ignoring the records that are deleted anyway
+func (d *deletion) restrictingFields() []string {
+	set := make(map[string]struct{})
+	for key, fields := range d.restricted {
+		if d.deletes(key) {
+			continue
+		}
+		for _, field := range fields {
+			set[field] = struct{}{}
+		}
+	}
+	fields := make([]string, 0, len(set))
+	for field := range set {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// referencingByField returns the records that reference the record of the format with the id, by reference
+func (bc *Boocat) referencingByField(ctx context.Context, formatName, id string) (map[Reference][]map[string]string,
+	error) {
+	referencing := make(map[Reference][]map[string]string)
+	for _, reference := range bc.ReferencesTo(formatName) {
+		filtered, err := bc.FilterRecords(ctx, reference.FormatName, Filter{
+			Equal: map[string]string{reference.Field: id},
+		})
+		if err != nil {
+			return nil, err
+		}
+		referencing[reference] = filtered.Records
+	}
+	return referencing, nil
+}
+
+// removeReferences removes the IDs from the reference fields of the record, without validating it. Single value
+// fields are left empty and list fields keep the rest of their values.
+func (bc *Boocat) removeReferences(ctx context.Context, key recordKey, fields map[string][]string) error {
+	record, err := bc.GetRecord(ctx, key.formatName, key.id)
+	if errors.Is(err, bcerrors.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	format, _ := bc.format(key.formatName)
+	updated := make(map[string]string, len(record))
+	for field, value := range record {
+		updated[field] = value
+	}
+	for field, ids := range fields {
+		kept := make([]string, 0)
+		for _, value := range format.Values(field, updated[field]) {
+			if !contains(ids, value) {
+				kept = append(kept, value)
+			}
+		}
+		if len(kept) == 0 {
+			delete(updated, field)
+		} else {
+			updated[field] = JoinList(kept)
+		}
+	}
+	updated[ModifiedField] = modifiedNow()
+	if err := bc.db.UpdateRecord(ctx, key.formatName, updated); err != nil {
+		return bcerrors.NewUnexpectedError(fmt.Errorf("updating record in database: %v\n", err))
+	}
+	bc.changed(ctx, key.formatName, updated)
+	return nil
+}
+
+// CheckReferences returns the references of all the records of all formats to records that don't exist, sorted by
+// format, ID and field
+func (bc *Boocat) CheckReferences(ctx context.Context) ([]DanglingReference, error) {
+	if bc.db == nil {
+		return nil, bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	exists := make(map[recordKey]bool)
+	var dangling []DanglingReference
+	for formatName, format := range bc.Formats() {
+		if len(format.References) == 0 {
+			continue
+		}
+		records, err := bc.ListRecords(ctx, formatName)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			for field, refFormatName := range format.References {
+				for _, refID := range format.Values(field, record[field]) {
+					if refID == "" {
+						continue
+					}
+					found, err := bc.recordExists(ctx, exists, recordKey{formatName: refFormatName, id: refID})
+					if err != nil {
+						return nil, err
+					}
+					if !found {
+						dangling = append(dangling, DanglingReference{
+							FormatName: formatName,
+							ID:         record["id"],
+							Field:      field,
+							RefID:      refID,
+						})
+					}
+				}
+			}
+		}
+	}
+	sort.Slice(dangling, func(i, j int) bool {
+		a, b := dangling[i], dangling[j]
+		if a.FormatName != b.FormatName {
+			return a.FormatName < b.FormatName
+		}
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Field < b.Field
+	})
+	return dangling, nil
+}
+
+// RepairReferences repairs dangling references as if the referenced records had just been deleted. Records whose field
+// cascades are deleted, and the references are removed otherwise, because there's nothing left to restrict.
+func (bc *Boocat) RepairReferences(ctx context.Context, dangling []DanglingReference) error {
+	nulled := make(map[recordKey]map[string][]string)
+	var deleted []recordKey
+	for _, reference := range dangling {
+		key := recordKey{formatName: reference.FormatName, id: reference.ID}
+		if format, _ := bc.format(reference.FormatName); format.Policy(reference.Field) == Cascade {
+			deleted = append(deleted, key)
+			continue
+		}
+		if nulled[key] == nil {
+			nulled[key] = make(map[string][]string)
+		}
+		nulled[key][reference.Field] = append(nulled[key][reference.Field], reference.RefID)
+	}
+	for key, fields := range nulled {
+		if err := bc.removeReferences(ctx, key, fields); err != nil {
+			return err
+		}
+	}
+	for _, key := range deleted {
+		err := bc.DeleteRecord(ctx, key.formatName, key.id)
+		if err != nil && !errors.Is(err, bcerrors.ErrRecordNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordExists returns if the record exists, caching the result in exists
+func (bc *Boocat) recordExists(ctx context.Context, exists map[recordKey]bool, key recordKey) (bool, error) {
+	if found, checked := exists[key]; checked {
+		return found, nil
+	}
+	_, err := bc.GetRecord(ctx, key.formatName, key.id)
+	switch {
+	case err == nil:
+		exists[key] = true
+	case errors.Is(err, bcerrors.ErrRecordNotFound):
+		exists[key] = false
+	default:
+		return false, err
+	}
+	return exists[key], nil
+}
+
+// contains returns if the value is in the values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
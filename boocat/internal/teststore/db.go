@@ -0,0 +1,287 @@
+package teststore
+
+// Implements an in-memory database of boocat for the tests of the packages that work on the records of a
+// boocat.Boocat
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// DB is a database in memory. Records added get numbers as IDs, from the number of records of their format up to the
+// first one that isn't taken, and restored records keep theirs, whatever they are. Records are returned in the order
+// they were first stored.
+type DB struct {
+	// Records by format name and ID
+	records map[string]map[string]map[string]string
+	// IDs of the records by format name, in the order they were first stored
+	ids         map[string][]string
+	definitions map[string]boocat.FormatDefinition
+}
+
+// NewDB returns an empty database
+func NewDB() *DB {
+	return &DB{
+		records:     make(map[string]map[string]map[string]string),
+		ids:         make(map[string][]string),
+		definitions: make(map[string]boocat.FormatDefinition),
+	}
+}
+
+// NewBoocat returns a boocat with the formats and a new database initialized for them
+func NewBoocat(formats ...boocat.Format) (*boocat.Boocat, *DB) {
+	db := NewDB()
+	return db.Boocat(formats...), db
+}
+
+// Boocat returns a boocat with the formats and the database initialized for them. The formats can validate their
+// references with db.ReferenceValidator.
+func (db *DB) Boocat(formats ...boocat.Format) *boocat.Boocat {
+	var bc boocat.Boocat
+	for _, format := range formats {
+		bc.SetFormat(format.Name, format)
+		db.InitializeCollection(context.Background(), format)
+	}
+	bc.SetDatabase(db)
+	return &bc
+}
+
+// Book returns a format of books with a name, an author, a year, a synopsis, an ISBN and a work, whose references
+// aren't validated except the work, which reference validates
+func Book(reference func(formatName string) boocat.Validate) boocat.Format {
+	return boocat.Format{
+		Name: "book",
+		Fields: map[string]boocat.Validate{
+			"name":     nil,
+			"author":   nil,
+			"year":     nil,
+			"synopsis": nil,
+			"isbn":     nil,
+			"work":     boocat.Optional(reference("work")),
+		},
+		Searchable: map[string]struct{}{"name": {}, "synopsis": {}},
+		References: map[string]string{"work": "work"},
+		OnDelete:   map[string]boocat.ReferencePolicy{"work": boocat.SetNull},
+		Display:    "name",
+	}
+}
+
+// Restore stores the records of the format with their IDs and without validating them, e.g. to initialize the
+// records of tests
+func (db *DB) Restore(formatName string, records ...map[string]string) {
+	for _, record := range records {
+		if err := db.RestoreRecord(context.Background(), formatName, record); err != nil {
+			panic(fmt.Sprintf("restoring record %v of format '%s': %v", record, formatName, err))
+		}
+	}
+}
+
+// AddRecord adds a new record of the format
+func (db *DB) AddRecord(_ context.Context, formatName string, record map[string]string) (string, error) {
+	if _, found := record["id"]; found {
+		return "", bcerrors.ErrRecordHasID
+	}
+	if _, found := db.records[formatName]; !found {
+		return "", bcerrors.ErrFormatNotFound
+	}
+	next := len(db.ids[formatName])
+	for db.records[formatName][strconv.Itoa(next)] != nil {
+		next++
+	}
+	id := strconv.Itoa(next)
+	stored := copyRecord(record)
+	stored["id"] = id
+	db.store(formatName, stored)
+	return id, nil
+}
+
+// UpdateRecord updates a record of the format
+func (db *DB) UpdateRecord(_ context.Context, formatName string, record map[string]string) error {
+	if record["id"] == "" {
+		return bcerrors.ErrRecordDoesntHaveID
+	}
+	records, found := db.records[formatName]
+	if !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	if _, found := records[record["id"]]; !found {
+		return bcerrors.ErrRecordNotFound
+	}
+	records[record["id"]] = copyRecord(record)
+	return nil
+}
+
+// RestoreRecord stores a record of the format with its id, replacing the record with that id if there is one
+func (db *DB) RestoreRecord(_ context.Context, formatName string, record map[string]string) error {
+	if record["id"] == "" {
+		return bcerrors.ErrRecordDoesntHaveID
+	}
+	if _, found := db.records[formatName]; !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	db.store(formatName, copyRecord(record))
+	return nil
+}
+
+// DeleteRecord deletes the record of the format with the id
+func (db *DB) DeleteRecord(_ context.Context, formatName, id string) error {
+	records, found := db.records[formatName]
+	if !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	if _, found := records[id]; !found {
+		return bcerrors.ErrRecordNotFound
+	}
+	delete(records, id)
+	for i, storedID := range db.ids[formatName] {
+		if storedID == id {
+			db.ids[formatName] = append(db.ids[formatName][:i:i], db.ids[formatName][i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// GetRecord returns the record of the format with the id
+func (db *DB) GetRecord(_ context.Context, formatName, id string) (map[string]string, error) {
+	records, found := db.records[formatName]
+	if !found {
+		return nil, bcerrors.ErrFormatNotFound
+	}
+	record, found := records[id]
+	if !found {
+		return nil, bcerrors.ErrRecordNotFound
+	}
+	return copyRecord(record), nil
+}
+
+// GetAllRecords returns all records of the format
+func (db *DB) GetAllRecords(_ context.Context, formatName string) ([]map[string]string, error) {
+	return db.matching(formatName, func(map[string]string) bool { return true })
+}
+
+// SearchRecord returns the records of the format with a field that contains the value, case-insensitive
+func (db *DB) SearchRecord(_ context.Context, formatName, value string) ([]map[string]string, error) {
+	return db.matching(formatName, func(record map[string]string) bool {
+		for _, fieldValue := range record {
+			if strings.Contains(strings.ToLower(fieldValue), strings.ToLower(value)) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// FilterRecords returns the records of the format whose fields have the values in equal. List fields match if any of
+// their values does.
+func (db *DB) FilterRecords(_ context.Context, formatName string, equal map[string]string) (
+	[]map[string]string, error) {
+	return db.matching(formatName, func(record map[string]string) bool {
+		return Matches(record, equal)
+	})
+}
+
+// PrefixRecords returns up to limit records of the format whose field starts with prefix, case-insensitive, sorted by
+// that field
+func (db *DB) PrefixRecords(_ context.Context, formatName, field, prefix string, limit int) (
+	[]map[string]string, error) {
+	records, err := db.matching(formatName, func(record map[string]string) bool {
+		return strings.HasPrefix(strings.ToLower(record[field]), strings.ToLower(prefix))
+	})
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i][field] < records[j][field]
+	})
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records, err
+}
+
+// ReferenceValidator returns a validator of references to records of the format
+func (db *DB) ReferenceValidator(formatName string) boocat.Validate {
+	return func(ctx context.Context, value interface{}) string {
+		stringValue := fmt.Sprintf("%v", value)
+		if _, err := db.GetRecord(ctx, formatName, stringValue); err != nil {
+			return fmt.Sprintf("record of format '%s' and ID '%s' not found", formatName, stringValue)
+		}
+		return ""
+	}
+}
+
+// InitializeCollection creates the set of records of the format if it doesn't exist
+func (db *DB) InitializeCollection(_ context.Context, format boocat.Format) error {
+	if _, found := db.records[format.Name]; !found {
+		db.records[format.Name] = make(map[string]map[string]string)
+	}
+	return nil
+}
+
+// GetFormatDefinitions returns the stored format definitions
+func (db *DB) GetFormatDefinitions(_ context.Context) ([]boocat.FormatDefinition, error) {
+	definitions := make([]boocat.FormatDefinition, 0, len(db.definitions))
+	for _, definition := range db.definitions {
+		definitions = append(definitions, definition)
+	}
+	return definitions, nil
+}
+
+// SaveFormatDefinition stores a format definition
+func (db *DB) SaveFormatDefinition(_ context.Context, definition boocat.FormatDefinition) error {
+	db.definitions[definition.Name] = definition
+	return nil
+}
+
+// store stores the record of the format, keeping its position if it was already stored
+func (db *DB) store(formatName string, record map[string]string) {
+	if _, found := db.records[formatName][record["id"]]; !found {
+		db.ids[formatName] = append(db.ids[formatName], record["id"])
+	}
+	db.records[formatName][record["id"]] = record
+}
+
+// matching returns copies of the records of the format that match, in the order they were first stored
+func (db *DB) matching(formatName string, matches func(record map[string]string) bool) ([]map[string]string,
+	error) {
+	records, found := db.records[formatName]
+	if !found {
+		return nil, bcerrors.ErrFormatNotFound
+	}
+	var matching []map[string]string
+	for _, id := range db.ids[formatName] {
+		if record, found := records[id]; found && matches(record) {
+			matching = append(matching, copyRecord(record))
+		}
+	}
+	return matching, nil
+}
+
+// Matches returns if the record has all the field values. Fields with several values match if any of them does.
+func Matches(record map[string]string, equal map[string]string) bool {
+	for field, value := range equal {
+		matches := false
+		for _, recordValue := range boocat.SplitList(record[field]) {
+			if recordValue == value {
+				matches = true
+			}
+		}
+		if !matches && !(value == "" && record[field] == "") {
+			return false
+		}
+	}
+	return true
+}
+
+// copyRecord returns a copy of the record
+func copyRecord(record map[string]string) map[string]string {
+	copied := make(map[string]string, len(record))
+	for field, value := range record {
+		copied[field] = value
+	}
+	return copied
+}
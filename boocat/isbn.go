@@ -0,0 +1,90 @@
+package boocat
+
+// Implements the validation and normalisation of ISBNs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ValidateISBN is a validator of ISBN-10 and ISBN-13, with or without hyphens and spaces. The empty value is valid,
+// because books published before ISBNs don't have one.
+func ValidateISBN(_ context.Context, value interface{}) string {
+	stringValue := fmt.Sprintf("%v", value)
+	digits := isbnDigits(stringValue)
+	switch {
+	case stringValue == "":
+		return ""
+	case len(digits) == 10 && validISBN10(digits):
+		return ""
+	case len(digits) == 13 && validISBN13(digits):
+		return ""
+	default:
+		return "not a valid ISBN"
+	}
+}
+
+// NormalizeISBN returns the ISBN-13 of a valid ISBN-10 or ISBN-13, without hyphens and spaces. Values that aren't valid
+// ISBNs are returned as they are, so that validation can report them.
+func NormalizeISBN(value string) string {
+	digits := isbnDigits(value)
+	switch {
+	case len(digits) == 10 && validISBN10(digits):
+		isbn13 := "978" + digits[:9]
+		return isbn13 + string(isbn13CheckDigit(isbn13))
+	case len(digits) == 13 && validISBN13(digits):
+		return digits
+	default:
+		return value
+	}
+}
+
+// isbnDigits returns the ISBN without hyphens and spaces, and with the check digit X in uppercase
+func isbnDigits(value string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(value))
+}
+
+// validISBN10 returns if the ten characters are digits, except the last one that may be X, with a valid checksum
+func validISBN10(digits string) bool {
+	sum := 0
+	for i, r := range digits {
+		var digit int
+		switch {
+		case r >= '0' && r <= '9':
+			digit = int(r - '0')
+		case r == 'X' && i == 9:
+			digit = 10
+		default:
+			return false
+		}
+		sum += (10 - i) * digit
+	}
+	return sum%11 == 0
+}
+
+// validISBN13 returns if the thirteen characters are digits with a valid checksum and a 978 or 979 prefix
+func validISBN13(digits string) bool {
+	if !strings.HasPrefix(digits, "978") && !strings.HasPrefix(digits, "979") {
+		return false
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return isbn13CheckDigit(digits[:12]) == digits[12]
+}
+
+// isbn13CheckDigit returns the check digit of the first twelve digits of an ISBN-13
+func isbn13CheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(digits[i]-'0')
+	}
+	return byte('0' + (10-sum%10)%10)
+}
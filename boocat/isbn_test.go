@@ -0,0 +1,43 @@
+package boocat
+
+import (
+	"context"
+	"testing"
+)
+
+// TestValidateISBN tests validating ISBN-10 and ISBN-13 with ValidateISBN
+func TestValidateISBN(t *testing.T) {
+	for value, valid := range map[string]bool{
+		"0-451-52493-4":     true,
+		"0451524934":        true,
+		"080442957X":        true,
+		"080442957x":        true,
+		"978-0-451-52493-5": true,
+		"9780451524935":     true,
+		"0-451-52493-5":     false,
+		"9780451524936":     false,
+		"9770451524937":     false,
+		"X804429570":        false,
+		"97804515249":       false,
+		"":                  true,
+		" ":                 false,
+	} {
+		if fail := ValidateISBN(context.Background(), value); (fail == "") != valid {
+			t.Errorf("unexpected validation of %q: %q", value, fail)
+		}
+	}
+}
+
+// TestNormalizeISBN tests normalizing ISBNs to ISBN-13 with NormalizeISBN
+func TestNormalizeISBN(t *testing.T) {
+	for value, expected := range map[string]string{
+		"0-451-52493-4":     "9780451524935",
+		"080442957X":        "9780804429573",
+		"978-0-451-52493-5": "9780451524935",
+		"0-451-52493-5":     "0-451-52493-5",
+	} {
+		if normalized := NormalizeISBN(value); normalized != expected {
+			t.Errorf("unexpected normalization of %q: %q", value, normalized)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package marc
+
+// Implements the import of MARC records as book and author records
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// Names of the formats the MARC records are imported to
+const (
+	bookFormat   = "book"
+	authorFormat = "author"
+)
+
+// Book contains the data of a MARC record that is imported
+type Book struct {
+	// Title from 245 $a and $b
+	Title string
+	// Author's name from 100 $a, in direct order
+	Author string
+	// Year of publication from 264 $c of the publication, or 260 $c
+	Year string
+	// Summary from 520 $a
+	Summary string
+}
+
+// Failure is a MARC record that couldn't be imported
+type Failure struct {
+	// Position of the record in the file, starting at 1
+	Position int
+	Title    string
+	// Format whose validation failed, and the fields that failed and why
+	Format string
+	Failed map[string]string
+	// Error that isn't a validation failure, if any
+	Err error
+}
+
+// Report is the result of an import
+type Report struct {
+	Books    int
+	Authors  int
+	Failures []Failure
+}
+
+// Importer imports MARC records, reusing the author records that already exist
+type Importer struct {
+	bc *boocat.Boocat
+	// IDs of the author records by name
+	authorIDs map[string]string
+}
+
+// Characters that MARC adds at the end of subfields to separate them from the next ones
+const trailingPunctuation = " /:;,.="
+
+// Regular expression of a year in a publication date, e.g. "c1949."
+var yearRegExp = regexp.MustCompile(`[0-9]{4}`)
+
+// NewImporter returns an importer of MARC records to the book and author formats of bc
+func NewImporter(bc *boocat.Boocat) *Importer {
+	return &Importer{
+		bc:        bc,
+		authorIDs: make(map[string]string),
+	}
+}
+
+// Import adds a book record for every MARC record, and an author record for every author that doesn't have one yet.
+// Books are validated before their authors are added, and authors added for books that fail are deleted.
+func (im *Importer) Import(ctx context.Context, records []Record) Report {
+	var report Report
+	for i, record := range records {
+		book := BookFromRecord(record)
+		failure := Failure{Position: i + 1, Title: book.Title, Format: bookFormat}
+		bookRecord := nonEmpty(map[string]string{
+			"name":     book.Title,
+			"year":     book.Year,
+			"synopsis": book.Summary,
+		})
+		failed, err := im.bc.ValidateRecord(ctx, bookFormat, bookRecord)
+		if err == nil && len(failed) > 0 {
+			err = bcerrors.ValidationFailedError{Failed: failed}
+		}
+		if err != nil {
+			report.Failures = append(report.Failures, withError(failure, err))
+			continue
+		}
+		authorID, added, err := im.authorID(ctx, book.Author)
+		if err != nil {
+			failure.Format = authorFormat
+			report.Failures = append(report.Failures, withError(failure, err))
+			continue
+		}
+		if authorID != "" {
+			bookRecord["author"] = authorID
+		}
+		if _, err := im.bc.AddRecord(ctx, bookFormat, bookRecord); err != nil {
+			report.Failures = append(report.Failures, withError(failure, err))
+			if added && !im.removeAuthor(ctx, book.Author) {
+				report.Authors++
+			}
+			continue
+		}
+		if added {
+			report.Authors++
+		}
+		report.Books++
+	}
+	return report
+}
+
+// BookFromRecord returns the data of the record that is imported, without the trailing punctuation of MARC
+func BookFromRecord(record Record) Book {
+	title := trimPunctuation(record.SubfieldValue("245", "a"))
+	if subtitle := trimPunctuation(record.SubfieldValue("245", "b")); subtitle != "" {
+		title += ": " + subtitle
+	}
+	year := yearRegExp.FindString(publicationDate(record))
+	if year == "" {
+		year = yearRegExp.FindString(record.SubfieldValue("260", "c"))
+	}
+	return Book{
+		Title:   title,
+		Author:  directOrder(trimPunctuation(record.SubfieldValue("100", "a"))),
+		Year:    year,
+		Summary: strings.TrimSpace(record.SubfieldValue("520", "a")),
+	}
+}
+
+// publicationDate returns $c of the first 264 field whose second indicator is 1, which is the field of the
+// publication, and not of the production, distribution, manufacture or copyright
+func publicationDate(record Record) string {
+	for _, field := range record.Fields {
+		if field.Tag != "264" || len(field.Indicators) != 2 || field.Indicators[1] != '1' {
+			continue
+		}
+		for _, subfield := range field.Subfields {
+			if subfield.Code == "c" {
+				return subfield.Value
+			}
+		}
+	}
+	return ""
+}
+
+// authorID returns the ID of the author record with the name, adding it if there isn't one. It also returns if it was
+// added. If the name is empty, it returns the empty string.
+func (im *Importer) authorID(ctx context.Context, name string) (string, bool, error) {
+	if name == "" {
+		return "", false, nil
+	}
+	if id, found := im.authorIDs[name]; found {
+		return id, false, nil
+	}
+	filtered, err := im.bc.FilterRecords(ctx, authorFormat, boocat.Filter{
+		Equal: map[string]string{"name": name},
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if len(filtered.Records) > 0 {
+		im.authorIDs[name] = filtered.Records[0]["id"]
+		return im.authorIDs[name], false, nil
+	}
+	id, err := im.bc.AddRecord(ctx, authorFormat, map[string]string{"name": name})
+	if err != nil {
+		return "", false, err
+	}
+	im.authorIDs[name] = id
+	return id, true, nil
+}
+
+// removeAuthor deletes the author record with the name that was added for a book that failed, and returns if it was
+// deleted. If it can't be deleted, it's kept for the next books.
+func (im *Importer) removeAuthor(ctx context.Context, name string) bool {
+	if err := im.bc.DeleteRecord(ctx, authorFormat, im.authorIDs[name]); err != nil {
+		return false
+	}
+	delete(im.authorIDs, name)
+	return true
+}
+
+// withError returns the failure with the validation failures or the error
+func withError(failure Failure, err error) Failure {
+	var validationError bcerrors.ValidationFailedError
+	if errors.As(err, &validationError) {
+		failure.Failed = validationError.Failed
+	} else {
+		failure.Err = err
+	}
+	return failure
+}
+
+// directOrder returns a name in inverted order, e.g. "Orwell, George", in direct order, e.g. "George Orwell"
+func directOrder(name string) string {
+	parts := strings.SplitN(name, ",", 2)
+	if len(parts) < 2 {
+		return name
+	}
+	return strings.TrimSpace(parts[1]) + " " + strings.TrimSpace(parts[0])
+}
+
+// trimPunctuation returns the value without the spaces and the punctuation that MARC adds between subfields
+func trimPunctuation(value string) string {
+	return strings.TrimRight(strings.TrimSpace(value), trailingPunctuation)
+}
+
+// nonEmpty returns the record without the fields whose values are empty
+func nonEmpty(record map[string]string) map[string]string {
+	for field, value := range record {
+		if value == "" {
+			delete(record, field)
+		}
+	}
+	return record
+}
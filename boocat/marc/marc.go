@@ -0,0 +1,205 @@
+package marc
+
+// Implements the reading of MARC21 records, in binary and MARCXML encodings
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Delimiters of the binary encoding
+const (
+	subfieldDelimiter = 0x1f
+	fieldTerminator   = 0x1e
+	recordTerminator  = 0x1d
+)
+
+// Lengths of the parts of the binary encoding
+const (
+	leaderLength         = 24
+	directoryEntryLength = 12
+)
+
+// Record is a MARC record
+type Record struct {
+	Leader string
+	Fields []Field
+}
+
+// Field is a control field, which has a value, or a data field, which has indicators and subfields
+type Field struct {
+	Tag        string
+	Value      string
+	Indicators string
+	Subfields  []Subfield
+}
+
+// Subfield of a data field
+type Subfield struct {
+	Code  string
+	Value string
+}
+
+// Reader reads binary MARC21 records
+type Reader struct {
+	r *bufio.Reader
+}
+
+// xmlRecord is a record as encoded in MARCXML
+type xmlRecord struct {
+	Leader        string `xml:"leader"`
+	ControlFields []struct {
+		Tag   string `xml:"tag,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"controlfield"`
+	DataFields []struct {
+		Tag       string `xml:"tag,attr"`
+		Ind1      string `xml:"ind1,attr"`
+		Ind2      string `xml:"ind2,attr"`
+		Subfields []struct {
+			Code  string `xml:"code,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"subfield"`
+	} `xml:"datafield"`
+}
+
+// ErrInvalidRecord is returned when a binary record isn't well formed
+var ErrInvalidRecord = errors.New("invalid MARC record")
+
+// NewReader returns a reader of the binary MARC21 records in r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next record, or io.EOF if there are no more records
+func (mr *Reader) Read() (Record, error) {
+	data, err := mr.r.ReadBytes(recordTerminator)
+	if err == io.EOF && len(bytes.TrimSpace(data)) == 0 {
+		return Record{}, io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return Record{}, err
+	}
+	return parseBinary(data)
+}
+
+// ReadAll returns all the remaining records
+func (mr *Reader) ReadAll() ([]Record, error) {
+	var records []Record
+	for {
+		record, err := mr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+// ReadXML returns all the records of a MARCXML document, whether it's a collection or a single record
+func ReadXML(r io.Reader) ([]Record, error) {
+	decoder := xml.NewDecoder(r)
+	var records []Record
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "record" {
+			var xr xmlRecord
+			if err := decoder.DecodeElement(&xr, &start); err != nil {
+				return records, err
+			}
+			records = append(records, xr.record())
+		}
+	}
+}
+
+// SubfieldValue returns the value of the first subfield with the code in the first field with the tag, or the empty
+// string if there isn't any
+func (r Record) SubfieldValue(tag, code string) string {
+	for _, field := range r.Fields {
+		if field.Tag == tag {
+			for _, subfield := range field.Subfields {
+				if subfield.Code == code {
+					return subfield.Value
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// parseBinary returns the record encoded in data
+func parseBinary(data []byte) (Record, error) {
+	data = bytes.TrimLeft(data, "\r\n")
+	if len(data) < leaderLength {
+		return Record{}, fmt.Errorf("%w: too short", ErrInvalidRecord)
+	}
+	leader := string(data[:leaderLength])
+	base, err := strconv.Atoi(leader[12:17])
+	if err != nil || base <= leaderLength || base > len(data) {
+		return Record{}, fmt.Errorf("%w: bad base address of data", ErrInvalidRecord)
+	}
+	record := Record{Leader: leader}
+	directory := data[leaderLength : base-1]
+	for i := 0; i+directoryEntryLength <= len(directory); i += directoryEntryLength {
+		entry := string(directory[i : i+directoryEntryLength])
+		tag := entry[:3]
+		length, lengthErr := strconv.Atoi(entry[3:7])
+		start, startErr := strconv.Atoi(entry[7:12])
+		if lengthErr != nil || startErr != nil || base+start+length > len(data) {
+			return Record{}, fmt.Errorf("%w: bad directory entry for tag %s", ErrInvalidRecord, tag)
+		}
+		content := bytes.TrimRight(data[base+start:base+start+length], string([]byte{fieldTerminator}))
+		record.Fields = append(record.Fields, parseField(tag, content))
+	}
+	return record, nil
+}
+
+// parseField returns the field with the tag encoded in content
+func parseField(tag string, content []byte) Field {
+	if isControlTag(tag) {
+		return Field{Tag: tag, Value: string(content)}
+	}
+	field := Field{Tag: tag}
+	parts := bytes.Split(content, []byte{subfieldDelimiter})
+	field.Indicators = string(parts[0])
+	for _, part := range parts[1:] {
+		if len(part) > 0 {
+			field.Subfields = append(field.Subfields, Subfield{Code: string(part[:1]), Value: string(part[1:])})
+		}
+	}
+	return field
+}
+
+// isControlTag returns if the tag is of a control field, i.e. 001 to 009
+func isControlTag(tag string) bool {
+	return len(tag) == 3 && tag[0] == '0' && tag[1] == '0'
+}
+
+// record returns the record of a MARCXML record
+func (xr xmlRecord) record() Record {
+	record := Record{Leader: xr.Leader}
+	for _, cf := range xr.ControlFields {
+		record.Fields = append(record.Fields, Field{Tag: cf.Tag, Value: cf.Value})
+	}
+	for _, df := range xr.DataFields {
+		field := Field{Tag: df.Tag, Indicators: df.Ind1 + df.Ind2}
+		for _, sf := range df.Subfields {
+			field.Subfields = append(field.Subfields, Subfield{Code: sf.Code, Value: sf.Value})
+		}
+		record.Fields = append(record.Fields, field)
+	}
+	return record
+}
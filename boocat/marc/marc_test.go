@@ -0,0 +1,169 @@
+package marc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/internal/teststore"
+)
+
+// marcXML is a MARCXML collection with a record for testing
+const marcXML = `<?xml version="1.0" encoding="UTF-8"?>
+<collection xmlns="http://www.loc.gov/MARC21/slim">
+  <record>
+    <leader>00000nam a2200000 a 4500</leader>
+    <controlfield tag="001">42</controlfield>
+    <datafield tag="100" ind1="1" ind2=" ">
+      <subfield code="a">Orwell, George,</subfield>
+      <subfield code="d">1903-1950.</subfield>
+    </datafield>
+    <datafield tag="245" ind1="1" ind2="0">
+      <subfield code="a">Nineteen Eighty-Four /</subfield>
+      <subfield code="c">George Orwell.</subfield>
+    </datafield>
+    <datafield tag="260" ind1=" " ind2=" ">
+      <subfield code="a">London :</subfield>
+      <subfield code="b">Secker &amp; Warburg,</subfield>
+      <subfield code="c">1949.</subfield>
+    </datafield>
+    <datafield tag="520" ind1=" " ind2=" ">
+      <subfield code="a">Dystopia</subfield>
+    </datafield>
+  </record>
+</collection>`
+
+// TestReadBinary tests reading binary MARC21 records with Reader
+func TestReadBinary(t *testing.T) {
+	data := binaryRecord([][2]string{
+		{"001", "42"},
+		{"100", "1 \x1faOrwell, George,\x1fd1903-1950."},
+		{"245", "10\x1faAnimal Farm :\x1fba fairy story /\x1fcGeorge Orwell."},
+		{"264", " 1\x1faLondon :\x1fbSecker and Warburg,\x1fc1945."},
+	})
+	records, err := NewReader(bytes.NewReader(append(data, data...))).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("unexpected number of records: %v", len(records))
+	}
+	if !reflect.DeepEqual(records[0].Fields[0], Field{Tag: "001", Value: "42"}) {
+		t.Errorf("unexpected control field: %v", records[0].Fields[0])
+	}
+	if !reflect.DeepEqual(records[0].Fields[1], Field{
+		Tag:        "100",
+		Indicators: "1 ",
+		Subfields:  []Subfield{{Code: "a", Value: "Orwell, George,"}, {Code: "d", Value: "1903-1950."}},
+	}) {
+		t.Errorf("unexpected data field: %v", records[0].Fields[1])
+	}
+	if book := BookFromRecord(records[1]); !reflect.DeepEqual(book, Book{
+		Title:  "Animal Farm: a fairy story",
+		Author: "George Orwell",
+		Year:   "1945",
+	}) {
+		t.Errorf("unexpected book: %v", book)
+	}
+}
+
+// TestReadBinaryInvalid tests reading a record that isn't well formed with Reader
+func TestReadBinaryInvalid(t *testing.T) {
+	_, err := NewReader(strings.NewReader("00042nam\x1d")).Read()
+	if err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+// TestReadXML tests reading a MARCXML collection with ReadXML
+func TestReadXML(t *testing.T) {
+	records, err := ReadXML(strings.NewReader(marcXML))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("unexpected number of records: %v", len(records))
+	}
+	if book := BookFromRecord(records[0]); !reflect.DeepEqual(book, Book{
+		Title:   "Nineteen Eighty-Four",
+		Author:  "George Orwell",
+		Year:    "1949",
+		Summary: "Dystopia",
+	}) {
+		t.Errorf("unexpected book: %v", book)
+	}
+}
+
+// TestPublicationYear tests taking the year of publication only from the 264 fields of the publication
+func TestPublicationYear(t *testing.T) {
+	record := Record{Fields: []Field{
+		{Tag: "264", Indicators: " 4", Subfields: []Subfield{{Code: "c", Value: "©1944"}}},
+		{Tag: "264", Indicators: " 1", Subfields: []Subfield{{Code: "a", Value: "London"}, {Code: "c", Value: "1945."}}},
+	}}
+	if year := BookFromRecord(record).Year; year != "1945" {
+		t.Errorf("unexpected year: %v", year)
+	}
+	record.Fields = record.Fields[:1]
+	if year := BookFromRecord(record).Year; year != "" {
+		t.Errorf("unexpected year of copyright: %v", year)
+	}
+}
+
+// TestImportFailedBook tests that importing a book that fails validation doesn't leave its new author behind
+func TestImportFailedBook(t *testing.T) {
+	bc, _ := teststore.NewBoocat(
+		boocat.Format{Name: authorFormat, Fields: map[string]boocat.Validate{"name": nil}, Display: "name"},
+		boocat.Format{Name: bookFormat, Fields: map[string]boocat.Validate{
+			"name":     nil,
+			"author":   nil,
+			"synopsis": nil,
+			"year": func(_ context.Context, value interface{}) string {
+				if value != "1949" {
+					return "not 1949"
+				}
+				return ""
+			},
+		}, References: map[string]string{"author": authorFormat}},
+	)
+	records := []Record{
+		{Fields: []Field{
+			{Tag: "100", Subfields: []Subfield{{Code: "a", Value: "Huxley, Aldous"}}},
+			{Tag: "245", Subfields: []Subfield{{Code: "a", Value: "Brave New World"}}},
+			{Tag: "260", Subfields: []Subfield{{Code: "c", Value: "1932"}}},
+		}},
+		{Fields: []Field{
+			{Tag: "100", Subfields: []Subfield{{Code: "a", Value: "Orwell, George"}}},
+			{Tag: "245", Subfields: []Subfield{{Code: "a", Value: "Nineteen Eighty-Four"}}},
+			{Tag: "260", Subfields: []Subfield{{Code: "c", Value: "1949"}}},
+		}},
+	}
+	report := NewImporter(bc).Import(context.Background(), records)
+	if report.Books != 1 || report.Authors != 1 || len(report.Failures) != 1 ||
+		!reflect.DeepEqual(report.Failures[0], Failure{Position: 1, Title: "Brave New World", Format: bookFormat,
+			Failed: map[string]string{"year": "not 1949"}}) {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	authors, err := bc.AllRecords(context.Background(), authorFormat)
+	if err != nil || len(authors) != 1 || authors[0]["name"] != "George Orwell" {
+		t.Errorf("unexpected authors: %v, %v", authors, err)
+	}
+}
+
+// binaryRecord returns the binary encoding of a record with the tags and contents of the fields
+func binaryRecord(fields [][2]string) []byte {
+	var directory, data bytes.Buffer
+	for _, field := range fields {
+		content := field[1] + string(rune(fieldTerminator))
+		directory.WriteString(fmt.Sprintf("%s%04d%05d", field[0], len(content), data.Len()))
+		data.WriteString(content)
+	}
+	directory.WriteByte(fieldTerminator)
+	base := leaderLength + directory.Len()
+	length := base + data.Len() + 1
+	leader := fmt.Sprintf("%05dnam a22%05d a 4500", length, base)
+	return []byte(leader + directory.String() + data.String() + string(rune(recordTerminator)))
+}
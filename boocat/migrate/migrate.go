@@ -0,0 +1,166 @@
+package migrate
+
+// Implements versioned migrations of the records of formats. Migrations are applied in order of version, and the
+// versions already applied are recorded so that every migration is applied only once.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/ivanmartinez/boocat/boocat"
+)
+
+// Migration is a versioned set of changes of records
+type Migration struct {
+	// Version of the migration. Migrations are applied in increasing order of version.
+	Version int
+	// Human readable description of the migration
+	Description string
+	// Steps of the migration, applied in order
+	Steps []Step
+}
+
+// Step changes the records of a format
+type Step struct {
+	// Name of the format of the records that are changed
+	FormatName string
+	// Change changes a record and returns if it was changed
+	Change func(record map[string]string) bool
+}
+
+// State stores which migrations have been applied
+type State interface {
+	// AppliedMigrations returns the versions of the applied migrations
+	AppliedMigrations(ctx context.Context) ([]int, error)
+	// AddAppliedMigration records that the migration with the version has been applied
+	AddAppliedMigration(ctx context.Context, version int, description string) error
+}
+
+// Options of a migration run
+type Options struct {
+	// DryRun applies the migrations without storing the changed records or the migration state
+	DryRun bool
+}
+
+// Result is the result of applying a migration
+type Result struct {
+	Version     int
+	Description string
+	// Number of records changed per format name
+	Changed map[string]int
+}
+
+// store is where migrations read and write records
+type store interface {
+	AllRecords(ctx context.Context, formatName string) ([]map[string]string, error)
+	RestoreRecord(ctx context.Context, formatName string, record map[string]string) error
+}
+
+// Migrate applies the migrations that haven't been applied yet to the records of bc, in order of version, and returns
+// their results. Changed records are stored without validation, so that steps don't need to leave valid records.
+// A migration is recorded as applied once all the records it changed are stored.
+func Migrate(ctx context.Context, bc *boocat.Boocat, state State, migrations []Migration, options Options) (
+	[]Result, error) {
+	return migrate(ctx, bc, state, migrations, options)
+}
+
+// migrate applies the pending migrations to the records of s
+func migrate(ctx context.Context, s store, state State, migrations []Migration, options Options) ([]Result, error) {
+	pending, err := Pending(ctx, state, migrations)
+	if err != nil {
+		return nil, err
+	}
+	// Records by format, as changed by the previous migrations
+	records := make(map[string][]map[string]string)
+	results := make([]Result, 0, len(pending))
+	for _, migration := range pending {
+		changed := make(map[string]map[string]map[string]string)
+		for _, step := range migration.Steps {
+			if _, loaded := records[step.FormatName]; !loaded {
+				loadedRecords, err := loadRecords(ctx, s, step.FormatName)
+				if err != nil {
+					return results, fmt.Errorf("migration %d: %w", migration.Version, err)
+				}
+				records[step.FormatName] = loadedRecords
+			}
+			for _, record := range records[step.FormatName] {
+				if step.Change(record) {
+					if changed[step.FormatName] == nil {
+						changed[step.FormatName] = make(map[string]map[string]string)
+					}
+					changed[step.FormatName][record["id"]] = record
+				}
+			}
+		}
+		result := Result{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Changed:     make(map[string]int, len(changed)),
+		}
+		for formatName, changedRecords := range changed {
+			result.Changed[formatName] = len(changedRecords)
+			if options.DryRun {
+				continue
+			}
+			for _, record := range changedRecords {
+				if err := s.RestoreRecord(ctx, formatName, record); err != nil {
+					return results, fmt.Errorf("migration %d: storing record '%s' of format '%s': %w",
+						migration.Version, record["id"], formatName, err)
+				}
+			}
+		}
+		if !options.DryRun {
+			if err := state.AddAppliedMigration(ctx, migration.Version, migration.Description); err != nil {
+				return results, fmt.Errorf("migration %d: recording migration: %w", migration.Version, err)
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Pending returns the migrations that haven't been applied, sorted by version. Versions must be unique.
+func Pending(ctx context.Context, state State, migrations []Migration) ([]Migration, error) {
+	applied, err := state.AppliedMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting applied migrations: %w", err)
+	}
+	appliedSet := make(map[int]struct{}, len(applied))
+	for _, version := range applied {
+		appliedSet[version] = struct{}{}
+	}
+	versions := make(map[int]struct{}, len(migrations))
+	pending := make([]Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		if _, found := versions[migration.Version]; found {
+			return nil, fmt.Errorf("more than one migration with version %d", migration.Version)
+		}
+		versions[migration.Version] = struct{}{}
+		if _, found := appliedSet[migration.Version]; !found {
+			pending = append(pending, migration)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Version < pending[j].Version
+	})
+	return pending, nil
+}
+
+// loadRecords returns copies of all the records of the format, including the ones in the trash so that they are
+// migrated too, and copied so that they can be changed in dry runs
+func loadRecords(ctx context.Context, s store, formatName string) ([]map[string]string, error) {
+	records, err := s.AllRecords(ctx, formatName)
+	if err != nil {
+		return nil, fmt.Errorf("getting records of format '%s': %w", formatName, err)
+	}
+	copies := make([]map[string]string, 0, len(records))
+	for _, record := range records {
+		copied := make(map[string]string, len(record))
+		for field, value := range record {
+			copied[field] = value
+		}
+		copies = append(copies, copied)
+	}
+	return copies, nil
+}
@@ -0,0 +1,144 @@
+package migrate
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/internal/teststore"
+)
+
+// mockState stores the applied migrations in memory
+type mockState struct {
+	applied []int
+}
+
+// AppliedMigrations returns the versions of the applied migrations
+func (s *mockState) AppliedMigrations(_ context.Context) ([]int, error) {
+	return s.applied, nil
+}
+
+// AddAppliedMigration records that the migration with the version has been applied
+func (s *mockState) AddAppliedMigration(_ context.Context, version int, _ string) error {
+	s.applied = append(s.applied, version)
+	return nil
+}
+
+// TestMigrate tests successfully applying the pending migrations in order of version
+func TestMigrate(t *testing.T) {
+	s := initializedStore()
+	state := &mockState{applied: []int{1}}
+	results, err := migrate(context.Background(), s, state, testMigrations(), Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(results, []Result{
+		{Version: 2, Description: "rename synopsys", Changed: map[string]int{"book": 2}},
+		{Version: 3, Description: "default year", Changed: map[string]int{"book": 1}},
+	}) {
+		t.Errorf("unexpected results: %v", results)
+	}
+	if !reflect.DeepEqual(state.applied, []int{1, 2, 3}) {
+		t.Errorf("unexpected applied migrations: %v", state.applied)
+	}
+	if record, _ := s.GetRecord(context.Background(), "book", "0"); !reflect.DeepEqual(record, map[string]string{
+		"id": "0", "name": "Animal Farm", "year": "1945", "synopsis": "fable",
+	}) {
+		t.Errorf("unexpected record: %v", record)
+	}
+	if record, _ := s.GetRecord(context.Background(), "book", "2"); !reflect.DeepEqual(record, map[string]string{
+		"id": "2", "name": "Norwegian Wood", "year": "unknown", "synopsis": "novel",
+	}) {
+		t.Errorf("unexpected record: %v", record)
+	}
+}
+
+// TestMigrateDryRun tests applying migrations without storing the records or the state
+func TestMigrateDryRun(t *testing.T) {
+	s := initializedStore()
+	state := &mockState{}
+	results, err := migrate(context.Background(), s, state, testMigrations(), Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 3 {
+		t.Errorf("unexpected results: %v", results)
+	}
+	if len(state.applied) != 0 {
+		t.Errorf("unexpected applied migrations: %v", state.applied)
+	}
+	if record, _ := s.GetRecord(context.Background(), "book", "0"); record["synopsys"] != "fable" {
+		t.Errorf("record changed: %v", record)
+	}
+}
+
+// TestPendingDuplicateVersion tests getting the pending migrations when two have the same version
+func TestPendingDuplicateVersion(t *testing.T) {
+	migrations := append(testMigrations(), Migration{Version: 2})
+	if _, err := Pending(context.Background(), &mockState{}, migrations); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+// TestSplitAndMergeFields tests the steps that split and merge fields
+func TestSplitAndMergeFields(t *testing.T) {
+	record := map[string]string{"name": "George Orwell"}
+	split := SplitField("author", "name", []string{"first", "last"}, func(value string) []string {
+		return strings.SplitN(value, " ", 2)
+	})
+	if !split.Change(record) || !reflect.DeepEqual(record, map[string]string{"first": "George", "last": "Orwell"}) {
+		t.Errorf("unexpected split record: %v", record)
+	}
+	merge := MergeFields("author", []string{"last", "first"}, "name", func(values []string) string {
+		return strings.Join(values, ", ")
+	})
+	if !merge.Change(record) || !reflect.DeepEqual(record, map[string]string{"name": "Orwell, George"}) {
+		t.Errorf("unexpected merged record: %v", record)
+	}
+}
+
+// TestTransformField tests the step that transforms the values of a field
+func TestTransformField(t *testing.T) {
+	transform := TransformField("author", "name", strings.ToUpper)
+	record := map[string]string{"name": "George Orwell"}
+	if !transform.Change(record) || record["name"] != "GEORGE ORWELL" {
+		t.Errorf("unexpected record: %v", record)
+	}
+	if transform.Change(record) {
+		t.Errorf("unchanged record reported as changed")
+	}
+}
+
+// testMigrations returns migrations for testing, not sorted by version
+func testMigrations() []Migration {
+	return []Migration{
+		{
+			Version:     3,
+			Description: "default year",
+			Steps:       []Step{AddField("book", "year", "unknown")},
+		},
+		{
+			Version:     1,
+			Description: "uppercase names",
+			Steps:       []Step{TransformField("book", "name", strings.ToUpper)},
+		},
+		{
+			Version:     2,
+			Description: "rename synopsys",
+			Steps:       []Step{RenameField("book", "synopsys", "synopsis")},
+		},
+	}
+}
+
+// initializedStore returns a boocat with records for testing
+func initializedStore() *boocat.Boocat {
+	db := teststore.NewDB()
+	bc := db.Boocat(teststore.Book(db.ReferenceValidator))
+	db.Restore("book",
+		map[string]string{"id": "0", "name": "Animal Farm", "year": "1945", "synopsys": "fable"},
+		map[string]string{"id": "1", "name": "Nineteen Eighty-Four", "year": "1949", "synopsys": "dystopia"},
+		map[string]string{"id": "2", "name": "Norwegian Wood", "synopsis": "novel"})
+	return bc
+}
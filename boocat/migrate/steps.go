@@ -0,0 +1,110 @@
+package migrate
+
+// Implements the common steps of migrations. Records don't have empty fields, so steps remove the fields they leave
+// empty.
+
+// RenameField returns a step that renames a field of the records of the format. If a record already has a value in
+// the new field, that value is kept and the old field is removed.
+func RenameField(formatName, from, to string) Step {
+	return Step{
+		FormatName: formatName,
+		Change: func(record map[string]string) bool {
+			value, found := record[from]
+			if !found {
+				return false
+			}
+			delete(record, from)
+			if record[to] == "" {
+				record[to] = value
+			}
+			return true
+		},
+	}
+}
+
+// AddField returns a step that sets a value to a field of the records of the format that don't have it
+func AddField(formatName, field, value string) Step {
+	return Step{
+		FormatName: formatName,
+		Change: func(record map[string]string) bool {
+			if record[field] != "" || value == "" {
+				return false
+			}
+			record[field] = value
+			return true
+		},
+	}
+}
+
+// SplitField returns a step that splits the value of a field of the records of the format into several fields. The
+// split function returns the values of the fields in the same order as into. Missing values leave their fields
+// unchanged. The split field is removed unless it's one of the fields split into.
+func SplitField(formatName, field string, into []string, split func(value string) []string) Step {
+	return Step{
+		FormatName: formatName,
+		Change: func(record map[string]string) bool {
+			value, found := record[field]
+			if !found {
+				return false
+			}
+			delete(record, field)
+			for i, splitValue := range split(value) {
+				if i < len(into) && splitValue != "" {
+					record[into[i]] = splitValue
+				}
+			}
+			return true
+		},
+	}
+}
+
+// MergeFields returns a step that merges the values of fields of the records of the format into a field. The merge
+// function gets the values in the same order as fields, with the empty string for missing ones. The merged fields
+// are removed unless one of them is the field merged into.
+func MergeFields(formatName string, fields []string, into string, merge func(values []string) string) Step {
+	return Step{
+		FormatName: formatName,
+		Change: func(record map[string]string) bool {
+			values := make([]string, len(fields))
+			found := false
+			for i, field := range fields {
+				values[i] = record[field]
+				if values[i] != "" {
+					found = true
+				}
+				delete(record, field)
+			}
+			if !found {
+				return false
+			}
+			if merged := merge(values); merged != "" {
+				record[into] = merged
+			}
+			return true
+		},
+	}
+}
+
+// TransformField returns a step that replaces the values of a field of the records of the format with the values
+// returned by transform. The field is removed if transform returns the empty string.
+func TransformField(formatName, field string, transform func(value string) string) Step {
+	return Step{
+		FormatName: formatName,
+		Change: func(record map[string]string) bool {
+			value, found := record[field]
+			if !found {
+				return false
+			}
+			transformed := transform(value)
+			if transformed == value {
+				return false
+			}
+			if transformed == "" {
+				delete(record, field)
+			} else {
+				record[field] = transformed
+			}
+			return true
+		},
+	}
+}
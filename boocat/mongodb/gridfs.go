@@ -0,0 +1,147 @@
+package mongodb
+
+// Implements a store of blobs in MongoDB GridFS
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/ivanmartinez/boocat/boocat/blob"
+)
+
+// Name of the GridFS bucket of the blobs
+const blobsBucket = "blobs"
+
+// gridFSStore stores every blob as a GridFS file whose ID is its key
+type gridFSStore struct {
+	bucket *gridfs.Bucket
+}
+
+// blobMetadata is the metadata of the GridFS file of a blob
+type blobMetadata struct {
+	Name        string `bson:"name"`
+	ContentType string `bson:"contentType"`
+}
+
+// gridFSBlob is a blob stored in GridFS. GridFS streams can only be read forward, so seeking backwards opens the file
+// again. Seeking is deferred until the next read, so that getting the size by seeking to the end is free.
+type gridFSBlob struct {
+	bucket *gridfs.Bucket
+	key    string
+	size   int64
+	stream *gridfs.DownloadStream
+	// Position of the stream, and the position to read from next
+	streamPosition int64
+	position       int64
+}
+
+// BlobStore returns a store of blobs in a GridFS bucket of the database
+func (db *mongoDB) BlobStore() (blob.Store, error) {
+	bucket, err := gridfs.NewBucket(db.client.Database(dbName), options.GridFSBucket().SetName(blobsBucket))
+	if err != nil {
+		return nil, err
+	}
+	return &gridFSStore{bucket: bucket}, nil
+}
+
+// Put stores a blob with the key, replacing the blob with that key if there is one
+func (s *gridFSStore) Put(ctx context.Context, key string, info blob.Info, r io.Reader) error {
+	if !blob.ValidKey(key) {
+		return blob.ErrInvalidKey
+	}
+	if err := s.Delete(ctx, key); err != nil && !errors.Is(err, blob.ErrNotFound) {
+		return err
+	}
+	metadata := blobMetadata{Name: info.Name, ContentType: info.ContentType}
+	return s.bucket.UploadFromStreamWithID(key, key, r, options.GridFSUpload().SetMetadata(metadata))
+}
+
+// Get returns the blob with the key and its info
+func (s *gridFSStore) Get(_ context.Context, key string) (blob.Blob, blob.Info, error) {
+	stream, err := s.bucket.OpenDownloadStream(key)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, blob.Info{}, blob.ErrNotFound
+	}
+	if err != nil {
+		return nil, blob.Info{}, err
+	}
+	file := stream.GetFile()
+	var metadata blobMetadata
+	if file.Metadata != nil {
+		if err := bson.Unmarshal(file.Metadata, &metadata); err != nil {
+			stream.Close()
+			return nil, blob.Info{}, err
+		}
+	}
+	info := blob.Info{
+		Name:        metadata.Name,
+		ContentType: metadata.ContentType,
+		Size:        file.Length,
+		ModTime:     file.UploadDate,
+	}
+	return &gridFSBlob{bucket: s.bucket, key: key, size: file.Length, stream: stream}, info, nil
+}
+
+// Delete deletes the blob with the key
+func (s *gridFSStore) Delete(_ context.Context, key string) error {
+	err := s.bucket.Delete(key)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return blob.ErrNotFound
+	}
+	return err
+}
+
+// Read reads from the current position
+func (b *gridFSBlob) Read(p []byte) (int, error) {
+	if b.position < b.streamPosition {
+		b.stream.Close()
+		stream, err := b.bucket.OpenDownloadStream(b.key)
+		if err != nil {
+			return 0, err
+		}
+		b.stream, b.streamPosition = stream, 0
+	}
+	if b.position > b.streamPosition {
+		// Read and discard instead of DownloadStream.Skip, which can skip whole chunks when skipping part of one
+		skipped, err := io.CopyN(ioutil.Discard, b.stream, b.position-b.streamPosition)
+		b.streamPosition += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.stream.Read(p)
+	b.streamPosition += int64(n)
+	b.position = b.streamPosition
+	return n, err
+}
+
+// Seek sets the position of the next read
+func (b *gridFSBlob) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = b.position + offset
+	case io.SeekEnd:
+		position = b.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if position < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.position = position
+	return position, nil
+}
+
+// Close closes the stream
+func (b *gridFSBlob) Close() error {
+	return b.stream.Close()
+}
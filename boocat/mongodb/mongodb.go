@@ -4,7 +4,12 @@ package mongodb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -17,15 +22,31 @@ import (
 
 const (
 	dbName = "boocat"
+	// Prefix of the names of the unique indexes
+	uniqueIndexPrefix = "unique_"
+	// Suffix of the names of the unique indexes
+	uniqueIndexSuffix = "_untrashed"
+	// Error code of MongoDB for duplicate keys in unique indexes
+	duplicateKeyCode = 11000
+	// Name of the collection with the applied migrations
+	migrationsCollection = "_migrations"
+	// Name of the collection with the definitions of the formats defined at runtime
+	formatsCollection = "_formats"
 )
 
 // mongoDB is the client side definition of a MongoDB database
 type mongoDB struct {
 	// MongoDB client
 	client *mongo.Client
+	// mutex protects the maps of collections, unique indexes and formats, which can change while serving requests
+	mutex sync.RWMutex
 	// Map of collections. Every collection contains the records of a format
 	// (author, book...)
 	collections map[string]*mongo.Collection
+	// Map of the unique indexes of every collection by name, with the fields of every index
+	uniqueIndexes map[string]map[string][]string
+	// Map of formats by name, used to store list fields as arrays
+	formats map[string]boocat.Format
 }
 
 // Name and fields of a collection text index
@@ -50,40 +71,71 @@ func NewMongoDB(ctx context.Context, dbURI *string) (*mongoDB, error) {
 
 // InitializeCollections initializes the collections and sets indexes accordingly to the formats
 func (db *mongoDB) InitializeCollections(ctx context.Context, formats map[string]boocat.Format) error {
-	db3 := db.client.Database(dbName)
-	collections := make(map[string]*mongo.Collection, len(formats))
+	db.mutex.Lock()
+	db.collections = make(map[string]*mongo.Collection, len(formats))
+	db.uniqueIndexes = make(map[string]map[string][]string, len(formats))
+	db.formats = make(map[string]boocat.Format, len(formats))
+	db.mutex.Unlock()
 	for _, format := range formats {
-		collection := db3.Collection(format.Name)
-		collections[format.Name] = collection
-		indexes := collection.Indexes()
-		index, err := findTextIndex(ctx, indexes)
-		if err != nil {
+		if err := db.InitializeCollection(ctx, format); err != nil {
 			return err
 		}
-		if index != nil {
-			// If the fields of the index don't match the searchable fields of the format
-			if !format.SearchableAre(index.fields) {
-				// Re-create the index with the format's searchable fields
-				if _, err := indexes.DropOne(ctx, index.name); err != nil {
-					return fmt.Errorf("dropping existing index: %w", err)
-				}
-				indexModel := textIndexModel(format)
-				if _, err := indexes.CreateOne(ctx, indexModel); err != nil {
+	}
+	return nil
+}
+
+// InitializeCollection initializes the collection of a format, creating it if it doesn't exist, and sets its indexes
+// accordingly to the format
+func (db *mongoDB) InitializeCollection(ctx context.Context, format boocat.Format) error {
+	collection := db.client.Database(dbName).Collection(format.Name)
+	indexes := collection.Indexes()
+	index, err := findTextIndex(ctx, indexes)
+	if err != nil {
+		return err
+	}
+	if index != nil {
+		// If the fields of the index don't match the searchable fields of the format
+		if !format.SearchableAre(index.fields) {
+			// Re-create the index with the format's searchable fields
+			if _, err := indexes.DropOne(ctx, index.name); err != nil {
+				return fmt.Errorf("dropping existing index: %w", err)
+			}
+			if len(format.Searchable) > 0 {
+				if _, err := indexes.CreateOne(ctx, textIndexModel(format)); err != nil {
 					return fmt.Errorf("creating new index: %w", err)
 				}
 			}
-		} else {
-			indexModel := textIndexModel(format)
-			if _, err := indexes.CreateOne(ctx, indexModel); err != nil {
-				return fmt.Errorf("creating new index: %w", err)
-			}
+		}
+	} else if len(format.Searchable) > 0 {
+		if _, err := indexes.CreateOne(ctx, textIndexModel(format)); err != nil {
+			return fmt.Errorf("creating new index: %w", err)
 		}
 	}
-	db.collections = collections
-
+	uniqueIndexes, err := initializeUniqueIndexes(ctx, indexes, format)
+	if err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.collections == nil {
+		db.collections = make(map[string]*mongo.Collection)
+		db.uniqueIndexes = make(map[string]map[string][]string)
+		db.formats = make(map[string]boocat.Format)
+	}
+	db.collections[format.Name] = collection
+	db.uniqueIndexes[format.Name] = uniqueIndexes
+	db.formats[format.Name] = format
 	return nil
 }
 
+// collection returns the collection of the format, and if it's found
+func (db *mongoDB) collection(formatName string) (*mongo.Collection, bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	collection, found := db.collections[formatName]
+	return collection, found
+}
+
 // Disconnect disconnects the database
 func (db *mongoDB) Disconnect(ctx context.Context) error {
 	return db.client.Disconnect(ctx)
@@ -94,13 +146,13 @@ func (db *mongoDB) AddRecord(ctx context.Context, formatName string, record map[
 	if _, found := record["id"]; found {
 		return "", bcerrors.ErrRecordHasID
 	}
-	col, found := db.collections[formatName]
+	col, found := db.collection(formatName)
 	if !found {
 		return "", bcerrors.ErrFormatNotFound
 	}
-	res, err := col.InsertOne(ctx, record)
+	res, err := col.InsertOne(ctx, db.recordToDocument(formatName, record))
 	if err != nil {
-		return "", err
+		return "", db.duplicateError(formatName, err)
 	}
 	return res.InsertedID.(primitive.ObjectID).Hex(), err
 }
@@ -111,16 +163,14 @@ func (db *mongoDB) UpdateRecord(ctx context.Context, formatName string, record m
 	if id == "" {
 		return bcerrors.ErrRecordDoesntHaveID
 	}
-	col, found := db.collections[formatName]
+	col, found := db.collection(formatName)
 	if !found {
 		return bcerrors.ErrFormatNotFound
 	}
-	// Get ObjectID as used by MongoDB
-	objectID, _ := primitive.ObjectIDFromHex(id)
-	result, err := col.ReplaceOne(ctx, bson.M{"_id": objectID},
-		fields)
+	result, err := col.ReplaceOne(ctx, bson.M{"_id": documentID(id)},
+		db.recordToDocument(formatName, fields))
 	if err != nil {
-		return err
+		return db.duplicateError(formatName, err)
 	}
 	if result.MatchedCount != 1 {
 		return bcerrors.ErrRecordNotFound
@@ -128,16 +178,45 @@ func (db *mongoDB) UpdateRecord(ctx context.Context, formatName string, record m
 	return nil
 }
 
+// RestoreRecord stores a record of the format with its id, replacing the record with that id if there is one
+func (db *mongoDB) RestoreRecord(ctx context.Context, formatName string, record map[string]string) error {
+	id, fields := splitID(record)
+	if id == "" {
+		return bcerrors.ErrRecordDoesntHaveID
+	}
+	col, found := db.collection(formatName)
+	if !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	_, err := col.ReplaceOne(ctx, bson.M{"_id": documentID(id)}, db.recordToDocument(formatName, fields),
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// DeleteRecord deletes the record of the format with the id
+func (db *mongoDB) DeleteRecord(ctx context.Context, formatName, id string) error {
+	col, found := db.collection(formatName)
+	if !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	result, err := col.DeleteOne(ctx, bson.M{"_id": documentID(id)})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount != 1 {
+		return bcerrors.ErrRecordNotFound
+	}
+	return nil
+}
+
 // GetRecord returns the record of the format with the id
 func (db *mongoDB) GetRecord(ctx context.Context, formatName, id string) (map[string]string, error) {
-	col, found := db.collections[formatName]
+	col, found := db.collection(formatName)
 	if !found {
 		return nil, bcerrors.ErrFormatNotFound
 	}
-	// Get ObjectID as used by MongoDB
-	objectID, _ := primitive.ObjectIDFromHex(id)
-	var document map[string]string
-	err := col.FindOne(ctx, bson.M{"_id": objectID}).Decode(&document)
+	var document bson.M
+	err := col.FindOne(ctx, bson.M{"_id": documentID(id)}).Decode(&document)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, bcerrors.ErrRecordNotFound
@@ -149,7 +228,7 @@ func (db *mongoDB) GetRecord(ctx context.Context, formatName, id string) (map[st
 
 // GetAllRecords returns all records of a specific format from the database
 func (db *mongoDB) GetAllRecords(ctx context.Context, formatName string) ([]map[string]string, error) {
-	col, found := db.collections[formatName]
+	col, found := db.collection(formatName)
 	if !found {
 		return nil, bcerrors.ErrFormatNotFound
 	}
@@ -157,7 +236,7 @@ func (db *mongoDB) GetAllRecords(ctx context.Context, formatName string) ([]map[
 	if err != nil {
 		return nil, err
 	}
-	var documents []map[string]string
+	var documents []bson.M
 	if err = cursor.All(ctx, &documents); err != nil {
 		return nil, err
 	}
@@ -166,7 +245,7 @@ func (db *mongoDB) GetAllRecords(ctx context.Context, formatName string) ([]map[
 
 // SearchRecord returns all records the format that have the value in their searchable fields
 func (db *mongoDB) SearchRecord(ctx context.Context, formatName, value string) ([]map[string]string, error) {
-	col, found := db.collections[formatName]
+	col, found := db.collection(formatName)
 	if !found {
 		return nil, bcerrors.ErrFormatNotFound
 	}
@@ -174,13 +253,117 @@ func (db *mongoDB) SearchRecord(ctx context.Context, formatName, value string) (
 	if err != nil {
 		return nil, err
 	}
-	var documents []map[string]string
+	var documents []bson.M
 	if err = cursor.All(context.TODO(), &documents); err != nil {
 		return nil, err
 	}
 	return documentsToRecords(documents), nil
 }
 
+// FilterRecords returns all records of the format whose fields have the values in equal
+func (db *mongoDB) FilterRecords(ctx context.Context, formatName string, equal map[string]string) (
+	[]map[string]string, error) {
+	col, found := db.collection(formatName)
+	if !found {
+		return nil, bcerrors.ErrFormatNotFound
+	}
+	filter := make(bson.M, len(equal))
+	for field, value := range equal {
+		filter[field] = value
+	}
+	cursor, err := col.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var documents []bson.M
+	if err = cursor.All(ctx, &documents); err != nil {
+		return nil, err
+	}
+	return documentsToRecords(documents), nil
+}
+
+// PrefixRecords returns up to limit records of the format whose field starts with prefix, case-insensitive, sorted by
+// that field
+func (db *mongoDB) PrefixRecords(ctx context.Context, formatName, field, prefix string, limit int) (
+	[]map[string]string, error) {
+	col, found := db.collection(formatName)
+	if !found {
+		return nil, bcerrors.ErrFormatNotFound
+	}
+	filter := bson.M{field: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix), Options: "i"}}
+	opts := options.Find().SetSort(bson.M{field: 1}).SetLimit(int64(limit))
+	cursor, err := col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var documents []bson.M
+	if err = cursor.All(ctx, &documents); err != nil {
+		return nil, err
+	}
+	return documentsToRecords(documents), nil
+}
+
+// formatDocument is the document of a format definition
+type formatDocument struct {
+	Name       string            `bson:"_id"`
+	Fields     map[string]string `bson:"fields"`
+	Searchable []string          `bson:"searchable"`
+	Display    string            `bson:"display"`
+}
+
+// GetFormatDefinitions returns the stored definitions of the formats defined at runtime
+func (db *mongoDB) GetFormatDefinitions(ctx context.Context) ([]boocat.FormatDefinition, error) {
+	cursor, err := db.client.Database(dbName).Collection(formatsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var docs []formatDocument
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	definitions := make([]boocat.FormatDefinition, 0, len(docs))
+	for _, doc := range docs {
+		definitions = append(definitions, boocat.FormatDefinition(doc))
+	}
+	return definitions, nil
+}
+
+// SaveFormatDefinition stores the definition of a format defined at runtime, replacing the one with the same name
+func (db *mongoDB) SaveFormatDefinition(ctx context.Context, definition boocat.FormatDefinition) error {
+	_, err := db.client.Database(dbName).Collection(formatsCollection).ReplaceOne(ctx,
+		bson.M{"_id": definition.Name}, formatDocument(definition), options.Replace().SetUpsert(true))
+	return err
+}
+
+// AppliedMigrations returns the versions of the applied migrations
+func (db *mongoDB) AppliedMigrations(ctx context.Context) ([]int, error) {
+	cursor, err := db.client.Database(dbName).Collection(migrationsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		Version int `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	versions := make([]int, 0, len(docs))
+	for _, doc := range docs {
+		versions = append(versions, doc.Version)
+	}
+	return versions, nil
+}
+
+// AddAppliedMigration records that the migration with the version has been applied, and when
+func (db *mongoDB) AddAppliedMigration(ctx context.Context, version int, description string) error {
+	_, err := db.client.Database(dbName).Collection(migrationsCollection).InsertOne(ctx, bson.M{
+		"_id":         version,
+		"description": description,
+		"applied":     time.Now(),
+	})
+	return err
+}
+
 // ReferenceValidator returns a validator of references to records of the format
 func (db *mongoDB) ReferenceValidator(formatName string) boocat.Validate {
 	return func(ctx context.Context, value interface{}) string {
@@ -233,6 +416,104 @@ func findTextIndex(ctx context.Context, indexes mongo.IndexView) (*textIndex, er
 	return nil, nil
 }
 
+// initializeUniqueIndexes creates the unique indexes of the format that don't exist, and drops the existing unique
+// indexes that the format doesn't have. It returns the unique indexes by name, with their fields.
+func initializeUniqueIndexes(ctx context.Context, indexes mongo.IndexView, format boocat.Format) (
+	map[string][]string, error) {
+	uniqueIndexes := make(map[string][]string, len(format.Unique))
+	for _, fields := range format.Unique {
+		uniqueIndexes[uniqueIndexName(fields)] = fields
+	}
+	existing, err := indexNames(ctx, indexes)
+	if err != nil {
+		return nil, err
+	}
+	for name := range existing {
+		if _, found := uniqueIndexes[name]; !found && strings.HasPrefix(name, uniqueIndexPrefix) {
+			if _, err := indexes.DropOne(ctx, name); err != nil {
+				return nil, fmt.Errorf("dropping existing index: %w", err)
+			}
+		}
+	}
+	for name, fields := range uniqueIndexes {
+		if _, found := existing[name]; !found {
+			if _, err := indexes.CreateOne(ctx, uniqueIndexModel(fields)); err != nil {
+				return nil, fmt.Errorf("creating new index: %w", err)
+			}
+		}
+	}
+	return uniqueIndexes, nil
+}
+
+// indexNames returns the names of the indexes
+func indexNames(ctx context.Context, indexes mongo.IndexView) (map[string]struct{}, error) {
+	cursor, err := indexes.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting list of indexes: %w", err)
+	}
+	names := make(map[string]struct{})
+	for cursor.Next(ctx) {
+		var result bson.M
+		if err := cursor.Decode(&result); err != nil {
+			return nil, fmt.Errorf("decoding index cursor: %w", err)
+		}
+		if name, ok := result["name"].(string); ok {
+			names[name] = struct{}{}
+		}
+	}
+	return names, nil
+}
+
+// uniqueIndexModel returns the model to create a unique index of the fields. Only documents with non-empty values in
+// all the fields are indexed, so that records without them don't collide. The time records were moved to the trash is
+// part of the index too, so that they don't collide with the records that take their values later. Partial indexes
+// can't leave out documents that have a field.
+func uniqueIndexModel(fields []string) mongo.IndexModel {
+	keys := make(bson.D, 0, len(fields)+1)
+	partialFilter := make(bson.M, len(fields))
+	for _, field := range fields {
+		keys = append(keys, primitive.E{Key: field, Value: 1})
+		partialFilter[field] = bson.M{"$gt": ""}
+	}
+	keys = append(keys, primitive.E{Key: boocat.TrashedField, Value: 1})
+	return mongo.IndexModel{
+		Keys: keys,
+		Options: options.Index().
+			SetName(uniqueIndexName(fields)).
+			SetUnique(true).
+			SetPartialFilterExpression(partialFilter),
+	}
+}
+
+// uniqueIndexName returns the name of the unique index of the fields. Indexes that don't include the time records were
+// moved to the trash don't have the suffix, and are dropped.
+func uniqueIndexName(fields []string) string {
+	return uniqueIndexPrefix + strings.Join(fields, "_") + uniqueIndexSuffix
+}
+
+// duplicateError returns a DuplicateError with the fields of the unique index of the format that err is about, if err
+// is a duplicate key error. Otherwise it returns err.
+func (db *mongoDB) duplicateError(formatName string, err error) error {
+	var writeException mongo.WriteException
+	if !errors.As(err, &writeException) {
+		return err
+	}
+	for _, writeError := range writeException.WriteErrors {
+		if writeError.Code != duplicateKeyCode {
+			continue
+		}
+		db.mutex.RLock()
+		uniqueIndexes := db.uniqueIndexes[formatName]
+		db.mutex.RUnlock()
+		for name, fields := range uniqueIndexes {
+			if strings.Contains(writeError.Message, "index: "+name+" ") {
+				return bcerrors.DuplicateError{Fields: fields}
+			}
+		}
+	}
+	return err
+}
+
 // textIndexModel returns the model to create a text index that matches the searchable fields of the format
 func textIndexModel(format boocat.Format) mongo.IndexModel {
 	keys := make(bson.D, 0, len(format.Searchable))
@@ -258,8 +539,33 @@ func splitID(record map[string]string) (string, map[string]string) {
 	return id, recordWithoutID
 }
 
-// Return a slice of records from a slice of MongoDB documents. It just renames "_id" keys to "id".
-func documentsToRecords(docs []map[string]string) []map[string]string {
+// recordToDocument returns the MongoDB document of a record of the format. Values of list fields are stored as arrays.
+func (db *mongoDB) recordToDocument(formatName string, record map[string]string) bson.M {
+	db.mutex.RLock()
+	format := db.formats[formatName]
+	db.mutex.RUnlock()
+	document := make(bson.M, len(record))
+	for field, value := range record {
+		if format.IsList(field) {
+			document[field] = boocat.SplitList(value)
+		} else {
+			document[field] = value
+		}
+	}
+	return document
+}
+
+// documentID returns the "_id" of the document of the record with the id. IDs of records added by MongoDB are
+// ObjectIDs, and IDs of records restored from other databases that aren't ObjectIDs are kept as strings.
+func documentID(id string) interface{} {
+	if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+		return objectID
+	}
+	return id
+}
+
+// Return a slice of records from a slice of MongoDB documents
+func documentsToRecords(docs []bson.M) []map[string]string {
 	records := make([]map[string]string, 0, len(docs))
 	for _, d := range docs {
 		records = append(records, documentToRecord(d))
@@ -267,12 +573,28 @@ func documentsToRecords(docs []map[string]string) []map[string]string {
 	return records
 }
 
-// Returns a record from a MongoDB document. It just renames "_id" key to "id".
-func documentToRecord(doc map[string]string) map[string]string {
-	if id, found := doc["_id"]; found {
-		delete(doc, "_id")
-		doc["id"] = id
-		return doc
+// Returns a record from a MongoDB document. "_id" key is renamed to "id" and arrays are joined as values of list
+// fields.
+func documentToRecord(doc bson.M) map[string]string {
+	record := make(map[string]string, len(doc))
+	for field, value := range doc {
+		if field == "_id" {
+			field = "id"
+		}
+		switch typed := value.(type) {
+		case string:
+			record[field] = typed
+		case primitive.ObjectID:
+			record[field] = typed.Hex()
+		case primitive.A:
+			values := make([]string, 0, len(typed))
+			for _, v := range typed {
+				values = append(values, fmt.Sprintf("%v", v))
+			}
+			record[field] = boocat.JoinList(values)
+		default:
+			record[field] = fmt.Sprintf("%v", typed)
+		}
 	}
-	return doc
+	return record
 }
@@ -0,0 +1,243 @@
+package oai
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/internal/teststore"
+	"github.com/ivanmartinez/boocat/boocat/subjects"
+)
+
+// TestIdentify tests describing the repository
+func TestIdentify(t *testing.T) {
+	p := initializedProvider()
+	response, err := p.Respond(context.Background(), "http://example.com/oai", url.Values{"verb": {"Identify"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(response.Identify, &Identify{
+		RepositoryName:    "boocat",
+		BaseURL:           "http://example.com/oai",
+		ProtocolVersion:   "2.0",
+		AdminEmails:       []string{"admin@example.com"},
+		EarliestDatestamp: "2021-01-01T00:00:00Z",
+		DeletedRecord:     "transient",
+		Granularity:       "YYYY-MM-DDThh:mm:ssZ",
+	}) {
+		t.Errorf("unexpected identify: %+v", response.Identify)
+	}
+	if response.ResponseDate != "2021-06-01T12:00:00Z" || response.Request.Verb != "Identify" {
+		t.Errorf("unexpected response: %+v", response)
+	}
+}
+
+// TestGetRecord tests getting a record in Dublin Core, with its references resolved and its subjects, and a deleted
+// record
+func TestGetRecord(t *testing.T) {
+	p := initializedProvider()
+	response, err := p.Respond(context.Background(), "", url.Values{"verb": {"GetRecord"},
+		"identifier": {"oai:example.com:book/0"}, "metadataPrefix": {"oai_dc"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := Record{
+		Header: Header{Identifier: "oai:example.com:book/0", Datestamp: "2021-03-01T10:00:00Z",
+			SetSpecs: []string{"book"}},
+		Metadata: newMetadata([]Element{
+			newElement("contributor", "Mary"),
+			newElement("contributor", "John"),
+			newElement("creator", "Frank Herbert"),
+			newElement("title", "Dune"),
+			newElement("subject", "Science fiction"),
+		}),
+	}
+	if response.GetRecord == nil || !reflect.DeepEqual(response.GetRecord.Record, expected) {
+		t.Errorf("unexpected record: %+v", response.GetRecord)
+	}
+	response, err = p.Respond(context.Background(), "", url.Values{"verb": {"GetRecord"},
+		"identifier": {"oai:example.com:book/2"}, "metadataPrefix": {"oai_dc"}})
+	if err != nil || response.GetRecord == nil || !reflect.DeepEqual(response.GetRecord.Record, Record{
+		Header: Header{Status: "deleted", Identifier: "oai:example.com:book/2", Datestamp: "2021-05-01T08:30:00Z",
+			SetSpecs: []string{"book"}},
+	}) {
+		t.Errorf("unexpected deleted record: %+v, %v", response.GetRecord, err)
+	}
+}
+
+// TestListIdentifiers tests selective harvesting by set and datestamps
+func TestListIdentifiers(t *testing.T) {
+	p := initializedProvider()
+	for _, test := range []struct {
+		args        url.Values
+		identifiers []string
+	}{
+		{url.Values{}, []string{"author/0", "book/1", "book/0", "author/1", "author/2", "book/2"}},
+		{url.Values{"set": {"book"}}, []string{"book/1", "book/0", "book/2"}},
+		{url.Values{"from": {"2021-03-01"}}, []string{"book/0", "author/1", "author/2", "book/2"}},
+		{url.Values{"until": {"2021-03-01T09:00:00Z"}}, []string{"author/0", "book/1"}},
+		{url.Values{"from": {"2021-02-01"}, "until": {"2021-03-01"}}, []string{"book/1", "book/0"}},
+	} {
+		args := url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"oai_dc"}}
+		for name, values := range test.args {
+			args[name] = values
+		}
+		response, err := p.Respond(context.Background(), "", args)
+		if err != nil || response.ListIdentifiers == nil {
+			t.Errorf("unexpected response to %v: %+v, %v", test.args, response, err)
+			continue
+		}
+		var identifiers []string
+		for _, header := range response.ListIdentifiers.Headers {
+			identifiers = append(identifiers, header.Identifier[len("oai:example.com:"):])
+		}
+		if !reflect.DeepEqual(identifiers, test.identifiers) || response.ListIdentifiers.ResumptionToken != nil {
+			t.Errorf("unexpected identifiers of %v: %v", test.args, identifiers)
+		}
+	}
+}
+
+// TestListRecordsResumption tests listing records in parts with resumption tokens
+func TestListRecordsResumption(t *testing.T) {
+	p := initializedProvider()
+	for i := 0; i < listLimit+10; i++ {
+		p.store.(*boocat.Boocat).RestoreRecord(context.Background(), "author", map[string]string{
+			"id": fmt.Sprintf("n%03d", i), "name": "Author", boocat.ModifiedField: "2021-04-01T00:00:00Z"})
+	}
+	args := url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"oai_dc"}, "set": {"author"}}
+	var identifiers []string
+	for part := 0; part < 3; part++ {
+		response, err := p.Respond(context.Background(), "", args)
+		if err != nil || response.ListRecords == nil {
+			t.Fatalf("unexpected response: %+v, %v", response, err)
+		}
+		for _, record := range response.ListRecords.Records {
+			identifiers = append(identifiers, record.Header.Identifier)
+		}
+		token := response.ListRecords.ResumptionToken
+		if token == nil || token.CompleteListSize != listLimit+13 {
+			t.Fatalf("unexpected resumption token: %+v", token)
+		}
+		if token.Value == "" {
+			if part != 1 || token.Cursor != listLimit {
+				t.Errorf("unexpected last part: %d, %+v", part, token)
+			}
+			break
+		}
+		args = url.Values{"verb": {"ListRecords"}, "resumptionToken": {token.Value}}
+	}
+	if len(identifiers) != listLimit+13 || identifiers[0] != "oai:example.com:author/0" ||
+		identifiers[listLimit+12] != fmt.Sprintf("oai:example.com:author/n%03d", listLimit+9) {
+		t.Errorf("unexpected records: %d, %v", len(identifiers), identifiers)
+	}
+}
+
+// TestChanged tests modifying the records whose metadata may change with the changes of the records they reference,
+// of their tags and of the subjects they are tagged with
+func TestChanged(t *testing.T) {
+	for _, test := range []struct {
+		formatName string
+		record     map[string]string
+		modified   map[string]bool
+	}{
+		{"author", map[string]string{"id": "2", "name": "Joan"}, map[string]bool{"0": true, "1": false}},
+		{subjects.TagFormat, map[string]string{"id": "1", "subject": "0", "format": "book", "record": "1"},
+			map[string]bool{"0": false, "1": true}},
+		{subjects.SubjectFormat, map[string]string{"id": "0", "name": "Sci-fi"}, map[string]bool{"0": true, "1": false}},
+		{"patron", map[string]string{"id": "0", "name": "Ann"}, map[string]bool{"0": false, "1": false}},
+	} {
+		p := initializedProvider()
+		p.Changed(context.Background(), test.formatName, test.record)
+		for id, modified := range test.modified {
+			book, _ := p.store.GetRecord(context.Background(), "book", id)
+			if (book[boocat.ModifiedField] == "2021-06-01T12:00:00Z") != modified {
+				t.Errorf("unexpected book %s after change of %s %v: %v", id, test.formatName, test.record, book)
+			}
+		}
+	}
+}
+
+// TestErrors tests the errors of the protocol
+func TestErrors(t *testing.T) {
+	p := initializedProvider()
+	for _, test := range []struct {
+		args url.Values
+		code string
+	}{
+		{url.Values{}, BadVerb},
+		{url.Values{"verb": {"Delete"}}, BadVerb},
+		{url.Values{"verb": {"Identify"}, "set": {"book"}}, BadArgument},
+		{url.Values{"verb": {"GetRecord"}, "identifier": {"oai:example.com:book/0"}}, BadArgument},
+		{url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"oai_dc", "oai_dc"}}, BadArgument},
+		{url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"oai_dc"}, "resumptionToken": {"x"}}, BadArgument},
+		{url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"oai_dc"}, "from": {"2021-13-01"}}, BadArgument},
+		{url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"oai_dc"}, "from": {"2021-04-01"},
+			"until": {"2021-03-01"}}, BadArgument},
+		{url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"oai_dc"}, "from": {"2021-03-01"},
+			"until": {"2021-04-01T00:00:00Z"}}, BadArgument},
+		{url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"marc21"}}, CannotDisseminateFormat},
+		{url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"oai_dc"}, "set": {"patron"}}, NoRecordsMatch},
+		{url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"oai_dc"}, "from": {"2022-01-01"}}, NoRecordsMatch},
+		{url.Values{"verb": {"ListRecords"}, "resumptionToken": {"x"}}, BadResumptionToken},
+		{url.Values{"verb": {"ListSets"}, "resumptionToken": {"x"}}, BadResumptionToken},
+		{url.Values{"verb": {"GetRecord"}, "identifier": {"oai:example.com:book/7"}, "metadataPrefix": {"oai_dc"}},
+			IDDoesNotExist},
+		{url.Values{"verb": {"GetRecord"}, "identifier": {"oai:example.com:patron/0"},
+			"metadataPrefix": {"oai_dc"}}, IDDoesNotExist},
+		{url.Values{"verb": {"GetRecord"}, "identifier": {"oai:example.com:book/0"}, "metadataPrefix": {"marc21"}},
+			CannotDisseminateFormat},
+	} {
+		response, err := p.Respond(context.Background(), "", test.args)
+		if err != nil || len(response.Errors) != 1 || response.Errors[0].Code != test.code {
+			t.Errorf("unexpected response to %v: %+v, %v", test.args, response.Errors, err)
+		}
+	}
+}
+
+// TestValidateIdentifier tests that repositories are identified by domain names
+func TestValidateIdentifier(t *testing.T) {
+	for identifier, valid := range map[string]bool{"example.com": true, "lib.example-1.org": true, "localhost": false,
+		"": false, "1example.com": false, "example.com:80": false} {
+		if err := ValidateIdentifier(identifier); (err == nil) != valid {
+			t.Errorf("unexpected result validating %q: %v", identifier, err)
+		}
+	}
+}
+
+// initializedProvider returns a provider of books and authors, with a book tagged with a subject and a deleted book
+func initializedProvider() *Provider {
+	db := teststore.NewDB()
+	s := db.Boocat(append(subjects.Formats(db.ReferenceValidator),
+		boocat.Format{Name: "author", Fields: map[string]boocat.Validate{"name": nil}, Display: "name"},
+		boocat.Format{Name: "book", Fields: map[string]boocat.Validate{"title": nil, "author": nil, "translators": nil},
+			Display: "title", Lists: map[string]struct{}{"translators": {}},
+			References: map[string]string{"author": "author", "translators": "author"}},
+		boocat.Format{Name: "patron", Fields: map[string]boocat.Validate{"name": nil}})...)
+	db.Restore("author",
+		map[string]string{"id": "0", "name": "Frank Herbert", boocat.ModifiedField: "2021-01-01T00:00:00Z"},
+		map[string]string{"id": "1", "name": "Mary", boocat.ModifiedField: "2021-04-01T00:00:00Z"},
+		map[string]string{"id": "2", "name": "John", boocat.ModifiedField: "2021-04-01T00:00:00Z"})
+	db.Restore("book",
+		map[string]string{"id": "0", "title": "Dune", "author": "0", "translators": "1\n2",
+			boocat.ModifiedField: "2021-03-01T10:00:00Z"},
+		map[string]string{"id": "1", "title": "Emma", boocat.ModifiedField: "2021-02-01T00:00:00Z"},
+		map[string]string{"id": "2", "title": "Ulysses", boocat.TrashedField: "2021-05-01T08:30:00.123456789Z"})
+	db.Restore("patron", map[string]string{"id": "0", "name": "Ann"})
+	db.Restore(subjects.SubjectFormat, map[string]string{"id": "0", "name": "Science fiction"})
+	db.Restore(subjects.TagFormat, map[string]string{"id": "0", "subject": "0", "format": "book", "record": "0"})
+	p := newProvider(s, Config{
+		RepositoryName:       "boocat",
+		RepositoryIdentifier: "example.com",
+		AdminEmail:           "admin@example.com",
+		Sets: map[string]Elements{
+			"author": {"name": "title"},
+			"book":   {"title": "title", "author": "creator", "translators": "contributor"},
+		},
+	})
+	p.now = func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+	return p
+}
@@ -0,0 +1,646 @@
+package oai
+
+// Implements an OAI-PMH 2.0 data provider of the records of boocat, for aggregators to harvest them in Dublin Core
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/subjects"
+)
+
+// Codes of the errors of the protocol
+const (
+	BadArgument             = "badArgument"
+	BadResumptionToken      = "badResumptionToken"
+	BadVerb                 = "badVerb"
+	CannotDisseminateFormat = "cannotDisseminateFormat"
+	IDDoesNotExist          = "idDoesNotExist"
+	NoRecordsMatch          = "noRecordsMatch"
+)
+
+const (
+	// Prefix of the only metadata format, unqualified Dublin Core
+	dublinCorePrefix = "oai_dc"
+	// Layouts of the datestamps with the granularities of the provider
+	datestampLayout = "2006-01-02T15:04:05Z"
+	dayLayout       = "2006-01-02"
+	// Datestamp of the records that don't have the time they were modified, because they weren't changed since
+	// boocat started keeping it
+	earliestDatestamp = "1970-01-01T00:00:00Z"
+	// Maximum number of records or headers of each part of the lists
+	listLimit = 100
+)
+
+// ErrInvalidIdentifier is returned when the identifier of a repository isn't a domain name, as the identifiers of
+// records in the oai scheme require
+var ErrInvalidIdentifier = errors.New("repository identifier isn't a domain name")
+
+// repositoryIdentifier matches the identifiers of repositories of the oai scheme, which are domain names
+var repositoryIdentifier = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9\-]*(\.[a-zA-Z][a-zA-Z0-9\-]*)+$`)
+
+// Elements maps the fields of the records of a format to the Dublin Core elements they are exposed as, e.g. "title"
+// or "creator". Reference fields are exposed as the display values of the referenced records.
+type Elements map[string]string
+
+// Config configures a provider
+type Config struct {
+	RepositoryName string
+	// Identifier of the repository in the identifiers of its records, e.g. its domain name
+	RepositoryIdentifier string
+	AdminEmail           string
+	// Formats of the records exposed, each as a set, by name, and the elements of their fields
+	Sets map[string]Elements
+}
+
+// store holds the records exposed by the provider
+type store interface {
+	Formats() map[string]boocat.Format
+	GetRecord(ctx context.Context, formatName string, id string) (map[string]string, error)
+	AllRecords(ctx context.Context, formatName string) ([]map[string]string, error)
+	FilterRecords(ctx context.Context, formatName string, filter boocat.Filter) (boocat.FilteredRecords, error)
+	SetInternalFields(ctx context.Context, formatName, id string, fields map[string]string) error
+}
+
+// Provider answers OAI-PMH requests with the records of the formats of its sets. Records are in the list from the time
+// they are added until they are purged from the trash, as deleted records while they are in the trash, and their
+// datestamps are the times they were modified. Records are modified too when the records they reference in their
+// elements, their tags or the subjects they are tagged with change.
+type Provider struct {
+	store  store
+	config Config
+	// now returns the current time
+	now func() time.Time
+}
+
+// ValidateIdentifier returns ErrInvalidIdentifier if the identifier of a repository isn't a domain name, e.g.
+// "localhost"
+func ValidateIdentifier(identifier string) error {
+	if !repositoryIdentifier.MatchString(identifier) {
+		return ErrInvalidIdentifier
+	}
+	return nil
+}
+
+// NewProvider returns the provider of the records of bc, which follows the changes of its records
+func NewProvider(bc *boocat.Boocat, config Config) *Provider {
+	p := newProvider(bc, config)
+	bc.OnChange(p.Changed)
+	return p
+}
+
+// newProvider returns the provider of the records of s
+func newProvider(s store, config Config) *Provider {
+	return &Provider{store: s, config: config, now: time.Now}
+}
+
+// Changed updates the boocat.ModifiedField of the records of the sets whose metadata may change with the change of the
+// record of the format: the records that reference it in their elements, the record of a tag, and the records tagged
+// with a subject. It's a boocat.ChangeHook. On errors, only the records found until then are modified.
+func (p *Provider) Changed(ctx context.Context, formatName string, record map[string]string) {
+	switch formatName {
+	case subjects.TagFormat:
+		p.touch(ctx, record["format"], []map[string]string{{"id": record["record"]}})
+		return
+	case subjects.SubjectFormat:
+		tags, err := p.store.FilterRecords(ctx, subjects.TagFormat,
+			boocat.Filter{Equal: map[string]string{"subject": record["id"]}})
+		if err != nil {
+			return
+		}
+		for _, tag := range tags.Records {
+			p.touch(ctx, tag["format"], []map[string]string{{"id": tag["record"]}})
+		}
+	}
+	formats := p.store.Formats()
+	for _, setName := range p.setNames() {
+		for field := range p.config.Sets[setName] {
+			if formats[setName].References[field] != formatName {
+				continue
+			}
+			referencing, err := p.store.FilterRecords(ctx, setName,
+				boocat.Filter{Equal: map[string]string{field: record["id"]}})
+			if err != nil {
+				return
+			}
+			p.touch(ctx, setName, referencing.Records)
+		}
+	}
+}
+
+// touch sets the boocat.ModifiedField of the records of the format to now, if it's the format of a set
+func (p *Provider) touch(ctx context.Context, formatName string, records []map[string]string) {
+	if _, found := p.config.Sets[formatName]; !found {
+		return
+	}
+	modified := p.now().UTC().Format(time.RFC3339)
+	for _, record := range records {
+		p.store.SetInternalFields(ctx, formatName, record["id"], map[string]string{boocat.ModifiedField: modified})
+	}
+}
+
+// arguments are the arguments of a verb
+type arguments struct {
+	required []string
+	optional []string
+	// Argument that can only be used alone, if any
+	exclusive string
+}
+
+// verbs maps the verbs to their arguments
+var verbs = map[string]arguments{
+	"Identify":            {},
+	"ListMetadataFormats": {optional: []string{"identifier"}},
+	"ListSets":            {exclusive: "resumptionToken"},
+	"GetRecord":           {required: []string{"identifier", "metadataPrefix"}},
+	"ListIdentifiers": {required: []string{"metadataPrefix"}, optional: []string{"from", "until", "set"},
+		exclusive: "resumptionToken"},
+	"ListRecords": {required: []string{"metadataPrefix"}, optional: []string{"from", "until", "set"},
+		exclusive: "resumptionToken"},
+}
+
+// harvest is a selective harvest of the records of the sets, from the record after the one with the key if any
+type harvest struct {
+	Set   string
+	From  string
+	Until string
+	After *key
+}
+
+// key sorts the records of the sets by datestamp, set and ID, which is the order of the lists
+type key struct {
+	Datestamp string
+	Set       string
+	ID        string
+}
+
+// item is a record of a set
+type item struct {
+	key
+	record map[string]string
+}
+
+// Respond returns the response to the request with the arguments to the provider at the base URL. The error is only
+// returned for unexpected errors, and the response has the errors of the protocol.
+func (p *Provider) Respond(ctx context.Context, baseURL string, args url.Values) (Response, error) {
+	response := Response{
+		XSI:            xsiNamespace,
+		SchemaLocation: oaiNamespace + " " + oaiSchema,
+		ResponseDate:   p.now().UTC().Format(datestampLayout),
+		Request:        Request{URL: baseURL},
+	}
+	verb := args.Get("verb")
+	if _, found := verbs[verb]; !found || len(args["verb"]) > 1 {
+		response.Errors = []Error{{Code: BadVerb, Message: "illegal or missing verb"}}
+		return response, nil
+	}
+	if message := checkArguments(verbs[verb], args); message != "" {
+		response.Errors = []Error{{Code: BadArgument, Message: message}}
+		return response, nil
+	}
+	response.Request = Request{
+		Verb:            verb,
+		Identifier:      args.Get("identifier"),
+		MetadataPrefix:  args.Get("metadataPrefix"),
+		From:            args.Get("from"),
+		Until:           args.Get("until"),
+		Set:             args.Get("set"),
+		ResumptionToken: args.Get("resumptionToken"),
+		URL:             baseURL,
+	}
+	var oaiError *Error
+	var err error
+	switch verb {
+	case "Identify":
+		response.Identify, err = p.identify(ctx, baseURL)
+	case "ListMetadataFormats":
+		response.ListMetadataFormats, oaiError, err = p.listMetadataFormats(ctx, args.Get("identifier"))
+	case "ListSets":
+		response.ListSets, oaiError = p.listSets(args.Get("resumptionToken"))
+	case "GetRecord":
+		response.GetRecord, oaiError, err = p.getRecord(ctx, args.Get("identifier"), args.Get("metadataPrefix"))
+	case "ListIdentifiers", "ListRecords":
+		var items []item
+		var token *ResumptionToken
+		items, token, oaiError, err = p.list(ctx, args)
+		if verb == "ListIdentifiers" && oaiError == nil && err == nil {
+			response.ListIdentifiers = &ListIdentifiers{ResumptionToken: token}
+			for _, item := range items {
+				response.ListIdentifiers.Headers = append(response.ListIdentifiers.Headers, p.header(item))
+			}
+		}
+		if verb == "ListRecords" && oaiError == nil && err == nil {
+			response.ListRecords = &ListRecords{ResumptionToken: token}
+			for _, item := range items {
+				record, err := p.record(ctx, item)
+				if err != nil {
+					return Response{}, err
+				}
+				response.ListRecords.Records = append(response.ListRecords.Records, record)
+			}
+		}
+	}
+	if err != nil {
+		return Response{}, err
+	}
+	if oaiError != nil {
+		response.Errors = []Error{*oaiError}
+	}
+	return response, nil
+}
+
+// checkArguments returns why the arguments aren't valid for the verb, or the empty string if they are
+func checkArguments(verb arguments, args url.Values) string {
+	if verb.exclusive != "" && args.Get(verb.exclusive) != "" {
+		if len(args) != 2 || len(args[verb.exclusive]) > 1 {
+			return verb.exclusive + " must be the only argument"
+		}
+		return ""
+	}
+	for name, values := range args {
+		if name != "verb" && !contains(verb.required, name) && !contains(verb.optional, name) {
+			return "illegal argument " + name
+		}
+		if len(values) > 1 {
+			return "repeated argument " + name
+		}
+	}
+	for _, name := range verb.required {
+		if args.Get(name) == "" {
+			return "missing argument " + name
+		}
+	}
+	return ""
+}
+
+// identify returns the description of the repository
+func (p *Provider) identify(ctx context.Context, baseURL string) (*Identify, error) {
+	earliest := ""
+	for formatName := range p.config.Sets {
+		items, err := p.items(ctx, formatName)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if earliest == "" || item.Datestamp < earliest {
+				earliest = item.Datestamp
+			}
+		}
+	}
+	if earliest == "" {
+		earliest = p.now().UTC().Format(datestampLayout)
+	}
+	return &Identify{
+		RepositoryName:    p.config.RepositoryName,
+		BaseURL:           baseURL,
+		ProtocolVersion:   "2.0",
+		AdminEmails:       []string{p.config.AdminEmail},
+		EarliestDatestamp: earliest,
+		DeletedRecord:     "transient",
+		Granularity:       "YYYY-MM-DDThh:mm:ssZ",
+	}, nil
+}
+
+// listMetadataFormats returns the metadata formats of the record with the identifier, or of all records if it's
+// empty
+func (p *Provider) listMetadataFormats(ctx context.Context, identifier string) (*ListMetadataFormats, *Error,
+	error) {
+	if identifier != "" {
+		if _, oaiError, err := p.find(ctx, identifier); oaiError != nil || err != nil {
+			return nil, oaiError, err
+		}
+	}
+	return &ListMetadataFormats{MetadataFormats: []MetadataFormat{
+		{Prefix: dublinCorePrefix, Schema: oaiDCSchema, Namespace: oaiDCNamespace},
+	}}, nil, nil
+}
+
+// listSets returns the sets, which are listed at once so that they are never resumed
+func (p *Provider) listSets(resumptionToken string) (*ListSets, *Error) {
+	if resumptionToken != "" {
+		return nil, &Error{Code: BadResumptionToken, Message: "sets are listed at once"}
+	}
+	var sets ListSets
+	for _, formatName := range p.setNames() {
+		sets.Sets = append(sets.Sets, Set{Spec: formatName, Name: formatName})
+	}
+	return &sets, nil
+}
+
+// getRecord returns the record with the identifier in the metadata format
+func (p *Provider) getRecord(ctx context.Context, identifier, metadataPrefix string) (*GetRecord, *Error, error) {
+	found, oaiError, err := p.find(ctx, identifier)
+	if oaiError != nil || err != nil {
+		return nil, oaiError, err
+	}
+	if metadataPrefix != dublinCorePrefix {
+		return nil, &Error{Code: CannotDisseminateFormat, Message: "only oai_dc is supported"}, nil
+	}
+	record, err := p.record(ctx, found)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &GetRecord{Record: record}, nil, nil
+}
+
+// find returns the record with the identifier, even if it's deleted
+func (p *Provider) find(ctx context.Context, identifier string) (item, *Error, error) {
+	notFound := &Error{Code: IDDoesNotExist, Message: "unknown identifier " + identifier}
+	prefix := "oai:" + p.config.RepositoryIdentifier + ":"
+	if !strings.HasPrefix(identifier, prefix) {
+		return item{}, notFound, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(identifier, prefix), "/", 2)
+	if _, found := p.config.Sets[parts[0]]; !found || len(parts) != 2 {
+		return item{}, notFound, nil
+	}
+	items, err := p.items(ctx, parts[0])
+	if err != nil {
+		return item{}, nil, err
+	}
+	for _, item := range items {
+		if item.ID == parts[1] {
+			return item, nil, nil
+		}
+	}
+	return item{}, notFound, nil
+}
+
+// list returns the part of the list of records selected by the arguments of ListIdentifiers or ListRecords, and the
+// token to resume the list if it's incomplete
+func (p *Provider) list(ctx context.Context, args url.Values) ([]item, *ResumptionToken, *Error, error) {
+	h := harvest{Set: args.Get("set")}
+	if token := args.Get("resumptionToken"); token != "" {
+		var valid bool
+		if h, valid = decodeToken(token); !valid {
+			return nil, nil, &Error{Code: BadResumptionToken, Message: "invalid resumption token"}, nil
+		}
+	} else {
+		if args.Get("metadataPrefix") != dublinCorePrefix {
+			return nil, nil, &Error{Code: CannotDisseminateFormat, Message: "only oai_dc is supported"}, nil
+		}
+		var message string
+		if h.From, h.Until, message = datestampRange(args.Get("from"), args.Get("until")); message != "" {
+			return nil, nil, &Error{Code: BadArgument, Message: message}, nil
+		}
+	}
+	setNames := p.setNames()
+	if h.Set != "" {
+		if _, found := p.config.Sets[h.Set]; !found {
+			return nil, nil, &Error{Code: NoRecordsMatch, Message: "unknown set " + h.Set}, nil
+		}
+		setNames = []string{h.Set}
+	}
+	var selected []item
+	for _, formatName := range setNames {
+		items, err := p.items(ctx, formatName)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, item := range items {
+			if (h.From == "" || item.Datestamp >= h.From) && (h.Until == "" || item.Datestamp <= h.Until) {
+				selected = append(selected, item)
+			}
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].key.before(selected[j].key)
+	})
+	cursor := 0
+	if h.After != nil {
+		cursor = sort.Search(len(selected), func(i int) bool {
+			return h.After.before(selected[i].key)
+		})
+	}
+	if cursor == len(selected) && h.After == nil {
+		return nil, nil, &Error{Code: NoRecordsMatch, Message: "no records match the arguments"}, nil
+	}
+	part := selected[cursor:]
+	if len(part) > listLimit {
+		part = part[:listLimit]
+	}
+	if cursor == 0 && len(part) == len(selected) {
+		return part, nil, nil, nil
+	}
+	token := &ResumptionToken{CompleteListSize: len(selected), Cursor: cursor}
+	if cursor+len(part) < len(selected) {
+		next := h
+		last := part[len(part)-1].key
+		next.After = &last
+		token.Value = next.encode()
+	}
+	return part, token, nil, nil
+}
+
+// datestampRange returns the bounds of the datestamps of a harvest from the arguments, or why they aren't valid.
+// Bounds with the granularity of days include the whole day. Both bounds must have the same granularity.
+func datestampRange(from, until string) (string, string, string) {
+	if from != "" && until != "" && len(from) != len(until) {
+		return "", "", "from and until have different granularities"
+	}
+	var err error
+	if from != "" {
+		if from, err = datestamp(from, "T00:00:00Z"); err != nil {
+			return "", "", "illegal from"
+		}
+	}
+	if until != "" {
+		if until, err = datestamp(until, "T23:59:59Z"); err != nil {
+			return "", "", "illegal until"
+		}
+	}
+	if from != "" && until != "" && from > until {
+		return "", "", "from is later than until"
+	}
+	return from, until, ""
+}
+
+// datestamp returns the argument in the layout of the datestamps of records, completing days with the time
+func datestamp(argument, time string) (string, error) {
+	if len(argument) == len(dayLayout) {
+		argument += time
+	}
+	parsed, err := parseTime(argument)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Format(datestampLayout), nil
+}
+
+// parseTime parses a datestamp
+func parseTime(value string) (time.Time, error) {
+	return time.Parse(datestampLayout, value)
+}
+
+// items returns the records of the format, including the deleted ones, with their datestamps
+func (p *Provider) items(ctx context.Context, formatName string) ([]item, error) {
+	records, err := p.store.AllRecords(ctx, formatName)
+	if errors.Is(err, bcerrors.ErrFormatNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	items := make([]item, 0, len(records))
+	for _, record := range records {
+		stamp := earliestDatestamp
+		if modified, err := time.Parse(time.RFC3339, record[boocat.ModifiedField]); err == nil {
+			stamp = modified.UTC().Format(datestampLayout)
+		} else if trashed, err := time.Parse(time.RFC3339Nano, record[boocat.TrashedField]); err == nil {
+			stamp = trashed.UTC().Format(datestampLayout)
+		}
+		items = append(items, item{key: key{Datestamp: stamp, Set: formatName, ID: record["id"]}, record: record})
+	}
+	return items, nil
+}
+
+// header returns the header of the record
+func (p *Provider) header(item item) Header {
+	header := Header{
+		Identifier: "oai:" + p.config.RepositoryIdentifier + ":" + item.Set + "/" + item.ID,
+		Datestamp:  item.Datestamp,
+		SetSpecs:   []string{item.Set},
+	}
+	if _, deleted := item.record[boocat.TrashedField]; deleted {
+		header.Status = "deleted"
+	}
+	return header
+}
+
+// record returns the record with its metadata in Dublin Core, unless it's deleted
+func (p *Provider) record(ctx context.Context, item item) (Record, error) {
+	record := Record{Header: p.header(item)}
+	if record.Header.Status == "deleted" {
+		return record, nil
+	}
+	elements, err := p.dublinCore(ctx, item.Set, item.record)
+	if err != nil {
+		return Record{}, err
+	}
+	record.Metadata = newMetadata(elements)
+	return record, nil
+}
+
+// dublinCore returns the Dublin Core elements of the record of the format, sorted by element and then by field, and
+// the subjects the record is tagged with as "subject" elements
+func (p *Provider) dublinCore(ctx context.Context, formatName string, record map[string]string) ([]Element, error) {
+	formats := p.store.Formats()
+	format := formats[formatName]
+	elements := p.config.Sets[formatName]
+	fields := make([]string, 0, len(elements))
+	for field := range elements {
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		if elements[fields[i]] != elements[fields[j]] {
+			return elements[fields[i]] < elements[fields[j]]
+		}
+		return fields[i] < fields[j]
+	})
+	var dublinCore []Element
+	for _, field := range fields {
+		for _, value := range format.Values(field, record[field]) {
+			if refFormatName, isReference := format.References[field]; isReference {
+				referenced, err := p.store.GetRecord(ctx, refFormatName, value)
+				if errors.Is(err, bcerrors.ErrRecordNotFound) {
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				value = referenced[formats[refFormatName].Display]
+			}
+			if value != "" {
+				dublinCore = append(dublinCore, newElement(elements[field], value))
+			}
+		}
+	}
+	tags, err := p.store.FilterRecords(ctx, subjects.TagFormat,
+		boocat.Filter{Equal: map[string]string{"format": formatName, "record": record["id"]}})
+	if errors.Is(err, bcerrors.ErrFormatNotFound) {
+		return dublinCore, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags.Records {
+		subject, err := p.store.GetRecord(ctx, subjects.SubjectFormat, tag["subject"])
+		if errors.Is(err, bcerrors.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		dublinCore = append(dublinCore, newElement("subject", subject["name"]))
+	}
+	return dublinCore, nil
+}
+
+// setNames returns the names of the formats of the sets, sorted
+func (p *Provider) setNames() []string {
+	names := make([]string, 0, len(p.config.Sets))
+	for formatName := range p.config.Sets {
+		names = append(names, formatName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// before returns if the key sorts before the other
+func (k key) before(other key) bool {
+	if k.Datestamp != other.Datestamp {
+		return k.Datestamp < other.Datestamp
+	}
+	if k.Set != other.Set {
+		return k.Set < other.Set
+	}
+	return k.ID < other.ID
+}
+
+// encode returns the harvest as a resumption token
+func (h harvest) encode() string {
+	values := url.Values{"set": {h.Set}, "from": {h.From}, "until": {h.Until}}
+	if h.After != nil {
+		values.Set("datestamp", h.After.Datestamp)
+		values.Set("afterset", h.After.Set)
+		values.Set("id", h.After.ID)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(values.Encode()))
+}
+
+// decodeToken returns the harvest of the resumption token, and if the token is valid
+func decodeToken(token string) (harvest, bool) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return harvest{}, false
+	}
+	values, err := url.ParseQuery(string(decoded))
+	if err != nil {
+		return harvest{}, false
+	}
+	h := harvest{Set: values.Get("set"), From: values.Get("from"), Until: values.Get("until")}
+	after := key{Datestamp: values.Get("datestamp"), Set: values.Get("afterset"), ID: values.Get("id")}
+	if _, err := parseTime(after.Datestamp); err != nil || after.Set == "" || after.ID == "" {
+		return harvest{}, false
+	}
+	h.After = &after
+	return h, true
+}
+
+// contains returns if the value is in the slice
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package oai
+
+// Implements the XML documents of the responses of OAI-PMH
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// Namespaces and schemas of the XML documents
+const (
+	oaiNamespace        = "http://www.openarchives.org/OAI/2.0/"
+	oaiSchema           = "http://www.openarchives.org/OAI/2.0/OAI-PMH.xsd"
+	xsiNamespace        = "http://www.w3.org/2001/XMLSchema-instance"
+	oaiDCNamespace      = "http://www.openarchives.org/OAI/2.0/oai_dc/"
+	oaiDCSchema         = "http://www.openarchives.org/OAI/2.0/oai_dc.xsd"
+	dublinCoreNamespace = "http://purl.org/dc/elements/1.1/"
+)
+
+// Response is the response to an OAI-PMH request. It has either errors or the element of the verb of the request.
+type Response struct {
+	XMLName             xml.Name             `xml:"http://www.openarchives.org/OAI/2.0/ OAI-PMH"`
+	XSI                 string               `xml:"xmlns:xsi,attr"`
+	SchemaLocation      string               `xml:"xsi:schemaLocation,attr"`
+	ResponseDate        string               `xml:"responseDate"`
+	Request             Request              `xml:"request"`
+	Errors              []Error              `xml:"error"`
+	Identify            *Identify            `xml:"Identify"`
+	ListMetadataFormats *ListMetadataFormats `xml:"ListMetadataFormats"`
+	ListSets            *ListSets            `xml:"ListSets"`
+	GetRecord           *GetRecord           `xml:"GetRecord"`
+	ListIdentifiers     *ListIdentifiers     `xml:"ListIdentifiers"`
+	ListRecords         *ListRecords         `xml:"ListRecords"`
+}
+
+// Request is the request a response is for. The arguments are only set if they are valid.
+type Request struct {
+	Verb            string `xml:"verb,attr,omitempty"`
+	Identifier      string `xml:"identifier,attr,omitempty"`
+	MetadataPrefix  string `xml:"metadataPrefix,attr,omitempty"`
+	From            string `xml:"from,attr,omitempty"`
+	Until           string `xml:"until,attr,omitempty"`
+	Set             string `xml:"set,attr,omitempty"`
+	ResumptionToken string `xml:"resumptionToken,attr,omitempty"`
+	// Base URL of the provider
+	URL string `xml:",chardata"`
+}
+
+// Error is an error of the protocol, with one of the codes defined by OAI-PMH
+type Error struct {
+	Code    string `xml:"code,attr"`
+	Message string `xml:",chardata"`
+}
+
+// Identify describes the repository
+type Identify struct {
+	RepositoryName    string   `xml:"repositoryName"`
+	BaseURL           string   `xml:"baseURL"`
+	ProtocolVersion   string   `xml:"protocolVersion"`
+	AdminEmails       []string `xml:"adminEmail"`
+	EarliestDatestamp string   `xml:"earliestDatestamp"`
+	DeletedRecord     string   `xml:"deletedRecord"`
+	Granularity       string   `xml:"granularity"`
+}
+
+// ListMetadataFormats lists the metadata formats records are available in
+type ListMetadataFormats struct {
+	MetadataFormats []MetadataFormat `xml:"metadataFormat"`
+}
+
+// MetadataFormat is a metadata format records are available in
+type MetadataFormat struct {
+	Prefix    string `xml:"metadataPrefix"`
+	Schema    string `xml:"schema"`
+	Namespace string `xml:"metadataNamespace"`
+}
+
+// ListSets lists the sets of records
+type ListSets struct {
+	Sets []Set `xml:"set"`
+}
+
+// Set is a set of records
+type Set struct {
+	Spec string `xml:"setSpec"`
+	Name string `xml:"setName"`
+}
+
+// GetRecord has a record
+type GetRecord struct {
+	Record Record `xml:"record"`
+}
+
+// ListIdentifiers lists the headers of records, and the token to resume the list if it's incomplete
+type ListIdentifiers struct {
+	Headers         []Header         `xml:"header"`
+	ResumptionToken *ResumptionToken `xml:"resumptionToken"`
+}
+
+// ListRecords lists records, and the token to resume the list if it's incomplete
+type ListRecords struct {
+	Records         []Record         `xml:"record"`
+	ResumptionToken *ResumptionToken `xml:"resumptionToken"`
+}
+
+// Record is a record with its metadata, which deleted records don't have
+type Record struct {
+	Header   Header    `xml:"header"`
+	Metadata *Metadata `xml:"metadata"`
+}
+
+// Header identifies a record, and has the time it was last modified and its sets
+type Header struct {
+	// Status is "deleted" for deleted records
+	Status     string   `xml:"status,attr,omitempty"`
+	Identifier string   `xml:"identifier"`
+	Datestamp  string   `xml:"datestamp"`
+	SetSpecs   []string `xml:"setSpec"`
+}
+
+// Metadata is the metadata of a record in Dublin Core
+type Metadata struct {
+	DublinCore DublinCore `xml:"oai_dc:dc"`
+}
+
+// DublinCore is a record in unqualified Dublin Core
+type DublinCore struct {
+	OAIDC          string    `xml:"xmlns:oai_dc,attr"`
+	DC             string    `xml:"xmlns:dc,attr"`
+	XSI            string    `xml:"xmlns:xsi,attr"`
+	SchemaLocation string    `xml:"xsi:schemaLocation,attr"`
+	Elements       []Element `xml:",any"`
+}
+
+// Element is a Dublin Core element, e.g. "title", with a value
+type Element struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// ResumptionToken resumes an incomplete list. It's empty in the last part of the list.
+type ResumptionToken struct {
+	CompleteListSize int    `xml:"completeListSize,attr"`
+	Cursor           int    `xml:"cursor,attr"`
+	Value            string `xml:",chardata"`
+}
+
+// newElement returns the Dublin Core element with the name and the value
+func newElement(name, value string) Element {
+	return Element{XMLName: xml.Name{Local: "dc:" + name}, Value: value}
+}
+
+// newMetadata returns the metadata with the Dublin Core elements
+func newMetadata(elements []Element) *Metadata {
+	return &Metadata{DublinCore: DublinCore{
+		OAIDC:          oaiDCNamespace,
+		DC:             dublinCoreNamespace,
+		XSI:            xsiNamespace,
+		SchemaLocation: oaiDCNamespace + " " + oaiDCSchema,
+		Elements:       elements,
+	}}
+}
+
+// Write writes the response as an XML document
+func (r Response) Write(w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(r)
+}
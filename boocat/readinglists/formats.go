@@ -0,0 +1,78 @@
+package readinglists
+
+// Implements the formats of the records of reading lists and their entries
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+)
+
+// Names of the formats of reading lists
+const (
+	// Lists of books owned by patrons, e.g. "To read"
+	ListFormat = "readinglist"
+	// Books in lists, with their position and a note
+	EntryFormat = "listentry"
+)
+
+// KeyField is the internal field of lists with the key of their shareable URL, which shows them even if they are
+// private
+const KeyField = "_key"
+
+// SecretField is the internal field of patrons with the SHA-256 hash of the secret they sign in to their lists with,
+// in hexadecimal
+const SecretField = "_secret"
+
+// Formats returns the formats of reading lists. reference returns the validator of the fields that reference records
+// of a format. Lists are deleted with their owners, and entries with their lists and books. Entries aren't unique by
+// list and book because removed entries stay in the trash, and Lists keeps a book only once in a list instead. The
+// formats don't have display fields, so that private lists aren't completed by name.
+func Formats(reference func(formatName string) boocat.Validate) []boocat.Format {
+	return []boocat.Format{
+		{
+			Name: ListFormat,
+			Fields: map[string]boocat.Validate{
+				"name":        boocat.ValidateRequired,
+				"owner":       reference(circulation.PatronFormat),
+				"visibility":  validateVisibility,
+				"description": nil,
+			},
+			References: map[string]string{"owner": circulation.PatronFormat},
+			OnDelete:   map[string]boocat.ReferencePolicy{"owner": boocat.Cascade},
+		},
+		{
+			Name: EntryFormat,
+			Fields: map[string]boocat.Validate{
+				"list":     reference(ListFormat),
+				"book":     reference("book"),
+				"position": validatePosition,
+				"note":     nil,
+			},
+			References: map[string]string{"list": ListFormat, "book": "book"},
+			OnDelete:   map[string]boocat.ReferencePolicy{"list": boocat.Cascade, "book": boocat.Cascade},
+		},
+	}
+}
+
+// validateVisibility validates the visibility of a list
+func validateVisibility(_ context.Context, value interface{}) string {
+	switch Visibility(fmt.Sprintf("%v", value)) {
+	case Public, Private:
+		return ""
+	default:
+		return "not a visibility"
+	}
+}
+
+// validatePosition validates the position of an entry in its list, which is a number from 1
+func validatePosition(_ context.Context, value interface{}) string {
+	position, err := strconv.Atoi(fmt.Sprintf("%v", value))
+	if err != nil || position < 1 {
+		return "not a number of one or more"
+	}
+	return ""
+}
@@ -0,0 +1,476 @@
+package readinglists
+
+// Implements the reading lists of patrons, which hold books in order with notes and are public, or private and shown
+// only to their owners and through their shareable URLs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// ErrNotOwner is returned when changing a list of another patron
+var ErrNotOwner = errors.New("list of another patron")
+
+// ErrWrongSecret is returned when signing in with the card of a patron that isn't found, or with a secret that isn't
+// the patron's
+var ErrWrongSecret = errors.New("wrong card or secret")
+
+// ErrInvalidVisibility is returned when a list is given a visibility other than Public or Private
+var ErrInvalidVisibility = errors.New("list can only be public or private")
+
+// Length in bytes of the keys of the shareable URLs of lists
+const keyLength = 16
+
+// Visibility is who can see a list
+type Visibility string
+
+const (
+	// Public lists are shown to everyone
+	Public Visibility = "public"
+	// Private lists are shown to their owners and through their shareable URLs
+	Private Visibility = "private"
+)
+
+// List is a reading list of a patron
+type List struct {
+	ID          string
+	Name        string
+	OwnerID     string
+	Visibility  Visibility
+	Description string
+	// Key of the shareable URL of the list
+	Key string
+}
+
+// Entry is a book in a list
+type Entry struct {
+	ID     string
+	ListID string
+	BookID string
+	// Position of the book in the list, from 1
+	Position int
+	Note     string
+}
+
+// store is the part of boocat.Boocat that lists use
+type store interface {
+	GetRecord(ctx context.Context, formatName string, id string) (map[string]string, error)
+	FilterRecords(ctx context.Context, formatName string, filter boocat.Filter) (boocat.FilteredRecords, error)
+	AddRecord(ctx context.Context, formatName string, record map[string]string) (string, error)
+	UpdateRecord(ctx context.Context, formatName string, record map[string]string) error
+	DeleteRecord(ctx context.Context, formatName string, id string) error
+	SetInternalFields(ctx context.Context, formatName, id string, fields map[string]string) error
+}
+
+// Lists creates and changes reading lists, keeping the positions of their entries from 1 without gaps
+type Lists struct {
+	store store
+	// mutex serializes the changes of entries, so that their positions don't clash
+	mutex sync.Mutex
+}
+
+// NewLists returns the reading lists of the records of bc, which follows the changes of its records to renumber the
+// entries of the lists whose entries are changed without it, e.g. deleted with their books
+func NewLists(bc *boocat.Boocat) *Lists {
+	ls := newLists(bc)
+	bc.OnChange(ls.Changed)
+	return ls
+}
+
+// newLists returns the reading lists of the records of s
+func newLists(s store) *Lists {
+	return &Lists{store: s}
+}
+
+// changingKey is the key of the value of the contexts of the changes of entries made by Lists, which renumber the
+// entries themselves
+type changingKey struct{}
+
+// Changed renumbers the entries of the list of the entry if the record of the format is an entry changed without
+// Lists. It's a boocat.ChangeHook. Entries of deleted lists aren't renumbered. Errors are ignored, and the entries are
+// renumbered again with the next change.
+func (ls *Lists) Changed(ctx context.Context, formatName string, record map[string]string) {
+	if formatName != EntryFormat || ctx.Value(changingKey{}) != nil {
+		return
+	}
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ctx = context.WithValue(ctx, changingKey{}, true)
+	if _, err := ls.List(ctx, record["list"]); err != nil {
+		return
+	}
+	if entries, err := ls.Entries(ctx, record["list"]); err == nil {
+		ls.renumber(ctx, entries)
+	}
+}
+
+// NewSecret sets a new secret that the patron with the id signs in to their lists with, replacing the previous one,
+// and returns it. Only its hash is stored.
+func (ls *Lists) NewSecret(ctx context.Context, patronID string) (string, error) {
+	secret, err := newKey()
+	if err != nil {
+		return "", bcerrors.NewUnexpectedError(err)
+	}
+	err = ls.store.SetInternalFields(ctx, circulation.PatronFormat, patronID,
+		map[string]string{SecretField: secretHash(secret)})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// SignIn returns the patron with the card if the secret is the patron's. The error is ErrWrongSecret if the patron
+// isn't found, doesn't have a secret or has another one.
+func (ls *Lists) SignIn(ctx context.Context, card, secret string) (map[string]string, error) {
+	return ls.signIn(ctx, card, func(patron map[string]string) bool {
+		return subtle.ConstantTimeCompare([]byte(secretHash(secret)), []byte(patron[SecretField])) == 1
+	})
+}
+
+// SessionToken returns the token that keeps the patron signed in with SignInWithToken. It doesn't reveal the secret of
+// the patron, and stops working when the secret is replaced.
+func (ls *Lists) SessionToken(patron map[string]string) string {
+	return sessionToken(patron)
+}
+
+// SignInWithToken returns the patron with the card if the token is the patron's session token. The error is
+// ErrWrongSecret if the patron isn't found, doesn't have a secret or has another token.
+func (ls *Lists) SignInWithToken(ctx context.Context, card, token string) (map[string]string, error) {
+	return ls.signIn(ctx, card, func(patron map[string]string) bool {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(sessionToken(patron))) == 1
+	})
+}
+
+// signIn returns the first patron with the card and a secret that matches. The error is ErrWrongSecret if there's
+// none.
+func (ls *Lists) signIn(ctx context.Context, card string, matches func(patron map[string]string) bool) (
+	map[string]string, error) {
+	if card == "" {
+		return nil, ErrWrongSecret
+	}
+	filtered, err := ls.store.FilterRecords(ctx, circulation.PatronFormat,
+		boocat.Filter{Equal: map[string]string{"card": card}})
+	if err != nil {
+		return nil, err
+	}
+	for _, patron := range filtered.Records {
+		if patron[SecretField] != "" && matches(patron) {
+			return patron, nil
+		}
+	}
+	return nil, ErrWrongSecret
+}
+
+// VisibleTo returns if the list is shown to the patron with the id, which is empty for anonymous visitors, with the
+// key of a shareable URL, which may be empty too
+func (l List) VisibleTo(patronID, key string) bool {
+	return l.Visibility == Public || (patronID != "" && patronID == l.OwnerID) ||
+		(key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(l.Key)) == 1)
+}
+
+// Create creates a list of the patron with the id with a new key, and returns it. The list is deleted if the key can't
+// be stored, and the error is unexpected if it can't be deleted either.
+func (ls *Lists) Create(ctx context.Context, ownerID, name string, visibility Visibility, description string) (List,
+	error) {
+	if visibility != Public && visibility != Private {
+		return List{}, ErrInvalidVisibility
+	}
+	if _, err := ls.store.GetRecord(ctx, circulation.PatronFormat, ownerID); err != nil {
+		return List{}, err
+	}
+	list := List{
+		Name:        strings.TrimSpace(name),
+		OwnerID:     ownerID,
+		Visibility:  visibility,
+		Description: strings.TrimSpace(description),
+	}
+	var err error
+	if list.Key, err = newKey(); err != nil {
+		return List{}, bcerrors.NewUnexpectedError(err)
+	}
+	if list.ID, err = ls.store.AddRecord(ctx, ListFormat, list.record()); err != nil {
+		return List{}, err
+	}
+	if err := ls.store.SetInternalFields(ctx, ListFormat, list.ID, map[string]string{KeyField: list.Key}); err != nil {
+		if undoErr := ls.store.DeleteRecord(ctx, ListFormat, list.ID); undoErr != nil {
+			return List{}, bcerrors.NewUndoError(err, undoErr)
+		}
+		return List{}, err
+	}
+	return list, nil
+}
+
+// List returns the list with the id
+func (ls *Lists) List(ctx context.Context, id string) (List, error) {
+	record, err := ls.store.GetRecord(ctx, ListFormat, id)
+	if err != nil {
+		return List{}, err
+	}
+	return listFromRecord(record), nil
+}
+
+// Update sets the name, visibility and description of the list with the id of the patron with ownerID, and returns it
+func (ls *Lists) Update(ctx context.Context, ownerID, id, name string, visibility Visibility, description string) (
+	List, error) {
+	if visibility != Public && visibility != Private {
+		return List{}, ErrInvalidVisibility
+	}
+	list, err := ls.ownedList(ctx, ownerID, id)
+	if err != nil {
+		return List{}, err
+	}
+	list.Name, list.Visibility, list.Description = strings.TrimSpace(name), visibility, strings.TrimSpace(description)
+	if err := ls.store.UpdateRecord(ctx, ListFormat, list.record()); err != nil {
+		return List{}, err
+	}
+	return list, nil
+}
+
+// Delete deletes the list with the id of the patron with ownerID, and its entries
+func (ls *Lists) Delete(ctx context.Context, ownerID, id string) error {
+	if _, err := ls.ownedList(ctx, ownerID, id); err != nil {
+		return err
+	}
+	return ls.store.DeleteRecord(ctx, ListFormat, id)
+}
+
+// PatronLists returns the lists of the patron with the id, sorted by name
+func (ls *Lists) PatronLists(ctx context.Context, patronID string) ([]List, error) {
+	return ls.lists(ctx, map[string]string{"owner": patronID})
+}
+
+// PublicLists returns the public lists of all patrons, sorted by name
+func (ls *Lists) PublicLists(ctx context.Context) ([]List, error) {
+	return ls.lists(ctx, map[string]string{"visibility": string(Public)})
+}
+
+// Entries returns the entries of the list with the id, sorted by position
+func (ls *Lists) Entries(ctx context.Context, listID string) ([]Entry, error) {
+	filtered, err := ls.store.FilterRecords(ctx, EntryFormat, boocat.Filter{Equal: map[string]string{"list": listID}})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(filtered.Records))
+	for _, record := range filtered.Records {
+		entries = append(entries, entryFromRecord(record))
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Position < entries[j].Position
+	})
+	return entries, nil
+}
+
+// AddBook adds the book with the id at the end of the list with listID of the patron with ownerID, and returns the
+// entry. Adding a book that is already in the list changes its note.
+func (ls *Lists) AddBook(ctx context.Context, ownerID, listID, bookID, note string) (Entry, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ctx = context.WithValue(ctx, changingKey{}, true)
+	if _, err := ls.ownedList(ctx, ownerID, listID); err != nil {
+		return Entry{}, err
+	}
+	if _, err := ls.store.GetRecord(ctx, "book", bookID); err != nil {
+		return Entry{}, err
+	}
+	entries, err := ls.Entries(ctx, listID)
+	if err != nil {
+		return Entry{}, err
+	}
+	for _, entry := range entries {
+		if entry.BookID == bookID {
+			entry.Note = strings.TrimSpace(note)
+			return entry, ls.store.UpdateRecord(ctx, EntryFormat, entry.record())
+		}
+	}
+	entry := Entry{ListID: listID, BookID: bookID, Position: len(entries) + 1, Note: strings.TrimSpace(note)}
+	if entry.ID, err = ls.store.AddRecord(ctx, EntryFormat, entry.record()); err != nil {
+		return Entry{}, err
+	}
+	return entry, nil
+}
+
+// RemoveEntry removes the entry with the id from the list with listID of the patron with ownerID, moving up the
+// entries after it
+func (ls *Lists) RemoveEntry(ctx context.Context, ownerID, listID, entryID string) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ctx = context.WithValue(ctx, changingKey{}, true)
+	entries, i, err := ls.ownedEntry(ctx, ownerID, listID, entryID)
+	if err != nil {
+		return err
+	}
+	if err := ls.store.DeleteRecord(ctx, EntryFormat, entryID); err != nil {
+		return err
+	}
+	return ls.renumber(ctx, append(entries[:i], entries[i+1:]...))
+}
+
+// MoveEntry moves the entry with the id of the list with listID of the patron with ownerID to the position, or to the
+// first or last position if it's out of bounds
+func (ls *Lists) MoveEntry(ctx context.Context, ownerID, listID, entryID string, position int) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ctx = context.WithValue(ctx, changingKey{}, true)
+	entries, i, err := ls.ownedEntry(ctx, ownerID, listID, entryID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case position < 1:
+		position = 1
+	case position > len(entries):
+		position = len(entries)
+	}
+	moved := entries[i]
+	entries = append(entries[:i], entries[i+1:]...)
+	entries = append(entries[:position-1], append([]Entry{moved}, entries[position-1:]...)...)
+	return ls.renumber(ctx, entries)
+}
+
+// ownedList returns the list with the id, or ErrNotOwner if it isn't of the patron with ownerID
+func (ls *Lists) ownedList(ctx context.Context, ownerID, id string) (List, error) {
+	list, err := ls.List(ctx, id)
+	if err != nil {
+		return List{}, err
+	}
+	if list.OwnerID != ownerID {
+		return List{}, ErrNotOwner
+	}
+	return list, nil
+}
+
+// ownedEntry returns the entries of the list with listID of the patron with ownerID, and the index of the entry with
+// entryID in them. The error is bcerrors.ErrRecordNotFound if the entry isn't in the list.
+func (ls *Lists) ownedEntry(ctx context.Context, ownerID, listID, entryID string) ([]Entry, int, error) {
+	if _, err := ls.ownedList(ctx, ownerID, listID); err != nil {
+		return nil, 0, err
+	}
+	entries, err := ls.Entries(ctx, listID)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, entry := range entries {
+		if entry.ID == entryID {
+			return entries, i, nil
+		}
+	}
+	return nil, 0, bcerrors.ErrRecordNotFound
+}
+
+// renumber sets the positions of the entries to their order, updating the ones that change
+func (ls *Lists) renumber(ctx context.Context, entries []Entry) error {
+	for i, entry := range entries {
+		if entry.Position == i+1 {
+			continue
+		}
+		entry.Position = i + 1
+		if err := ls.store.UpdateRecord(ctx, EntryFormat, entry.record()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lists returns the lists whose records have the field values, sorted by name
+func (ls *Lists) lists(ctx context.Context, equal map[string]string) ([]List, error) {
+	filtered, err := ls.store.FilterRecords(ctx, ListFormat, boocat.Filter{Equal: equal})
+	if err != nil {
+		return nil, err
+	}
+	lists := make([]List, 0, len(filtered.Records))
+	for _, record := range filtered.Records {
+		lists = append(lists, listFromRecord(record))
+	}
+	sort.SliceStable(lists, func(i, j int) bool {
+		return strings.ToLower(lists[i].Name) < strings.ToLower(lists[j].Name)
+	})
+	return lists, nil
+}
+
+// record returns the record of the list, without its key
+func (l List) record() map[string]string {
+	record := map[string]string{
+		"name":        l.Name,
+		"owner":       l.OwnerID,
+		"visibility":  string(l.Visibility),
+		"description": l.Description,
+	}
+	if l.ID != "" {
+		record["id"] = l.ID
+	}
+	return record
+}
+
+// listFromRecord returns the list of a record
+func listFromRecord(record map[string]string) List {
+	return List{
+		ID:          record["id"],
+		Name:        record["name"],
+		OwnerID:     record["owner"],
+		Visibility:  Visibility(record["visibility"]),
+		Description: record["description"],
+		Key:         record[KeyField],
+	}
+}
+
+// record returns the record of the entry
+func (e Entry) record() map[string]string {
+	record := map[string]string{
+		"list":     e.ListID,
+		"book":     e.BookID,
+		"position": strconv.Itoa(e.Position),
+		"note":     e.Note,
+	}
+	if e.ID != "" {
+		record["id"] = e.ID
+	}
+	return record
+}
+
+// entryFromRecord returns the entry of a record
+func entryFromRecord(record map[string]string) Entry {
+	entry := Entry{
+		ID:     record["id"],
+		ListID: record["list"],
+		BookID: record["book"],
+		Note:   record["note"],
+	}
+	entry.Position, _ = strconv.Atoi(record["position"])
+	return entry
+}
+
+// secretHash returns the SHA-256 hash of the secret of a patron in hexadecimal
+func secretHash(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// sessionToken returns the session token of the patron, which is the HMAC-SHA256 of the card keyed with the hash of
+// the secret of the patron, in hexadecimal
+func sessionToken(patron map[string]string) string {
+	mac := hmac.New(sha256.New, []byte(patron[SecretField]))
+	mac.Write([]byte(patron["card"]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newKey returns a random key for a shareable URL or the secret of a patron
+func newKey() (string, error) {
+	bytes := make([]byte, keyLength)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
@@ -0,0 +1,167 @@
+package readinglists
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/internal/teststore"
+)
+
+// TestCreate tests creating lists, and who they are shown to
+func TestCreate(t *testing.T) {
+	s := initializedStore()
+	ls := newLists(s)
+	private, err := ls.Create(context.Background(), "0", " To read ", Private, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored, _ := s.GetRecord(context.Background(), ListFormat, private.ID)
+	if private.Name != "To read" || len(private.Key) != 2*keyLength || stored[KeyField] != private.Key {
+		t.Errorf("unexpected list: %+v", private)
+	}
+	if !private.VisibleTo("0", "") || private.VisibleTo("1", "") || private.VisibleTo("", "") ||
+		!private.VisibleTo("", private.Key) || private.VisibleTo("", "wrong") {
+		t.Errorf("unexpected visibility of private list")
+	}
+	if _, err := ls.Create(context.Background(), "0", "Onboarding", Public, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ls.Create(context.Background(), "0", "Secret", "hidden", ""); !errors.Is(err, ErrInvalidVisibility) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	public, err := ls.PublicLists(context.Background())
+	if err != nil || len(public) != 1 || public[0].Name != "Onboarding" || !public[0].VisibleTo("", "") {
+		t.Errorf("unexpected public lists: %+v, %v", public, err)
+	}
+	if _, err := ls.Update(context.Background(), "1", private.ID, "Mine", Public, ""); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	updated, err := ls.Update(context.Background(), "0", private.ID, "Mine", Public, "")
+	stored, _ = s.GetRecord(context.Background(), ListFormat, private.ID)
+	if err != nil || updated.Key != private.Key || stored[KeyField] != private.Key {
+		t.Errorf("unexpected list: %+v, %v", updated, err)
+	}
+}
+
+// TestEntries tests adding, moving and removing the books of a list
+func TestEntries(t *testing.T) {
+	s := initializedStore()
+	ls := newLists(s)
+	list, _ := ls.Create(context.Background(), "0", "To read", Private, "")
+	for _, bookID := range []string{"0", "1", "2", "1"} {
+		if _, err := ls.AddBook(context.Background(), "0", list.ID, bookID, "note "+bookID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := ls.AddBook(context.Background(), "1", list.ID, "0", ""); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := ls.MoveEntry(context.Background(), "0", list.ID, "2", 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertBooks(t, ls, list.ID, []string{"2", "0", "1"})
+	if err := ls.MoveEntry(context.Background(), "0", list.ID, "2", 9); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertBooks(t, ls, list.ID, []string{"0", "1", "2"})
+	if err := ls.RemoveEntry(context.Background(), "0", list.ID, "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertBooks(t, ls, list.ID, []string{"1", "2"})
+	if err := ls.RemoveEntry(context.Background(), "0", list.ID, "0"); !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestDeleteBook tests that deleting a book renumbers the lists it was in
+func TestDeleteBook(t *testing.T) {
+	s := initializedStore()
+	ls := NewLists(s)
+	list, _ := ls.Create(context.Background(), "0", "To read", Private, "")
+	for _, bookID := range []string{"0", "1", "2"} {
+		if _, err := ls.AddBook(context.Background(), "0", list.ID, bookID, ""); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := s.DeleteRecord(context.Background(), "book", "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err := ls.Entries(context.Background(), list.ID)
+	if err != nil || len(entries) != 2 || entries[0].Position != 1 || entries[1].Position != 2 {
+		t.Errorf("unexpected entries: %+v, %v", entries, err)
+	}
+	if err := s.RestoreFromTrash(context.Background(), "book", "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err = ls.Entries(context.Background(), list.ID)
+	if err != nil || len(entries) != 3 || entries[2].Position != 3 {
+		t.Errorf("unexpected entries: %+v, %v", entries, err)
+	}
+}
+
+// TestSignIn tests signing in with the secret of a patron and with its session token, which stop working when the
+// secret is replaced by a new one
+func TestSignIn(t *testing.T) {
+	s := initializedStore()
+	ls := newLists(s)
+	if _, err := ls.SignIn(context.Background(), "A1", ""); !errors.Is(err, ErrWrongSecret) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	old, err := ls.NewSecret(context.Background(), "0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	patron, _ := ls.SignIn(context.Background(), "A1", old)
+	oldToken := ls.SessionToken(patron)
+	if patron, err := ls.SignInWithToken(context.Background(), "A1", oldToken); err != nil || patron["id"] != "0" {
+		t.Errorf("unexpected result: %v, %v", patron, err)
+	}
+	secret, _ := ls.NewSecret(context.Background(), "0")
+	if _, err := ls.SignInWithToken(context.Background(), "A1", oldToken); !errors.Is(err, ErrWrongSecret) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if patron, _ := s.GetRecord(context.Background(), circulation.PatronFormat, "0"); patron[SecretField] == secret {
+		t.Errorf("secret stored without hashing")
+	}
+	if patron, err := ls.SignIn(context.Background(), "A1", secret); err != nil || patron["id"] != "0" {
+		t.Errorf("unexpected result: %v, %v", patron, err)
+	}
+	for _, signIn := range [][2]string{{"A1", old}, {"B2", secret}, {"C3", secret}, {"", ""}} {
+		if _, err := ls.SignIn(context.Background(), signIn[0], signIn[1]); !errors.Is(err, ErrWrongSecret) {
+			t.Errorf("unexpected error signing in with %v: %v", signIn, err)
+		}
+	}
+}
+
+// assertBooks checks that the list with the id has the books with the ids in order, with positions from 1
+func assertBooks(t *testing.T, ls *Lists, listID string, bookIDs []string) {
+	t.Helper()
+	entries, err := ls.Entries(context.Background(), listID)
+	if err != nil || len(entries) != len(bookIDs) {
+		t.Fatalf("unexpected entries: %+v, %v", entries, err)
+	}
+	for i, entry := range entries {
+		if entry.BookID != bookIDs[i] || entry.Position != i+1 || entry.Note != "note "+bookIDs[i] {
+			t.Errorf("unexpected entries: %+v", entries)
+		}
+	}
+}
+
+// initializedStore returns a boocat with patrons and books for testing
+func initializedStore() *boocat.Boocat {
+	db := teststore.NewDB()
+	bc := db.Boocat(append(append(circulation.Formats(db.ReferenceValidator), Formats(db.ReferenceValidator)...),
+		teststore.Book(db.ReferenceValidator))...)
+	db.Restore(circulation.PatronFormat,
+		map[string]string{"id": "0", "name": "Ann", "card": "A1"},
+		map[string]string{"id": "1", "name": "Bob", "card": "B2"})
+	db.Restore("book",
+		map[string]string{"id": "0", "name": "Nineteen Eighty-Four"},
+		map[string]string{"id": "1", "name": "Neuromancer"},
+		map[string]string{"id": "2", "name": "Dune"})
+	return bc
+}
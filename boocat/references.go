@@ -0,0 +1,135 @@
+package boocat
+
+// Implements the resolution of references between records of different formats
+
+import (
+	"context"
+	"sort"
+)
+
+// Reference is a field of a format that references records of another format
+type Reference struct {
+	// Name of the format that has the field
+	FormatName string
+	// Name of the field
+	Field string
+}
+
+// ResolveRecord returns a record of a format by id with its references resolved in both directions. Reference fields
+// are resolved as in ResolveReferences. For every format that references the format of the record there's a key with
+// the name of that format plus "s", e.g. "books", whose value is the slice of records of that format that reference
+// the record.
+func (bc *Boocat) ResolveRecord(ctx context.Context, formatName string, id string) (map[string]interface{}, error) {
+	record, err := bc.GetRecord(ctx, formatName, id)
+	if err != nil {
+		return nil, err
+	}
+	resolved := bc.ResolveReferences(ctx, formatName, record)
+	referencing, err := bc.ReferencingRecords(ctx, formatName, id)
+	if err != nil {
+		return nil, err
+	}
+	for refFormatName, records := range referencing {
+		resolved[refFormatName+"s"] = records
+	}
+	return resolved, nil
+}
+
+// ResolveReferences returns a copy of a record of a format whose reference fields have the referenced records as
+// values. If a referenced record isn't found, the value is a map with just its ID. If a reference field is empty or
+// missing, the value is an empty map. The values of list fields are slices, of referenced records for list
+// reference fields and of strings otherwise.
+func (bc *Boocat) ResolveReferences(ctx context.Context, formatName string,
+	record map[string]string) map[string]interface{} {
+	format, _ := bc.format(formatName)
+	resolved := make(map[string]interface{}, len(record)+len(format.References))
+	for field, value := range record {
+		resolved[field] = value
+	}
+	for field := range format.Lists {
+		if _, isReference := format.References[field]; !isReference {
+			resolved[field] = SplitList(record[field])
+		}
+	}
+	for field, refFormatName := range format.References {
+		if format.IsList(field) {
+			values := SplitList(record[field])
+			referenced := make([]map[string]string, 0, len(values))
+			for _, refID := range values {
+				referenced = append(referenced, bc.referencedRecord(ctx, refFormatName, refID))
+			}
+			resolved[field] = referenced
+		} else {
+			resolved[field] = bc.referencedRecord(ctx, refFormatName, record[field])
+		}
+	}
+	return resolved
+}
+
+// referencedRecord returns the record of a format with the id, a map with just the id if it isn't found, or an empty
+// map if the id is empty
+func (bc *Boocat) referencedRecord(ctx context.Context, formatName, id string) map[string]string {
+	if id == "" {
+		return map[string]string{}
+	}
+	record, err := bc.GetRecord(ctx, formatName, id)
+	if err != nil {
+		return map[string]string{"id": id}
+	}
+	return record
+}
+
+// ReferencingRecords returns the records of every format that references records of a format, that reference the
+// record with the id, by the name of their format. Formats that reference the format have a key even if no record
+// references the record.
+func (bc *Boocat) ReferencingRecords(ctx context.Context, formatName string, id string) (
+	map[string][]map[string]string, error) {
+	referencing := make(map[string][]map[string]string)
+	for _, reference := range bc.ReferencesTo(formatName) {
+		filtered, err := bc.FilterRecords(ctx, reference.FormatName, Filter{
+			Equal: map[string]string{reference.Field: id},
+		})
+		if err != nil {
+			return nil, err
+		}
+		referencing[reference.FormatName] = appendNew(referencing[reference.FormatName], filtered.Records)
+	}
+	return referencing, nil
+}
+
+// ReferencesTo returns the fields of all formats that reference records of the format, sorted by format and field
+func (bc *Boocat) ReferencesTo(formatName string) []Reference {
+	var references []Reference
+	for _, format := range bc.Formats() {
+		for field, refFormatName := range format.References {
+			if refFormatName == formatName {
+				references = append(references, Reference{FormatName: format.Name, Field: field})
+			}
+		}
+	}
+	sort.Slice(references, func(i, j int) bool {
+		if references[i].FormatName != references[j].FormatName {
+			return references[i].FormatName < references[j].FormatName
+		}
+		return references[i].Field < references[j].Field
+	})
+	return references
+}
+
+// appendNew appends to records the new records whose IDs aren't already in records
+func appendNew(records []map[string]string, newRecords []map[string]string) []map[string]string {
+	if records == nil {
+		records = make([]map[string]string, 0, len(newRecords))
+	}
+	ids := make(map[string]struct{}, len(records))
+	for _, record := range records {
+		ids[record["id"]] = struct{}{}
+	}
+	for _, record := range newRecords {
+		if _, found := ids[record["id"]]; !found {
+			records = append(records, record)
+			ids[record["id"]] = struct{}{}
+		}
+	}
+	return records
+}
@@ -0,0 +1,288 @@
+package related
+
+// Implements the catalog data the relations between books are computed from, and their scores
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/readinglists"
+	"github.com/ivanmartinez/boocat/boocat/subjects"
+)
+
+// Weights of the kinds of relations in the scores of related books, which add up to 1
+const (
+	// Books by the same author
+	authorWeight = 0.3
+	// Books with the same subjects
+	subjectsWeight = 0.3
+	// Books with similar synopses
+	synopsisWeight = 0.2
+	// Books in the same reading lists or borrowed by the same patrons
+	readersWeight = 0.2
+)
+
+// Minimum length of the words of synopses that are compared
+const minWordLength = 3
+
+// stopWords are the common words that aren't compared in synopses
+var stopWords = map[string]struct{}{
+	"and": {}, "are": {}, "but": {}, "for": {}, "from": {}, "has": {}, "have": {}, "her": {}, "his": {}, "its": {},
+	"not": {}, "that": {}, "the": {}, "their": {}, "them": {}, "they": {}, "this": {}, "was": {}, "were": {},
+	"which": {}, "who": {}, "with": {},
+}
+
+// catalog has the data of all the books that relates them, indexed both ways
+type catalog struct {
+	books map[string]map[string]string
+	// IDs of the books by author ID
+	byAuthor map[string][]string
+	// Subject IDs by book ID, and book IDs by subject ID
+	subjects  map[string]map[string]struct{}
+	bySubject map[string][]string
+	// TF-IDF vectors of the synopses by book ID, normalized to length 1, and book IDs by the words of their synopses
+	synopses map[string]map[string]float64
+	byWord   map[string][]string
+	// Reading lists and patrons, as groups of books read together, by book ID, and book IDs by group
+	groups  map[string]map[string]struct{}
+	byGroup map[string][]string
+}
+
+// scored is a book related to another, with how much from 0 to 1
+type scored struct {
+	id    string
+	score float64
+}
+
+// loadCatalog loads the data of the books from s. The formats of subjects, reading lists and circulation are
+// optional.
+func loadCatalog(ctx context.Context, s store) (*catalog, error) {
+	c := &catalog{
+		books:     make(map[string]map[string]string),
+		byAuthor:  make(map[string][]string),
+		subjects:  make(map[string]map[string]struct{}),
+		bySubject: make(map[string][]string),
+		synopses:  make(map[string]map[string]float64),
+		byWord:    make(map[string][]string),
+		groups:    make(map[string]map[string]struct{}),
+		byGroup:   make(map[string][]string),
+	}
+	books, err := records(ctx, s, BookFormat, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, book := range books {
+		c.books[book["id"]] = book
+		if book["author"] != "" {
+			c.byAuthor[book["author"]] = append(c.byAuthor[book["author"]], book["id"])
+		}
+	}
+	c.indexSynopses()
+	tags, err := records(ctx, s, subjects.TagFormat, map[string]string{"format": BookFormat})
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		if _, found := c.books[tag["record"]]; !found {
+			continue
+		}
+		if add(c.subjects, tag["record"], tag["subject"]) {
+			c.bySubject[tag["subject"]] = append(c.bySubject[tag["subject"]], tag["record"])
+		}
+	}
+	entries, err := records(ctx, s, readinglists.EntryFormat, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		c.addToGroup("list "+entry["list"], entry["book"])
+	}
+	copies, err := records(ctx, s, circulation.CopyFormat, nil)
+	if err != nil {
+		return nil, err
+	}
+	bookOfCopy := make(map[string]string, len(copies))
+	for _, record := range copies {
+		bookOfCopy[record["id"]] = record["book"]
+	}
+	loans, err := records(ctx, s, circulation.LoanFormat, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, loan := range loans {
+		if bookID, found := bookOfCopy[loan["copy"]]; found {
+			c.addToGroup("patron "+loan["patron"], bookID)
+		}
+	}
+	return c, nil
+}
+
+// records returns the records of the format with the values of equal, or none if the format isn't set
+func records(ctx context.Context, s store, formatName string, equal map[string]string) ([]map[string]string, error) {
+	filtered, err := s.FilterRecords(ctx, formatName, boocat.Filter{Equal: equal})
+	if errors.Is(err, bcerrors.ErrFormatNotFound) {
+		return nil, nil
+	}
+	return filtered.Records, err
+}
+
+// add adds the value to the set of the key in sets, and returns if it wasn't there
+func add(sets map[string]map[string]struct{}, key, value string) bool {
+	if _, found := sets[key][value]; found {
+		return false
+	}
+	if sets[key] == nil {
+		sets[key] = make(map[string]struct{})
+	}
+	sets[key][value] = struct{}{}
+	return true
+}
+
+// addToGroup adds the book with the id to the group, if it's in the catalog
+func (c *catalog) addToGroup(group, bookID string) {
+	if _, found := c.books[bookID]; !found {
+		return
+	}
+	if add(c.groups, bookID, group) {
+		c.byGroup[group] = append(c.byGroup[group], bookID)
+	}
+}
+
+// indexSynopses weights the words of the synopses of the books by how often they are in each synopsis and how rare
+// they are in all of them
+func (c *catalog) indexSynopses() {
+	counts := make(map[string]map[string]int)
+	documents := make(map[string]int)
+	for id, book := range c.books {
+		words := synopsisWords(book["synopsis"])
+		if len(words) == 0 {
+			continue
+		}
+		counts[id] = make(map[string]int)
+		for _, word := range words {
+			if counts[id][word] == 0 {
+				documents[word]++
+			}
+			counts[id][word]++
+		}
+	}
+	for id, bookCounts := range counts {
+		vector := make(map[string]float64, len(bookCounts))
+		length := 0.0
+		for word, count := range bookCounts {
+			weight := float64(count) * math.Log(float64(len(counts))/float64(documents[word]))
+			if weight == 0 {
+				continue
+			}
+			vector[word] = weight
+			length += weight * weight
+		}
+		if len(vector) == 0 {
+			continue
+		}
+		length = math.Sqrt(length)
+		for word := range vector {
+			vector[word] /= length
+			c.byWord[word] = append(c.byWord[word], id)
+		}
+		c.synopses[id] = vector
+	}
+}
+
+// synopsisWords returns the words of the synopsis that are compared, in lower case
+func synopsisWords(synopsis string) []string {
+	words := strings.FieldsFunc(strings.ToLower(synopsis), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	compared := make([]string, 0, len(words))
+	for _, word := range words {
+		if _, found := stopWords[word]; found || utf8.RuneCountInString(word) < minWordLength {
+			continue
+		}
+		compared = append(compared, word)
+	}
+	return compared
+}
+
+// related returns up to limit books related to the book with the id, the most related first. Books of the same work
+// are editions of the book rather than related books, so they aren't included.
+func (c *catalog) related(id string, limit int) []scored {
+	book := c.books[id]
+	candidates := make(map[string]struct{})
+	for _, other := range c.byAuthor[book["author"]] {
+		candidates[other] = struct{}{}
+	}
+	for subject := range c.subjects[id] {
+		for _, other := range c.bySubject[subject] {
+			candidates[other] = struct{}{}
+		}
+	}
+	for word := range c.synopses[id] {
+		for _, other := range c.byWord[word] {
+			candidates[other] = struct{}{}
+		}
+	}
+	for group := range c.groups[id] {
+		for _, other := range c.byGroup[group] {
+			candidates[other] = struct{}{}
+		}
+	}
+	related := make([]scored, 0, len(candidates))
+	for other := range candidates {
+		if other == id || (book["work"] != "" && c.books[other]["work"] == book["work"]) {
+			continue
+		}
+		if score := c.score(id, other); score > 0 {
+			related = append(related, scored{id: other, score: score})
+		}
+	}
+	sort.Slice(related, func(i, j int) bool {
+		if related[i].score != related[j].score {
+			return related[i].score > related[j].score
+		}
+		return related[i].id < related[j].id
+	})
+	if len(related) > limit {
+		related = related[:limit]
+	}
+	return related
+}
+
+// score returns how related the books with the ids are, from 0 to 1
+func (c *catalog) score(id, other string) float64 {
+	score := 0.0
+	if author := c.books[id]["author"]; author != "" && c.books[other]["author"] == author {
+		score += authorWeight
+	}
+	if shared := shared(c.subjects[id], c.subjects[other]); shared > 0 {
+		score += subjectsWeight * float64(shared) / float64(len(c.subjects[id])+len(c.subjects[other])-shared)
+	}
+	cosine := 0.0
+	for word, weight := range c.synopses[id] {
+		cosine += weight * c.synopses[other][word]
+	}
+	score += synopsisWeight * cosine
+	if shared := shared(c.groups[id], c.groups[other]); shared > 0 {
+		score += readersWeight * float64(shared) / math.Sqrt(float64(len(c.groups[id])*len(c.groups[other])))
+	}
+	return score
+}
+
+// shared returns how many values two sets share
+func shared(set, other map[string]struct{}) int {
+	count := 0
+	for value := range set {
+		if _, found := other[value]; found {
+			count++
+		}
+	}
+	return count
+}
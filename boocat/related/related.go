@@ -0,0 +1,299 @@
+package related
+
+// Implements the recommendations of books related to others, computed from the catalog data and cached in the books
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/readinglists"
+	"github.com/ivanmartinez/boocat/boocat/subjects"
+)
+
+// BookFormat is the name of the format of books
+const BookFormat = "book"
+
+// Internal fields of books with their cached related books
+const (
+	// IDs of the related books, the most related first
+	RelatedField = "_related"
+	// Time the related books were computed in RFC 3339 format. Books without it have to be computed again, and keep
+	// their related books until then.
+	ComputedField = "_relatedtime"
+)
+
+// Limit is the maximum number of related books of a book
+const Limit = 5
+
+// store holds the books and the records they're related by
+type store interface {
+	GetRecord(ctx context.Context, formatName string, id string) (map[string]string, error)
+	FilterRecords(ctx context.Context, formatName string, filter boocat.Filter) (boocat.FilteredRecords, error)
+	SetInternalFields(ctx context.Context, formatName, id string, fields map[string]string) error
+}
+
+// Engine computes the books related to others by author, subjects, synopsis and readers, and caches them in the
+// books. When records change, the books whose related books may change are marked as stale, and computed again by
+// Refresh. Their cached related books are returned until then.
+type Engine struct {
+	store store
+	// computing serializes the computations of related books
+	computing sync.Mutex
+	// mutex protects marked, citing and uncited
+	mutex sync.Mutex
+	// IDs of the books marked as stale since the last computation started
+	marked map[string]struct{}
+	// IDs of the books whose cached related books include a book, by book ID. It's built by every computation, and
+	// is nil until the first one.
+	citing map[string]map[string]struct{}
+	// IDs of the books changed before citing was built, whose citing books the first computation computes
+	uncited map[string]struct{}
+	// now returns the current time
+	now func() time.Time
+}
+
+// NewEngine returns the engine of the related books of the records of bc, which follows the changes of its records
+func NewEngine(bc *boocat.Boocat) *Engine {
+	e := newEngine(bc)
+	bc.OnChange(e.Changed)
+	return e
+}
+
+// newEngine returns the engine of the related books of the records of s
+func newEngine(s store) *Engine {
+	return &Engine{store: s, marked: make(map[string]struct{}), uncited: make(map[string]struct{}), now: time.Now}
+}
+
+// Related returns the cached books related to the book with the id, the most related first. They aren't computed, so
+// they may be stale until Refresh computes them again, and there are none until it computes them for the first time.
+func (e *Engine) Related(ctx context.Context, bookID string) ([]map[string]string, error) {
+	book, err := e.store.GetRecord(ctx, BookFormat, bookID)
+	if err != nil {
+		return nil, err
+	}
+	related := make([]map[string]string, 0, Limit)
+	for _, id := range boocat.SplitList(book[RelatedField]) {
+		record, err := e.store.GetRecord(ctx, BookFormat, id)
+		if errors.Is(err, bcerrors.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		related = append(related, record)
+	}
+	return related, nil
+}
+
+// Refresh computes the related books of the stale books, and returns how many it computed
+func (e *Engine) Refresh(ctx context.Context) (int, error) {
+	return e.compute(ctx, e.stale)
+}
+
+// RefreshAll computes the related books of all books, and returns how many it computed
+func (e *Engine) RefreshAll(ctx context.Context) (int, error) {
+	return e.compute(ctx, func(map[string]string) bool { return true })
+}
+
+// Changed marks the books whose related books may change with the change of the record of the format as stale. It's
+// a boocat.ChangeHook. Changes of text similarity between books that aren't otherwise related are only taken into
+// account when the books are computed again. On errors, only the books found until then are marked.
+func (e *Engine) Changed(ctx context.Context, formatName string, record map[string]string) {
+	ids, _ := e.affected(ctx, formatName, record)
+	e.mutex.Lock()
+	if formatName == BookFormat {
+		ids = append(ids, e.citingBooks(record["id"])...)
+	}
+	for _, id := range ids {
+		e.marked[id] = struct{}{}
+	}
+	e.mutex.Unlock()
+	// The books stay marked if their computed time can't be removed, so that they are computed again while the engine
+	// runs
+	for _, id := range ids {
+		book, err := e.store.GetRecord(ctx, BookFormat, id)
+		if err == nil && book[ComputedField] != "" {
+			e.store.SetInternalFields(ctx, BookFormat, id, map[string]string{ComputedField: ""})
+		}
+	}
+}
+
+// citingBooks returns the IDs of the books whose cached related books include the book with the id. Before citing is
+// built, it keeps the ID for the first computation and returns none. e.mutex must be locked.
+func (e *Engine) citingBooks(id string) []string {
+	if e.citing == nil {
+		e.uncited[id] = struct{}{}
+		return nil
+	}
+	ids := make([]string, 0, len(e.citing[id]))
+	for citingID := range e.citing[id] {
+		ids = append(ids, citingID)
+	}
+	return ids
+}
+
+// affected returns the IDs of the books whose related books may change with the change of the record of the format,
+// except the books whose related books include a changed book, which are in citing. On errors, it returns the IDs
+// found until then.
+func (e *Engine) affected(ctx context.Context, formatName string, record map[string]string) ([]string, error) {
+	switch formatName {
+	case BookFormat:
+		ids := []string{record["id"]}
+		if record["author"] != "" {
+			sameAuthor, err := records(ctx, e.store, BookFormat, map[string]string{"author": record["author"]})
+			if err != nil {
+				return ids, err
+			}
+			ids = appendIDs(ids, sameAuthor, "id")
+		}
+		return ids, nil
+	case subjects.TagFormat:
+		if record["format"] != BookFormat {
+			return nil, nil
+		}
+		tags, err := records(ctx, e.store, subjects.TagFormat,
+			map[string]string{"subject": record["subject"], "format": BookFormat})
+		return appendIDs([]string{record["record"]}, tags, "record"), err
+	case readinglists.EntryFormat:
+		entries, err := records(ctx, e.store, readinglists.EntryFormat, map[string]string{"list": record["list"]})
+		return appendIDs([]string{record["book"]}, entries, "book"), err
+	case circulation.CopyFormat:
+		return []string{record["book"]}, nil
+	case circulation.LoanFormat:
+		loans, err := records(ctx, e.store, circulation.LoanFormat, map[string]string{"patron": record["patron"]})
+		if err != nil {
+			return nil, err
+		}
+		var ids []string
+		for _, loan := range append(loans, record) {
+			copyRecord, err := e.store.GetRecord(ctx, circulation.CopyFormat, loan["copy"])
+			if err != nil && !errors.Is(err, bcerrors.ErrRecordNotFound) {
+				return ids, err
+			}
+			if err == nil {
+				ids = append(ids, copyRecord["book"])
+			}
+		}
+		return ids, nil
+	}
+	return nil, nil
+}
+
+// appendIDs appends the values of the field of the records to ids
+func appendIDs(ids []string, records []map[string]string, field string) []string {
+	for _, record := range records {
+		ids = append(ids, record[field])
+	}
+	return ids
+}
+
+// stale returns if the related books of the book have to be computed again
+func (e *Engine) stale(book map[string]string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, marked := e.marked[book["id"]]
+	return marked || book[ComputedField] == ""
+}
+
+// compute computes the related books of the books marked as stale and the books selected, caches them, and returns
+// how many it computed. Books marked as stale again while computing aren't cached, so that they are computed again.
+// It builds citing from the cached related books, and computes the books citing the books changed before.
+func (e *Engine) compute(ctx context.Context, selected func(book map[string]string) bool) (int, error) {
+	e.computing.Lock()
+	defer e.computing.Unlock()
+	e.mutex.Lock()
+	pending := e.marked
+	e.marked = make(map[string]struct{})
+	e.mutex.Unlock()
+	c, err := loadCatalog(ctx, e.store)
+	if err != nil {
+		e.mark(pending)
+		return 0, err
+	}
+	e.mutex.Lock()
+	e.citing = make(map[string]map[string]struct{})
+	for id, book := range c.books {
+		cite(e.citing, id, nil, boocat.SplitList(book[RelatedField]))
+	}
+	for uncitedID := range e.uncited {
+		for id := range e.citing[uncitedID] {
+			pending[id] = struct{}{}
+		}
+	}
+	e.uncited = make(map[string]struct{})
+	e.mutex.Unlock()
+	for id, book := range c.books {
+		if selected(book) {
+			pending[id] = struct{}{}
+		}
+	}
+	ids := make([]string, 0, len(pending))
+	for id := range pending {
+		if _, found := c.books[id]; found {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	computed := 0
+	for i, id := range ids {
+		related := c.related(id, Limit)
+		relatedIDs := make([]string, len(related))
+		for j, book := range related {
+			relatedIDs[j] = book.id
+		}
+		fields := map[string]string{
+			RelatedField:  boocat.JoinList(relatedIDs),
+			ComputedField: e.now().UTC().Format(time.RFC3339),
+		}
+		e.mutex.Lock()
+		_, marked := e.marked[id]
+		if !marked {
+			err = e.store.SetInternalFields(ctx, BookFormat, id, fields)
+		}
+		if !marked && err == nil {
+			cite(e.citing, id, boocat.SplitList(c.books[id][RelatedField]), relatedIDs)
+		}
+		e.mutex.Unlock()
+		if errors.Is(err, bcerrors.ErrRecordNotFound) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			left := make(map[string]struct{}, len(ids)-i)
+			for _, leftID := range ids[i:] {
+				left[leftID] = struct{}{}
+			}
+			e.mark(left)
+			return computed, err
+		}
+		if !marked {
+			computed++
+		}
+	}
+	return computed, nil
+}
+
+// cite replaces the books the book with the id cites in citing, which are the books in its cached related books
+func cite(citing map[string]map[string]struct{}, id string, old, cited []string) {
+	for _, oldID := range old {
+		delete(citing[oldID], id)
+	}
+	for _, citedID := range cited {
+		add(citing, citedID, id)
+	}
+}
+
+// mark marks the books with the ids as stale
+func (e *Engine) mark(ids map[string]struct{}) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for id := range ids {
+		e.marked[id] = struct{}{}
+	}
+}
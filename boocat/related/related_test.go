@@ -0,0 +1,122 @@
+package related
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	"github.com/ivanmartinez/boocat/boocat/internal/teststore"
+	"github.com/ivanmartinez/boocat/boocat/readinglists"
+	"github.com/ivanmartinez/boocat/boocat/subjects"
+)
+
+// TestRelated tests computing the books related to a book by author, subjects, synopsis and reading lists, without
+// the books of the same work, and that they are only computed by refreshing
+func TestRelated(t *testing.T) {
+	s := initializedStore()
+	e := newEngine(s)
+	if related, err := e.Related(context.Background(), "0"); err != nil || len(related) != 0 {
+		t.Errorf("related books computed without refreshing: %v, %v", related, err)
+	}
+	if _, err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ids := relatedIDs(t, e, "0"); !reflect.DeepEqual(ids, []string{"2", "1", "3"}) {
+		t.Errorf("unexpected related books: %v", ids)
+	}
+	s.SetInternalFields(context.Background(), BookFormat, "0", map[string]string{RelatedField: "3"})
+	if ids := relatedIDs(t, e, "0"); !reflect.DeepEqual(ids, []string{"3"}) {
+		t.Errorf("cached related books not used: %v", ids)
+	}
+}
+
+// TestChanged tests marking the books whose related books may change as stale, and refreshing them
+func TestChanged(t *testing.T) {
+	s := initializedStore()
+	e := newEngine(s)
+	if computed, err := e.RefreshAll(context.Background()); err != nil || computed != 5 {
+		t.Fatalf("unexpected refresh: %d, %v", computed, err)
+	}
+	if computed, err := e.Refresh(context.Background()); err != nil || computed != 0 {
+		t.Fatalf("unexpected refresh: %d, %v", computed, err)
+	}
+	e.Changed(context.Background(), subjects.TagFormat,
+		map[string]string{"id": "2", "subject": "0", "format": BookFormat, "record": "3"})
+	e.Changed(context.Background(), circulation.LoanFormat, map[string]string{"id": "1", "copy": "1", "patron": "0"})
+	for id, stale := range map[string]bool{"0": true, "1": false, "2": true, "3": true, "4": true} {
+		if book, _ := s.GetRecord(context.Background(), BookFormat, id); (book[ComputedField] == "") != stale {
+			t.Errorf("unexpected cache of book %s: %v", id, book)
+		}
+	}
+	if ids := relatedIDs(t, e, "0"); !reflect.DeepEqual(ids, []string{"2", "1", "3"}) {
+		t.Errorf("stale related books not used: %v", ids)
+	}
+	if computed, err := e.Refresh(context.Background()); err != nil || computed != 4 {
+		t.Errorf("unexpected refresh: %d, %v", computed, err)
+	}
+}
+
+// TestChangedBook tests marking as stale the books whose related books include a changed book, also when it changes
+// before the first computation
+func TestChangedBook(t *testing.T) {
+	s := initializedStore()
+	e := newEngine(s)
+	if _, err := e.RefreshAll(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	book, _ := s.GetRecord(context.Background(), BookFormat, "3")
+	e.Changed(context.Background(), BookFormat, book)
+	for id, stale := range map[string]bool{"0": true, "1": false, "2": false, "3": true, "4": false} {
+		if book, _ := s.GetRecord(context.Background(), BookFormat, id); (book[ComputedField] == "") != stale {
+			t.Errorf("unexpected cache of book %s: %v", id, book)
+		}
+	}
+	if computed, err := e.Refresh(context.Background()); err != nil || computed != 2 {
+		t.Fatalf("unexpected refresh: %d, %v", computed, err)
+	}
+	e = newEngine(s)
+	e.Changed(context.Background(), BookFormat, book)
+	if computed, err := e.Refresh(context.Background()); err != nil || computed != 2 {
+		t.Errorf("unexpected refresh: %d, %v", computed, err)
+	}
+}
+
+// relatedIDs returns the IDs of the related books of the book with the id
+func relatedIDs(t *testing.T, e *Engine, id string) []string {
+	related, err := e.Related(context.Background(), id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var ids []string
+	for _, book := range related {
+		ids = append(ids, book["id"])
+	}
+	return ids
+}
+
+// initializedStore returns a boocat with books related by author, subjects, synopsis and reading lists
+func initializedStore() *boocat.Boocat {
+	db := teststore.NewDB()
+	formats := append(circulation.Formats(db.ReferenceValidator), subjects.Formats(db.ReferenceValidator)...)
+	formats = append(formats, readinglists.Formats(db.ReferenceValidator)...)
+	bc := db.Boocat(append(formats, teststore.Book(db.ReferenceValidator))...)
+	db.Restore(BookFormat,
+		map[string]string{"id": "0", "author": "0", "work": "0", "synopsis": "The desert planet, its spice and the empire"},
+		map[string]string{"id": "1", "author": "0", "synopsis": "Messiah and emperor of the spice"},
+		map[string]string{"id": "2", "author": "1", "synopsis": "A war in the desert"},
+		map[string]string{"id": "3", "author": "2", "synopsis": "Recipes of pasta"},
+		map[string]string{"id": "4", "author": "0", "work": "0"})
+	db.Restore(subjects.TagFormat,
+		map[string]string{"id": "0", "subject": "0", "format": BookFormat, "record": "0"},
+		map[string]string{"id": "1", "subject": "0", "format": BookFormat, "record": "2"})
+	db.Restore(readinglists.EntryFormat,
+		map[string]string{"id": "0", "list": "0", "book": "0"},
+		map[string]string{"id": "1", "list": "0", "book": "3"})
+	db.Restore(circulation.CopyFormat,
+		map[string]string{"id": "0", "book": "4"},
+		map[string]string{"id": "1", "book": "2"})
+	db.Restore(circulation.LoanFormat, map[string]string{"id": "0", "copy": "0", "patron": "0"})
+	return bc
+}
@@ -0,0 +1,79 @@
+package reviews
+
+// Implements the format of the records of reviews
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+)
+
+// ReviewFormat is the name of the format of reviews of books by patrons
+const ReviewFormat = "review"
+
+// Internal fields of the reviewed books with the average rating of their approved reviews and how many there are,
+// which are removed when there are none
+const (
+	RatingField  = "_rating"
+	RatingsField = "_ratings"
+)
+
+// Lowest and highest ratings
+const (
+	MinRating = 1
+	MaxRating = 5
+)
+
+// Layout of the times reviews are submitted
+const submittedLayout = time.RFC3339Nano
+
+// Format returns the format of reviews. reference returns the validator of the fields that reference records of a
+// format. A patron can only review a book once, and reviews are deleted with their books and patrons.
+func Format(reference func(formatName string) boocat.Validate) boocat.Format {
+	return boocat.Format{
+		Name: ReviewFormat,
+		Fields: map[string]boocat.Validate{
+			"book":      reference("book"),
+			"patron":    reference(circulation.PatronFormat),
+			"rating":    validateRating,
+			"text":      nil,
+			"status":    validateStatus,
+			"submitted": validateSubmitted,
+		},
+		References: map[string]string{"book": "book", "patron": circulation.PatronFormat},
+		OnDelete:   map[string]boocat.ReferencePolicy{"book": boocat.Cascade, "patron": boocat.Cascade},
+		Facets:     map[string]struct{}{"rating": {}, "status": {}},
+		Unique:     [][]string{{"book", "patron"}},
+	}
+}
+
+// validateRating validates a rating between MinRating and MaxRating
+func validateRating(_ context.Context, value interface{}) string {
+	rating, err := strconv.Atoi(fmt.Sprintf("%v", value))
+	if err != nil || rating < MinRating || rating > MaxRating {
+		return fmt.Sprintf("not a number from %d to %d", MinRating, MaxRating)
+	}
+	return ""
+}
+
+// validateStatus validates the status of a review
+func validateStatus(_ context.Context, value interface{}) string {
+	switch Status(fmt.Sprintf("%v", value)) {
+	case Pending, Approved, Rejected:
+		return ""
+	default:
+		return "not a review status"
+	}
+}
+
+// validateSubmitted validates the time a review was submitted
+func validateSubmitted(_ context.Context, value interface{}) string {
+	if _, err := time.Parse(submittedLayout, fmt.Sprintf("%v", value)); err != nil {
+		return "not a time in RFC 3339 format"
+	}
+	return ""
+}
@@ -0,0 +1,272 @@
+package reviews
+
+// Implements the reviews of books by patrons, which are moderated before they count for the ratings of the books
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// ErrInvalidRating is returned when submitting a review with a rating out of bounds
+var ErrInvalidRating = errors.New("rating must be from 1 to 5")
+
+// ErrInvalidStatus is returned when moderating a review with a status other than Approved or Rejected
+var ErrInvalidStatus = errors.New("review can only be approved or rejected")
+
+// Status is the moderation status of a review
+type Status string
+
+const (
+	// Pending reviews wait for moderation
+	Pending Status = "pending"
+	// Approved reviews are shown and count for the rating of their books
+	Approved Status = "approved"
+	// Rejected reviews aren't shown
+	Rejected Status = "rejected"
+)
+
+// Review is a review of a book by a patron
+type Review struct {
+	ID       string
+	BookID   string
+	PatronID string
+	Rating   int
+	Text     string
+	Status   Status
+	// Time the review was last submitted
+	Submitted time.Time
+}
+
+// store is what reviews need of boocat.Boocat
+type store interface {
+	GetRecord(ctx context.Context, formatName string, id string) (map[string]string, error)
+	FilterRecords(ctx context.Context, formatName string, filter boocat.Filter) (boocat.FilteredRecords, error)
+	AddRecord(ctx context.Context, formatName string, record map[string]string) (string, error)
+	UpdateRecord(ctx context.Context, formatName string, record map[string]string) error
+	SetInternalFields(ctx context.Context, formatName, id string, fields map[string]string) error
+}
+
+// Reviews submits and moderates reviews, and keeps the ratings of the books in their RatingField and RatingsField up
+// to date with every change made through it. Changes of reviews are undone if the ratings can't be counted, and an
+// unexpected error is returned if they can't be undone either.
+type Reviews struct {
+	store store
+	// mutex serializes the changes of reviews, so that the ratings of books are counted after every change
+	mutex sync.Mutex
+	// now returns the current time
+	now func() time.Time
+}
+
+// NewReviews returns the reviews of the records of bc, which follows the changes of its records to count the ratings
+// of the books whose reviews are changed without it, e.g. deleted with their patrons or restored from the trash
+func NewReviews(bc *boocat.Boocat) *Reviews {
+	r := newReviews(bc)
+	bc.OnChange(r.Changed)
+	return r
+}
+
+// newReviews returns the reviews of the records of s
+func newReviews(s store) *Reviews {
+	return &Reviews{store: s, now: time.Now}
+}
+
+// changingKey is the key of the value of the contexts of the changes of reviews made by Reviews, which count the
+// ratings themselves
+type changingKey struct{}
+
+// Changed counts the ratings of the book of the review again if the record of the format is a review changed without
+// Reviews. It's a boocat.ChangeHook. Errors are ignored, and the ratings are counted again with the next change.
+func (r *Reviews) Changed(ctx context.Context, formatName string, record map[string]string) {
+	if formatName != ReviewFormat || ctx.Value(changingKey{}) != nil {
+		return
+	}
+	r.Recount(ctx, record["book"])
+}
+
+// Submit submits the review of the patron with the id of the book with the id, and returns it. A patron who already
+// reviewed the book replaces the review. Submitted reviews wait for moderation. The error is ErrInvalidRating if the
+// rating is out of bounds.
+func (r *Reviews) Submit(ctx context.Context, bookID, patronID string, rating int, text string) (Review, error) {
+	if rating < MinRating || rating > MaxRating {
+		return Review{}, ErrInvalidRating
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ctx = context.WithValue(ctx, changingKey{}, true)
+	if _, err := r.store.GetRecord(ctx, "book", bookID); err != nil {
+		return Review{}, err
+	}
+	if _, err := r.store.GetRecord(ctx, circulation.PatronFormat, patronID); err != nil {
+		return Review{}, err
+	}
+	review := Review{
+		BookID:    bookID,
+		PatronID:  patronID,
+		Rating:    rating,
+		Text:      strings.TrimSpace(text),
+		Status:    Pending,
+		Submitted: r.now().UTC(),
+	}
+	previous, err := r.reviews(ctx, map[string]string{"book": bookID, "patron": patronID})
+	if err != nil {
+		return Review{}, err
+	}
+	if len(previous) == 0 {
+		review.ID, err = r.store.AddRecord(ctx, ReviewFormat, review.record())
+		if err != nil {
+			return Review{}, err
+		}
+		return review, nil
+	}
+	review.ID = previous[0].ID
+	if err := r.store.UpdateRecord(ctx, ReviewFormat, review.record()); err != nil {
+		return Review{}, err
+	}
+	if previous[0].Status != Approved {
+		return review, nil
+	}
+	if err := r.recount(ctx, bookID); err != nil {
+		if undoErr := r.store.UpdateRecord(ctx, ReviewFormat, previous[0].record()); undoErr != nil {
+			return Review{}, bcerrors.NewUndoError(err, undoErr)
+		}
+		return Review{}, err
+	}
+	return review, nil
+}
+
+// Moderate sets the status of the review with the id to Approved or Rejected, and returns the review. The error is
+// ErrInvalidStatus for other statuses.
+func (r *Reviews) Moderate(ctx context.Context, id string, status Status) (Review, error) {
+	if status != Approved && status != Rejected {
+		return Review{}, ErrInvalidStatus
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ctx = context.WithValue(ctx, changingKey{}, true)
+	record, err := r.store.GetRecord(ctx, ReviewFormat, id)
+	if err != nil {
+		return Review{}, err
+	}
+	previous := reviewFromRecord(record)
+	review := previous
+	review.Status = status
+	if err := r.store.UpdateRecord(ctx, ReviewFormat, review.record()); err != nil {
+		return Review{}, err
+	}
+	if previous.Status != Approved && status != Approved {
+		return review, nil
+	}
+	if err := r.recount(ctx, review.BookID); err != nil {
+		if undoErr := r.store.UpdateRecord(ctx, ReviewFormat, previous.record()); undoErr != nil {
+			return Review{}, bcerrors.NewUndoError(err, undoErr)
+		}
+		return Review{}, err
+	}
+	return review, nil
+}
+
+// Pending returns the reviews that wait for moderation, the oldest first
+func (r *Reviews) Pending(ctx context.Context) ([]Review, error) {
+	pending, err := r.reviews(ctx, map[string]string{"status": string(Pending)})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Submitted.Before(pending[j].Submitted)
+	})
+	return pending, nil
+}
+
+// BookReviews returns the approved reviews of the book with the id, the newest first
+func (r *Reviews) BookReviews(ctx context.Context, bookID string) ([]Review, error) {
+	approved, err := r.reviews(ctx, map[string]string{"book": bookID, "status": string(Approved)})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(approved, func(i, j int) bool {
+		return approved[i].Submitted.After(approved[j].Submitted)
+	})
+	return approved, nil
+}
+
+// Recount counts the rating of the book with the id again, e.g. after its reviews are changed without Reviews
+func (r *Reviews) Recount(ctx context.Context, bookID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.recount(ctx, bookID)
+}
+
+// recount sets the average rating of the approved reviews of the book with the id and how many there are
+func (r *Reviews) recount(ctx context.Context, bookID string) error {
+	approved, err := r.reviews(ctx, map[string]string{"book": bookID, "status": string(Approved)})
+	if err != nil {
+		return err
+	}
+	fields := map[string]string{RatingField: "", RatingsField: ""}
+	if len(approved) > 0 {
+		sum := 0
+		for _, review := range approved {
+			sum += review.Rating
+		}
+		fields[RatingField] = strconv.FormatFloat(float64(sum)/float64(len(approved)), 'f', 1, 64)
+		fields[RatingsField] = strconv.Itoa(len(approved))
+	}
+	err = r.store.SetInternalFields(ctx, "book", bookID, fields)
+	if errors.Is(err, bcerrors.ErrRecordNotFound) {
+		// Deleted books don't have ratings to keep
+		return nil
+	}
+	return err
+}
+
+// reviews returns the reviews whose records have the field values
+func (r *Reviews) reviews(ctx context.Context, equal map[string]string) ([]Review, error) {
+	filtered, err := r.store.FilterRecords(ctx, ReviewFormat, boocat.Filter{Equal: equal})
+	if err != nil {
+		return nil, err
+	}
+	reviews := make([]Review, 0, len(filtered.Records))
+	for _, record := range filtered.Records {
+		reviews = append(reviews, reviewFromRecord(record))
+	}
+	return reviews, nil
+}
+
+// record returns the record of the review
+func (r Review) record() map[string]string {
+	record := map[string]string{
+		"book":      r.BookID,
+		"patron":    r.PatronID,
+		"rating":    strconv.Itoa(r.Rating),
+		"text":      r.Text,
+		"status":    string(r.Status),
+		"submitted": r.Submitted.Format(submittedLayout),
+	}
+	if r.ID != "" {
+		record["id"] = r.ID
+	}
+	return record
+}
+
+// reviewFromRecord returns the review of a record
+func reviewFromRecord(record map[string]string) Review {
+	review := Review{
+		ID:       record["id"],
+		BookID:   record["book"],
+		PatronID: record["patron"],
+		Text:     record["text"],
+		Status:   Status(record["status"]),
+	}
+	review.Rating, _ = strconv.Atoi(record["rating"])
+	review.Submitted, _ = time.Parse(submittedLayout, record["submitted"])
+	return review
+}
@@ -0,0 +1,174 @@
+package reviews
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/internal/teststore"
+)
+
+// errFailed is the error of the changes of failingStore
+var errFailed = errors.New("failed")
+
+// failingStore is a store that fails to set internal fields, and to update records after a number of updates
+type failingStore struct {
+	store
+	// Number of updates that succeed
+	updates int
+}
+
+// UpdateRecord updates the record if there are updates left, and fails otherwise
+func (s *failingStore) UpdateRecord(ctx context.Context, formatName string, record map[string]string) error {
+	if s.updates == 0 {
+		return errFailed
+	}
+	s.updates--
+	return s.store.UpdateRecord(ctx, formatName, record)
+}
+
+// SetInternalFields fails
+func (s *failingStore) SetInternalFields(context.Context, string, string, map[string]string) error {
+	return errFailed
+}
+
+// TestSubmit tests submitting reviews, which wait for moderation, and replacing them
+func TestSubmit(t *testing.T) {
+	s := initializedStore()
+	r := initializedReviews(s)
+	review, err := r.Submit(context.Background(), "0", "0", 4, " Beautiful ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if review.Status != Pending || review.Text != "Beautiful" {
+		t.Errorf("unexpected review: %+v", review)
+	}
+	if _, err := r.Submit(context.Background(), "0", "0", 5, "Even better"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reviews, _ := s.ListRecords(context.Background(), ReviewFormat); len(reviews) != 1 ||
+		reviews[0]["rating"] != "5" {
+		t.Errorf("unexpected reviews: %v", reviews)
+	}
+	if _, err := r.Submit(context.Background(), "0", "1", 6, ""); !errors.Is(err, ErrInvalidRating) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := r.Submit(context.Background(), "7", "1", 3, ""); !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestModerate tests the moderation queue, and the ratings of the book after approving and rejecting reviews
+func TestModerate(t *testing.T) {
+	s := initializedStore()
+	r := initializedReviews(s)
+	first, _ := r.Submit(context.Background(), "0", "0", 4, "")
+	r.now = func() time.Time { return time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC) }
+	second, _ := r.Submit(context.Background(), "0", "1", 5, "")
+	pending, err := r.Pending(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pending) != 2 || pending[0].ID != first.ID {
+		t.Errorf("unexpected pending reviews: %+v", pending)
+	}
+	for _, id := range []string{first.ID, second.ID} {
+		if _, err := r.Moderate(context.Background(), id, Approved); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if book, _ := s.GetRecord(context.Background(), "book", "0"); book[RatingField] != "4.5" || book[RatingsField] != "2" {
+		t.Errorf("unexpected book: %v", book)
+	}
+	if _, err := r.Moderate(context.Background(), second.ID, Rejected); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if book, _ := s.GetRecord(context.Background(), "book", "0"); book[RatingField] != "4.0" || book[RatingsField] != "1" {
+		t.Errorf("unexpected book: %v", book)
+	}
+	if _, err := r.Submit(context.Background(), "0", "0", 2, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if book, _ := s.GetRecord(context.Background(), "book", "0"); book[RatingField] != "" {
+		t.Errorf("unexpected book: %v", book)
+	}
+	if _, err := r.Moderate(context.Background(), first.ID, Pending); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestModerateUndoFail tests approving a review when the ratings can't be counted and the review can't be restored
+func TestModerateUndoFail(t *testing.T) {
+	s := initializedStore()
+	r := initializedReviews(s)
+	review, _ := r.Submit(context.Background(), "0", "0", 4, "")
+	r.store = &failingStore{store: s, updates: 1}
+	_, err := r.Moderate(context.Background(), review.ID, Approved)
+	var unexpectedError bcerrors.UnexpectedError
+	if !errors.As(err, &unexpectedError) || !errors.Is(err, errFailed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestDeleteReviewer tests counting the ratings of a book again when the reviews of a patron are deleted with the
+// patron and restored from the trash
+func TestDeleteReviewer(t *testing.T) {
+	s := initializedStore()
+	r := NewReviews(s)
+	for patronID, rating := range map[string]int{"0": 4, "1": 5} {
+		review, _ := r.Submit(context.Background(), "0", patronID, rating, "")
+		r.Moderate(context.Background(), review.ID, Approved)
+	}
+	if err := s.DeleteRecord(context.Background(), circulation.PatronFormat, "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if book, _ := s.GetRecord(context.Background(), "book", "0"); book[RatingField] != "4.0" ||
+		book[RatingsField] != "1" {
+		t.Errorf("unexpected book: %v", book)
+	}
+	if err := s.RestoreFromTrash(context.Background(), circulation.PatronFormat, "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if book, _ := s.GetRecord(context.Background(), "book", "0"); book[RatingField] != "4.5" ||
+		book[RatingsField] != "2" {
+		t.Errorf("unexpected book: %v", book)
+	}
+}
+
+// TestBookReviews tests listing the approved reviews of a book
+func TestBookReviews(t *testing.T) {
+	r := initializedReviews(initializedStore())
+	first, _ := r.Submit(context.Background(), "0", "0", 4, "")
+	r.Submit(context.Background(), "0", "1", 5, "")
+	r.Moderate(context.Background(), first.ID, Approved)
+	reviews, err := r.BookReviews(context.Background(), "0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reviews) != 1 || reviews[0].ID != first.ID {
+		t.Errorf("unexpected reviews: %+v", reviews)
+	}
+}
+
+// initializedReviews returns the reviews of the store, on 2021-03-01
+func initializedReviews(s store) *Reviews {
+	r := newReviews(s)
+	r.now = func() time.Time { return time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC) }
+	return r
+}
+
+// initializedStore returns a boocat with a book and patrons for testing
+func initializedStore() *boocat.Boocat {
+	db := teststore.NewDB()
+	bc := db.Boocat(append(circulation.Formats(db.ReferenceValidator), Format(db.ReferenceValidator),
+		teststore.Book(db.ReferenceValidator))...)
+	db.Restore("book", map[string]string{"id": "0", "name": "Norwegian Wood"})
+	db.Restore(circulation.PatronFormat,
+		map[string]string{"id": "0", "name": "Haruki Murakami", "card": "P0001"},
+		map[string]string{"id": "1", "name": "George Orwell", "card": "P0002"})
+	return bc
+}
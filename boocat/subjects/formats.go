@@ -0,0 +1,51 @@
+package subjects
+
+// Implements the formats of the records of the vocabulary of subjects and the tags of records with subjects
+
+import (
+	"github.com/ivanmartinez/boocat/boocat"
+)
+
+// Names of the formats of subjects
+const (
+	// Terms of the vocabulary, each with its broader term, if any, and its synonyms
+	SubjectFormat = "subject"
+	// Assignments of subjects to records of any format
+	TagFormat = "tag"
+)
+
+// Formats returns the formats of subjects. reference returns the validator of the fields that reference records of a
+// format. Deleting a subject makes its narrower terms top terms and deletes its tags. Tags reference records of any
+// format, which must exist.
+func Formats(reference func(formatName string) boocat.Validate) []boocat.Format {
+	return []boocat.Format{
+		{
+			Name: SubjectFormat,
+			Fields: map[string]boocat.Validate{
+				"name":     boocat.ValidateRequired,
+				"broader":  boocat.Optional(reference(SubjectFormat)),
+				"synonyms": nil,
+				"note":     nil,
+			},
+			Searchable: map[string]struct{}{"name": {}, "synonyms": {}},
+			Lists:      map[string]struct{}{"synonyms": {}},
+			References: map[string]string{"broader": SubjectFormat},
+			OnDelete:   map[string]boocat.ReferencePolicy{"broader": boocat.SetNull},
+			Unique:     [][]string{{"name"}},
+			Display:    "name",
+		},
+		{
+			Name: TagFormat,
+			Fields: map[string]boocat.Validate{
+				"subject": reference(SubjectFormat),
+				"format":  boocat.ValidateRequired,
+				"record":  boocat.ValidateRequired,
+			},
+			References:       map[string]string{"subject": SubjectFormat},
+			FormatReferences: map[string]string{"record": "format"},
+			OnDelete:         map[string]boocat.ReferencePolicy{"subject": boocat.Cascade},
+			Unique:           [][]string{{"subject", "format", "record"}},
+			Facets:           map[string]struct{}{"format": {}},
+		},
+	}
+}
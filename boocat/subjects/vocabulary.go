@@ -0,0 +1,329 @@
+package subjects
+
+// Implements the controlled vocabulary of subjects, whose terms form a hierarchy of broader and narrower terms, and the
+// tagging of records of any format with them
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// Subject is a term of the vocabulary
+type Subject struct {
+	ID   string
+	Name string
+	// ID of the broader term, empty for top terms
+	BroaderID string
+	// Other names of the subject, which find it as its name does
+	Synonyms []string
+	// Note about the scope of the subject
+	Note string
+}
+
+// TaggedRecord is a record tagged with a subject
+type TaggedRecord struct {
+	FormatName string
+	Record     map[string]string
+}
+
+// store holds the subjects and tags
+type store interface {
+	GetRecord(ctx context.Context, formatName string, id string) (map[string]string, error)
+	ListRecords(ctx context.Context, formatName string) ([]map[string]string, error)
+	FilterRecords(ctx context.Context, formatName string, filter boocat.Filter) (boocat.FilteredRecords, error)
+	AddRecord(ctx context.Context, formatName string, record map[string]string) (string, error)
+	DeleteRecord(ctx context.Context, formatName string, id string) error
+}
+
+// Vocabulary browses the subjects, and tags records with them
+type Vocabulary struct {
+	store store
+}
+
+// NewVocabulary returns the vocabulary of the records of bc, which removes the tags of the records that are deleted
+func NewVocabulary(bc *boocat.Boocat) *Vocabulary {
+	v := newVocabulary(bc)
+	bc.OnChange(v.Changed)
+	return v
+}
+
+// newVocabulary returns the vocabulary of the records of s
+func newVocabulary(s store) *Vocabulary {
+	return &Vocabulary{store: s}
+}
+
+// Changed deletes the tags of the record of the format if it was deleted. It's a boocat.ChangeHook. Restoring the
+// record doesn't restore its tags.
+func (v *Vocabulary) Changed(ctx context.Context, formatName string, record map[string]string) {
+	if _, deleted := record[boocat.TrashedField]; !deleted || formatName == TagFormat {
+		return
+	}
+	v.deleteTags(ctx, map[string]string{"format": formatName, "record": record["id"]})
+}
+
+// Subject returns the subject with the id
+func (v *Vocabulary) Subject(ctx context.Context, id string) (Subject, error) {
+	record, err := v.store.GetRecord(ctx, SubjectFormat, id)
+	if err != nil {
+		return Subject{}, err
+	}
+	return subjectFromRecord(record), nil
+}
+
+// Find returns the subject whose name or a synonym is the term, case-insensitive. The error is
+// bcerrors.ErrRecordNotFound if there's none.
+func (v *Vocabulary) Find(ctx context.Context, term string) (Subject, error) {
+	h, err := v.hierarchy(ctx)
+	if err != nil {
+		return Subject{}, err
+	}
+	term = strings.TrimSpace(term)
+	var synonym *Subject
+	for i, subject := range h.subjects {
+		if strings.EqualFold(subject.Name, term) {
+			return subject, nil
+		}
+		for _, name := range subject.Synonyms {
+			if synonym == nil && strings.EqualFold(name, term) {
+				synonym = &h.subjects[i]
+			}
+		}
+	}
+	if synonym != nil {
+		return *synonym, nil
+	}
+	return Subject{}, bcerrors.ErrRecordNotFound
+}
+
+// Top returns the subjects without broader term, sorted by name
+func (v *Vocabulary) Top(ctx context.Context) ([]Subject, error) {
+	h, err := v.hierarchy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return h.narrower[""], nil
+}
+
+// Narrower returns the subjects whose broader term is the subject with the id, sorted by name
+func (v *Vocabulary) Narrower(ctx context.Context, id string) ([]Subject, error) {
+	h, err := v.hierarchy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return h.narrower[id], nil
+}
+
+// Broader returns the broader terms of the subject, from the top term to its direct broader term
+func (v *Vocabulary) Broader(ctx context.Context, subject Subject) ([]Subject, error) {
+	var broader []Subject
+	visited := map[string]struct{}{subject.ID: {}}
+	for id := subject.BroaderID; id != ""; id = broader[0].BroaderID {
+		if _, found := visited[id]; found {
+			break
+		}
+		visited[id] = struct{}{}
+		term, err := v.Subject(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		broader = append([]Subject{term}, broader...)
+	}
+	return broader, nil
+}
+
+// Expand returns the ids of the subject with the id and of all its narrower terms, at any depth
+func (v *Vocabulary) Expand(ctx context.Context, id string) ([]string, error) {
+	h, err := v.hierarchy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	expanded := []string{id}
+	visited := map[string]struct{}{id: {}}
+	for i := 0; i < len(expanded); i++ {
+		for _, subject := range h.narrower[expanded[i]] {
+			if _, found := visited[subject.ID]; !found {
+				visited[subject.ID] = struct{}{}
+				expanded = append(expanded, subject.ID)
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// Tag tags the record of the format with the id with the subject with the id. Tagging it again does nothing.
+func (v *Vocabulary) Tag(ctx context.Context, formatName, recordID, subjectID string) error {
+	if _, err := v.store.GetRecord(ctx, formatName, recordID); err != nil {
+		return err
+	}
+	if _, err := v.store.GetRecord(ctx, SubjectFormat, subjectID); err != nil {
+		return err
+	}
+	tags, err := v.tags(ctx, map[string]string{"subject": subjectID, "format": formatName, "record": recordID})
+	if err != nil || len(tags) > 0 {
+		return err
+	}
+	_, err = v.store.AddRecord(ctx, TagFormat, map[string]string{
+		"subject": subjectID,
+		"format":  formatName,
+		"record":  recordID,
+	})
+	return err
+}
+
+// Untag removes the subject with the id from the record of the format with the id
+func (v *Vocabulary) Untag(ctx context.Context, formatName, recordID, subjectID string) error {
+	return v.deleteTags(ctx, map[string]string{"subject": subjectID, "format": formatName, "record": recordID})
+}
+
+// MoveTags moves the subjects of the record of the format with fromID to the record with toID, e.g. after merging
+// the records. Subjects the record with toID already has aren't repeated.
+func (v *Vocabulary) MoveTags(ctx context.Context, formatName, fromID, toID string) error {
+	tags, err := v.tags(ctx, map[string]string{"format": formatName, "record": fromID})
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := v.Tag(ctx, formatName, toID, tag["subject"]); err != nil {
+			return err
+		}
+		if err := v.store.DeleteRecord(ctx, TagFormat, tag["id"]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordSubjects returns the subjects of the record of the format with the id, sorted by name
+func (v *Vocabulary) RecordSubjects(ctx context.Context, formatName, recordID string) ([]Subject, error) {
+	tags, err := v.tags(ctx, map[string]string{"format": formatName, "record": recordID})
+	if err != nil {
+		return nil, err
+	}
+	subjects := make([]Subject, 0, len(tags))
+	for _, tag := range tags {
+		subject, err := v.Subject(ctx, tag["subject"])
+		if err != nil {
+			continue
+		}
+		subjects = append(subjects, subject)
+	}
+	sortByName(subjects)
+	return subjects, nil
+}
+
+// Tagged returns the records tagged with the subject with the id, and with its narrower terms if narrower is true,
+// sorted by format and id. The tags of records that aren't found, e.g. because they were deleted before their tags were
+// removed with them, are deleted.
+func (v *Vocabulary) Tagged(ctx context.Context, subjectID string, narrower bool) ([]TaggedRecord, error) {
+	ids := []string{subjectID}
+	if narrower {
+		var err error
+		if ids, err = v.Expand(ctx, subjectID); err != nil {
+			return nil, err
+		}
+	}
+	var tagged []TaggedRecord
+	found := make(map[[2]string]struct{})
+	for _, id := range ids {
+		tags, err := v.tags(ctx, map[string]string{"subject": id})
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			key := [2]string{tag["format"], tag["record"]}
+			if _, isFound := found[key]; isFound {
+				continue
+			}
+			record, err := v.store.GetRecord(ctx, tag["format"], tag["record"])
+			if errors.Is(err, bcerrors.ErrRecordNotFound) || errors.Is(err, bcerrors.ErrFormatNotFound) {
+				if err := v.store.DeleteRecord(ctx, TagFormat, tag["id"]); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			found[key] = struct{}{}
+			tagged = append(tagged, TaggedRecord{FormatName: tag["format"], Record: record})
+		}
+	}
+	sort.SliceStable(tagged, func(i, j int) bool {
+		if tagged[i].FormatName != tagged[j].FormatName {
+			return tagged[i].FormatName < tagged[j].FormatName
+		}
+		return tagged[i].Record["id"] < tagged[j].Record["id"]
+	})
+	return tagged, nil
+}
+
+// hierarchy holds all the subjects, loaded at once
+type hierarchy struct {
+	// All the subjects, sorted by name
+	subjects []Subject
+	// Subjects by the id of their broader term, sorted by name. Top terms are under the empty id.
+	narrower map[string][]Subject
+}
+
+// hierarchy loads all the subjects with a single listing, and returns their hierarchy
+func (v *Vocabulary) hierarchy(ctx context.Context) (hierarchy, error) {
+	records, err := v.store.ListRecords(ctx, SubjectFormat)
+	if err != nil {
+		return hierarchy{}, err
+	}
+	h := hierarchy{subjects: make([]Subject, 0, len(records)), narrower: make(map[string][]Subject)}
+	for _, record := range records {
+		h.subjects = append(h.subjects, subjectFromRecord(record))
+	}
+	sortByName(h.subjects)
+	for _, subject := range h.subjects {
+		h.narrower[subject.BroaderID] = append(h.narrower[subject.BroaderID], subject)
+	}
+	return h, nil
+}
+
+// tags returns the records of the tags with the field values
+func (v *Vocabulary) tags(ctx context.Context, equal map[string]string) ([]map[string]string, error) {
+	filtered, err := v.store.FilterRecords(ctx, TagFormat, boocat.Filter{Equal: equal})
+	if err != nil {
+		return nil, err
+	}
+	return filtered.Records, nil
+}
+
+// deleteTags deletes the tags with the field values
+func (v *Vocabulary) deleteTags(ctx context.Context, equal map[string]string) error {
+	tags, err := v.tags(ctx, equal)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := v.store.DeleteRecord(ctx, TagFormat, tag["id"]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subjectFromRecord returns the subject of a record
+func subjectFromRecord(record map[string]string) Subject {
+	return Subject{
+		ID:        record["id"],
+		Name:      record["name"],
+		BroaderID: record["broader"],
+		Synonyms:  boocat.SplitList(record["synonyms"]),
+		Note:      record["note"],
+	}
+}
+
+// sortByName sorts the subjects by name, case-insensitive
+func sortByName(subjects []Subject) {
+	sort.SliceStable(subjects, func(i, j int) bool {
+		return strings.ToLower(subjects[i].Name) < strings.ToLower(subjects[j].Name)
+	})
+}
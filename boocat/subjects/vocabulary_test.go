@@ -0,0 +1,142 @@
+package subjects
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/internal/teststore"
+)
+
+// TestFind tests finding subjects by name and by synonym
+func TestFind(t *testing.T) {
+	v := newVocabulary(initializedStore())
+	subject, err := v.Find(context.Background(), " science fiction ")
+	if err != nil || subject.ID != "1" {
+		t.Errorf("unexpected subject: %+v, %v", subject, err)
+	}
+	subject, err = v.Find(context.Background(), "Sci-fi")
+	if err != nil || subject.ID != "1" {
+		t.Errorf("unexpected subject: %+v, %v", subject, err)
+	}
+	if _, err := v.Find(context.Background(), "Poetry"); !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestHierarchy tests the top, broader and narrower terms, and expanding a subject to its narrower terms
+func TestHierarchy(t *testing.T) {
+	v := newVocabulary(initializedStore())
+	top, err := v.Top(context.Background())
+	if err != nil || len(top) != 1 || top[0].Name != "Fiction" {
+		t.Errorf("unexpected top terms: %+v, %v", top, err)
+	}
+	narrower, err := v.Narrower(context.Background(), "0")
+	if err != nil || len(narrower) != 2 || narrower[0].Name != "Dystopias" {
+		t.Errorf("unexpected narrower terms: %+v, %v", narrower, err)
+	}
+	cyberpunk, _ := v.Subject(context.Background(), "3")
+	broader, err := v.Broader(context.Background(), cyberpunk)
+	if err != nil || len(broader) != 2 || broader[0].Name != "Fiction" || broader[1].Name != "Science fiction" {
+		t.Errorf("unexpected broader terms: %+v, %v", broader, err)
+	}
+	expanded, err := v.Expand(context.Background(), "0")
+	if err != nil || !reflect.DeepEqual(expanded, []string{"0", "2", "1", "3"}) {
+		t.Errorf("unexpected expanded subjects: %v, %v", expanded, err)
+	}
+}
+
+// TestTag tests tagging records, and getting the records of a subject with and without its narrower terms
+func TestTag(t *testing.T) {
+	s := initializedStore()
+	v := newVocabulary(s)
+	for _, tag := range [][2]string{{"0", "1"}, {"1", "3"}, {"1", "3"}} {
+		if err := v.Tag(context.Background(), "book", tag[0], tag[1]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if tags, _ := s.ListRecords(context.Background(), TagFormat); len(tags) != 2 {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+	if err := v.Tag(context.Background(), "book", "7", "1"); !errors.Is(err, bcerrors.ErrRecordNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, tag := range []map[string]string{
+		{"subject": "2", "format": "magazine", "record": "0"},
+		{"subject": "2", "format": "book", "record": "7"},
+	} {
+		var validationErr bcerrors.ValidationFailedError
+		if _, err := s.AddRecord(context.Background(), TagFormat, tag); !errors.As(err, &validationErr) {
+			t.Errorf("unexpected error adding %v: %v", tag, err)
+		}
+	}
+	tagged, err := v.Tagged(context.Background(), "1", false)
+	if err != nil || len(tagged) != 1 || tagged[0].Record["id"] != "0" {
+		t.Errorf("unexpected tagged records: %+v, %v", tagged, err)
+	}
+	tagged, err = v.Tagged(context.Background(), "0", true)
+	if err != nil || len(tagged) != 2 {
+		t.Errorf("unexpected tagged records: %+v, %v", tagged, err)
+	}
+	if err := v.Untag(context.Background(), "book", "1", "3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	subjects, err := v.RecordSubjects(context.Background(), "book", "1")
+	if err != nil || len(subjects) != 0 {
+		t.Errorf("unexpected subjects: %+v, %v", subjects, err)
+	}
+}
+
+// TestDeleteTagged tests that deleting a record deletes its tags
+func TestDeleteTagged(t *testing.T) {
+	s := initializedStore()
+	v := NewVocabulary(s)
+	v.Tag(context.Background(), "book", "0", "1")
+	v.Tag(context.Background(), "book", "1", "1")
+	if err := s.DeleteRecord(context.Background(), "book", "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tags, _ := s.ListRecords(context.Background(), TagFormat)
+	if len(tags) != 1 || tags[0]["record"] != "1" {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+	tagged, err := v.Tagged(context.Background(), "1", false)
+	if err != nil || len(tagged) != 1 || tagged[0].Record["id"] != "1" {
+		t.Errorf("unexpected tagged records: %+v, %v", tagged, err)
+	}
+}
+
+// TestMoveTags tests moving the subjects of a record to another, without repeating the subjects it already has
+func TestMoveTags(t *testing.T) {
+	s := initializedStore()
+	v := newVocabulary(s)
+	v.Tag(context.Background(), "book", "0", "1")
+	v.Tag(context.Background(), "book", "0", "2")
+	v.Tag(context.Background(), "book", "1", "1")
+	if err := v.MoveTags(context.Background(), "book", "0", "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	subjects, err := v.RecordSubjects(context.Background(), "book", "1")
+	tags, _ := s.ListRecords(context.Background(), TagFormat)
+	if err != nil || len(subjects) != 2 || len(tags) != 2 {
+		t.Errorf("unexpected subjects: %+v, %v", subjects, err)
+	}
+}
+
+// initializedStore returns a boocat with a hierarchy of subjects and books for testing
+func initializedStore() *boocat.Boocat {
+	db := teststore.NewDB()
+	bc := db.Boocat(append(Formats(db.ReferenceValidator), teststore.Book(db.ReferenceValidator))...)
+	db.Restore(SubjectFormat,
+		map[string]string{"id": "0", "name": "Fiction"},
+		map[string]string{"id": "1", "name": "Science fiction", "broader": "0", "synonyms": "Sci-fi\nSF"},
+		map[string]string{"id": "2", "name": "Dystopias", "broader": "0"},
+		map[string]string{"id": "3", "name": "Cyberpunk", "broader": "1"})
+	db.Restore("book",
+		map[string]string{"id": "0", "name": "Nineteen Eighty-Four"},
+		map[string]string{"id": "1", "name": "Neuromancer"})
+	return bc
+}
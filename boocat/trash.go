@@ -0,0 +1,230 @@
+package boocat
+
+// Implements the trash, where deleted records are kept until they are purged
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// TrashedField is the internal field of the records in the trash, with the time they were deleted in RFC 3339 format.
+// Records deleted together because of cascades have the same time, so that they are restored together.
+const TrashedField = "_trashed"
+
+// TrashedRecord is a record in the trash
+type TrashedRecord struct {
+	FormatName string
+	Record     map[string]string
+	// Time the record was deleted
+	Trashed time.Time
+}
+
+// Trash returns the records of all formats in the trash, the most recently deleted first
+func (bc *Boocat) Trash(ctx context.Context) ([]TrashedRecord, error) {
+	if bc.db == nil {
+		return nil, bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	var trash []TrashedRecord
+	for formatName := range bc.Formats() {
+		records, err := bc.db.GetAllRecords(ctx, formatName)
+		if err != nil {
+			return nil, bcerrors.NewUnexpectedError(fmt.Errorf("getting records from database: %v\n", err))
+		}
+		for _, record := range records {
+			if !trashed(record) {
+				continue
+			}
+			trashedTime, _ := time.Parse(time.RFC3339Nano, record[TrashedField])
+			trash = append(trash, TrashedRecord{FormatName: formatName, Record: record, Trashed: trashedTime})
+		}
+	}
+	sort.Slice(trash, func(i, j int) bool {
+		if !trash[i].Trashed.Equal(trash[j].Trashed) {
+			return trash[i].Trashed.After(trash[j].Trashed)
+		}
+		if trash[i].FormatName != trash[j].FormatName {
+			return trash[i].FormatName < trash[j].FormatName
+		}
+		return trash[i].Record["id"] < trash[j].Record["id"]
+	})
+	return trash, nil
+}
+
+// AllRecords returns all the records of a format, including the ones in the trash
+func (bc *Boocat) AllRecords(ctx context.Context, formatName string) ([]map[string]string, error) {
+	if bc.db == nil {
+		return nil, bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	records, err := bc.db.GetAllRecords(ctx, formatName)
+	switch {
+	case err == nil:
+		return records, nil
+	case errors.Is(err, bcerrors.ErrFormatNotFound):
+		return nil, bcerrors.ErrFormatNotFound
+	default:
+		return nil, bcerrors.NewUnexpectedError(fmt.Errorf("getting records from database: %v\n", err))
+	}
+}
+
+// RestoreFromTrash restores a record of a format from the trash, together with the records deleted with it and the
+// records in the trash they reference. References removed when the record was deleted aren't restored. It returns a
+// DuplicateError without restoring any record if another record has taken the unique values of one of them.
+func (bc *Boocat) RestoreFromTrash(ctx context.Context, formatName, id string) error {
+	if bc.db == nil {
+		return bcerrors.NewUnexpectedError(errors.New("database not set"))
+	}
+	if _, found := bc.format(formatName); !found {
+		return bcerrors.ErrFormatNotFound
+	}
+	record, err := bc.db.GetRecord(ctx, formatName, id)
+	switch {
+	case errors.Is(err, bcerrors.ErrRecordNotFound):
+		return bcerrors.ErrRecordNotFound
+	case err != nil:
+		return bcerrors.NewUnexpectedError(fmt.Errorf("getting record from database: %v\n", err))
+	case !trashed(record):
+		return bcerrors.ErrRecordNotFound
+	}
+	var group []TrashedRecord
+	if err := bc.trashedGroup(ctx, record[TrashedField], make(map[string]struct{}), &group); err != nil {
+		return err
+	}
+	// Unique values of the records in the trash may have been used by other records since they were deleted
+	for _, item := range group {
+		format, _ := bc.format(item.FormatName)
+		for _, fields := range format.Unique {
+			equal, complete := uniqueValues(item.Record, fields)
+			if !complete {
+				continue
+			}
+			used, err := bc.usedByOther(ctx, format, item.Record["id"], equal)
+			if err != nil {
+				return err
+			}
+			if used {
+				return bcerrors.DuplicateError{Fields: fields}
+			}
+		}
+	}
+	for _, item := range group {
+		restoredRecord := make(map[string]string, len(item.Record))
+		for field, value := range item.Record {
+			if field != TrashedField {
+				restoredRecord[field] = value
+			}
+		}
+		restoredRecord[ModifiedField] = modifiedNow()
+		if err := bc.db.UpdateRecord(ctx, item.FormatName, restoredRecord); err != nil {
+			return bcerrors.NewUnexpectedError(fmt.Errorf("updating record in database: %v\n", err))
+		}
+		bc.changed(ctx, item.FormatName, restoredRecord)
+	}
+	return nil
+}
+
+// trashedGroup adds to group the records deleted at the time, and the records in the trash they reference. collected
+// has the times already added.
+func (bc *Boocat) trashedGroup(ctx context.Context, trashedTime string, collected map[string]struct{},
+	group *[]TrashedRecord) error {
+	collected[trashedTime] = struct{}{}
+	for formatName, format := range bc.Formats() {
+		records, err := bc.db.FilterRecords(ctx, formatName, map[string]string{TrashedField: trashedTime})
+		if err != nil {
+			return bcerrors.NewUnexpectedError(fmt.Errorf("getting records from database: %v\n", err))
+		}
+		for _, record := range records {
+			*group = append(*group, TrashedRecord{FormatName: formatName, Record: record})
+			for field, refFormatName := range format.References {
+				for _, refID := range format.Values(field, record[field]) {
+					referenced, err := bc.db.GetRecord(ctx, refFormatName, refID)
+					if err != nil || !trashed(referenced) {
+						continue
+					}
+					if _, found := collected[referenced[TrashedField]]; found {
+						continue
+					}
+					if err := bc.trashedGroup(ctx, referenced[TrashedField], collected, group); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// PurgeTrash permanently deletes the records deleted before the time and their attached files, and returns how many
+// records it deleted
+func (bc *Boocat) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	trash, err := bc.Trash(ctx)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, item := range trash {
+		if !item.Trashed.Before(before) {
+			continue
+		}
+		attachments := bc.attachmentKeys(ctx, item.FormatName, item.Record["id"])
+		err := bc.db.DeleteRecord(ctx, item.FormatName, item.Record["id"])
+		switch {
+		case err == nil:
+			purged++
+		case errors.Is(err, bcerrors.ErrRecordNotFound):
+			// Already deleted
+		default:
+			return purged, bcerrors.NewUnexpectedError(fmt.Errorf("deleting record from database: %v\n", err))
+		}
+		bc.deleteAttachments(ctx, attachments)
+	}
+	return purged, nil
+}
+
+// trash moves the record of the format with the id to the trash, with the time of the deletion
+func (bc *Boocat) trash(ctx context.Context, key recordKey, trashedTime string) error {
+	record, err := bc.db.GetRecord(ctx, key.formatName, key.id)
+	switch {
+	case errors.Is(err, bcerrors.ErrFormatNotFound):
+		return bcerrors.ErrFormatNotFound
+	case errors.Is(err, bcerrors.ErrRecordNotFound):
+		// Already deleted
+		return nil
+	case err != nil:
+		return bcerrors.NewUnexpectedError(fmt.Errorf("getting record from database: %v\n", err))
+	case trashed(record):
+		return nil
+	}
+	updated := make(map[string]string, len(record)+1)
+	for field, value := range record {
+		updated[field] = value
+	}
+	updated[TrashedField] = trashedTime
+	updated[ModifiedField] = modifiedNow()
+	if err := bc.db.UpdateRecord(ctx, key.formatName, updated); err != nil {
+		return bcerrors.NewUnexpectedError(fmt.Errorf("updating record in database: %v\n", err))
+	}
+	bc.changed(ctx, key.formatName, updated)
+	return nil
+}
+
+// trashed returns if the record is in the trash
+func trashed(record map[string]string) bool {
+	_, found := record[TrashedField]
+	return found
+}
+
+// untrashed returns the records that aren't in the trash
+func untrashed(records []map[string]string) []map[string]string {
+	kept := make([]map[string]string, 0, len(records))
+	for _, record := range records {
+		if !trashed(record) {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
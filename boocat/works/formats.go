@@ -0,0 +1,68 @@
+package works
+
+// Implements the formats of the records of works and series
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/ivanmartinez/boocat/boocat"
+)
+
+// Names of the formats of works
+const (
+	// Series of works, e.g. a trilogy
+	SeriesFormat = "series"
+	// Works, which are the abstract creations that editions publish, e.g. "Nineteen Eighty-Four" in any language
+	WorkFormat = "work"
+	// Editions of works, which are the book records
+	EditionFormat = "book"
+)
+
+// WorkField is the field of editions that references their work
+const WorkField = "work"
+
+// Formats returns the formats of works and series. reference returns the validator of the fields that reference
+// records of a format. Deleting a series removes its works from it.
+func Formats(reference func(formatName string) boocat.Validate) []boocat.Format {
+	return []boocat.Format{
+		{
+			Name: SeriesFormat,
+			Fields: map[string]boocat.Validate{
+				"name": boocat.ValidateRequired,
+			},
+			Searchable: map[string]struct{}{"name": {}},
+			Display:    "name",
+		},
+		{
+			Name: WorkFormat,
+			Fields: map[string]boocat.Validate{
+				"name":     boocat.ValidateRequired,
+				"author":   boocat.Optional(reference("author")),
+				"series":   boocat.Optional(reference(SeriesFormat)),
+				"position": boocat.Optional(validatePosition),
+			},
+			Searchable: map[string]struct{}{"name": {}},
+			References: map[string]string{"author": "author", "series": SeriesFormat},
+			OnDelete:   map[string]boocat.ReferencePolicy{"series": boocat.SetNull},
+			Facets:     map[string]struct{}{"series": {}},
+			Display:    "name",
+		},
+	}
+}
+
+// ValidateWork returns the validator of the field of editions that references their work, which is optional.
+// reference returns the validator of the fields that reference records of a format.
+func ValidateWork(reference func(formatName string) boocat.Validate) boocat.Validate {
+	return boocat.Optional(reference(WorkFormat))
+}
+
+// validatePosition validates the position of a work in its series, which is a number from 1
+func validatePosition(_ context.Context, value interface{}) string {
+	position, err := strconv.Atoi(fmt.Sprintf("%v", value))
+	if err != nil || position < 1 {
+		return "not a number of one or more"
+	}
+	return ""
+}
@@ -0,0 +1,207 @@
+package works
+
+// Implements the grouping of editions by work, the ordering of works in series, and the merging of editions into works
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// ErrNoEditions is returned when merging no editions into a work
+var ErrNoEditions = errors.New("no editions to merge")
+
+// Group is a work and its editions, or an edition without work
+type Group struct {
+	// Work of the editions, which is nil for an edition without work
+	Work     map[string]string
+	Editions []map[string]string
+}
+
+// store holds the editions and works
+type store interface {
+	GetRecord(ctx context.Context, formatName string, id string) (map[string]string, error)
+	ListRecords(ctx context.Context, formatName string) ([]map[string]string, error)
+	FilterRecords(ctx context.Context, formatName string, filter boocat.Filter) (boocat.FilteredRecords, error)
+	AddRecord(ctx context.Context, formatName string, record map[string]string) (string, error)
+	UpdateRecord(ctx context.Context, formatName string, record map[string]string) error
+	DeleteRecord(ctx context.Context, formatName string, id string) error
+}
+
+// Works groups editions by work, and merges editions into works
+type Works struct {
+	store store
+}
+
+// NewWorks returns the works of the records of bc
+func NewWorks(bc *boocat.Boocat) *Works {
+	return newWorks(bc)
+}
+
+// newWorks returns the works of the records of s
+func newWorks(s store) *Works {
+	return &Works{store: s}
+}
+
+// Editions returns the editions of the work with the id, sorted by year
+func (w *Works) Editions(ctx context.Context, workID string) ([]map[string]string, error) {
+	filtered, err := w.store.FilterRecords(ctx, EditionFormat, boocat.Filter{
+		Equal: map[string]string{WorkField: workID},
+		Sort:  "year",
+	})
+	return filtered.Records, err
+}
+
+// SeriesWorks returns the works of the series with the id, sorted by their position in it. Works without position go
+// last.
+func (w *Works) SeriesWorks(ctx context.Context, seriesID string) ([]map[string]string, error) {
+	filtered, err := w.store.FilterRecords(ctx, WorkFormat, boocat.Filter{
+		Equal: map[string]string{"series": seriesID},
+		Sort:  "position",
+	})
+	return filtered.Records, err
+}
+
+// Group groups the editions by work, in the order the first edition of every work has in editions. Editions without
+// work, or whose work isn't found, are groups on their own.
+func (w *Works) Group(ctx context.Context, editions []map[string]string) ([]Group, error) {
+	var groups []Group
+	indexes := make(map[string]int)
+	for _, edition := range editions {
+		workID := edition[WorkField]
+		if i, found := indexes[workID]; found {
+			groups[i].Editions = append(groups[i].Editions, edition)
+			continue
+		}
+		var work map[string]string
+		if workID != "" {
+			var err error
+			work, err = w.store.GetRecord(ctx, WorkFormat, workID)
+			if err != nil && !errors.Is(err, bcerrors.ErrRecordNotFound) {
+				return nil, err
+			}
+		}
+		if work != nil {
+			indexes[workID] = len(groups)
+		}
+		groups = append(groups, Group{Work: work, Editions: []map[string]string{edition}})
+	}
+	return groups, nil
+}
+
+// Candidates returns the groups of editions without work that seem to be editions of the same work, because they
+// have the same author and the same name except for case, spaces and punctuation. Groups are sorted by name.
+func (w *Works) Candidates(ctx context.Context) ([][]map[string]string, error) {
+	editions, err := w.store.ListRecords(ctx, EditionFormat)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string][]map[string]string)
+	var keys []string
+	for _, edition := range editions {
+		if edition[WorkField] != "" {
+			continue
+		}
+		key := comparableName(edition["name"]) + "\x00" + edition["author"]
+		if _, found := byKey[key]; !found {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], edition)
+	}
+	sort.Strings(keys)
+	var candidates [][]map[string]string
+	for _, key := range keys {
+		if len(byKey[key]) > 1 {
+			candidates = append(candidates, byKey[key])
+		}
+	}
+	return candidates, nil
+}
+
+// Merge makes the editions with the ids editions of the work with the id, and returns the id of the work. If workID
+// is empty, a new work is added with the name and author of the first edition. If an edition can't be changed, the
+// editions that were changed and the added work are restored, and the error is unexpected if they can't be. The error
+// is ErrNoEditions if there are no ids.
+func (w *Works) Merge(ctx context.Context, editionIDs []string, workID string) (string, error) {
+	if len(editionIDs) == 0 {
+		return "", ErrNoEditions
+	}
+	editions := make([]map[string]string, 0, len(editionIDs))
+	for _, id := range editionIDs {
+		edition, err := w.store.GetRecord(ctx, EditionFormat, id)
+		if err != nil {
+			return "", err
+		}
+		editions = append(editions, withoutInternalFields(edition))
+	}
+	added := workID == ""
+	if added {
+		work := map[string]string{"name": editions[0]["name"]}
+		if author := editions[0]["author"]; author != "" {
+			work["author"] = author
+		}
+		var err error
+		if workID, err = w.store.AddRecord(ctx, WorkFormat, work); err != nil {
+			return "", err
+		}
+	} else if _, err := w.store.GetRecord(ctx, WorkFormat, workID); err != nil {
+		return "", err
+	}
+	for i, edition := range editions {
+		merged := withoutInternalFields(edition)
+		merged[WorkField] = workID
+		if err := w.store.UpdateRecord(ctx, EditionFormat, merged); err != nil {
+			return "", w.undoMerge(ctx, err, editions[:i], workID, added)
+		}
+	}
+	return workID, nil
+}
+
+// undoMerge restores the changed editions after the merge failed with err, and deletes the work with the id if it was
+// added. It returns err, or an unexpected error if the changes can't be undone, after trying to undo all of them.
+func (w *Works) undoMerge(ctx context.Context, err error, changed []map[string]string, workID string,
+	added bool) error {
+	var undoErr error
+	for _, edition := range changed {
+		if updateErr := w.store.UpdateRecord(ctx, EditionFormat, edition); updateErr != nil && undoErr == nil {
+			undoErr = updateErr
+		}
+	}
+	if added {
+		if deleteErr := w.store.DeleteRecord(ctx, WorkFormat, workID); deleteErr != nil && undoErr == nil {
+			undoErr = deleteErr
+		}
+	}
+	if undoErr != nil {
+		return bcerrors.NewUndoError(err, undoErr)
+	}
+	return err
+}
+
+// withoutInternalFields returns a copy of the record without the internal fields, whose names start with an
+// underscore, so that it can be updated
+func withoutInternalFields(record map[string]string) map[string]string {
+	copied := make(map[string]string, len(record))
+	for field, value := range record {
+		if !strings.HasPrefix(field, "_") {
+			copied[field] = value
+		}
+	}
+	return copied
+}
+
+// comparableName returns the name in lower case without the characters that aren't letters or digits
+func comparableName(name string) string {
+	var comparable strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			comparable.WriteRune(r)
+		}
+	}
+	return comparable.String()
+}
@@ -0,0 +1,132 @@
+package works
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/internal/teststore"
+)
+
+// unmergeableStore is a store that fails to add the edition with the id to a work
+type unmergeableStore struct {
+	store
+	id string
+}
+
+// UpdateRecord fails if the record is the edition with the id and has a work, and updates it otherwise
+func (s unmergeableStore) UpdateRecord(ctx context.Context, formatName string, record map[string]string) error {
+	if record["id"] == s.id && record[WorkField] != "" {
+		return errors.New("update failed")
+	}
+	return s.store.UpdateRecord(ctx, formatName, record)
+}
+
+// undeletableStore is a store that fails to delete records
+type undeletableStore struct {
+	store
+}
+
+// DeleteRecord fails
+func (s undeletableStore) DeleteRecord(context.Context, string, string) error {
+	return errors.New("delete failed")
+}
+
+// TestMerge tests merging editions into a new work and into an existing one
+func TestMerge(t *testing.T) {
+	s := initializedStore()
+	w := newWorks(s)
+	workID, err := w.Merge(context.Background(), []string{"0", "1"}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	work, _ := s.GetRecord(context.Background(), WorkFormat, workID)
+	if work["name"] != "Nineteen Eighty-Four" || work["author"] != "0" {
+		t.Errorf("unexpected work: %v", work)
+	}
+	if _, err := w.Merge(context.Background(), []string{"2"}, workID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, id := range []string{"0", "1", "2"} {
+		if edition, _ := s.GetRecord(context.Background(), EditionFormat, id); edition[WorkField] != workID {
+			t.Errorf("unexpected edition: %v", edition)
+		}
+	}
+	if edition, _ := s.GetRecord(context.Background(), EditionFormat, "0"); edition["_rating"] != "4.5" {
+		t.Errorf("unexpected edition: %v", edition)
+	}
+	if _, err := w.Merge(context.Background(), nil, ""); !errors.Is(err, ErrNoEditions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestMergeRestore tests that a merge that fails restores the editions and removes the added work
+func TestMergeRestore(t *testing.T) {
+	s := initializedStore()
+	w := newWorks(unmergeableStore{s, "1"})
+	if _, err := w.Merge(context.Background(), []string{"0", "1"}, ""); err == nil {
+		t.Fatal("expected error")
+	}
+	works, _ := s.ListRecords(context.Background(), WorkFormat)
+	if edition, _ := s.GetRecord(context.Background(), EditionFormat, "0"); len(works) != 0 ||
+		edition[WorkField] != "" {
+		t.Errorf("unexpected records: %v, %v", works, edition)
+	}
+}
+
+// TestMergeUndoFail tests that a merge that fails returns an unexpected error if the added work can't be removed
+func TestMergeUndoFail(t *testing.T) {
+	s := initializedStore()
+	w := newWorks(undeletableStore{unmergeableStore{s, "1"}})
+	_, err := w.Merge(context.Background(), []string{"0", "1"}, "")
+	var unexpectedError bcerrors.UnexpectedError
+	if !errors.As(err, &unexpectedError) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if edition, _ := s.GetRecord(context.Background(), EditionFormat, "0"); edition[WorkField] != "" {
+		t.Errorf("unexpected edition: %v", edition)
+	}
+}
+
+// TestGroup tests grouping editions by work in the order of their first edition
+func TestGroup(t *testing.T) {
+	s := initializedStore()
+	w := newWorks(s)
+	workID, _ := w.Merge(context.Background(), []string{"0", "2"}, "")
+	editions, _ := s.ListRecords(context.Background(), EditionFormat)
+	groups, err := w.Group(context.Background(), editions)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(groups) != 3 || groups[0].Work["id"] != workID || len(groups[0].Editions) != 2 || groups[1].Work != nil {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+}
+
+// TestCandidates tests finding editions without work that seem to be of the same work
+func TestCandidates(t *testing.T) {
+	w := newWorks(initializedStore())
+	candidates, err := w.Candidates(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candidates) != 1 || len(candidates[0]) != 2 || candidates[0][1]["id"] != "2" {
+		t.Errorf("unexpected candidates: %v", candidates)
+	}
+}
+
+// initializedStore returns a boocat with editions and their author for testing
+func initializedStore() *boocat.Boocat {
+	db := teststore.NewDB()
+	author := boocat.Format{Name: "author", Fields: map[string]boocat.Validate{"name": nil}, Display: "name"}
+	bc := db.Boocat(append(Formats(db.ReferenceValidator), teststore.Book(db.ReferenceValidator), author)...)
+	db.Restore("author", map[string]string{"id": "0", "name": "George Orwell"})
+	db.Restore(EditionFormat,
+		map[string]string{"id": "0", "name": "Nineteen Eighty-Four", "author": "0", "year": "1949", "_rating": "4.5"},
+		map[string]string{"id": "1", "name": "1984", "author": "0", "year": "1950"},
+		map[string]string{"id": "2", "name": "Nineteen Eighty Four", "author": "0", "year": "2003"},
+		map[string]string{"id": "3", "name": "Animal Farm", "author": "0", "year": "1945"})
+	return bc
+}
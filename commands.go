@@ -0,0 +1,321 @@
+package main
+
+// Implements the commands that can be run instead of the web server
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat/backup"
+	"github.com/ivanmartinez/boocat/boocat/csvio"
+	"github.com/ivanmartinez/boocat/boocat/marc"
+	"github.com/ivanmartinez/boocat/boocat/migrate"
+	"github.com/ivanmartinez/boocat/boocat/related"
+)
+
+// commands maps the names of the commands to the functions that run them with the rest of the arguments
+var commands = map[string]func(args []string) error{
+	"import":    runImport,
+	"export":    runExport,
+	"backup":    runBackup,
+	"restore":   runRestore,
+	"marc":      runMarc,
+	"integrity": runIntegrity,
+	"migrate":   runMigrate,
+	"purge":     runPurge,
+	"related":   runRelated,
+}
+
+// runImport imports the records of a format from a CSV file
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dbURI := flags.String("dburi", "mongodb://127.0.0.1:27017", "Database URI")
+	formatName := flags.String("format", "", "Name of the format of the records")
+	fileName := flags.String("file", "", "CSV file to import")
+	dryRun := flags.Bool("dryrun", false, "Validate the records without adding them")
+	resolve := flags.Bool("resolve", false, "Translate display values of referenced records to IDs")
+	flags.Parse(args)
+
+	file, err := os.Open(*fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx := context.Background()
+	bc, db, err := openBoocat(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect(ctx)
+
+	report, err := csvio.Import(ctx, bc, *formatName, file, csvio.Options{DryRun: *dryRun, Resolve: *resolve})
+	for _, failure := range report.Failures {
+		printRowFailure(failure)
+	}
+	fmt.Printf("%d rows read, %d added, %d failed\n", report.Rows, report.Added, len(report.Failures))
+	return err
+}
+
+// runExport exports the records of a format to a CSV file
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dbURI := flags.String("dburi", "mongodb://127.0.0.1:27017", "Database URI")
+	formatName := flags.String("format", "", "Name of the format of the records")
+	fileName := flags.String("file", "", "CSV file to export to")
+	resolve := flags.Bool("resolve", false, "Translate IDs of referenced records to display values")
+	flags.Parse(args)
+
+	file, err := os.Create(*fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx := context.Background()
+	bc, db, err := openBoocat(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect(ctx)
+
+	return csvio.Export(ctx, bc, *formatName, file, csvio.Options{Resolve: *resolve})
+}
+
+// runMarc imports the records of a binary MARC21 or MARCXML file as books and authors
+func runMarc(args []string) error {
+	flags := flag.NewFlagSet("marc", flag.ExitOnError)
+	dbURI := flags.String("dburi", "mongodb://127.0.0.1:27017", "Database URI")
+	fileName := flags.String("file", "", "MARC file to import. Files with extension .xml are read as MARCXML.")
+	flags.Parse(args)
+
+	file, err := os.Open(*fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var records []marc.Record
+	if strings.EqualFold(filepath.Ext(*fileName), ".xml") {
+		records, err = marc.ReadXML(file)
+	} else {
+		records, err = marc.NewReader(file).ReadAll()
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	bc, db, err := openBoocat(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect(ctx)
+
+	report := marc.NewImporter(bc).Import(ctx, records)
+	for _, failure := range report.Failures {
+		printMarcFailure(failure)
+	}
+	fmt.Printf("%d records read, %d books and %d authors added, %d failed\n", len(records), report.Books,
+		report.Authors, len(report.Failures))
+	return nil
+}
+
+// printRowFailure prints why a row couldn't be imported
+func printRowFailure(failure csvio.RowFailure) {
+	if failure.Err != nil {
+		fmt.Printf("line %d: %v\n", failure.Line, failure.Err)
+	}
+	fields := make([]string, 0, len(failure.Failed))
+	for field := range failure.Failed {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		fmt.Printf("line %d: %s: %s\n", failure.Line, field, failure.Failed[field])
+	}
+}
+
+// runBackup dumps all the records of all the formats to a JSON Lines archive
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	dbURI := flags.String("dburi", "mongodb://127.0.0.1:27017", "Database URI")
+	fileName := flags.String("file", "", "Archive file to write")
+	flags.Parse(args)
+
+	file, err := os.Create(*fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx := context.Background()
+	bc, db, err := openBoocat(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect(ctx)
+
+	counts, err := backup.Dump(ctx, bc, file)
+	printCounts("written", counts)
+	return err
+}
+
+// runRestore restores all the records of a JSON Lines archive, keeping their IDs
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbURI := flags.String("dburi", "mongodb://127.0.0.1:27017", "Database URI")
+	fileName := flags.String("file", "", "Archive file to read")
+	flags.Parse(args)
+
+	file, err := os.Open(*fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx := context.Background()
+	bc, db, err := openBoocat(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect(ctx)
+
+	counts, err := backup.Restore(ctx, bc, file)
+	printCounts("restored", counts)
+	return err
+}
+
+// runIntegrity reports the references to records that don't exist, and optionally repairs them
+func runIntegrity(args []string) error {
+	flags := flag.NewFlagSet("integrity", flag.ExitOnError)
+	dbURI := flags.String("dburi", "mongodb://127.0.0.1:27017", "Database URI")
+	repair := flags.Bool("repair", false, "Remove the dangling references, or delete their records if they cascade")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	bc, db, err := openBoocat(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect(ctx)
+
+	dangling, err := bc.CheckReferences(ctx)
+	if err != nil {
+		return err
+	}
+	for _, reference := range dangling {
+		fmt.Printf("%s %s: %s references missing record %s\n", reference.FormatName, reference.ID, reference.Field,
+			reference.RefID)
+	}
+	fmt.Printf("%d dangling references\n", len(dangling))
+	if !*repair || len(dangling) == 0 {
+		return nil
+	}
+	if err := bc.RepairReferences(ctx, dangling); err != nil {
+		return err
+	}
+	fmt.Println("dangling references repaired")
+	return nil
+}
+
+// runMigrate applies the pending migrations of the records
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbURI := flags.String("dburi", "mongodb://127.0.0.1:27017", "Database URI")
+	dryRun := flags.Bool("dryrun", false, "Report the changes without storing them")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	bc, db, err := openBoocat(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect(ctx)
+
+	results, err := migrate.Migrate(ctx, bc, db, migrations, migrate.Options{DryRun: *dryRun})
+	for _, result := range results {
+		fmt.Printf("migration %d: %s\n", result.Version, result.Description)
+		printCounts("changed", result.Changed)
+	}
+	if err == nil && len(results) == 0 {
+		fmt.Println("no pending migrations")
+	}
+	return err
+}
+
+// runPurge permanently deletes the records that have been in the trash for longer than the retention time
+func runPurge(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	dbURI := flags.String("dburi", "mongodb://127.0.0.1:27017", "Database URI")
+	retention := flags.Duration("retention", defaultRetention, "Time deleted records are kept in the trash")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	bc, db, err := openBoocat(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect(ctx)
+
+	purged, err := bc.PurgeTrash(ctx, time.Now().Add(-*retention))
+	fmt.Printf("%d records purged\n", purged)
+	return err
+}
+
+// runRelated computes the related books of the stale books, or of all books
+func runRelated(args []string) error {
+	flags := flag.NewFlagSet("related", flag.ExitOnError)
+	dbURI := flags.String("dburi", "mongodb://127.0.0.1:27017", "Database URI")
+	all := flags.Bool("all", false, "Compute the related books of all books, e.g. after importing or restoring")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	bc, db, err := openBoocat(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect(ctx)
+
+	engine := related.NewEngine(bc)
+	refresh := engine.Refresh
+	if *all {
+		refresh = engine.RefreshAll
+	}
+	computed, err := refresh(ctx)
+	fmt.Printf("related books of %d books computed\n", computed)
+	return err
+}
+
+// printCounts prints the number of records per format
+func printCounts(action string, counts map[string]int) {
+	formatNames := make([]string, 0, len(counts))
+	for formatName := range counts {
+		formatNames = append(formatNames, formatName)
+	}
+	sort.Strings(formatNames)
+	for _, formatName := range formatNames {
+		fmt.Printf("%s: %d records %s\n", formatName, counts[formatName], action)
+	}
+}
+
+// printMarcFailure prints why a MARC record couldn't be imported
+func printMarcFailure(failure marc.Failure) {
+	if failure.Err != nil {
+		fmt.Printf("record %d (%s): %s: %v\n", failure.Position, failure.Title, failure.Format, failure.Err)
+	}
+	fields := make([]string, 0, len(failure.Failed))
+	for field := range failure.Failed {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		fmt.Printf("record %d (%s): %s %s: %s\n", failure.Position, failure.Title, failure.Format, field,
+			failure.Failed[field])
+	}
+}
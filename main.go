@@ -8,17 +8,48 @@ import (
 	"os/signal"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/blob"
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	"github.com/ivanmartinez/boocat/boocat/migrate"
 	"github.com/ivanmartinez/boocat/boocat/mongodb"
+	"github.com/ivanmartinez/boocat/boocat/oai"
+	"github.com/ivanmartinez/boocat/boocat/readinglists"
+	"github.com/ivanmartinez/boocat/boocat/related"
+	"github.com/ivanmartinez/boocat/boocat/reviews"
+	"github.com/ivanmartinez/boocat/boocat/subjects"
+	"github.com/ivanmartinez/boocat/boocat/works"
 	"github.com/ivanmartinez/boocat/webserver"
 )
 
 func main() {
+	// Run a command if the first argument is one
+	if len(os.Args) > 1 {
+		if command, found := commands[os.Args[1]]; found {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// Parse flags
 	url := flag.String("url", "localhost:80", "This boocat's base URL")
 	dbURI := flag.String("dburi", "mongodb://127.0.0.1:27017", "Database URI")
+	applyMigrations := flag.Bool("migrate", false, "Apply the pending migrations before starting")
+	adminPassword := flag.String("adminpassword", "", "Password of the admin section, which is disabled without it")
+	blobsDir := flag.String("blobs", "", "Directory to store attached files in, instead of the database")
+	retention := flag.Duration("retention", defaultRetention, "Time deleted records are kept in the trash, 0 to keep them")
+	loanDays := flag.Int("loandays", circulation.DefaultPolicy.LoanDays, "Days copies are lent for")
+	maxRenewals := flag.Int("maxrenewals", circulation.DefaultPolicy.MaxRenewals, "Times a loan can be renewed")
+	pickupDays := flag.Int("pickupdays", circulation.DefaultPolicy.PickupDays,
+		"Days copies assigned to holds wait to be picked up")
+	oaiEmail := flag.String("oaiemail", "", "Email of the admin of the OAI-PMH endpoint, which is disabled without it")
+	oaiID := flag.String("oaiid", "", "Domain name of the OAI-PMH repository, the host of -url by default")
 	flag.Parse()
 
 	// Create channel for listening to OS signals and connect OS interrupts to
@@ -32,11 +63,181 @@ func main() {
 		cancel()
 	}()
 
-	// Initialize database
-	db, err := mongodb.NewMongoDB(ctx, dbURI)
+	// Initialize database and formats
+	bc, db, err := openBoocat(ctx, dbURI)
 	if err != nil {
 		webserver.Error.Fatal(err)
 	}
+	if *blobsDir != "" {
+		blobs, err := blob.NewFileStore(*blobsDir)
+		if err != nil {
+			webserver.Error.Fatal(err)
+		}
+		bc.SetBlobStore(blobs)
+	}
+	if *applyMigrations {
+		results, err := migrate.Migrate(ctx, bc, db, migrations, migrate.Options{})
+		for _, result := range results {
+			webserver.Info.Printf("applied migration %d: %s", result.Version, result.Description)
+		}
+		if err != nil {
+			webserver.Error.Fatal(err)
+		}
+	}
+
+	if *retention > 0 {
+		go purgeTrash(ctx, bc, *retention)
+	}
+
+	desk := circulation.NewDesk(bc, circulation.Policy{LoanDays: *loanDays, MaxRenewals: *maxRenewals,
+		PickupDays: *pickupDays})
+	go expireHolds(ctx, desk)
+
+	engine := related.NewEngine(bc)
+	go refreshRelated(ctx, engine)
+
+	// The provider follows the changes of records even if the OAI-PMH endpoint is disabled, so that their datestamps
+	// are right when it's enabled
+	config := oaiConfig(*url, *oaiID, *oaiEmail)
+	provider := oai.NewProvider(bc, config)
+
+	ws := webserver.Initialize(*url, bc)
+	ws.SetAdminPassword(*adminPassword)
+	ws.SetDesk(desk)
+	ws.SetReviews(reviews.NewReviews(bc))
+	ws.SetSubjects(subjects.NewVocabulary(bc))
+	ws.SetWorks(works.NewWorks(bc))
+	ws.SetReadingLists(readinglists.NewLists(bc))
+	ws.SetRelated(engine)
+	ws.SetOPDS("boocat")
+	if *oaiEmail != "" {
+		if err := oai.ValidateIdentifier(config.RepositoryIdentifier); err != nil {
+			webserver.Error.Fatalf("%v: '%s', set it with -oaiid", err, config.RepositoryIdentifier)
+		}
+		ws.SetOAI(provider)
+	}
+	loadWebFiles(ws)
+	ws.Start()
+
+	// Wait for ctx to be cancelled
+	<-ctx.Done()
+
+	// New context with timeout to shut the HTTP boocat down
+	ctxShutDown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	// Shut services down
+	ws.Shutdown(ctxShutDown)
+	if err := db.Disconnect(ctxShutDown); err != nil {
+		webserver.Error.Print(err)
+	}
+}
+
+const (
+	// Default time deleted records are kept in the trash
+	defaultRetention = 30 * 24 * time.Hour
+	// Time between purges of the trash
+	purgeInterval = time.Hour
+	// Time between expirations of the holds that weren't picked up
+	expireInterval = time.Hour
+	// Time between computations of the related books of the books whose related books are stale
+	refreshInterval = 10 * time.Minute
+)
+
+// purgeTrash purges the records that have been in the trash for longer than retention every purgeInterval, until ctx
+// is done
+func purgeTrash(ctx context.Context, bc *boocat.Boocat, retention time.Duration) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := bc.PurgeTrash(ctx, time.Now().Add(-retention))
+		if err != nil {
+			webserver.Error.Print(err)
+		}
+		if purged > 0 {
+			webserver.Info.Printf("purged %d records from the trash", purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireHolds expires the holds that weren't picked up in time every expireInterval, until ctx is done
+func expireHolds(ctx context.Context, desk *circulation.Desk) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		expired, err := desk.ExpireHolds(ctx)
+		if err != nil {
+			webserver.Error.Print(err)
+		}
+		if expired > 0 {
+			webserver.Info.Printf("expired %d holds", expired)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshRelated computes the related books of the books whose related books are stale every refreshInterval, until
+// ctx is done
+func refreshRelated(ctx context.Context, engine *related.Engine) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		computed, err := engine.Refresh(ctx)
+		if err != nil {
+			webserver.Error.Print(err)
+		}
+		if computed > 0 {
+			webserver.Info.Printf("computed the related books of %d books", computed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// database is the database of boocat, as used besides the boocat API and logic
+type database interface {
+	migrate.State
+	Disconnect(ctx context.Context) error
+}
+
+// oaiConfig returns the configuration of the OAI-PMH provider of the records of authors, books, works and series, whose
+// repository is identified by the identifier or, if it's empty, by the host of the URL
+func oaiConfig(url, identifier, adminEmail string) oai.Config {
+	if identifier == "" {
+		identifier = strings.SplitN(url, ":", 2)[0]
+	}
+	return oai.Config{
+		RepositoryName:       "boocat",
+		RepositoryIdentifier: identifier,
+		AdminEmail:           adminEmail,
+		Sets: map[string]oai.Elements{
+			"author": {"name": "title", "birthdate": "date", "biography": "description"},
+			"book": {"name": "title", "author": "creator", "translators": "contributor", "year": "date",
+				"synopsis": "description", "isbn": "identifier", works.WorkField: "relation"},
+			works.WorkFormat:   {"name": "title", "author": "creator", "series": "relation"},
+			works.SeriesFormat: {"name": "title"},
+		},
+	}
+}
+
+// openBoocat connects to the database and returns the boocat API and logic with the formats set, and the database
+// with the collections initialized accordingly
+func openBoocat(ctx context.Context, dbURI *string) (*boocat.Boocat, database, error) {
+	db, err := mongodb.NewMongoDB(ctx, dbURI)
+	if err != nil {
+		return nil, nil, err
+	}
 	// Set formats
 	var bc boocat.Boocat
 	bc.SetFormat("author", boocat.Format{
@@ -47,39 +248,65 @@ func main() {
 			"biography": nil,
 		},
 		Searchable: map[string]struct{}{"name": {}, "biography": {}},
+		Facets:     map[string]struct{}{"birthdate": {}},
+		Unique:     [][]string{{"name", "birthdate"}},
+		Display:    "name",
 	})
 	bc.SetFormat("book", boocat.Format{
 		Name: "book",
 		Fields: map[string]boocat.Validate{
-			"name":     regExpValidator("^([A-Z][a-z]*)([ |-][A-Z][a-z]*)*$"),
-			"year":     validateYear,
-			"author":   db.ReferenceValidator("author"),
-			"synopsis": nil,
+			"name":        regExpValidator("^([A-Z][a-z]*)([ |-][A-Z][a-z]*)*$"),
+			"year":        validateYear,
+			"author":      db.ReferenceValidator("author"),
+			"translators": db.ReferenceValidator("author"),
+			"synopsis":    nil,
+			"isbn":        boocat.ValidateISBN,
+			"cover":       nil,
+			"pdf":         nil,
+			"work":        works.ValidateWork(db.ReferenceValidator),
 		},
-		Searchable: map[string]struct{}{"name": {}, "synopsis": {}},
+		Searchable:  map[string]struct{}{"name": {}, "synopsis": {}},
+		Lists:       map[string]struct{}{"translators": {}},
+		References:  map[string]string{"author": "author", "translators": "author", "work": works.WorkFormat},
+		OnDelete:    map[string]boocat.ReferencePolicy{"translators": boocat.SetNull, "work": boocat.SetNull},
+		Attachments: map[string]string{"cover": "image/", "pdf": "application/pdf"},
+		Facets:      map[string]struct{}{"year": {}, "author": {}},
+		Normalizers: map[string]boocat.Normalize{"isbn": boocat.NormalizeISBN},
+		Unique:      [][]string{{"isbn"}},
+		Display:     "name",
 	})
+	for _, format := range circulation.Formats(db.ReferenceValidator) {
+		bc.SetFormat(format.Name, format)
+	}
+	bc.SetFormat(reviews.ReviewFormat, reviews.Format(db.ReferenceValidator))
+	for _, format := range subjects.Formats(db.ReferenceValidator) {
+		bc.SetFormat(format.Name, format)
+	}
+	for _, format := range works.Formats(db.ReferenceValidator) {
+		bc.SetFormat(format.Name, format)
+	}
+	for _, format := range readinglists.Formats(db.ReferenceValidator) {
+		bc.SetFormat(format.Name, format)
+	}
 	// Make sure database collections match the defined formats
 	if err := db.InitializeCollections(ctx, bc.Formats()); err != nil {
-		webserver.Error.Fatal(err)
+		return nil, nil, err
 	}
-
-	// Set database to use
+	// Set database to use, which stores attached files too
 	bc.SetDatabase(db)
-	ws := webserver.Initialize(*url, &bc)
-	loadWebFiles(&ws)
-	ws.Start()
-
-	// Wait for ctx to be cancelled
-	<-ctx.Done()
-
-	// New context with timeout to shut the HTTP boocat down
-	ctxShutDown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-
-	// Shut services down
-	ws.Shutdown(ctxShutDown)
-	if err := db.Disconnect(ctxShutDown); err != nil {
-		webserver.Error.Print(err)
+	blobs, err := db.BlobStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	bc.SetBlobStore(blobs)
+	// Set the validators that can be used by formats defined at runtime, and those formats
+	bc.SetValidator("year", func(_ string) (boocat.Validate, error) {
+		return validateYear, nil
+	})
+	if err := bc.LoadFormats(ctx); err != nil {
+		return nil, nil, err
 	}
+	return &bc, db, nil
 }
 
 // reqExpValidator returns a validator that uses the regular expression passed as argument
@@ -112,8 +339,11 @@ func validateYear(_ context.Context, value interface{}) string {
 
 func loadWebFiles(ws *webserver.Webserver) {
 	ws.LoadStaticFile("bcweb", "/index.html")
+	ws.LoadStaticFile("bcweb", "/autocomplete.js")
 	ws.LoadTemplate("bcweb", "/author.tmpl", "author")
 	ws.LoadTemplate("bcweb", "/book.tmpl", "book")
+	ws.LoadTemplate("bcweb", "/work.tmpl", "work")
+	ws.LoadTemplate("bcweb", "/series.tmpl", "series")
 	ws.LoadTemplate("bcweb", "/new/author.tmpl", "author")
 	ws.LoadTemplate("bcweb", "/new/book.tmpl", "book")
 	ws.LoadTemplate("bcweb", "/edit/author.tmpl", "author")
@@ -122,4 +352,21 @@ func loadWebFiles(ws *webserver.Webserver) {
 	ws.LoadTemplate("bcweb", "/list/book.tmpl", "book")
 	ws.LoadTemplate("bcweb", "/search/author.tmpl", "author")
 	ws.LoadTemplate("bcweb", "/search/book.tmpl", "book")
+	ws.LoadGenericTemplate("bcweb", "/generic/record.tmpl", "/")
+	ws.LoadGenericTemplate("bcweb", "/generic/edit.tmpl", "/new/")
+	ws.LoadGenericTemplate("bcweb", "/generic/edit.tmpl", "/edit/")
+	ws.LoadGenericTemplate("bcweb", "/generic/list.tmpl", "/list/")
+	ws.LoadAdminTemplate("bcweb", "/admin/formats.tmpl")
+	ws.LoadAdminTemplate("bcweb", "/admin/format.tmpl")
+	ws.LoadAdminTemplate("bcweb", "/admin/trash.tmpl")
+	ws.LoadAdminTemplate("bcweb", "/admin/reviews.tmpl")
+	ws.LoadAdminTemplate("bcweb", "/admin/works.tmpl")
+	ws.LoadAdminTemplate("bcweb", "/admin/duplicates.tmpl")
+	ws.LoadDeskTemplate("bcweb", "/desk.tmpl")
+	ws.LoadDeskTemplate("bcweb", "/desk/patron.tmpl")
+	ws.LoadDeskTemplate("bcweb", "/holds.tmpl")
+	ws.LoadReviewsTemplate("bcweb", "/reviews.tmpl")
+	ws.LoadSubjectsTemplate("bcweb", "/subjects.tmpl")
+	ws.LoadListsTemplate("bcweb", "/lists.tmpl")
+	ws.LoadListExportTemplate("bcweb", "/lists/markdown.tmpl", "text/markdown; charset=utf-8")
 }
@@ -0,0 +1,36 @@
+package main
+
+// Defines the migrations of the records to the current formats
+
+import (
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	"github.com/ivanmartinez/boocat/boocat/migrate"
+)
+
+// migrations of the records, in order of version. Applied migrations must not be changed, new ones are added at the
+// end with the next version.
+var migrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "Rename field synopsys of books to synopsis",
+		Steps: []migrate.Step{
+			migrate.RenameField("book", "synopsys", "synopsis"),
+		},
+	},
+	{
+		Version:     2,
+		Description: "Set the copy of the loans that haven't been returned to field onloan",
+		Steps: []migrate.Step{
+			{
+				FormatName: circulation.LoanFormat,
+				Change: func(record map[string]string) bool {
+					if record["returned"] != "" || record["onloan"] != "" {
+						return false
+					}
+					record["onloan"] = record["copy"]
+					return true
+				},
+			},
+		},
+	},
+}
@@ -0,0 +1,369 @@
+package webserver
+
+// Implements the admin section, where formats are defined at runtime, deleted records restored, reviews moderated,
+// editions merged into works and duplicate records merged
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/reviews"
+)
+
+// User name of the administrator
+const adminUser = "admin"
+
+// Number of empty rows to add fields in the format form
+const newFieldRows = 3
+
+// adminFormatsData is the data passed to the template of the list of formats
+type adminFormatsData struct {
+	// Formats sorted by name
+	Formats []adminFormat
+}
+
+// adminFormat is a format in the list of formats
+type adminFormat struct {
+	Name string
+	// Field names sorted
+	Fields []string
+	// If the format is defined at runtime and can be edited
+	Editable bool
+}
+
+// adminFormatData is the data passed to the template of the form of a format
+type adminFormatData struct {
+	Name    string
+	Display string
+	// Rows of the fields, followed by empty rows to add new fields
+	Fields []adminField
+	// Names of the validators that can be chosen
+	Validators []string
+	// Parts of the definition that failed validation, by "name", "fields", "searchable", "display" and
+	// "fields.<field>"
+	Failed map[string]string
+	// If the definition has just been saved
+	Saved bool
+}
+
+// adminTrashData is the data passed to the template of the trash
+type adminTrashData struct {
+	// Records in the trash, the most recently deleted first
+	Records []adminTrashedRecord
+	// Format and ID of the record that has just been restored or failed to be restored, if any
+	RestoredFormat string
+	RestoredID     string
+	// Unique fields whose values another record has taken, if the record couldn't be restored
+	Duplicate []string
+}
+
+// adminTrashedRecord is a record in the trash
+type adminTrashedRecord struct {
+	FormatName string
+	ID         string
+	// Value of the display field of the format, or the ID if the format doesn't have one
+	Display string
+	Trashed string
+}
+
+// adminField is a row of a field in the form of a format
+type adminField struct {
+	Index      int
+	Name       string
+	Validator  string
+	Searchable bool
+}
+
+// SetAdminPassword enables the admin section, which requires HTTP basic authentication with user "admin" and the
+// password. The admin section is disabled if the password is empty.
+func (ws *Webserver) SetAdminPassword(password string) {
+	ws.adminPassword = password
+}
+
+// LoadAdminTemplate loads a template of the admin section from a file located in rootPath+path. The path of the URL of
+// the template will be path without the file extension.
+func (ws *Webserver) LoadAdminTemplate(rootPath, path string) {
+	tmpl, err := template.ParseFiles(rootPath + path)
+	if err != nil {
+		Error.Fatal(err)
+	}
+	ws.adminTemplates[strings.TrimSuffix(path, filepath.Ext(path))] = tmpl
+}
+
+// handleAdmin handles a request of the admin section. "/admin/formats" lists the formats, "/admin/format" is the
+// form of the format with the name in the "name" query parameter, or of a new format without it, "/admin/trash"
+// lists the deleted records, which are restored by posting their "format" and "id", "/admin/reviews" lists the
+// reviews waiting for moderation, which are moderated by posting their "id" and "status", "/admin/works" merges
+// editions into works as described in adminWorks, and "/admin/duplicates" lists suspected duplicate records as
+// described in adminDuplicates.
+func (ws *Webserver) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if !ws.authorized(w, r) {
+		return
+	}
+	tmpl, found := ws.adminTemplates[r.URL.Path]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	var data interface{}
+	switch {
+	case r.URL.Path == "/admin/formats" && r.Method == http.MethodGet:
+		data = ws.adminFormats()
+	case r.URL.Path == "/admin/format" && r.Method == http.MethodGet:
+		name := r.URL.Query().Get("name")
+		definition, found := ws.formatDefinition(name)
+		if name != "" && !found {
+			http.NotFound(w, r)
+			return
+		}
+		data = ws.adminFormatForm(definition, nil, false)
+	case r.URL.Path == "/admin/format" && r.Method == http.MethodPost:
+		r.ParseForm()
+		definition := definitionFromForm(r)
+		err := ws.bc.SaveFormat(r.Context(), definition)
+		var validationError bcerrors.ValidationFailedError
+		switch {
+		case errors.As(err, &validationError):
+			data = ws.adminFormatForm(definition, validationError.Failed, false)
+		case err != nil:
+			Error.Printf("%v", err.Error())
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		default:
+			data = ws.adminFormatForm(definition, nil, true)
+		}
+	case r.URL.Path == "/admin/trash" && r.Method == http.MethodGet:
+		trash, err := ws.adminTrash(r.Context())
+		if err != nil {
+			Error.Printf("%v", err.Error())
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		data = trash
+	case r.URL.Path == "/admin/trash" && r.Method == http.MethodPost:
+		r.ParseForm()
+		formatName, id := r.PostForm.Get("format"), r.PostForm.Get("id")
+		err := ws.bc.RestoreFromTrash(r.Context(), formatName, id)
+		var duplicateError bcerrors.DuplicateError
+		switch {
+		case errors.Is(err, bcerrors.ErrFormatNotFound), errors.Is(err, bcerrors.ErrRecordNotFound):
+			http.NotFound(w, r)
+			return
+		case errors.As(err, &duplicateError):
+		case err != nil:
+			Error.Printf("%v", err.Error())
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		trash, err := ws.adminTrash(r.Context())
+		if err != nil {
+			Error.Printf("%v", err.Error())
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		trash.RestoredFormat, trash.RestoredID = formatName, id
+		trash.Duplicate = duplicateError.Fields
+		data = trash
+	case r.URL.Path == "/admin/reviews" && ws.reviews == nil:
+		http.NotFound(w, r)
+		return
+	case r.URL.Path == "/admin/reviews" && r.Method == http.MethodGet:
+		queue, err := ws.adminReviews(r.Context())
+		if err != nil {
+			Error.Printf("%v", err.Error())
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		data = queue
+	case r.URL.Path == "/admin/reviews" && r.Method == http.MethodPost:
+		r.ParseForm()
+		review, err := ws.reviews.Moderate(r.Context(), r.PostForm.Get("id"), reviews.Status(r.PostForm.Get("status")))
+		switch {
+		case errors.Is(err, bcerrors.ErrRecordNotFound):
+			http.NotFound(w, r)
+			return
+		case errors.Is(err, reviews.ErrInvalidStatus):
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		case err != nil:
+			Error.Printf("%v", err.Error())
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		queue, err := ws.adminReviews(r.Context())
+		if err != nil {
+			Error.Printf("%v", err.Error())
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		queue.Message = fmt.Sprintf("Review of %s %s", ws.listedReview(r.Context(), review).BookName, review.Status)
+		data = queue
+	case r.URL.Path == "/admin/works" && ws.works == nil:
+		http.NotFound(w, r)
+		return
+	case r.URL.Path == "/admin/works" && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		var status int
+		if status, data = ws.adminWorks(r); status != http.StatusOK {
+			http.Error(w, "", status)
+			return
+		}
+	case r.URL.Path == "/admin/duplicates" && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		var status int
+		if status, data = ws.adminDuplicates(r); status != http.StatusOK {
+			http.Error(w, "", status)
+			return
+		}
+	default:
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		Error.Printf("%v", err.Error())
+	}
+}
+
+// authorized returns if the request has the credentials of the administrator. Otherwise it responds with not found if
+// the admin section is disabled, or asks for the credentials.
+func (ws *Webserver) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if ws.adminPassword == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || user != adminUser || subtle.ConstantTimeCompare([]byte(password), []byte(ws.adminPassword)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="boocat admin"`)
+		http.Error(w, "", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// adminFormats returns the template data of the list of formats
+func (ws *Webserver) adminFormats() adminFormatsData {
+	editable := make(map[string]struct{})
+	for _, definition := range ws.bc.FormatDefinitions() {
+		editable[definition.Name] = struct{}{}
+	}
+	var data adminFormatsData
+	for name, format := range ws.bc.Formats() {
+		fields := make([]string, 0, len(format.Fields))
+		for field := range format.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		_, isEditable := editable[name]
+		data.Formats = append(data.Formats, adminFormat{Name: name, Fields: fields, Editable: isEditable})
+	}
+	sort.Slice(data.Formats, func(i, j int) bool {
+		return data.Formats[i].Name < data.Formats[j].Name
+	})
+	return data
+}
+
+// adminTrash returns the template data of the trash
+func (ws *Webserver) adminTrash(ctx context.Context) (adminTrashData, error) {
+	trash, err := ws.bc.Trash(ctx)
+	if err != nil {
+		return adminTrashData{}, err
+	}
+	formats := ws.bc.Formats()
+	var data adminTrashData
+	for _, trashed := range trash {
+		display := trashed.Record[formats[trashed.FormatName].Display]
+		if display == "" {
+			display = trashed.Record["id"]
+		}
+		data.Records = append(data.Records, adminTrashedRecord{
+			FormatName: trashed.FormatName,
+			ID:         trashed.Record["id"],
+			Display:    display,
+			Trashed:    trashed.Trashed.Local().Format("2006-01-02 15:04"),
+		})
+	}
+	return data, nil
+}
+
+// formatDefinition returns the definition of the format defined at runtime with the name, and if it's found
+func (ws *Webserver) formatDefinition(name string) (boocat.FormatDefinition, bool) {
+	for _, definition := range ws.bc.FormatDefinitions() {
+		if definition.Name == name {
+			return definition, true
+		}
+	}
+	return boocat.FormatDefinition{}, false
+}
+
+// adminFormatForm returns the template data of the form of the format definition
+func (ws *Webserver) adminFormatForm(definition boocat.FormatDefinition, failed map[string]string,
+	saved bool) adminFormatData {
+	data := adminFormatData{
+		Name:       definition.Name,
+		Display:    definition.Display,
+		Validators: ws.bc.ValidatorNames(),
+		Failed:     failed,
+		Saved:      saved,
+	}
+	searchable := make(map[string]struct{}, len(definition.Searchable))
+	for _, field := range definition.Searchable {
+		searchable[field] = struct{}{}
+	}
+	fields := make([]string, 0, len(definition.Fields))
+	for field := range definition.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		_, isSearchable := searchable[field]
+		data.Fields = append(data.Fields, adminField{
+			Index:      len(data.Fields),
+			Name:       field,
+			Validator:  definition.Fields[field],
+			Searchable: isSearchable,
+		})
+	}
+	for i := 0; i < newFieldRows; i++ {
+		data.Fields = append(data.Fields, adminField{Index: len(data.Fields)})
+	}
+	return data
+}
+
+// definitionFromForm returns the format definition submitted with the form of a format. The rows of fields are the
+// repeated "field" and "validator" values, and "searchable" has the indexes of the searchable rows. Rows without
+// field name are left out, which is how fields are removed.
+func definitionFromForm(r *http.Request) boocat.FormatDefinition {
+	definition := boocat.FormatDefinition{
+		Name:    strings.TrimSpace(r.PostForm.Get("name")),
+		Fields:  make(map[string]string),
+		Display: r.PostForm.Get("display"),
+	}
+	searchable := make(map[string]struct{})
+	for _, index := range r.PostForm["searchable"] {
+		searchable[index] = struct{}{}
+	}
+	validators := r.PostForm["validator"]
+	for i, field := range r.PostForm["field"] {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if i < len(validators) {
+			definition.Fields[field] = strings.TrimSpace(validators[i])
+		} else {
+			definition.Fields[field] = ""
+		}
+		if _, found := searchable[strconv.Itoa(i)]; found {
+			definition.Searchable = append(definition.Searchable, field)
+		}
+	}
+	return definition
+}
@@ -0,0 +1,98 @@
+package webserver
+
+// Implements the upload and download of the files attached to records
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// handleAttachment handles a request for an attached file. The key of the file is the last element of the URL path,
+// e.g. "/attachments/0123abcd", and the "thumbnail" query parameter requests the thumbnail of an image. Range requests
+// are supported.
+func (ws *Webserver) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/attachments/")
+	_, thumbnail := r.URL.Query()["thumbnail"]
+	file, info, err := ws.bc.Attachment(r.Context(), key, thumbnail)
+	switch {
+	case errors.Is(err, bcerrors.ErrRecordNotFound):
+		http.NotFound(w, r)
+		return
+	case err != nil:
+		Error.Printf("%v", err.Error())
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	if info.Name != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": info.Name}))
+	}
+	http.ServeContent(w, r, info.Name, info.ModTime, file)
+}
+
+// addAttachments stores the files uploaded in the attachment fields of the format, and sets the keys of the stored
+// files in params. Attachment fields without an uploaded file keep their submitted values. It returns the fields
+// whose files aren't accepted, and the fields with stored files and their submitted values.
+func (ws *Webserver) addAttachments(r *http.Request, formatName string, params map[string]string) (
+	map[string]string, map[string]string, error) {
+	failed := make(map[string]string)
+	uploaded := make(map[string]string)
+	if r.MultipartForm == nil {
+		return failed, uploaded, nil
+	}
+	format := ws.bc.Formats()[formatName]
+	for field := range format.Attachments {
+		headers := r.MultipartForm.File[field]
+		if len(headers) == 0 || headers[0].Size == 0 {
+			continue
+		}
+		file, err := headers[0].Open()
+		if err != nil {
+			ws.discardAttachments(r.Context(), params, uploaded)
+			return nil, nil, err
+		}
+		key, err := ws.bc.AddAttachment(r.Context(), formatName, field, headers[0].Filename, file)
+		file.Close()
+		var validationError bcerrors.ValidationFailedError
+		switch {
+		case errors.As(err, &validationError):
+			for failedField, fail := range validationError.Failed {
+				failed[failedField] = fail
+			}
+		case err != nil:
+			ws.discardAttachments(r.Context(), params, uploaded)
+			return nil, nil, err
+		default:
+			uploaded[field] = params[field]
+			params[field] = key
+		}
+	}
+	return failed, uploaded, nil
+}
+
+// discardAttachments deletes the files uploaded in the fields of a record that wasn't stored, and sets the fields of
+// params back to their submitted values
+func (ws *Webserver) discardAttachments(ctx context.Context, params, uploaded map[string]string) {
+	keys := make([]string, 0, len(uploaded))
+	for field, submitted := range uploaded {
+		keys = append(keys, params[field])
+		if submitted == "" {
+			delete(params, field)
+		} else {
+			params[field] = submitted
+		}
+	}
+	ws.bc.DiscardAttachments(ctx, keys)
+}
@@ -0,0 +1,273 @@
+package webserver
+
+// Implements the export of records as citations in BibTeX, RIS and CSL-JSON
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ivanmartinez/boocat/boocat"
+)
+
+// Names of the fields of the records that are used in citations
+const (
+	authorField   = "author"
+	yearField     = "year"
+	abstractField = "synopsis"
+	isbnField     = "isbn"
+)
+
+// citationStyle is a way of writing citations
+type citationStyle struct {
+	contentType string
+	write       func(w io.Writer, citations []citation) error
+}
+
+// citation contains the data of a record that is cited
+type citation struct {
+	ID     string
+	Book   bool
+	Title  string
+	Author string
+	Year   string
+	// Abstract of the cited work
+	Abstract string
+	ISBN     string
+}
+
+// cslName is a name as defined by CSL-JSON
+type cslName struct {
+	Family string `json:"family,omitempty"`
+	Given  string `json:"given,omitempty"`
+}
+
+// cslItem is an item as defined by CSL-JSON
+type cslItem struct {
+	ID       string             `json:"id"`
+	Type     string             `json:"type"`
+	Title    string             `json:"title,omitempty"`
+	Author   []cslName          `json:"author,omitempty"`
+	Issued   map[string][][]int `json:"issued,omitempty"`
+	Abstract string             `json:"abstract,omitempty"`
+	ISBN     string             `json:"ISBN,omitempty"`
+}
+
+// citationStyles maps the values of the "_cite" parameter to the citation styles
+var citationStyles = map[string]citationStyle{
+	"bibtex": {contentType: "application/x-bibtex", write: writeBibTeX},
+	"ris":    {contentType: "application/x-research-info-systems", write: writeRIS},
+	"csl":    {contentType: "application/vnd.citationstyles.csl+json", write: writeCSL},
+}
+
+// requestedCitationStyle returns the citation style requested with the "_cite" parameter or, if there isn't one, with
+// the Accept header. It returns false if none was requested, and a style without write function if the requested one
+// doesn't exist.
+func requestedCitationStyle(r *http.Request, params map[string]string) (citationStyle, bool) {
+	if name, found := params["_cite"]; found {
+		return citationStyles[name], true
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		for _, style := range citationStyles {
+			if style.contentType == mediaType {
+				return style, true
+			}
+		}
+	}
+	return citationStyle{}, false
+}
+
+// writeCitations writes the records of the format in data, which is a record or a list of records, as citations in
+// the style
+func (ws *Webserver) writeCitations(ctx context.Context, w http.ResponseWriter, formatName string, data interface{},
+	style citationStyle) error {
+	var records []map[string]string
+	switch typed := data.(type) {
+	case map[string]string:
+		records = []map[string]string{typed}
+	case map[string]interface{}:
+		records = []map[string]string{unresolvedRecord(typed)}
+	case listData:
+		records = typed.Records
+	}
+	format := ws.bc.Formats()[formatName]
+	authors := make(map[string]string)
+	citations := make([]citation, 0, len(records))
+	for _, record := range records {
+		citations = append(citations, citation{
+			ID:       record["id"],
+			Book:     formatName == "book",
+			Title:    record[format.Display],
+			Author:   ws.authorName(ctx, format, record, authors),
+			Year:     record[yearField],
+			Abstract: record[abstractField],
+			ISBN:     record[isbnField],
+		})
+	}
+	w.Header().Set("Content-Type", style.contentType+"; charset=utf-8")
+	return style.write(w, citations)
+}
+
+// authorName returns the display value of the author referenced by the record, or the empty string if there isn't
+// one. Names are cached in authors by ID.
+func (ws *Webserver) authorName(ctx context.Context, format boocat.Format, record map[string]string,
+	authors map[string]string) string {
+	authorFormatName, found := format.References[authorField]
+	id := record[authorField]
+	if !found || id == "" {
+		return ""
+	}
+	if name, found := authors[id]; found {
+		return name
+	}
+	if author, err := ws.bc.GetRecord(ctx, authorFormatName, id); err == nil {
+		authors[id] = author[ws.bc.Formats()[authorFormatName].Display]
+	}
+	return authors[id]
+}
+
+// unresolvedRecord returns a record with resolved references as a record with the IDs of the referenced records
+func unresolvedRecord(resolved map[string]interface{}) map[string]string {
+	record := make(map[string]string, len(resolved))
+	for field, value := range resolved {
+		switch typed := value.(type) {
+		case string:
+			record[field] = typed
+		case map[string]string:
+			record[field] = typed["id"]
+		case []string:
+			record[field] = boocat.JoinList(typed)
+		case []map[string]string:
+			ids := make([]string, 0, len(typed))
+			for _, referenced := range typed {
+				ids = append(ids, referenced["id"])
+			}
+			record[field] = boocat.JoinList(ids)
+		}
+	}
+	return record
+}
+
+// writeBibTeX writes the citations as BibTeX entries
+func writeBibTeX(w io.Writer, citations []citation) error {
+	for _, c := range citations {
+		entryType := "misc"
+		if c.Book {
+			entryType = "book"
+		}
+		if _, err := fmt.Fprintf(w, "@%s{%s,\n", entryType, c.ID); err != nil {
+			return err
+		}
+		for _, field := range [][2]string{
+			{"title", c.Title},
+			{"author", invertedName(c.Author)},
+			{"year", c.Year},
+			{"abstract", c.Abstract},
+			{"isbn", c.ISBN},
+		} {
+			if field[1] != "" {
+				if _, err := fmt.Fprintf(w, "  %s = {%s},\n", field[0], escapeBibTeX(field[1])); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := fmt.Fprint(w, "}\n\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRIS writes the citations as RIS references
+func writeRIS(w io.Writer, citations []citation) error {
+	for _, c := range citations {
+		referenceType := "GEN"
+		if c.Book {
+			referenceType = "BOOK"
+		}
+		for _, tag := range [][2]string{
+			{"TY", referenceType},
+			{"ID", c.ID},
+			{"TI", c.Title},
+			{"AU", invertedName(c.Author)},
+			{"PY", c.Year},
+			{"AB", c.Abstract},
+			{"SN", c.ISBN},
+			{"ER", ""},
+		} {
+			if tag[1] != "" || tag[0] == "ER" {
+				value := strings.ReplaceAll(tag[1], "\n", " ")
+				if _, err := fmt.Fprintf(w, "%s  - %s\r\n", tag[0], value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// writeCSL writes the citations as a CSL-JSON array of items
+func writeCSL(w io.Writer, citations []citation) error {
+	items := make([]cslItem, 0, len(citations))
+	for _, c := range citations {
+		item := cslItem{
+			ID:       c.ID,
+			Type:     "document",
+			Title:    c.Title,
+			Abstract: c.Abstract,
+			ISBN:     c.ISBN,
+		}
+		if c.Book {
+			item.Type = "book"
+		}
+		if c.Author != "" {
+			family, given := splitName(c.Author)
+			item.Author = []cslName{{Family: family, Given: given}}
+		}
+		if year, err := strconv.Atoi(c.Year); err == nil {
+			item.Issued = map[string][][]int{"date-parts": {{year}}}
+		}
+		items = append(items, item)
+	}
+	return json.NewEncoder(w).Encode(items)
+}
+
+// splitName returns the family name, which is the last word of the name, and the given names
+func splitName(name string) (string, string) {
+	name = strings.TrimSpace(name)
+	i := strings.LastIndex(name, " ")
+	if i < 0 {
+		return name, ""
+	}
+	return name[i+1:], name[:i]
+}
+
+// invertedName returns a name as family name, comma and given names, e.g. "Orwell, George"
+func invertedName(name string) string {
+	family, given := splitName(name)
+	if given == "" {
+		return family
+	}
+	return family + ", " + given
+}
+
+// escapeBibTeX returns the value with the characters that are special in BibTeX escaped
+func escapeBibTeX(value string) string {
+	var builder strings.Builder
+	for _, r := range value {
+		if strings.ContainsRune(`&%$#_{}`, r) {
+			builder.WriteRune('\\')
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
@@ -5,6 +5,7 @@ package webserver
 import (
 	"html/template"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -14,11 +15,14 @@ import (
 type Template struct {
 	template   *template.Template
 	formatName string
+	// If the template is generic, so its data is wrapped in genericData
+	generic bool
 }
 
 // StaticFile contains a static file
 type StaticFile struct {
-	content []byte
+	content     []byte
+	contentType string
 }
 
 // LoadTemplate loads a template from a file located in rootPath+path, and associates it to the format with name
@@ -48,7 +52,8 @@ func (ws *Webserver) LoadStaticFile(rootPath, path string) {
 		}
 		ws.staticFiles[strings.TrimSuffix(path, filepath.Ext(path))] =
 			&StaticFile{
-				content: content,
+				content:     content,
+				contentType: mime.TypeByExtension(filepath.Ext(path)),
 			}
 	default:
 		content, err := ioutil.ReadFile(rootPath + path)
@@ -57,7 +62,8 @@ func (ws *Webserver) LoadStaticFile(rootPath, path string) {
 		}
 		ws.staticFiles[path] =
 			&StaticFile{
-				content: content,
+				content:     content,
+				contentType: mime.TypeByExtension(filepath.Ext(path)),
 			}
 	}
 }
@@ -69,7 +75,9 @@ func (goTpl *Template) Write(w http.ResponseWriter, data interface{}) error {
 
 // Write writes the contents of the file to w
 func (sFile *StaticFile) Write(w http.ResponseWriter) error {
-	//@TODO: MIME types
+	if sFile.contentType != "" {
+		w.Header().Set("Content-Type", sFile.contentType)
+	}
 	_, err := w.Write(sFile.content)
 	return err
 }
@@ -0,0 +1,220 @@
+package webserver
+
+// Implements the pages of the circulation desk, where copies are checked out, returned and renewed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// Layout of the dates shown in the desk
+const deskDateLayout = "2006-01-02"
+
+// deskData is the data passed to the templates of the circulation desk
+type deskData struct {
+	// Result of the last operation, and if it failed
+	Message string
+	Failed  bool
+	// Patron whose loans are listed, if any, and if reading lists are enabled, so that the patron can get a secret
+	Patron map[string]string
+	Lists  bool
+	// Loans listed, which are the loans of the patron or the overdue loans
+	Loans []deskLoan
+	// Holds whose copies wait to be picked up
+	Holds []deskHold
+	Today string
+}
+
+// deskLoan is a loan as listed in the desk
+type deskLoan struct {
+	circulation.Loan
+	// Barcode of the copy, and name of its book and of the patron
+	Barcode    string
+	BookName   string
+	PatronName string
+	DueDate    string
+	// If the due date has passed
+	Late bool
+}
+
+// SetDesk enables the circulation desk, which requires the credentials of the admin section. Copies and patrons are
+// only managed with generic templates with those credentials too, and loans and holds only through the desk and the
+// holds pages.
+func (ws *Webserver) SetDesk(desk *circulation.Desk) {
+	ws.desk = desk
+	ws.restrict(adminAccess, circulation.CopyFormat, circulation.PatronFormat)
+	ws.restrict(noAccess, circulation.LoanFormat, circulation.HoldFormat)
+}
+
+// LoadDeskTemplate loads a template of the circulation desk from a file located in rootPath+path. The path of the URL
+// of the template will be path without the file extension.
+func (ws *Webserver) LoadDeskTemplate(rootPath, path string) {
+	tmpl, err := template.ParseFiles(rootPath + path)
+	if err != nil {
+		Error.Fatal(err)
+	}
+	ws.deskTemplates[strings.TrimSuffix(path, filepath.Ext(path))] = tmpl
+}
+
+// handleDesk handles a request of the circulation desk. "/desk" lists the overdue loans and the holds ready to be
+// picked up, and posting "action" as
+// "checkout", "return" or "renew" with the "copy" barcode and, to check out, the "patron" card applies the action.
+// "/desk/patron" lists the loans of the patron with the "card" query parameter, and posting the "card" issues a new
+// secret that the patron signs in to the reading lists and submits reviews with, if reading lists are enabled.
+func (ws *Webserver) handleDesk(w http.ResponseWriter, r *http.Request) {
+	if ws.desk == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !ws.authorized(w, r) {
+		return
+	}
+	tmpl, found := ws.deskTemplates[r.URL.Path]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	data := deskData{Today: ws.desk.Today().Format(deskDateLayout)}
+	var (
+		loans []circulation.Loan
+		err   error
+	)
+	switch {
+	case r.URL.Path == "/desk" && r.Method == http.MethodPost:
+		r.ParseForm()
+		data.Message, err = ws.deskAction(ctx, r.PostForm.Get("action"), r.PostForm.Get("copy"),
+			r.PostForm.Get("patron"))
+		if err != nil {
+			data.Message, data.Failed = deskFailure(err), true
+		}
+		fallthrough
+	case r.URL.Path == "/desk" && r.Method == http.MethodGet:
+		loans, err = ws.desk.Overdue(ctx)
+		if err == nil {
+			var holds []circulation.Hold
+			holds, err = ws.desk.ReadyHolds(ctx)
+			for _, hold := range holds {
+				data.Holds = append(data.Holds, ws.deskHold(ctx, hold))
+			}
+		}
+	case r.URL.Path == "/desk/patron" && (r.Method == http.MethodGet || ws.lists != nil):
+		r.ParseForm()
+		data.Patron, err = ws.bc.FindRecord(ctx, circulation.PatronFormat, "card", r.Form.Get("card"))
+		if errors.Is(err, bcerrors.ErrRecordNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		data.Lists = ws.lists != nil
+		if err == nil && r.Method == http.MethodPost {
+			var secret string
+			if secret, err = ws.lists.NewSecret(ctx, data.Patron["id"]); err == nil {
+				data.Message = fmt.Sprintf("New secret of the patron: %s", secret)
+			}
+		}
+		if err == nil {
+			loans, err = ws.desk.PatronLoans(ctx, data.Patron["id"])
+		}
+	default:
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		Error.Printf("%v", err.Error())
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	for _, loan := range loans {
+		data.Loans = append(data.Loans, ws.deskLoan(ctx, loan))
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		Error.Printf("%v", err.Error())
+	}
+}
+
+// deskAction applies the action to the copy with the barcode, and the patron with the card when checking out, and
+// returns the message of the result
+func (ws *Webserver) deskAction(ctx context.Context, action, barcode, card string) (string, error) {
+	copyRecord, err := ws.bc.FindRecord(ctx, circulation.CopyFormat, "barcode", barcode)
+	if errors.Is(err, bcerrors.ErrRecordNotFound) {
+		return "", fmt.Errorf("copy '%s' not found", barcode)
+	}
+	if err != nil {
+		return "", err
+	}
+	switch action {
+	case "checkout":
+		patron, err := ws.bc.FindRecord(ctx, circulation.PatronFormat, "card", card)
+		if errors.Is(err, bcerrors.ErrRecordNotFound) {
+			return "", fmt.Errorf("patron '%s' not found", card)
+		}
+		if err != nil {
+			return "", err
+		}
+		loan, err := ws.desk.Checkout(ctx, copyRecord["id"], patron["id"])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Checked out %s to %s, due %s", barcode, patron["name"],
+			loan.Due.Format(deskDateLayout)), nil
+	case "return":
+		loan, err := ws.desk.Return(ctx, copyRecord["id"])
+		if err != nil {
+			return "", err
+		}
+		message := fmt.Sprintf("Returned %s", barcode)
+		if days := int(math.Round(loan.Returned.Sub(loan.Due).Hours() / 24)); days > 0 {
+			message += fmt.Sprintf(", %d days late", days)
+		}
+		if hold, onHold, err := ws.desk.ReadyHold(ctx, copyRecord["id"]); err == nil && onHold {
+			message += fmt.Sprintf(", on hold for %s", ws.deskHold(ctx, hold).PatronName)
+		}
+		return message, nil
+	case "renew":
+		loan, err := ws.desk.Renew(ctx, copyRecord["id"])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Renewed %s, due %s", barcode, loan.Due.Format(deskDateLayout)), nil
+	default:
+		return "", fmt.Errorf("unknown action '%s'", action)
+	}
+}
+
+// deskFailure returns the message of an action that failed. Unexpected errors are logged instead of shown.
+func deskFailure(err error) string {
+	var unexpectedError bcerrors.UnexpectedError
+	if errors.As(err, &unexpectedError) {
+		Error.Printf("%v", err.Error())
+		return "Unexpected error"
+	}
+	return err.Error()
+}
+
+// deskLoan returns the loan as listed in the desk
+func (ws *Webserver) deskLoan(ctx context.Context, loan circulation.Loan) deskLoan {
+	listed := deskLoan{
+		Loan:    loan,
+		DueDate: loan.Due.Format(deskDateLayout),
+		Late:    loan.Overdue(ws.desk.Today()),
+	}
+	if copyRecord, err := ws.bc.GetRecord(ctx, circulation.CopyFormat, loan.CopyID); err == nil {
+		listed.Barcode = copyRecord["barcode"]
+		if book, err := ws.bc.GetRecord(ctx, "book", copyRecord["book"]); err == nil {
+			listed.BookName = book["name"]
+		}
+	}
+	if patron, err := ws.bc.GetRecord(ctx, circulation.PatronFormat, loan.PatronID); err == nil {
+		listed.PatronName = patron["name"]
+	}
+	return listed
+}
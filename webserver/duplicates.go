@@ -0,0 +1,112 @@
+package webserver
+
+// Implements the review of suspected duplicate records in the admin section, where they are merged or marked as
+// distinct
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// Minimum score of the duplicates listed when the request doesn't set one
+const defaultDuplicateScore = 0.8
+
+// adminDuplicatesData is the data passed to the template of the suspected duplicates
+type adminDuplicatesData struct {
+	// Formats with a display field, which can be checked for duplicates, sorted by name
+	Formats []string
+	// Format checked, which is empty if none is chosen, and its fields sorted by name
+	FormatName string
+	Fields     []string
+	// Minimum score of the listed duplicates
+	MinScore float64
+	// Suspected duplicates, the most similar first
+	Duplicates []boocat.Duplicate
+	// Result of the last operation, and if it failed
+	Message string
+	Failed  bool
+}
+
+// adminDuplicates handles a request of "/admin/duplicates", which lists the suspected duplicates of the records of the
+// "format" query parameter with at least the "score" query parameter. Posting "action" as "merge" with the ids of the
+// record to "keep" and of the record to "merge" into it merges them, and posting it as "distinct" with the ids of the
+// "first" and "second" records marks them as not being duplicates.
+func (ws *Webserver) adminDuplicates(r *http.Request) (int, interface{}) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	data := adminDuplicatesData{FormatName: query.Get("format"), MinScore: defaultDuplicateScore}
+	for name, format := range ws.bc.Formats() {
+		if format.Display != "" {
+			data.Formats = append(data.Formats, name)
+		}
+	}
+	sort.Strings(data.Formats)
+	if score := query.Get("score"); score != "" {
+		var err error
+		if data.MinScore, err = strconv.ParseFloat(score, 64); err != nil {
+			return http.StatusBadRequest, nil
+		}
+	}
+	if data.FormatName == "" {
+		return http.StatusOK, data
+	}
+	format, found := ws.bc.Formats()[data.FormatName]
+	if !found {
+		return http.StatusNotFound, nil
+	}
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		var err error
+		data.Message, err = ws.duplicateAction(ctx, data.FormatName, r.PostForm)
+		if err != nil {
+			data.Message, data.Failed = deskFailure(err), true
+		}
+	}
+	for field := range format.Fields {
+		data.Fields = append(data.Fields, field)
+	}
+	sort.Strings(data.Fields)
+	var err error
+	data.Duplicates, err = ws.bc.FindDuplicates(ctx, data.FormatName, data.MinScore)
+	switch {
+	case errors.Is(err, bcerrors.ErrNoDisplayField):
+		return http.StatusBadRequest, nil
+	case err != nil:
+		Error.Printf("%v", err.Error())
+		return http.StatusInternalServerError, nil
+	}
+	return http.StatusOK, data
+}
+
+// duplicateAction applies the posted action to records of the format, and returns the message of its result
+func (ws *Webserver) duplicateAction(ctx context.Context, formatName string, form url.Values) (string, error) {
+	switch form.Get("action") {
+	case "merge":
+		keptID, mergedID := form.Get("keep"), form.Get("merge")
+		if err := ws.bc.MergeRecords(ctx, formatName, keptID, mergedID); err != nil {
+			return "", err
+		}
+		if ws.subjects != nil {
+			if err := ws.subjects.MoveTags(ctx, formatName, mergedID, keptID); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("%s %s merged into %s", formatName, mergedID, keptID), nil
+	case "distinct":
+		first, second := form.Get("first"), form.Get("second")
+		if err := ws.bc.MarkDistinct(ctx, formatName, first, second); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s and %s marked as distinct", formatName, first, second), nil
+	default:
+		return "", fmt.Errorf("unknown action '%s'", form.Get("action"))
+	}
+}
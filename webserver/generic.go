@@ -0,0 +1,148 @@
+package webserver
+
+// Implements the templates shared by the formats that don't have their own, like the ones defined at runtime
+
+import (
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+
+	"github.com/ivanmartinez/boocat/boocat"
+)
+
+// access is who can use the generic templates and the autocompletion of a format
+type access int
+
+const (
+	// Anyone, which is the default
+	publicAccess access = iota
+	// Only with the credentials of the admin section
+	adminAccess
+	// No one, because the records are only changed and shown through the pages of the feature that manages them, which
+	// enforce its rules
+	noAccess
+)
+
+// genericData is the data passed to generic templates, with the format of the page and the data of the request
+type genericData struct {
+	Format string
+	// Field names sorted
+	Fields []string
+	// Names of the reference fields and the formats they reference
+	References map[string]string
+	// Name of the field used to display the records
+	Display string
+	// Data of the request, as passed to templates of a format
+	Data interface{}
+	// Names of the reference fields and the display fields of the formats they reference
+	referencedDisplays map[string]string
+}
+
+// LoadGenericTemplate loads a generic template from a file located in rootPath+path. The template is used for the URL
+// paths that are prefix followed by the name of a format without a template for that path, e.g. prefix "/edit/" is
+// used for "/edit/magazine".
+func (ws *Webserver) LoadGenericTemplate(rootPath, path, prefix string) {
+	tmpl, err := template.ParseFiles(rootPath + path)
+	if err != nil {
+		Error.Fatal(err)
+	}
+	ws.genericTemplates[prefix] = tmpl
+}
+
+// restrict sets the access to the generic templates and the autocompletion of the formats
+func (ws *Webserver) restrict(formatAccess access, formatNames ...string) {
+	for _, formatName := range formatNames {
+		ws.formatAccess[formatName] = formatAccess
+	}
+}
+
+// genericTemplate returns the generic template for the URL path, with the name of the format in the path. Formats
+// without access don't have generic templates.
+func (ws *Webserver) genericTemplate(path string) (*Template, bool) {
+	for prefix, tmpl := range ws.genericTemplates {
+		formatName := strings.TrimPrefix(path, prefix)
+		if !strings.HasPrefix(path, prefix) || strings.Contains(formatName, "/") ||
+			ws.formatAccess[formatName] == noAccess {
+			continue
+		}
+		if _, found := ws.bc.Formats()[formatName]; found {
+			return &Template{template: tmpl, formatName: formatName, generic: true}, true
+		}
+	}
+	return nil, false
+}
+
+// newGenericData returns the data passed to generic templates of the format with the data of the request. formats
+// are all the formats, used to display referenced records.
+func newGenericData(formats map[string]boocat.Format, format boocat.Format, data interface{}) genericData {
+	fields := make([]string, 0, len(format.Fields))
+	for field := range format.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	referencedDisplays := make(map[string]string, len(format.References))
+	for field, refFormatName := range format.References {
+		referencedDisplays[field] = formats[refFormatName].Display
+	}
+	return genericData{
+		Format:             format.Name,
+		Fields:             fields,
+		References:         format.References,
+		Display:            format.Display,
+		Data:               data,
+		referencedDisplays: referencedDisplays,
+	}
+}
+
+// Value returns the value of a field of the record in the data, as submitted in forms. Referenced records are their
+// IDs.
+func (d genericData) Value(field string) string {
+	switch record := d.Data.(type) {
+	case map[string]string:
+		return record[field]
+	case map[string]interface{}:
+		return formValueOf(record[field])
+	default:
+		return ""
+	}
+}
+
+// Label returns the value of a field of the record in the data, as displayed. Referenced records are their display
+// values.
+func (d genericData) Label(field string) string {
+	record, isRecord := d.Data.(map[string]interface{})
+	if !isRecord {
+		return d.Value(field)
+	}
+	referenced, isReference := record[field].(map[string]string)
+	if !isReference {
+		return d.Value(field)
+	}
+	if label := referenced[d.referencedDisplays[field]]; label != "" {
+		return label
+	}
+	return referenced["id"]
+}
+
+// formValueOf returns the value of a field of a record with its references resolved, as submitted in forms
+func formValueOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case map[string]string:
+		return v["id"]
+	case []string:
+		return boocat.JoinList(v)
+	case []map[string]string:
+		ids := make([]string, 0, len(v))
+		for _, referenced := range v {
+			ids = append(ids, referenced["id"])
+		}
+		return boocat.JoinList(ids)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -0,0 +1,148 @@
+package webserver
+
+// Implements the page of holds, where patrons place holds on books and see their positions in the queues
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+)
+
+// holdsData is the data passed to the template of the holds of a patron
+type holdsData struct {
+	// Result of the last operation, and if it failed
+	Message string
+	Failed  bool
+	// Card of the patron, and the patron if found
+	Card   string
+	Patron map[string]string
+	Holds  []deskHold
+}
+
+// deskHold is a hold as listed in the desk and the page of holds
+type deskHold struct {
+	circulation.Hold
+	// Name of the book and of the patron, and barcode of the copy assigned to the hold
+	BookName    string
+	PatronName  string
+	Barcode     string
+	ExpiresDate string
+}
+
+// handleHolds handles a request of the page of holds, which doesn't require credentials. "/holds" lists the holds of
+// the patron with the "card" query parameter. Posting "action" as "place" with the "book" id, or as "cancel" with the
+// "hold" id, places or cancels a hold of the patron with the "card".
+func (ws *Webserver) handleHolds(w http.ResponseWriter, r *http.Request) {
+	tmpl, found := ws.deskTemplates[r.URL.Path]
+	if ws.desk == nil || !found {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	var data holdsData
+	switch r.Method {
+	case http.MethodPost:
+		r.ParseForm()
+		data.Card = r.PostForm.Get("card")
+		var err error
+		data.Message, err = ws.holdAction(ctx, r.PostForm.Get("action"), data.Card, r.PostForm.Get("book"),
+			r.PostForm.Get("hold"))
+		if err != nil {
+			data.Message, data.Failed = deskFailure(err), true
+		}
+	case http.MethodGet:
+		data.Card = r.URL.Query().Get("card")
+	default:
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if data.Card != "" {
+		patron, err := ws.bc.FindRecord(ctx, circulation.PatronFormat, "card", data.Card)
+		if err != nil && !errors.Is(err, bcerrors.ErrRecordNotFound) {
+			Error.Printf("%v", err.Error())
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			data.Patron = patron
+			holds, err := ws.desk.PatronHolds(ctx, patron["id"])
+			if err != nil {
+				Error.Printf("%v", err.Error())
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+			for _, hold := range holds {
+				data.Holds = append(data.Holds, ws.deskHold(ctx, hold))
+			}
+		}
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		Error.Printf("%v", err.Error())
+	}
+}
+
+// holdAction applies the action for the patron with the card to the book or the hold with the ids, and returns the
+// message of the result
+func (ws *Webserver) holdAction(ctx context.Context, action, card, bookID, holdID string) (string, error) {
+	patron, err := ws.bc.FindRecord(ctx, circulation.PatronFormat, "card", card)
+	if errors.Is(err, bcerrors.ErrRecordNotFound) {
+		return "", fmt.Errorf("patron '%s' not found", card)
+	}
+	if err != nil {
+		return "", err
+	}
+	switch action {
+	case "place":
+		book, err := ws.bc.GetRecord(ctx, "book", bookID)
+		if errors.Is(err, bcerrors.ErrRecordNotFound) {
+			return "", errors.New("book not found")
+		}
+		if err != nil {
+			return "", err
+		}
+		hold, err := ws.desk.PlaceHold(ctx, bookID, patron["id"])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Placed hold on %s, number %d in the queue", book["name"], hold.Position), nil
+	case "cancel":
+		holds, err := ws.desk.PatronHolds(ctx, patron["id"])
+		if err != nil {
+			return "", err
+		}
+		for _, hold := range holds {
+			if hold.ID != holdID {
+				continue
+			}
+			if _, err := ws.desk.CancelHold(ctx, holdID); err != nil {
+				return "", err
+			}
+			return "Cancelled hold", nil
+		}
+		return "", errors.New("hold not found")
+	default:
+		return "", fmt.Errorf("unknown action '%s'", action)
+	}
+}
+
+// deskHold returns the hold as listed in the desk and the page of holds
+func (ws *Webserver) deskHold(ctx context.Context, hold circulation.Hold) deskHold {
+	listed := deskHold{Hold: hold}
+	if hold.Status == circulation.Ready {
+		listed.ExpiresDate = hold.Expires.Format(deskDateLayout)
+		if copyRecord, err := ws.bc.GetRecord(ctx, circulation.CopyFormat, hold.CopyID); err == nil {
+			listed.Barcode = copyRecord["barcode"]
+		}
+	}
+	if book, err := ws.bc.GetRecord(ctx, "book", hold.BookID); err == nil {
+		listed.BookName = book["name"]
+	}
+	if patron, err := ws.bc.GetRecord(ctx, circulation.PatronFormat, hold.PatronID); err == nil {
+		listed.PatronName = patron["name"]
+	}
+	return listed
+}
@@ -0,0 +1,120 @@
+package webserver
+
+// Implements the data passed to the templates of lists of records
+
+import (
+	"context"
+	"net/url"
+	"sort"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/works"
+)
+
+// listData is the data passed to templates of lists of records
+type listData struct {
+	Records []map[string]string
+	// Facets sorted by field name
+	Facets []facet
+	// Parameters of the request, used to keep them in forms
+	Params map[string]string
+	// URL query that removes all the filters
+	ClearURL string
+	// Records grouped by work, only for editions when works are enabled
+	Groups []works.Group
+}
+
+// facet contains the counted values of a field of the listed records
+type facet struct {
+	Field  string
+	Values []facetValue
+}
+
+// facetValue is a value of a facet and the URL query that toggles filtering by it
+type facetValue struct {
+	Value string
+	// Label to show instead of the value, which is the display value of the referenced record for reference fields
+	Label    string
+	Count    int
+	Selected bool
+	URL      string
+}
+
+// newListData returns the template data of the filtered records, listed with the parameters of the request. labels
+// has the labels of the facet values by field and value. Values without label are labelled with themselves.
+func newListData(filtered boocat.FilteredRecords, params map[string]string,
+	labels map[string]map[string]string) listData {
+	data := listData{
+		Records:  filtered.Records,
+		Facets:   make([]facet, 0, len(filtered.Facets)),
+		Params:   params,
+		ClearURL: "?",
+	}
+	for field, counts := range filtered.Facets {
+		f := facet{Field: field}
+		for _, value := range boocat.SortedValues(counts) {
+			selected := params[field] == value.Value
+			query := queryFromParams(params)
+			if selected {
+				query.Del(field)
+			} else {
+				query.Set(field, value.Value)
+			}
+			label, found := labels[field][value.Value]
+			if !found {
+				label = value.Value
+			}
+			f.Values = append(f.Values, facetValue{
+				Value:    value.Value,
+				Label:    label,
+				Count:    value.Count,
+				Selected: selected,
+				URL:      "?" + query.Encode(),
+			})
+		}
+		data.Facets = append(data.Facets, f)
+	}
+	sort.Slice(data.Facets, func(i, j int) bool {
+		return data.Facets[i].Field < data.Facets[j].Field
+	})
+	return data
+}
+
+// facetLabels returns the display values of the records referenced by the values of the facets of reference fields
+// of the format, by field and value
+func (ws *Webserver) facetLabels(ctx context.Context, format boocat.Format,
+	facets map[string]map[string]int) map[string]map[string]string {
+	labels := make(map[string]map[string]string)
+	for field, counts := range facets {
+		refFormatName, found := format.References[field]
+		if !found {
+			continue
+		}
+		display := ws.bc.Formats()[refFormatName].Display
+		labels[field] = make(map[string]string, len(counts))
+		for id := range counts {
+			if record, err := ws.bc.GetRecord(ctx, refFormatName, id); err == nil && record[display] != "" {
+				labels[field][id] = record[display]
+			}
+		}
+	}
+	return labels
+}
+
+// URLWith returns the URL query of the list with the parameter set to the value
+func (data listData) URLWith(param, value string) string {
+	query := queryFromParams(data.Params)
+	query.Set(param, value)
+	return "?" + query.Encode()
+}
+
+// queryFromParams returns the URL query with the non-empty parameters
+func queryFromParams(params map[string]string) url.Values {
+	query := make(url.Values, len(params))
+	for param, value := range params {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+	return query
+}
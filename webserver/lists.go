@@ -0,0 +1,326 @@
+package webserver
+
+// Implements the pages of reading lists, where patrons keep lists of books and share them, and the export of lists
+// with templates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/readinglists"
+)
+
+// Name of the cookie with the card and the session token of the patron signed in to the reading lists
+const listsCookie = "lists"
+
+// listsData is the data passed to the templates of reading lists
+type listsData struct {
+	// Result of the last operation, and if it failed
+	Message string
+	Failed  bool
+	// Card of the patron signed in, and the patron if one is
+	Card   string
+	Patron map[string]string
+	// Lists of the patron, and the public lists of all patrons
+	PatronLists []readinglists.List
+	PublicLists []readinglists.List
+	// List shown, which has an empty ID if none is, with the name of its owner and its entries
+	List      readinglists.List
+	OwnerName string
+	Entries   []listedEntry
+	// If the patron owns the list shown
+	Owner bool
+	// Key of the shareable URL the list is shown with, which is set for its owner too
+	Key string
+}
+
+// listedEntry is an entry of a list with its book
+type listedEntry struct {
+	readinglists.Entry
+	Book map[string]string
+}
+
+// listExport is a template that exports a list, and the content type of what it writes
+type listExport struct {
+	template    *texttemplate.Template
+	contentType string
+}
+
+// SetReadingLists enables the reading lists of patrons, who sign in to them with secrets issued at the circulation
+// desk. Lists are only shown through their pages then, so that private lists are only shown to their owners and
+// through their shareable URLs.
+func (ws *Webserver) SetReadingLists(lists *readinglists.Lists) {
+	ws.lists = lists
+	ws.restrict(noAccess, readinglists.ListFormat, readinglists.EntryFormat)
+}
+
+// LoadListsTemplate loads a template of the pages of reading lists from a file located in rootPath+path. The path of
+// the URL of the template will be path without the file extension.
+func (ws *Webserver) LoadListsTemplate(rootPath, path string) {
+	tmpl, err := template.ParseFiles(rootPath + path)
+	if err != nil {
+		Error.Fatal(err)
+	}
+	ws.listTemplates[strings.TrimSuffix(path, filepath.Ext(path))] = tmpl
+}
+
+// LoadListExportTemplate loads a text template that exports a reading list from a file located in rootPath+path,
+// which writes content of the content type. The path of the URL of the export will be path without the file
+// extension, e.g. "/lists/markdown".
+func (ws *Webserver) LoadListExportTemplate(rootPath, path, contentType string) {
+	tmpl, err := texttemplate.ParseFiles(rootPath + path)
+	if err != nil {
+		Error.Fatal(err)
+	}
+	ws.listExports[strings.TrimSuffix(path, filepath.Ext(path))] = listExport{template: tmpl, contentType: contentType}
+}
+
+// handleLists handles a request of the reading lists. "/lists" lists the public lists and the lists of the patron
+// signed in, or shows the list with the "id" query parameter if it's public, of the patron, or the "key" query
+// parameter is its key. Posting "action" as "signin" with the "card" and the "secret" of a patron signs the patron in
+// with a cookie, and "signout" signs out. Posting "create", "update", "delete", "add", "remove" or "move" changes the
+// lists of the patron signed in as described in listAction. The paths of export templates, e.g. "/lists/markdown",
+// export the list with the "id" if it would be shown.
+func (ws *Webserver) handleLists(w http.ResponseWriter, r *http.Request) {
+	if ws.lists == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if export, found := ws.listExports[r.URL.Path]; found && r.Method == http.MethodGet {
+		ws.exportList(w, r, export)
+		return
+	}
+	tmpl, found := ws.listTemplates[r.URL.Path]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	var (
+		data   listsData
+		listID string
+		err    error
+	)
+	switch r.Method {
+	case http.MethodPost:
+		r.ParseForm()
+		listID = r.PostForm.Get("list")
+		switch action := r.PostForm.Get("action"); action {
+		case "signin":
+			err = ws.listsSignIn(w, r, &data)
+		case "signout":
+			http.SetCookie(w, &http.Cookie{Name: listsCookie, Path: "/lists", MaxAge: -1})
+		default:
+			if err = ws.listsPatron(r, &data); err != nil {
+				break
+			}
+			if data.Patron == nil {
+				data.Message, data.Failed = "Sign in to change your lists", true
+				break
+			}
+			data.Message, err = ws.listAction(ctx, action, data.Patron["id"], &listID, r.PostForm)
+			if err != nil {
+				data.Message, data.Failed, err = deskFailure(err), true, nil
+			}
+		}
+	case http.MethodGet:
+		data.Key, listID = r.URL.Query().Get("key"), r.URL.Query().Get("id")
+		err = ws.listsPatron(r, &data)
+	default:
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = ws.listsPageData(ctx, &data, listID)
+	}
+	if errors.Is(err, bcerrors.ErrRecordNotFound) && r.Method == http.MethodPost {
+		// The list of a failed action that isn't shown to the patron, e.g. of another patron
+		err = ws.listsPageData(ctx, &data, "")
+	}
+	switch {
+	case errors.Is(err, bcerrors.ErrRecordNotFound):
+		http.NotFound(w, r)
+		return
+	case err != nil:
+		Error.Printf("%v", err.Error())
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		Error.Printf("%v", err.Error())
+	}
+}
+
+// exportList writes the list with the "id" query parameter with the export template, if the list would be shown
+func (ws *Webserver) exportList(w http.ResponseWriter, r *http.Request, export listExport) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	data := listsData{Key: query.Get("key")}
+	err := ws.listsPatron(r, &data)
+	if err == nil && query.Get("id") == "" {
+		err = bcerrors.ErrRecordNotFound
+	}
+	if err == nil {
+		err = ws.listsPageData(ctx, &data, query.Get("id"))
+	}
+	switch {
+	case errors.Is(err, bcerrors.ErrRecordNotFound):
+		http.NotFound(w, r)
+		return
+	case err != nil:
+		Error.Printf("%v", err.Error())
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", export.contentType)
+	if err := export.template.Execute(w, data); err != nil {
+		Error.Printf("%v", err.Error())
+	}
+}
+
+// listsSignIn signs in the patron with the posted "card" and "secret", setting the cookie and the patron in data
+func (ws *Webserver) listsSignIn(w http.ResponseWriter, r *http.Request, data *listsData) error {
+	card, secret := r.PostForm.Get("card"), r.PostForm.Get("secret")
+	patron, err := ws.lists.SignIn(r.Context(), card, secret)
+	switch {
+	case errors.Is(err, readinglists.ErrWrongSecret):
+		data.Message, data.Failed = "Wrong card or secret", true
+		return nil
+	case err != nil:
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     listsCookie,
+		Value:    url.Values{"card": {card}, "token": {ws.lists.SessionToken(patron)}}.Encode(),
+		Path:     "/lists",
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	data.Card, data.Patron = card, patron
+	return nil
+}
+
+// listsPatron sets the patron signed in with the cookie of the request in data, if there's one and its session token
+// is still the patron's
+func (ws *Webserver) listsPatron(r *http.Request, data *listsData) error {
+	cookie, err := r.Cookie(listsCookie)
+	if err != nil {
+		return nil
+	}
+	values, err := url.ParseQuery(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	patron, err := ws.lists.SignInWithToken(r.Context(), values.Get("card"), values.Get("token"))
+	switch {
+	case errors.Is(err, readinglists.ErrWrongSecret):
+		return nil
+	case err != nil:
+		return err
+	}
+	data.Card, data.Patron = values.Get("card"), patron
+	return nil
+}
+
+// listAction applies the action of the patron with the id to the list with the id in listID, or to a new list whose
+// id is set in listID, and returns the message of its result. "create" creates a list with the "name", "visibility"
+// and "description", which "update" changes, and "delete" deletes the list. "add" adds the "book" id with the "note",
+// "remove" removes the "entry" id and "move" moves it to the "position".
+func (ws *Webserver) listAction(ctx context.Context, action, patronID string, listID *string, form url.Values) (
+	string, error) {
+	visibility := readinglists.Visibility(form.Get("visibility"))
+	switch action {
+	case "create":
+		list, err := ws.lists.Create(ctx, patronID, form.Get("name"), visibility, form.Get("description"))
+		if err != nil {
+			return "", err
+		}
+		*listID = list.ID
+		return fmt.Sprintf("List '%s' created", list.Name), nil
+	case "update":
+		list, err := ws.lists.Update(ctx, patronID, *listID, form.Get("name"), visibility, form.Get("description"))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("List '%s' saved", list.Name), nil
+	case "delete":
+		if err := ws.lists.Delete(ctx, patronID, *listID); err != nil {
+			return "", err
+		}
+		*listID = ""
+		return "List deleted", nil
+	case "add":
+		if _, err := ws.lists.AddBook(ctx, patronID, *listID, form.Get("book"), form.Get("note")); err != nil {
+			return "", err
+		}
+		return "Book added", nil
+	case "remove":
+		if err := ws.lists.RemoveEntry(ctx, patronID, *listID, form.Get("entry")); err != nil {
+			return "", err
+		}
+		return "Book removed", nil
+	case "move":
+		position, err := strconv.Atoi(form.Get("position"))
+		if err != nil {
+			return "", fmt.Errorf("position '%s' isn't a number", form.Get("position"))
+		}
+		if err := ws.lists.MoveEntry(ctx, patronID, *listID, form.Get("entry"), position); err != nil {
+			return "", err
+		}
+		return "Book moved", nil
+	default:
+		return "", fmt.Errorf("unknown action '%s'", action)
+	}
+}
+
+// listsPageData sets the lists of the patron in data, the public lists, and the list with the id with its entries if
+// it's visible to the patron with the key in data. The error is bcerrors.ErrRecordNotFound if it isn't.
+func (ws *Webserver) listsPageData(ctx context.Context, data *listsData, id string) error {
+	patronID := data.Patron["id"]
+	if id != "" {
+		list, err := ws.lists.List(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !list.VisibleTo(patronID, data.Key) {
+			return bcerrors.ErrRecordNotFound
+		}
+		data.List, data.Owner = list, patronID == list.OwnerID
+		if data.Owner {
+			data.Key = list.Key
+		}
+		if owner, err := ws.bc.GetRecord(ctx, circulation.PatronFormat, list.OwnerID); err == nil {
+			data.OwnerName = owner["name"]
+		}
+		entries, err := ws.lists.Entries(ctx, id)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			book, err := ws.bc.GetRecord(ctx, "book", entry.BookID)
+			if err != nil {
+				continue
+			}
+			data.Entries = append(data.Entries, listedEntry{Entry: entry, Book: book})
+		}
+	}
+	var err error
+	if patronID != "" {
+		if data.PatronLists, err = ws.lists.PatronLists(ctx, patronID); err != nil {
+			return err
+		}
+	}
+	data.PublicLists, err = ws.lists.PublicLists(ctx)
+	return err
+}
@@ -0,0 +1,39 @@
+package webserver
+
+// Implements the OAI-PMH endpoint that aggregators harvest the records from
+
+import (
+	"net/http"
+
+	"github.com/ivanmartinez/boocat/boocat/oai"
+)
+
+// SetOAI enables the OAI-PMH endpoint of the provider
+func (ws *Webserver) SetOAI(provider *oai.Provider) {
+	ws.oai = provider
+}
+
+// handleOAI handles an OAI-PMH request, with its arguments in the query of GET requests or the form of POST requests
+func (ws *Webserver) handleOAI(w http.ResponseWriter, r *http.Request) {
+	if ws.oai == nil || (r.Method != http.MethodGet && r.Method != http.MethodPost) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, maxPostSize)
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	response, err := ws.oai.Respond(r.Context(), siteURL(r)+"/oai", r.Form)
+	if err != nil {
+		Error.Printf("%v", err.Error())
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	if err := response.Write(w); err != nil {
+		Error.Printf("%v", err.Error())
+	}
+}
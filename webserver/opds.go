@@ -0,0 +1,652 @@
+package webserver
+
+// Implements the OPDS catalog of the e-books for e-reader apps, in OPDS 1.2 under "/opds" and in OPDS 2.0 under
+// "/opds2". Both have the same navigation feeds per format and acquisition feeds of books.
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ivanmartinez/boocat/boocat"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/subjects"
+)
+
+const (
+	// Name of the format of the publications of the catalog
+	opdsBookFormat = "book"
+	// Number of entries of each page of the feeds
+	opdsPageSize = 25
+)
+
+// Media types of the OPDS documents
+const (
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opds2Type           = "application/opds+json"
+	openSearchType      = "application/opensearchdescription+xml"
+)
+
+// Relations of the links of OPDS entries
+const (
+	opdsAcquisitionRel = "http://opds-spec.org/acquisition/open-access"
+	opdsImageRel       = "http://opds-spec.org/image"
+	opdsThumbnailRel   = "http://opds-spec.org/image/thumbnail"
+)
+
+// opdsFeed is a feed of the catalog, independent of the version of OPDS it's written in
+type opdsFeed struct {
+	// Scheme and host of the URLs of the catalog
+	Site string
+	// Path of the feed after the prefix of the version, and its query without the page
+	Path  string
+	Query url.Values
+	Title string
+	// Acquisition feeds list publications, and navigation feeds list other feeds
+	Acquisition bool
+	Entries     []opdsEntry
+	// Number of the page from 1, and number of entries in all pages
+	Page  int
+	Total int
+}
+
+// opdsEntry is an entry of a feed, which is a publication in acquisition feeds and a link to another feed in
+// navigation feeds
+type opdsEntry struct {
+	ID    string
+	Title string
+	// Path and query of the linked feed after the prefix of the version, and if it's an acquisition feed
+	Feed            string
+	FeedAcquisition bool
+	// Data of publications
+	Authors []string
+	Summary string
+	Issued  string
+	ISBN    string
+	Files   []opdsFile
+}
+
+// opdsFile is a file attached to a publication
+type opdsFile struct {
+	Rel string
+	// Media type, which is empty if it's unknown
+	Type string
+	Key  string
+}
+
+// opdsVersion writes the feeds of a version of OPDS. base is the URL of the catalog in the version.
+type opdsVersion struct {
+	contentType func(feed opdsFeed) string
+	write       func(w io.Writer, base, catalogTitle string, feed opdsFeed, updated time.Time) error
+}
+
+// opdsVersions maps the URL path prefixes to the versions of OPDS
+var opdsVersions = map[string]opdsVersion{
+	"/opds": {
+		contentType: func(feed opdsFeed) string { return atomType(feed.Acquisition) },
+		write:       writeAtomFeed,
+	},
+	"/opds2": {
+		contentType: func(opdsFeed) string { return opds2Type },
+		write:       writeOPDS2Feed,
+	},
+}
+
+// siteURL returns the URL of the site the request was sent to, without a path, for the absolute URLs of feeds
+func siteURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// SetOPDS enables the OPDS catalog with the title, or disables it if the title is empty
+func (ws *Webserver) SetOPDS(title string) {
+	ws.opdsTitle = title
+}
+
+// handleOPDS handles a request to the OPDS catalog. "/opds" and "/opds2" are the root navigation feeds, "/opds/book"
+// lists the books with attached files, searched by the "q" parameter or filtered by a referenced record or a subject,
+// and "/opds/<format>" lists the records of the formats that books reference, and the subjects if they are enabled.
+// "/opds/search.xml" is the OpenSearch description. The "page" parameter selects the page of the feeds.
+func (ws *Webserver) handleOPDS(w http.ResponseWriter, r *http.Request) {
+	if ws.opdsTitle == "" || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	prefix := "/" + strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	version, found := opdsVersions[prefix]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	site := siteURL(r)
+	base := site + prefix
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if path == "/search.xml" && prefix == "/opds" {
+		w.Header().Set("Content-Type", openSearchType+"; charset=utf-8")
+		if err := writeOpenSearch(w, base, ws.opdsTitle); err != nil {
+			Error.Printf("%v", err.Error())
+		}
+		return
+	}
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	query.Del("page")
+	feed, status := ws.catalogFeed(r.Context(), path, query, page)
+	if status != http.StatusOK {
+		http.Error(w, "", status)
+		return
+	}
+	feed.Site, feed.Path, feed.Query = site, path, query
+	w.Header().Set("Content-Type", version.contentType(feed)+"; charset=utf-8")
+	if err := version.write(w, base, ws.opdsTitle, feed, time.Now().UTC()); err != nil {
+		Error.Printf("%v", err.Error())
+	}
+}
+
+// catalogFeed returns the page, from 1, of the feed of the path, or the status of the failure
+func (ws *Webserver) catalogFeed(ctx context.Context, path string, query url.Values, page int) (opdsFeed, int) {
+	books, found := ws.bc.Formats()[opdsBookFormat]
+	if !found {
+		return opdsFeed{}, http.StatusNotFound
+	}
+	fields := opdsReferenceFields(books)
+	switch {
+	case path == "":
+		feed := opdsFeed{Title: ws.opdsTitle}
+		feed.Entries = append(feed.Entries, opdsEntry{ID: "books", Title: "All books", Feed: "/" + opdsBookFormat,
+			FeedAcquisition: true})
+		formatNames := make([]string, 0, len(fields))
+		for formatName := range fields {
+			formatNames = append(formatNames, formatName)
+		}
+		sort.Strings(formatNames)
+		if ws.subjects != nil {
+			formatNames = append(formatNames, subjects.SubjectFormat)
+		}
+		for _, formatName := range formatNames {
+			feed.Entries = append(feed.Entries, opdsEntry{ID: formatName, Title: formatName, Feed: "/" + formatName})
+		}
+		return feed.paginated(page), http.StatusOK
+	case path == "/"+opdsBookFormat:
+		return ws.opdsBooks(ctx, books, fields, query, page)
+	case path == "/"+subjects.SubjectFormat && ws.subjects != nil:
+		feed, status := ws.opdsNavigation(ctx, subjects.SubjectFormat, subjects.SubjectFormat)
+		return feed.paginated(page), status
+	}
+	formatName := strings.TrimPrefix(path, "/")
+	if field, found := fields[formatName]; found {
+		feed, status := ws.opdsNavigation(ctx, formatName, field)
+		return feed.paginated(page), status
+	}
+	return opdsFeed{}, http.StatusNotFound
+}
+
+// opdsReferenceFields returns the fields of the format that reference a single record, by the name of the format of
+// the records they reference. Formats referenced by several fields are referenced by the first one by name.
+func opdsReferenceFields(format boocat.Format) map[string]string {
+	fields := make(map[string]string)
+	for field, formatName := range format.References {
+		if format.IsList(field) {
+			continue
+		}
+		if previous, found := fields[formatName]; !found || field < previous {
+			fields[formatName] = field
+		}
+	}
+	return fields
+}
+
+// opdsNavigation returns the navigation feed of the records of the format, sorted by their display field, each of
+// them linking to the books with its ID in the field
+func (ws *Webserver) opdsNavigation(ctx context.Context, formatName, field string) (opdsFeed, int) {
+	records, err := ws.bc.ListRecords(ctx, formatName)
+	if err != nil {
+		return opdsFeed{}, opdsFailure(err)
+	}
+	display := ws.bc.Formats()[formatName].Display
+	sortByDisplay(records, display)
+	feed := opdsFeed{Title: formatName, Entries: make([]opdsEntry, 0, len(records))}
+	for _, record := range records {
+		title := record[display]
+		if title == "" {
+			title = record["id"]
+		}
+		feed.Entries = append(feed.Entries, opdsEntry{
+			ID:              formatName + ":" + record["id"],
+			Title:           title,
+			Feed:            "/" + opdsBookFormat + "?" + url.Values{field: {record["id"]}}.Encode(),
+			FeedAcquisition: true,
+		})
+	}
+	return feed, http.StatusOK
+}
+
+// opdsBooks returns the page, from 1, of the acquisition feed of the books with attached files, sorted by their
+// display field. Only the entries of the page are built. The "q" parameter searches the books, and the parameters named
+// as fields that reference single records or "subject" filter them.
+func (ws *Webserver) opdsBooks(ctx context.Context, format boocat.Format, fields map[string]string,
+	query url.Values, page int) (opdsFeed, int) {
+	feed := opdsFeed{Title: "All books", Acquisition: true}
+	var records []map[string]string
+	var err error
+	switch search, subjectID := query.Get("q"), query.Get(subjects.SubjectFormat); {
+	case search != "":
+		feed.Title = "Search: " + search
+		records, err = ws.bc.SearchRecords(ctx, opdsBookFormat, search)
+	case subjectID != "" && ws.subjects != nil:
+		subject, subjectErr := ws.subjects.Subject(ctx, subjectID)
+		if subjectErr != nil {
+			return opdsFeed{}, opdsFailure(subjectErr)
+		}
+		feed.Title = subject.Name
+		tagged, taggedErr := ws.subjects.Tagged(ctx, subjectID, true)
+		for _, taggedRecord := range tagged {
+			if taggedRecord.FormatName == opdsBookFormat {
+				records = append(records, taggedRecord.Record)
+			}
+		}
+		err = taggedErr
+	default:
+		equal := make(map[string]string)
+		for formatName, field := range fields {
+			if id := query.Get(field); id != "" {
+				equal[field] = id
+				referenced, err := ws.bc.GetRecord(ctx, formatName, id)
+				if err != nil {
+					return opdsFeed{}, opdsFailure(err)
+				}
+				feed.Title = referenced[ws.bc.Formats()[formatName].Display]
+			}
+		}
+		if len(equal) == 0 {
+			records, err = ws.bc.ListRecords(ctx, opdsBookFormat)
+			break
+		}
+		var filtered boocat.FilteredRecords
+		filtered, err = ws.bc.FilterRecords(ctx, opdsBookFormat, boocat.Filter{Equal: equal})
+		records = filtered.Records
+	}
+	if err != nil {
+		return opdsFeed{}, opdsFailure(err)
+	}
+	eBooks := make([]map[string]string, 0, len(records))
+	for _, record := range records {
+		if isEBook(format, record) {
+			eBooks = append(eBooks, record)
+		}
+	}
+	sortByDisplay(eBooks, format.Display)
+	start, end := pageBounds(page, len(eBooks))
+	feed.Page, feed.Total = page, len(eBooks)
+	authors := make(map[string]string)
+	feed.Entries = make([]opdsEntry, 0, end-start)
+	for _, record := range eBooks[start:end] {
+		feed.Entries = append(feed.Entries, ws.publicationEntry(ctx, format, record, authors))
+	}
+	return feed, http.StatusOK
+}
+
+// isEBook returns if the book of the format has attached files other than images
+func isEBook(format boocat.Format, record map[string]string) bool {
+	for field, accepted := range format.Attachments {
+		if record[field] != "" && !strings.HasPrefix(accepted, "image/") {
+			return true
+		}
+	}
+	return false
+}
+
+// publicationEntry returns the entry of the book, with the content types of its files as stored in the book. Names of
+// authors are cached in authors by ID.
+func (ws *Webserver) publicationEntry(ctx context.Context, format boocat.Format, record map[string]string,
+	authors map[string]string) opdsEntry {
+	entry := opdsEntry{
+		ID:      opdsBookFormat + ":" + record["id"],
+		Title:   record[format.Display],
+		Summary: record[abstractField],
+		Issued:  record[yearField],
+		ISBN:    record[isbnField],
+	}
+	if author := ws.authorName(ctx, format, record, authors); author != "" {
+		entry.Authors = []string{author}
+	}
+	attachmentFields := make([]string, 0, len(format.Attachments))
+	for field := range format.Attachments {
+		attachmentFields = append(attachmentFields, field)
+	}
+	sort.Strings(attachmentFields)
+	for _, field := range attachmentFields {
+		key := record[field]
+		if key == "" {
+			continue
+		}
+		// Books stored before content types were kept only have the types their fields accept
+		contentType := record[boocat.AttachmentTypeField(field)]
+		if accepted := format.Attachments[field]; contentType == "" && !strings.HasSuffix(accepted, "/") {
+			contentType = accepted
+		}
+		if strings.HasPrefix(format.Attachments[field], "image/") {
+			entry.Files = append(entry.Files, opdsFile{Rel: opdsImageRel, Type: contentType, Key: key},
+				opdsFile{Rel: opdsThumbnailRel, Type: boocat.ThumbnailContentType, Key: key + "?thumbnail"})
+			continue
+		}
+		entry.Files = append(entry.Files, opdsFile{Rel: opdsAcquisitionRel, Type: contentType, Key: key})
+	}
+	return entry
+}
+
+// sortByDisplay sorts the records by the value of their display field, and then by ID
+func sortByDisplay(records []map[string]string, display string) {
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i][display] != records[j][display] {
+			return records[i][display] < records[j][display]
+		}
+		return records[i]["id"] < records[j]["id"]
+	})
+}
+
+// opdsFailure returns the status of the failure to get the records of a feed, and logs unexpected errors
+func opdsFailure(err error) int {
+	switch {
+	case errors.Is(err, bcerrors.ErrFormatNotFound), errors.Is(err, bcerrors.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		Error.Printf("%v", err.Error())
+		return http.StatusInternalServerError
+	}
+}
+
+// paginated returns the feed with the entries of the page, from 1, of its entries
+func (f opdsFeed) paginated(page int) opdsFeed {
+	start, end := pageBounds(page, len(f.Entries))
+	f.Page, f.Total, f.Entries = page, len(f.Entries), f.Entries[start:end]
+	return f
+}
+
+// pageBounds returns the index of the first entry of the page, from 1, of a feed with total entries, and the index
+// after its last entry
+func pageBounds(page, total int) (int, int) {
+	start := (page - 1) * opdsPageSize
+	if start > total {
+		start = total
+	}
+	end := start + opdsPageSize
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+// href returns the URL of the page of the feed, after the URL of the catalog
+func (f opdsFeed) href(page int) string {
+	query := make(url.Values, len(f.Query)+1)
+	for name, values := range f.Query {
+		query[name] = values
+	}
+	if page > 1 {
+		query.Set("page", strconv.Itoa(page))
+	}
+	if len(query) == 0 {
+		return f.Path
+	}
+	return f.Path + "?" + query.Encode()
+}
+
+// pages returns the links to the other pages of the feed by relation, if it has more than one
+func (f opdsFeed) pages() [][2]string {
+	last := (f.Total + opdsPageSize - 1) / opdsPageSize
+	if last <= 1 {
+		return nil
+	}
+	links := [][2]string{{"first", f.href(1)}}
+	if f.Page > 1 {
+		links = append(links, [2]string{"previous", f.href(f.Page - 1)})
+	}
+	if f.Page < last {
+		links = append(links, [2]string{"next", f.href(f.Page + 1)})
+	}
+	return append(links, [2]string{"last", f.href(last)})
+}
+
+// atomType returns the media type of OPDS 1.2 feeds of the kind
+func atomType(acquisition bool) string {
+	if acquisition {
+		return opdsAcquisitionType
+	}
+	return opdsNavigationType
+}
+
+// atomFeed is an OPDS 1.2 feed
+type atomFeed struct {
+	XMLName      xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	DC           string      `xml:"xmlns:dc,attr"`
+	OpenSearch   string      `xml:"xmlns:opensearch,attr"`
+	ID           string      `xml:"id"`
+	Title        string      `xml:"title"`
+	Updated      string      `xml:"updated"`
+	Author       atomAuthor  `xml:"author"`
+	Links        []atomLink  `xml:"link"`
+	TotalResults int         `xml:"opensearch:totalResults"`
+	ItemsPerPage int         `xml:"opensearch:itemsPerPage"`
+	StartIndex   int         `xml:"opensearch:startIndex"`
+	Entries      []atomEntry `xml:"entry"`
+}
+
+// atomEntry is an entry of an OPDS 1.2 feed
+type atomEntry struct {
+	ID         string       `xml:"id"`
+	Title      string       `xml:"title"`
+	Updated    string       `xml:"updated"`
+	Authors    []atomAuthor `xml:"author"`
+	Issued     string       `xml:"dc:issued,omitempty"`
+	Identifier string       `xml:"dc:identifier,omitempty"`
+	Summary    *atomText    `xml:"summary"`
+	Links      []atomLink   `xml:"link"`
+}
+
+// atomAuthor is an author of an Atom feed or entry
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+// atomText is a text construct of Atom
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// atomLink is a link of an Atom feed or entry
+type atomLink struct {
+	Rel   string `xml:"rel,attr"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+// writeAtomFeed writes the feed in OPDS 1.2
+func writeAtomFeed(w io.Writer, base, catalogTitle string, feed opdsFeed, updated time.Time) error {
+	timestamp := updated.Format(time.RFC3339)
+	selfType := atomType(feed.Acquisition)
+	atom := atomFeed{
+		DC:         "http://purl.org/dc/terms/",
+		OpenSearch: "http://a9.com/-/spec/opensearch/1.1/",
+		ID:         base + feed.href(feed.Page),
+		Title:      feed.Title,
+		Updated:    timestamp,
+		Author:     atomAuthor{Name: catalogTitle},
+		Links: []atomLink{
+			{Rel: "self", Href: base + feed.href(feed.Page), Type: selfType},
+			{Rel: "start", Href: base, Type: opdsNavigationType},
+			{Rel: "search", Href: base + "/search.xml", Type: openSearchType},
+		},
+		TotalResults: feed.Total,
+		ItemsPerPage: opdsPageSize,
+		StartIndex:   (feed.Page-1)*opdsPageSize + 1,
+		Entries:      make([]atomEntry, 0, len(feed.Entries)),
+	}
+	if feed.Path != "" {
+		atom.Links = append(atom.Links, atomLink{Rel: "up", Href: base, Type: opdsNavigationType})
+	}
+	for _, page := range feed.pages() {
+		atom.Links = append(atom.Links, atomLink{Rel: page[0], Href: base + page[1], Type: selfType})
+	}
+	for _, entry := range feed.Entries {
+		atomEntry := atomEntry{
+			ID:      "urn:boocat:" + entry.ID,
+			Title:   entry.Title,
+			Updated: timestamp,
+			Issued:  entry.Issued,
+		}
+		for _, author := range entry.Authors {
+			atomEntry.Authors = append(atomEntry.Authors, atomAuthor{Name: author})
+		}
+		if entry.ISBN != "" {
+			atomEntry.Identifier = "urn:isbn:" + entry.ISBN
+		}
+		if entry.Summary != "" {
+			atomEntry.Summary = &atomText{Type: "text", Text: entry.Summary}
+		}
+		if entry.Feed != "" {
+			atomEntry.Links = append(atomEntry.Links,
+				atomLink{Rel: "subsection", Href: base + entry.Feed, Type: atomType(entry.FeedAcquisition)})
+		}
+		for _, file := range entry.Files {
+			atomEntry.Links = append(atomEntry.Links,
+				atomLink{Rel: file.Rel, Href: feed.Site + "/attachments/" + file.Key, Type: file.Type})
+		}
+		atom.Entries = append(atom.Entries, atomEntry)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(atom)
+}
+
+// openSearchDescription is the OpenSearch description of the search of books
+type openSearchDescription struct {
+	XMLName     xml.Name `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName   string   `xml:"ShortName"`
+	Description string   `xml:"Description"`
+	URL         struct {
+		Type     string `xml:"type,attr"`
+		Template string `xml:"template,attr"`
+	} `xml:"Url"`
+}
+
+// writeOpenSearch writes the OpenSearch description of the search of books of the OPDS 1.2 catalog
+func writeOpenSearch(w io.Writer, base, catalogTitle string) error {
+	description := openSearchDescription{ShortName: catalogTitle, Description: "Search the e-books of " + catalogTitle}
+	description.URL.Type = opdsAcquisitionType
+	description.URL.Template = base + "/" + opdsBookFormat + "?q={searchTerms}"
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(description)
+}
+
+// opds2Feed is an OPDS 2.0 feed
+type opds2Feed struct {
+	Metadata     opds2Metadata      `json:"metadata"`
+	Links        []opds2Link        `json:"links"`
+	Navigation   []opds2Link        `json:"navigation,omitempty"`
+	Publications []opds2Publication `json:"publications,omitempty"`
+}
+
+// opds2Metadata is the metadata of an OPDS 2.0 feed
+type opds2Metadata struct {
+	Title         string `json:"title"`
+	NumberOfItems int    `json:"numberOfItems"`
+	ItemsPerPage  int    `json:"itemsPerPage"`
+	CurrentPage   int    `json:"currentPage"`
+}
+
+// opds2Link is a link of OPDS 2.0
+type opds2Link struct {
+	Rel       string `json:"rel,omitempty"`
+	Href      string `json:"href"`
+	Type      string `json:"type,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Templated bool   `json:"templated,omitempty"`
+}
+
+// opds2Publication is a publication of an OPDS 2.0 feed
+type opds2Publication struct {
+	Metadata struct {
+		Type        string   `json:"@type"`
+		Identifier  string   `json:"identifier"`
+		Title       string   `json:"title"`
+		Author      []string `json:"author,omitempty"`
+		Published   string   `json:"published,omitempty"`
+		Description string   `json:"description,omitempty"`
+	} `json:"metadata"`
+	Links  []opds2Link `json:"links"`
+	Images []opds2Link `json:"images,omitempty"`
+}
+
+// writeOPDS2Feed writes the feed in OPDS 2.0
+func writeOPDS2Feed(w io.Writer, base, _ string, feed opdsFeed, _ time.Time) error {
+	opds := opds2Feed{
+		Metadata: opds2Metadata{
+			Title:         feed.Title,
+			NumberOfItems: feed.Total,
+			ItemsPerPage:  opdsPageSize,
+			CurrentPage:   feed.Page,
+		},
+		Links: []opds2Link{
+			{Rel: "self", Href: base + feed.href(feed.Page), Type: opds2Type},
+			{Rel: "start", Href: base, Type: opds2Type},
+			{Rel: "search", Href: base + "/" + opdsBookFormat + "{?q}", Type: opds2Type, Templated: true},
+		},
+	}
+	if feed.Path != "" {
+		opds.Links = append(opds.Links, opds2Link{Rel: "up", Href: base, Type: opds2Type})
+	}
+	for _, page := range feed.pages() {
+		opds.Links = append(opds.Links, opds2Link{Rel: page[0], Href: base + page[1], Type: opds2Type})
+	}
+	for _, entry := range feed.Entries {
+		if entry.Feed != "" {
+			opds.Navigation = append(opds.Navigation,
+				opds2Link{Rel: "subsection", Href: base + entry.Feed, Type: opds2Type, Title: entry.Title})
+			continue
+		}
+		var publication opds2Publication
+		publication.Metadata.Type = "http://schema.org/Book"
+		publication.Metadata.Identifier = "urn:boocat:" + entry.ID
+		if entry.ISBN != "" {
+			publication.Metadata.Identifier = "urn:isbn:" + entry.ISBN
+		}
+		publication.Metadata.Title = entry.Title
+		publication.Metadata.Author = entry.Authors
+		publication.Metadata.Published = entry.Issued
+		publication.Metadata.Description = entry.Summary
+		publication.Links = []opds2Link{}
+		for _, file := range entry.Files {
+			link := opds2Link{Href: feed.Site + "/attachments/" + file.Key, Type: file.Type}
+			switch file.Rel {
+			case opdsImageRel:
+				publication.Images = append(publication.Images, link)
+			case opdsAcquisitionRel:
+				link.Rel = file.Rel
+				publication.Links = append(publication.Links, link)
+			}
+		}
+		opds.Publications = append(opds.Publications, publication)
+	}
+	return json.NewEncoder(w).Encode(opds)
+}
@@ -0,0 +1,24 @@
+package webserver
+
+// Implements the related books shown in the pages of books
+
+import (
+	"context"
+
+	"github.com/ivanmartinez/boocat/boocat/related"
+)
+
+// SetRelated enables the books related to each book in the pages of books
+func (ws *Webserver) SetRelated(engine *related.Engine) {
+	ws.related = engine
+}
+
+// relatedBooks returns the cached books related to the book with the id, or none if they can't be got
+func (ws *Webserver) relatedBooks(ctx context.Context, id string) []map[string]string {
+	books, err := ws.related.Related(ctx, id)
+	if err != nil {
+		Error.Printf("%v", err.Error())
+		return nil
+	}
+	return books
+}
@@ -0,0 +1,171 @@
+package webserver
+
+// Implements the pages of reviews, where patrons review books and the administrator moderates the reviews
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ivanmartinez/boocat/boocat/circulation"
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/reviews"
+)
+
+// reviewsData is the data passed to the template of the reviews of a book
+type reviewsData struct {
+	// Result of the last submission, and if it failed
+	Message string
+	Failed  bool
+	Book    map[string]string
+	// Approved reviews of the book, the newest first
+	Reviews []listedReview
+}
+
+// adminReviewsData is the data passed to the template of the moderation queue
+type adminReviewsData struct {
+	// Reviews waiting for moderation, the oldest first
+	Reviews []listedReview
+	// Result of the last moderation, if any
+	Message string
+}
+
+// listedReview is a review as listed in the pages of reviews
+type listedReview struct {
+	reviews.Review
+	// Name of the book and of the patron
+	BookName   string
+	PatronName string
+	// Date the review was submitted
+	SubmittedDate string
+}
+
+// SetReviews enables the reviews of books, which are moderated in the admin section. Reviews are only submitted and
+// moderated through their pages then, so that they can't skip the moderation or leave the ratings of books outdated.
+func (ws *Webserver) SetReviews(r *reviews.Reviews) {
+	ws.reviews = r
+	ws.restrict(noAccess, reviews.ReviewFormat)
+}
+
+// LoadReviewsTemplate loads a template of the reviews from a file located in rootPath+path. The path of the URL of the
+// template will be path without the file extension.
+func (ws *Webserver) LoadReviewsTemplate(rootPath, path string) {
+	tmpl, err := template.ParseFiles(rootPath + path)
+	if err != nil {
+		Error.Fatal(err)
+	}
+	ws.reviewTemplates[strings.TrimSuffix(path, filepath.Ext(path))] = tmpl
+}
+
+// handleReviews handles a request of the reviews of the book with the "book" id, which doesn't require credentials.
+// "/reviews" lists the approved reviews of the book, and posting the "card" and the "secret" of a patron, a "rating"
+// and a "text" submits the review of the patron. Patrons get their secrets at the circulation desk, so reviews can only
+// be submitted if reading lists are enabled.
+func (ws *Webserver) handleReviews(w http.ResponseWriter, r *http.Request) {
+	tmpl, found := ws.reviewTemplates[r.URL.Path]
+	if ws.reviews == nil || !found {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	var data reviewsData
+	switch r.Method {
+	case http.MethodPost:
+		r.ParseForm()
+		bookID := r.PostForm.Get("book")
+		var err error
+		data.Message, err = ws.submitReview(ctx, bookID, r.PostForm.Get("card"), r.PostForm.Get("secret"),
+			r.PostForm.Get("rating"), r.PostForm.Get("text"))
+		if err != nil {
+			data.Message, data.Failed = deskFailure(err), true
+		}
+		data.Book, err = ws.bc.GetRecord(ctx, "book", bookID)
+		if err != nil && !errors.Is(err, bcerrors.ErrRecordNotFound) {
+			Error.Printf("%v", err.Error())
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	case http.MethodGet:
+		var err error
+		data.Book, err = ws.bc.GetRecord(ctx, "book", r.URL.Query().Get("book"))
+		switch {
+		case errors.Is(err, bcerrors.ErrRecordNotFound):
+			http.NotFound(w, r)
+			return
+		case err != nil:
+			Error.Printf("%v", err.Error())
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if data.Book != nil {
+		approved, err := ws.reviews.BookReviews(ctx, data.Book["id"])
+		if err != nil {
+			Error.Printf("%v", err.Error())
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		for _, review := range approved {
+			data.Reviews = append(data.Reviews, ws.listedReview(ctx, review))
+		}
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		Error.Printf("%v", err.Error())
+	}
+}
+
+// submitReview submits the review of the book with the id by the patron with the card and the secret, and returns
+// the message of the result
+func (ws *Webserver) submitReview(ctx context.Context, bookID, card, secret, rating, text string) (string, error) {
+	if ws.lists == nil {
+		return "", errors.New("reviews can't be submitted without the secrets of patrons")
+	}
+	patron, err := ws.lists.SignIn(ctx, card, secret)
+	if err != nil {
+		return "", err
+	}
+	stars, err := strconv.Atoi(rating)
+	if err != nil {
+		return "", reviews.ErrInvalidRating
+	}
+	_, err = ws.reviews.Submit(ctx, bookID, patron["id"], stars, text)
+	if errors.Is(err, bcerrors.ErrRecordNotFound) {
+		return "", errors.New("book not found")
+	}
+	if err != nil {
+		return "", err
+	}
+	return "Thanks for the review, it will be shown once it's approved", nil
+}
+
+// adminReviews returns the template data of the moderation queue
+func (ws *Webserver) adminReviews(ctx context.Context) (adminReviewsData, error) {
+	var data adminReviewsData
+	pending, err := ws.reviews.Pending(ctx)
+	if err != nil {
+		return data, err
+	}
+	for _, review := range pending {
+		data.Reviews = append(data.Reviews, ws.listedReview(ctx, review))
+	}
+	return data, nil
+}
+
+// listedReview returns the review as listed in the pages of reviews
+func (ws *Webserver) listedReview(ctx context.Context, review reviews.Review) listedReview {
+	listed := listedReview{Review: review, SubmittedDate: review.Submitted.Local().Format(deskDateLayout)}
+	if book, err := ws.bc.GetRecord(ctx, "book", review.BookID); err == nil {
+		listed.BookName = book["name"]
+	}
+	if patron, err := ws.bc.GetRecord(ctx, circulation.PatronFormat, review.PatronID); err == nil {
+		listed.PatronName = patron["name"]
+	}
+	return listed
+}
@@ -4,11 +4,31 @@ package webserver
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"html/template"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/ivanmartinez/boocat/boocat"
+	"github.com/ivanmartinez/boocat/boocat/circulation"
 	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/oai"
+	"github.com/ivanmartinez/boocat/boocat/readinglists"
+	"github.com/ivanmartinez/boocat/boocat/related"
+	"github.com/ivanmartinez/boocat/boocat/reviews"
+	"github.com/ivanmartinez/boocat/boocat/subjects"
+	"github.com/ivanmartinez/boocat/boocat/works"
+)
+
+const (
+	// Maximum number of records returned by the autocomplete endpoint
+	autocompleteLimit = 10
+	// Maximum size of the body of POST requests, which limits the size of attached files
+	maxPostSize = 32 << 20
+	// Maximum size of the parts of multipart forms kept in memory, the rest are stored in temporary files
+	maxMultipartMemory = 1 << 20
 )
 
 type Webserver struct {
@@ -19,22 +39,76 @@ type Webserver struct {
 	// staticFiles is the map of static files of the website
 	// @TODO add sync.RWMutex for concurrent access
 	staticFiles map[string]*StaticFile
-	httpServer  *http.Server
+	// genericTemplates is the map of templates used for formats without their own, by URL path prefix
+	genericTemplates map[string]*template.Template
+	// formatAccess is the map of the access to the generic templates and the autocompletion of the formats that aren't
+	// public, by format name
+	formatAccess map[string]access
+	// adminTemplates is the map of templates of the admin section
+	adminTemplates map[string]*template.Template
+	// Password of the admin section, which is disabled if empty
+	adminPassword string
+	// Circulation desk, which is disabled if nil, and its templates
+	desk          *circulation.Desk
+	deskTemplates map[string]*template.Template
+	// Reviews of books, which are disabled if nil, and their templates
+	reviews         *reviews.Reviews
+	reviewTemplates map[string]*template.Template
+	// Vocabulary of subjects, which is disabled if nil, and its templates
+	subjects         *subjects.Vocabulary
+	subjectTemplates map[string]*template.Template
+	// Works of editions, which are disabled if nil
+	works *works.Works
+	// Engine of the related books shown in the pages of books, which are disabled if nil
+	related *related.Engine
+	// Reading lists of patrons, which are disabled if nil, their templates and their export templates
+	lists         *readinglists.Lists
+	listTemplates map[string]*template.Template
+	listExports   map[string]listExport
+	// Title of the OPDS catalog, which is disabled if empty
+	opdsTitle string
+	// OAI-PMH provider of the records, which is disabled if nil
+	oai        *oai.Provider
+	httpServer *http.Server
 }
 
-// Initialize initializes the web server configuration without starting it
-func Initialize(url string, bc *boocat.Boocat) Webserver {
-	ws := Webserver{
+// Initialize initializes the web server configuration without starting it. The returned web server must be used
+// through the pointer, because the handlers refer to it.
+func Initialize(url string, bc *boocat.Boocat) *Webserver {
+	ws := &Webserver{
 		bc: bc,
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", ws.handle)
+	mux.HandleFunc("/autocomplete/", ws.handleAutocomplete)
+	mux.HandleFunc("/admin/", ws.handleAdmin)
+	mux.HandleFunc("/attachments/", ws.handleAttachment)
+	mux.HandleFunc("/desk", ws.handleDesk)
+	mux.HandleFunc("/desk/", ws.handleDesk)
+	mux.HandleFunc("/holds", ws.handleHolds)
+	mux.HandleFunc("/reviews", ws.handleReviews)
+	mux.HandleFunc("/subjects", ws.handleSubjects)
+	mux.HandleFunc("/lists", ws.handleLists)
+	mux.HandleFunc("/lists/", ws.handleLists)
+	mux.HandleFunc("/opds", ws.handleOPDS)
+	mux.HandleFunc("/opds/", ws.handleOPDS)
+	mux.HandleFunc("/opds2", ws.handleOPDS)
+	mux.HandleFunc("/opds2/", ws.handleOPDS)
+	mux.HandleFunc("/oai", ws.handleOAI)
 	ws.httpServer = &http.Server{
 		Addr:    url,
 		Handler: mux,
 	}
 	ws.templates = make(map[string]*Template)
 	ws.staticFiles = make(map[string]*StaticFile)
+	ws.genericTemplates = make(map[string]*template.Template)
+	ws.formatAccess = make(map[string]access)
+	ws.adminTemplates = make(map[string]*template.Template)
+	ws.deskTemplates = make(map[string]*template.Template)
+	ws.reviewTemplates = make(map[string]*template.Template)
+	ws.subjectTemplates = make(map[string]*template.Template)
+	ws.listTemplates = make(map[string]*template.Template)
+	ws.listExports = make(map[string]listExport)
 	return ws
 }
 
@@ -66,6 +140,14 @@ func (ws *Webserver) handle(w http.ResponseWriter, r *http.Request) {
 		ws.handleWithTemplate(w, r, template)
 		return
 	}
+	// If there is a generic template for the path
+	if template, found := ws.genericTemplate(r.URL.Path); found {
+		if ws.formatAccess[template.formatName] == adminAccess && !ws.authorized(w, r) {
+			return
+		}
+		ws.handleWithTemplate(w, r, template)
+		return
+	}
 	// If there is a static file for the path
 	if file, found := ws.staticFiles[r.URL.Path]; found {
 		err := file.Write(w)
@@ -77,23 +159,86 @@ func (ws *Webserver) handle(w http.ResponseWriter, r *http.Request) {
 	http.NotFound(w, r)
 }
 
+// handleAutocomplete handles a request for the records of a format whose display field starts with the "prefix" query
+// parameter. The format name is the last element of the URL path, e.g. "/autocomplete/author". The response is a JSON
+// array of objects with the ID and the display value of every record.
+func (ws *Webserver) handleAutocomplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	formatName := strings.TrimPrefix(r.URL.Path, "/autocomplete/")
+	switch ws.formatAccess[formatName] {
+	case noAccess:
+		http.NotFound(w, r)
+		return
+	case adminAccess:
+		if !ws.authorized(w, r) {
+			return
+		}
+	}
+	records, err := ws.bc.CompleteRecords(r.Context(), formatName, r.URL.Query().Get("prefix"), autocompleteLimit)
+	switch {
+	case errors.Is(err, bcerrors.ErrFormatNotFound):
+		http.NotFound(w, r)
+		return
+	case errors.Is(err, bcerrors.ErrNoDisplayField):
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	case err != nil:
+		Error.Printf("%v", err.Error())
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	display := ws.bc.Formats()[formatName].Display
+	options := make([]map[string]string, 0, len(records))
+	for _, record := range records {
+		options = append(options, map[string]string{
+			"id":    record["id"],
+			"label": record[display],
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(options); err != nil {
+		Error.Printf("%v", err.Error())
+	}
+}
+
 // handleWithTemplate handles a request using a template to generate the response
 func (ws *Webserver) handleWithTemplate(w http.ResponseWriter, r *http.Request, template *Template) {
-	formValues := submittedFormValues(r)
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, maxPostSize)
+	}
+	formValues := submittedFormValues(r, ws.bc.Formats()[template.formatName])
 	var (
 		status int
 		data   interface{}
 	)
 	if r.Method == http.MethodGet {
-		status, data = ws.handleGet(r.Context(), template.formatName, formValues)
+		status, data = ws.handleGet(r.Context(), template.formatName, formValues,
+			isRecordPath(r.URL.Path, template.formatName))
 	} else {
 		// POST
-		status, data = ws.handlePost(r.Context(), template.formatName, formValues)
+		status, data = ws.handlePost(r, template.formatName, formValues)
 	}
 	if status != http.StatusOK {
 		http.Error(w, "", status)
 		return
 	}
+	if style, requested := requestedCitationStyle(r, formValues); requested && r.Method == http.MethodGet {
+		if style.write == nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		if err := ws.writeCitations(r.Context(), w, template.formatName, data, style); err != nil {
+			Error.Printf("%v", err.Error())
+		}
+		return
+	}
+	if template.generic {
+		formats := ws.bc.Formats()
+		data = newGenericData(formats, formats[template.formatName], data)
+	}
 	err := template.Write(w, data)
 	if err != nil {
 		Error.Printf("%v", err.Error())
@@ -101,28 +246,58 @@ func (ws *Webserver) handleWithTemplate(w http.ResponseWriter, r *http.Request,
 	}
 }
 
-// handleGet handles a GET request
-func (ws *Webserver) handleGet(ctx context.Context, formatName string, params map[string]string) (int, interface{}) {
+// handleGet handles a GET request. The pages of records find them by the value of a unique field too.
+func (ws *Webserver) handleGet(ctx context.Context, formatName string, params map[string]string, recordPage bool) (
+	int, interface{}) {
 	if id, found := params["id"]; found {
 		return ws.getRecord(ctx, formatName, id)
 	}
-	if search, found := params["_search"]; found {
-		return ws.searchRecords(ctx, formatName, search)
+	if recordPage {
+		format := ws.bc.Formats()[formatName]
+		for field, value := range params {
+			if format.IsUnique(field) && value != "" {
+				return ws.findRecord(ctx, formatName, field, value)
+			}
+		}
 	}
-	return ws.listRecords(ctx, formatName)
+	return ws.listRecords(ctx, formatName, params)
+}
+
+// isRecordPath returns if the URL path is of the page of a record of the format or the page to edit it, and not of a
+// list or a search
+func isRecordPath(path, formatName string) bool {
+	return path == "/"+formatName || path == "/edit/"+formatName
 }
 
-// handleGet handles a POST request
-func (ws *Webserver) handlePost(ctx context.Context, formatName string, params map[string]string) (int, interface{}) {
+// handlePost handles a POST request. Files uploaded in attachment fields are stored first, and the fields get their
+// keys. The files are deleted if the record isn't stored.
+func (ws *Webserver) handlePost(r *http.Request, formatName string, params map[string]string) (int, interface{}) {
+	ctx := r.Context()
+	failed, uploaded, err := ws.addAttachments(r, formatName, params)
+	switch {
+	case err != nil:
+		Error.Printf("%v", err.Error())
+		return http.StatusInternalServerError, nil
+	case len(failed) > 0:
+		ws.discardAttachments(ctx, params, uploaded)
+		addValidationFails(params, bcerrors.ValidationFailedError{Failed: failed})
+		return http.StatusOK, ws.bc.ResolveReferences(ctx, formatName, params)
+	}
+	if _, found := params["_delete"]; found {
+		ws.discardAttachments(ctx, params, uploaded)
+		return ws.deleteRecord(ctx, formatName, params["id"])
+	}
 	if _, found := params["id"]; found {
-		return ws.updateRecord(ctx, formatName, params)
+		return ws.updateRecord(ctx, formatName, params, uploaded)
 	}
-	return ws.addRecord(ctx, formatName, params)
+	return ws.addRecord(ctx, formatName, params, uploaded)
 }
 
-// getRecord handles a request to get a record
+// getRecord handles a request to get a record with its references resolved, and its subjects in "_subjects" if
+// subjects are enabled. The editions of works and the works of series are sorted if works are enabled, and the
+// related books of books replace the IDs in related.RelatedField if related books are enabled.
 func (ws *Webserver) getRecord(ctx context.Context, formatName, id string) (int, interface{}) {
-	record, err := ws.bc.GetRecord(ctx, formatName, id)
+	record, err := ws.bc.ResolveRecord(ctx, formatName, id)
 	switch {
 	case errors.Is(err, bcerrors.ErrFormatNotFound):
 		return http.StatusNotFound, nil
@@ -131,37 +306,70 @@ func (ws *Webserver) getRecord(ctx context.Context, formatName, id string) (int,
 	case err != nil:
 		return http.StatusInternalServerError, nil
 	}
+	if ws.subjects != nil {
+		record["_subjects"] = ws.recordSubjects(ctx, formatName, id)
+	}
+	if ws.works != nil {
+		if err := ws.workRecords(ctx, formatName, id, record); err != nil {
+			return http.StatusInternalServerError, nil
+		}
+	}
+	if ws.related != nil && formatName == related.BookFormat {
+		record[related.RelatedField] = ws.relatedBooks(ctx, id)
+	}
 	return http.StatusOK, record
 }
 
-// listRecords handles a request to get several records
-func (ws *Webserver) listRecords(ctx context.Context, formatName string) (int, interface{}) {
-	records, err := ws.bc.ListRecords(ctx, formatName)
+// findRecord handles a request to get a record by the value of a unique field
+func (ws *Webserver) findRecord(ctx context.Context, formatName, field, value string) (int, interface{}) {
+	record, err := ws.bc.FindRecord(ctx, formatName, field, value)
 	switch {
 	case errors.Is(err, bcerrors.ErrFormatNotFound):
 		return http.StatusNotFound, nil
+	case errors.Is(err, bcerrors.ErrRecordNotFound):
+		return http.StatusNotFound, nil
 	case err != nil:
 		return http.StatusInternalServerError, nil
 	}
-	return http.StatusOK, records
+	return ws.getRecord(ctx, formatName, record["id"])
 }
 
-// searchRecords handles a request to search for records
-func (ws *Webserver) searchRecords(ctx context.Context, formatName, search string) (int, interface{}) {
-	records, err := ws.bc.SearchRecords(ctx, formatName, search)
+// listRecords handles a request to get several records, optionally searched and filtered by the parameters
+func (ws *Webserver) listRecords(ctx context.Context, formatName string, params map[string]string) (int, interface{}) {
+	format, found := ws.bc.Formats()[formatName]
+	if !found {
+		return http.StatusNotFound, nil
+	}
+	filtered, err := ws.bc.FilterRecords(ctx, formatName, filterFromParams(format, params))
 	switch {
 	case errors.Is(err, bcerrors.ErrFormatNotFound):
 		return http.StatusNotFound, nil
+	case errors.Is(err, bcerrors.ErrFieldNotFound):
+		return http.StatusBadRequest, nil
 	case err != nil:
 		return http.StatusInternalServerError, nil
 	}
-	return http.StatusOK, records
+	data := newListData(filtered, params, ws.facetLabels(ctx, format, filtered.Facets))
+	if ws.works != nil && formatName == works.EditionFormat {
+		if data.Groups, err = ws.works.Group(ctx, filtered.Records); err != nil {
+			return http.StatusInternalServerError, nil
+		}
+	}
+	return http.StatusOK, data
 }
 
-// addRecord handles a request to add a record
-func (ws *Webserver) addRecord(ctx context.Context, formatName string, params map[string]string) (int, interface{}) {
-	_, err := ws.bc.AddRecord(ctx, formatName, params)
+// addRecord handles a request to add a record. The files uploaded in the fields are deleted if it isn't added.
+func (ws *Webserver) addRecord(ctx context.Context, formatName string, params, uploaded map[string]string) (int,
+	interface{}) {
+	id, err := ws.bc.AddRecord(ctx, formatName, params)
+	if err != nil {
+		ws.discardAttachments(ctx, params, uploaded)
+	}
+	var validationError bcerrors.ValidationFailedError
 	switch {
+	case errors.As(err, &validationError):
+		addValidationFails(params, validationError)
+		return http.StatusOK, ws.bc.ResolveReferences(ctx, formatName, params)
 	case errors.Is(err, bcerrors.ErrFormatNotFound):
 		return http.StatusNotFound, nil
 	case errors.Is(err, bcerrors.ErrRecordHasID):
@@ -169,39 +377,110 @@ func (ws *Webserver) addRecord(ctx context.Context, formatName string, params ma
 	case err != nil:
 		return http.StatusInternalServerError, nil
 	}
-	return http.StatusOK, nil
+	params["id"] = id
+	params["_success"] = "_"
+	return http.StatusOK, params
 }
 
-// updateRecord handles a request to update a record
-func (ws *Webserver) updateRecord(ctx context.Context, formatName string, params map[string]string) (int, interface{}) {
+// updateRecord handles a request to update a record. The files uploaded in the fields are deleted if it isn't updated.
+func (ws *Webserver) updateRecord(ctx context.Context, formatName string, params, uploaded map[string]string) (int,
+	interface{}) {
 	err := ws.bc.UpdateRecord(ctx, formatName, params)
+	if err != nil {
+		ws.discardAttachments(ctx, params, uploaded)
+	}
 	var validationError bcerrors.ValidationFailedError
 	switch {
 	case errors.As(err, &validationError):
 		addValidationFails(params, validationError)
-		return http.StatusOK, params
+		return http.StatusOK, ws.bc.ResolveReferences(ctx, formatName, params)
+	case errors.Is(err, bcerrors.ErrFormatNotFound), errors.Is(err, bcerrors.ErrRecordNotFound):
+		return http.StatusNotFound, nil
+	case errors.Is(err, bcerrors.ErrRecordDoesntHaveID):
+		return http.StatusBadRequest, nil
+	case err != nil:
+		return http.StatusInternalServerError, nil
 	}
 	params["_success"] = "_"
 	return http.StatusOK, params
 }
 
+// deleteRecord handles a request to delete a record. If the record is referenced by records that restrict its
+// deletion, the record is returned with "_delete_fail" set to the fields that reference it.
+func (ws *Webserver) deleteRecord(ctx context.Context, formatName, id string) (int, interface{}) {
+	err := ws.bc.DeleteRecord(ctx, formatName, id)
+	var referencedError bcerrors.ReferencedError
+	switch {
+	case errors.As(err, &referencedError):
+		status, data := ws.getRecord(ctx, formatName, id)
+		if record, isRecord := data.(map[string]interface{}); isRecord {
+			record["_delete_fail"] = strings.Join(referencedError.Fields, ", ")
+		}
+		return status, data
+	case errors.Is(err, bcerrors.ErrFormatNotFound):
+		return http.StatusNotFound, nil
+	case errors.Is(err, bcerrors.ErrRecordNotFound):
+		return http.StatusNotFound, nil
+	case err != nil:
+		return http.StatusInternalServerError, nil
+	}
+	return http.StatusOK, map[string]string{"_deleted": "_"}
+}
+
 // submittedFormValues returns a map with the values of the query parameters as well as the submitted form fields.
-// In case of conflict the form value prevails.
-func submittedFormValues(r *http.Request) map[string]string {
+// In case of conflict the form value prevails. All the values of the list fields of the format are joined, so that
+// they can be submitted with repeated inputs.
+func submittedFormValues(r *http.Request, format boocat.Format) map[string]string {
 	values := make(map[string]string)
 	// Read values from the query parameters
 	query := r.URL.Query()
 	for param := range query {
-		values[param] = query.Get(param)
+		values[param] = formValue(format, param, query)
 	}
 	// Read values from the posted form
-	r.ParseForm()
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.ParseMultipartForm(maxMultipartMemory)
+	} else {
+		r.ParseForm()
+	}
 	for field := range r.PostForm {
-		values[field] = r.PostForm.Get(field)
+		values[field] = formValue(format, field, r.PostForm)
 	}
 	return values
 }
 
+// formValue returns the value of a parameter, which is all the values joined if it's a list field of the format
+func formValue(format boocat.Format, param string, values url.Values) string {
+	if format.IsList(param) {
+		return boocat.JoinList(values[param])
+	}
+	return values.Get(param)
+}
+
+// filterFromParams returns the filter of records of the format set by the parameters. "_search" is the search value,
+// a field name is an exact value of the field, "_<field>_min" and "_<field>_max" are the bounds of a range of
+// values of the field, and "_sort" is the field to sort by, in descending order if it's prefixed with "-". Empty
+// parameters are ignored.
+func filterFromParams(format boocat.Format, params map[string]string) boocat.Filter {
+	filter := boocat.Filter{
+		Search: params["_search"],
+		Equal:  make(map[string]string),
+		Ranges: make(map[string]boocat.Range),
+	}
+	filter.Sort = strings.TrimPrefix(params["_sort"], "-")
+	filter.Descending = strings.HasPrefix(params["_sort"], "-")
+	for field := range format.Fields {
+		if value := params[field]; value != "" {
+			filter.Equal[field] = value
+		}
+		r := boocat.Range{Min: params["_"+field+"_min"], Max: params["_"+field+"_max"]}
+		if r.Min != "" || r.Max != "" {
+			filter.Ranges[field] = r
+		}
+	}
+	return filter
+}
+
 // addValidationFails returns params with the passed validation fails
 func addValidationFails(params map[string]string, validationError bcerrors.ValidationFailedError) map[string]string {
 	for field, err := range validationError.Failed {
@@ -0,0 +1,192 @@
+package webserver
+
+// Implements the pages of subjects, where records are browsed by subject and tagged with subjects
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/subjects"
+)
+
+// subjectsData is the data passed to the template of subjects
+type subjectsData struct {
+	// Result of the last operation, and if it failed
+	Message string
+	Failed  bool
+	// Searched term, if any
+	Query string
+	// Subject shown, which is empty if the top terms are listed
+	Subject subjects.Subject
+	// Broader terms of the subject from the top term, and its narrower terms
+	Broader  []subjects.Subject
+	Narrower []subjects.Subject
+	// Top terms, listed when no subject is shown
+	Top []subjects.Subject
+	// Records tagged with the subject, and with its narrower terms if Expanded
+	Records  []taggedRecord
+	Expanded bool
+}
+
+// taggedRecord is a record as listed in the pages of subjects
+type taggedRecord struct {
+	FormatName string
+	ID         string
+	// Value of the display field of the format, or the ID if the format doesn't have one
+	Display string
+}
+
+// SetSubjects enables the subjects, which are browsed without credentials and assigned with the credentials of the
+// admin section. Subjects and tags are only managed with generic templates with those credentials too.
+func (ws *Webserver) SetSubjects(vocabulary *subjects.Vocabulary) {
+	ws.subjects = vocabulary
+	ws.restrict(adminAccess, subjects.SubjectFormat, subjects.TagFormat)
+}
+
+// LoadSubjectsTemplate loads a template of the subjects from a file located in rootPath+path. The path of the URL of
+// the template will be path without the file extension.
+func (ws *Webserver) LoadSubjectsTemplate(rootPath, path string) {
+	tmpl, err := template.ParseFiles(rootPath + path)
+	if err != nil {
+		Error.Fatal(err)
+	}
+	ws.subjectTemplates[strings.TrimSuffix(path, filepath.Ext(path))] = tmpl
+}
+
+// handleSubjects handles a request of the subjects. "/subjects" lists the top terms, or shows the subject with the
+// "id" query parameter or whose name or synonym is the "q" query parameter, with the records tagged with it and its
+// narrower terms unless "narrower" is "no". Posting "action" as "tag" or "untag" with the "format" and "record" id of
+// a record and the "subject" name assigns or removes the subject, and redirects to the record.
+func (ws *Webserver) handleSubjects(w http.ResponseWriter, r *http.Request) {
+	tmpl, found := ws.subjectTemplates[r.URL.Path]
+	if ws.subjects == nil || !found {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	var (
+		data subjectsData
+		err  error
+	)
+	switch r.Method {
+	case http.MethodPost:
+		if !ws.authorized(w, r) {
+			return
+		}
+		r.ParseForm()
+		formatName, recordID := r.PostForm.Get("format"), r.PostForm.Get("record")
+		err = ws.tagAction(ctx, r.PostForm.Get("action"), formatName, recordID, r.PostForm.Get("subject"))
+		if err == nil {
+			http.Redirect(w, r, "/"+formatName+"?id="+url.QueryEscape(recordID), http.StatusSeeOther)
+			return
+		}
+		data.Message, data.Failed = deskFailure(err), true
+		data.Top, err = ws.subjects.Top(ctx)
+	case http.MethodGet:
+		query := r.URL.Query()
+		data.Query = query.Get("q")
+		data.Expanded = query.Get("narrower") != "no"
+		err = ws.subjectData(ctx, &data, query.Get("id"))
+		if errors.Is(err, bcerrors.ErrRecordNotFound) && query.Get("id") != "" {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, bcerrors.ErrRecordNotFound) {
+			data.Message, data.Failed = fmt.Sprintf("subject '%s' not found", data.Query), true
+			data.Top, err = ws.subjects.Top(ctx)
+		}
+	default:
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		Error.Printf("%v", err.Error())
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		Error.Printf("%v", err.Error())
+	}
+}
+
+// subjectData sets the data of the subject with the id, or of the searched subject, or of the top terms if there's
+// neither
+func (ws *Webserver) subjectData(ctx context.Context, data *subjectsData, id string) error {
+	var err error
+	switch {
+	case id != "":
+		data.Subject, err = ws.subjects.Subject(ctx, id)
+	case data.Query != "":
+		data.Subject, err = ws.subjects.Find(ctx, data.Query)
+	default:
+		data.Top, err = ws.subjects.Top(ctx)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if data.Broader, err = ws.subjects.Broader(ctx, data.Subject); err != nil {
+		return err
+	}
+	if data.Narrower, err = ws.subjects.Narrower(ctx, data.Subject.ID); err != nil {
+		return err
+	}
+	tagged, err := ws.subjects.Tagged(ctx, data.Subject.ID, data.Expanded)
+	if err != nil {
+		return err
+	}
+	formats := ws.bc.Formats()
+	for _, record := range tagged {
+		listed := taggedRecord{FormatName: record.FormatName, ID: record.Record["id"]}
+		if listed.Display = record.Record[formats[record.FormatName].Display]; listed.Display == "" {
+			listed.Display = listed.ID
+		}
+		data.Records = append(data.Records, listed)
+	}
+	return nil
+}
+
+// tagAction applies the action to the record of the format with the id and the subject whose name or synonym is the
+// term
+func (ws *Webserver) tagAction(ctx context.Context, action, formatName, recordID, term string) error {
+	subject, err := ws.subjects.Find(ctx, term)
+	if errors.Is(err, bcerrors.ErrRecordNotFound) {
+		return fmt.Errorf("subject '%s' not found", term)
+	}
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "tag":
+		err = ws.subjects.Tag(ctx, formatName, recordID, subject.ID)
+	case "untag":
+		err = ws.subjects.Untag(ctx, formatName, recordID, subject.ID)
+	default:
+		return fmt.Errorf("unknown action '%s'", action)
+	}
+	if errors.Is(err, bcerrors.ErrRecordNotFound) || errors.Is(err, bcerrors.ErrFormatNotFound) {
+		return fmt.Errorf("%s '%s' not found", formatName, recordID)
+	}
+	return err
+}
+
+// recordSubjects returns the subjects of the record of the format with the id, or nil if subjects are disabled or
+// they can't be got
+func (ws *Webserver) recordSubjects(ctx context.Context, formatName, id string) []subjects.Subject {
+	if ws.subjects == nil {
+		return nil
+	}
+	recordSubjects, err := ws.subjects.RecordSubjects(ctx, formatName, id)
+	if err != nil {
+		Error.Printf("%v", err.Error())
+		return nil
+	}
+	return recordSubjects
+}
@@ -0,0 +1,83 @@
+package webserver
+
+// Implements the grouping of editions by work in lists, the pages of works and series, and the merging of editions
+// into works in the admin section
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	bcerrors "github.com/ivanmartinez/boocat/boocat/errors"
+	"github.com/ivanmartinez/boocat/boocat/works"
+)
+
+// adminWorksData is the data passed to the template of the merging of editions into works
+type adminWorksData struct {
+	// Groups of editions without work that seem to be of the same work
+	Candidates [][]map[string]string
+	// Editions without work, and works, which can be merged by hand
+	Editions []map[string]string
+	Works    []map[string]string
+	// ID of the work editions have just been merged into, if any
+	MergedID string
+}
+
+// SetWorks enables the grouping of editions by work, which are merged in the admin section
+func (ws *Webserver) SetWorks(w *works.Works) {
+	ws.works = w
+}
+
+// workRecords sets the editions of a work in "books" sorted by year, or the works of a series in "works" sorted by
+// position, replacing the referencing records
+func (ws *Webserver) workRecords(ctx context.Context, formatName, id string, record map[string]interface{}) error {
+	var err error
+	switch formatName {
+	case works.WorkFormat:
+		record[works.EditionFormat+"s"], err = ws.works.Editions(ctx, id)
+	case works.SeriesFormat:
+		record[works.WorkFormat+"s"], err = ws.works.SeriesWorks(ctx, id)
+	}
+	return err
+}
+
+// adminWorks handles a request of "/admin/works", which lists the editions that seem to be of the same work and the
+// editions without work. Posting the "book" ids and optionally the id of an existing "work" merges the editions into
+// the work, or into a new one.
+func (ws *Webserver) adminWorks(r *http.Request) (int, interface{}) {
+	ctx := r.Context()
+	var data adminWorksData
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		mergedID, err := ws.works.Merge(ctx, r.PostForm["book"], r.PostForm.Get("work"))
+		var unexpectedError bcerrors.UnexpectedError
+		switch {
+		case errors.As(err, &unexpectedError):
+			Error.Printf("%v", err.Error())
+			return http.StatusInternalServerError, nil
+		case err != nil:
+			return http.StatusBadRequest, nil
+		}
+		data.MergedID = mergedID
+	}
+	var err error
+	if data.Candidates, err = ws.works.Candidates(ctx); err != nil {
+		Error.Printf("%v", err.Error())
+		return http.StatusInternalServerError, nil
+	}
+	editions, err := ws.bc.ListRecords(ctx, works.EditionFormat)
+	if err != nil {
+		Error.Printf("%v", err.Error())
+		return http.StatusInternalServerError, nil
+	}
+	for _, edition := range editions {
+		if edition[works.WorkField] == "" {
+			data.Editions = append(data.Editions, edition)
+		}
+	}
+	if data.Works, err = ws.bc.ListRecords(ctx, works.WorkFormat); err != nil {
+		Error.Printf("%v", err.Error())
+		return http.StatusInternalServerError, nil
+	}
+	return http.StatusOK, data
+}